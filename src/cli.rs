@@ -0,0 +1,3184 @@
+use crate::midi::arp::Pattern;
+use crate::midi::buffer::Overflow;
+use crate::midi::cc14;
+use crate::midi::decode::{hex_bytes, note_name, parse_note_name};
+use crate::midi::eventlog::RecordFormat;
+use crate::midi::filter::{message_type_names, parse_manufacturer_id, parse_message_types, TypeFilter};
+use crate::midi::mmc::MmcBridge;
+use crate::midi::notes::PanicMode;
+use crate::midi::port::{PortConfig, Sides};
+use crate::midi::ports::PortMatch;
+use crate::midi::quantize::Division;
+use crate::midi::reset::Reset;
+use crate::midi::spp::TimeSignature;
+use crate::midi::stuck::DEFAULT_STUCK_AFTER;
+use crate::midi::timeline::TimestampSource;
+use crate::midi::transform::{NoteOffStyle, VelocityCurve};
+use crate::midi::trigger::TriggerEvent;
+use crate::midi::zones::Zone;
+use crate::net::osc::CcMapping;
+use std::time::Duration;
+
+/// Subcommands with their usage and a short description, for `mc help` and `-h`
+pub const COMMANDS: &[(&str, &str, &str)] = &[
+    ("list", LIST_USAGE, "List MIDI ports with their indices"),
+    ("fwd", FORWARD_USAGE, "Forward from one port to another"),
+    ("monitor", MONITOR_USAGE, "Print decoded messages from a port"),
+    ("rec", RECORD_USAGE, "Record a port to a Standard MIDI File, CSV or JSON"),
+    ("play", PLAY_USAGE, "Play a Standard MIDI File or a CSV/JSON recording to a port"),
+    ("send", SEND_USAGE, "Send messages read from stdin to a port"),
+    ("sysex", SYSEX_USAGE, "Send the SysEx messages in a .syx file to a port"),
+    ("sysex-dump", SYSEX_DUMP_USAGE, "Save SysEx received from a port to a .syx file"),
+    ("arp", ARP_USAGE, "Arpeggiate held notes from one port to another"),
+    ("clock", CLOCK_USAGE, "Send MIDI clock to a port at a fixed tempo"),
+    ("tempo", TEMPO_USAGE, "Show the tempo and jitter of a port's incoming clock"),
+    ("mtc", MTC_USAGE, "Show the MIDI Time Code arriving on a port"),
+    ("spp", SPP_USAGE, "Show a port's Song Position Pointer as bars and beats"),
+    ("trigger", TRIGGER_USAGE, "Run shell commands when MIDI events arrive on a port"),
+    ("merge", MERGE_USAGE, "Merge several inputs into one output"),
+    ("split", SPLIT_USAGE, "Copy one input to several outputs"),
+    ("net-send", NET_SEND_USAGE, "Send a port's messages over UDP"),
+    ("net-recv", NET_RECV_USAGE, "Receive messages over UDP and send them to a port"),
+    ("osc-send", OSC_SEND_USAGE, "Send a port's messages as OSC"),
+    ("osc-recv", OSC_RECV_USAGE, "Receive OSC and send it to a port as MIDI"),
+    ("ws", WS_USAGE, "Stream a port's messages to WebSocket clients as JSON"),
+    ("rtp", RTP_USAGE, "Join an RTP-MIDI (Network MIDI) session as a virtual port"),
+    ("run", RUN_USAGE, "Start every route in a routes file"),
+    ("port", PORT_USAGE, "Create a named virtual port, optionally bridged to a device"),
+    ("bench", BENCH_USAGE, "Measure round-trip latency through a virtual port or a loopback"),
+];
+
+/// Flags accepted by every command (handled by `logging::take_log_args`)
+pub const GLOBAL_USAGE: &str = "[--log-level debug|info|error] [--log-format text|json] [--quiet]";
+
+/// Usage for a subcommand, including the internal modes spawned by the TUI
+pub fn usage(command: &str) -> Option<&'static str> {
+    match command {
+        "worker" => Some(FORWARD_USAGE),
+        "pipe-worker" => Some(PIPE_WORKER_USAGE),
+        _ => COMMANDS
+            .iter()
+            .find(|(name, _, _)| *name == command)
+            .map(|(_, usage, _)| *usage),
+    }
+}
+
+/// Returns true if `-h` or `--help` appears among a subcommand's arguments
+pub fn wants_help(args: &[String]) -> bool {
+    args.iter().any(|arg| arg == "-h" || arg == "--help")
+}
+
+/// Overview printed by `mc help`
+pub fn help_text(program: &str) -> String {
+    let mut text = format!("Usage: {} [<command>] [options]\n\n", program);
+    text.push_str("Without a command, starts the TUI.\n\nCommands:\n");
+    for (name, _, description) in COMMANDS {
+        text.push_str(&format!("  {:<10}{}\n", name, description));
+    }
+    text.push_str(&format!(
+        "\nGlobal options: {}\nRun '{} <command> -h' for the options of a command.\n",
+        GLOBAL_USAGE, program
+    ));
+    text
+}
+
+/// Options for `mc list`
+#[derive(Debug, Clone, PartialEq)]
+pub struct ListArgs {
+    pub json: bool,
+    /// Also show each port's driver identifier
+    pub verbose: bool,
+    /// Keep running and report ports as they appear and disappear
+    pub watch: bool,
+    /// How often `--watch` rescans the ports
+    pub interval: Duration,
+    /// Show the MIDI driver instead of the ports
+    pub drivers: bool,
+}
+
+pub const LIST_USAGE: &str = "[--json] [--verbose] [--watch [--interval MS]] [--drivers]";
+
+/// Parses the arguments following `list`
+pub fn parse_list_args(args: &[String]) -> Result<ListArgs, String> {
+    let mut json = false;
+    let mut verbose = false;
+    let mut watch = false;
+    let mut interval = None;
+    let mut drivers = false;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--json" => json = true,
+            "--drivers" => drivers = true,
+            "--verbose" | "-v" => verbose = true,
+            "--watch" => watch = true,
+            "--interval" => {
+                let value = iter.next().ok_or("--interval requires a value")?;
+                interval = Some(parse_window(value, "interval")?);
+            }
+            _ => return Err(format!("Unexpected argument '{}'", arg)),
+        }
+    }
+    if interval.is_some() && !watch {
+        return Err("--interval only applies with --watch".to_string());
+    }
+    if drivers && watch {
+        return Err("--drivers and --watch are mutually exclusive".to_string());
+    }
+
+    Ok(ListArgs {
+        json,
+        verbose,
+        watch,
+        interval: interval.unwrap_or(Duration::from_secs(1)),
+        drivers,
+    })
+}
+
+/// Options for `mc run`
+#[derive(Debug, Clone, PartialEq)]
+pub struct RunArgs {
+    pub routes: String,
+    /// `--control-socket`: Unix socket path for pausing and adjusting routes while they run
+    pub control_socket: Option<String>,
+}
+
+pub const RUN_USAGE: &str = "[--control-socket PATH] <routes.toml | ->";
+
+/// Parses the arguments following `run`
+pub fn parse_run_args(args: &[String]) -> Result<RunArgs, String> {
+    let mut positional = Vec::new();
+    let mut control_socket = None;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--control-socket" => {
+                control_socket = Some(iter.next().ok_or("--control-socket requires a value")?.clone());
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected a routes file".to_string());
+    }
+
+    Ok(RunArgs {
+        routes: positional.pop().unwrap(),
+        control_socket,
+    })
+}
+
+pub const PIPE_WORKER_USAGE: &str = "<output-port>";
+
+/// Parses the arguments of the internal `pipe-worker` mode, returning the output port name
+pub fn parse_pipe_worker_args(args: &[String]) -> Result<String, String> {
+    match args {
+        [port] => Ok(port.clone()),
+        _ => Err("Missing arguments for pipe-worker mode".to_string()),
+    }
+}
+
+/// Options for `mc fwd` (and the internal `worker` mode)
+#[derive(Debug, Clone, PartialEq)]
+pub struct ForwardArgs {
+    pub input: String,
+    /// One or more outputs, each receiving every forwarded message
+    pub outputs: Vec<String>,
+    pub match_mode: PortMatch,
+    /// MIDI channels to forward (1-16), empty means all
+    pub channels: Vec<u8>,
+    /// Semitone offset applied to note numbers
+    pub transpose: i8,
+    /// `--channel-shift`: offset added to every message's channel, wrapping modulo 16
+    pub channel_shift: i8,
+    /// Factor applied to note velocities
+    pub velocity_scale: f32,
+    /// Response curve applied to note velocities
+    pub velocity_curve: VelocityCurve,
+    /// Whether velocity shaping also applies to Note Off
+    pub velocity_note_off: bool,
+    /// `--fixed-velocity`: the velocity every Note On is sent with
+    pub fixed_velocity: Option<u8>,
+    /// Control Change renumbering as (from, to) controller pairs
+    pub cc_map: Vec<(u8, u8)>,
+    /// Factor applied to pitch bend around center
+    pub bend_scale: f32,
+    /// Flip the direction of pitch bend
+    pub bend_invert: bool,
+    /// Notes sent as Control Change instead, as (note, controller) pairs
+    pub note_to_cc: Vec<(u8, u8)>,
+    /// Drop Timing Clock (0xF8)
+    pub no_clock: bool,
+    /// Drop Clock, Start/Continue/Stop and Active Sensing
+    pub no_realtime: bool,
+    /// Message types to forward (`--only`) or drop (`--except`)
+    pub types: Option<TypeFilter>,
+    /// Inclusive range of notes to forward, None forwards all
+    pub note_range: Option<(u8, u8)>,
+    /// `--sysex-manufacturer` IDs; empty forwards all SysEx
+    pub sysex_manufacturers: Vec<Vec<u8>>,
+    /// `--block-note`: notes never forwarded, Note On or Off
+    pub block_notes: Vec<u8>,
+    /// `--block-cc`: controllers never forwarded
+    pub block_ccs: Vec<u8>,
+    /// Skip releasing held notes on shutdown
+    pub no_panic: bool,
+    /// `--panic-mode`: how held notes are released on shutdown
+    pub panic_mode: PanicMode,
+    /// Also forward the output port's input back to the input port's output
+    pub bidir: bool,
+    /// Suppress byte-identical messages repeated within this window
+    pub dedup_window: Option<Duration>,
+    /// Drop Control Change repeating the previous value of its controller
+    pub dedup_cc: bool,
+    /// Send each CC / channel pressure at most once per window, keeping the latest value
+    pub throttle_cc: Option<Duration>,
+    /// Send values still held by the throttle on shutdown
+    pub throttle_flush_on_stop: bool,
+    /// Periodically report throughput and latency
+    pub stats: bool,
+    /// Reopen ports that disappear (e.g. an unplugged USB device)
+    pub reconnect: bool,
+    /// `--wait`: how long to wait for missing ports before giving up
+    pub wait: Option<Duration>,
+    /// `--preserve-timing`, holding the `--max-buffer` limit on added delay
+    pub preserve_timing: Option<Duration>,
+    /// `--delay`: fixed latency added to every message
+    pub delay: Option<Duration>,
+    /// `--flush-on-stop`: send delayed messages still waiting at shutdown instead of dropping them
+    pub flush_on_stop: bool,
+    /// `--humanize-timing`: largest random delay added to notes
+    pub humanize_timing: Option<Duration>,
+    /// `--humanize-velocity`: largest random change to Note On velocity
+    pub humanize_velocity: u8,
+    /// `--seed` for the humanize randomness; random when not given
+    pub seed: Option<u64>,
+    /// `--harmonize` intervals in semitones
+    pub harmonize: Vec<i8>,
+    /// Turn each Note On into a toggle
+    pub latch: bool,
+    /// Hold Note Offs while the sustain pedal is down instead of forwarding CC 64
+    pub pedal_to_length: bool,
+    /// `--cc-scale`: multiply Control Change values
+    pub cc_scale: f32,
+    /// `--combine-14bit` (MSB, LSB) pairs, scaled as one value; empty scales as 7 bits
+    pub cc14_pairs: Vec<(u8, u8)>,
+    /// `--echo`: delay between repeats of each note, with `--echo-repeats` and `--echo-decay`
+    pub echo: Option<(Duration, u8, f32)>,
+    /// `--quantize` grid, at the `--quantize-bpm` tempo or following the input's clock
+    pub quantize: Option<(Division, Option<f64>)>,
+    /// `--mmc-bridge`: convert transport commands between MMC and realtime
+    pub mmc_bridge: Option<MmcBridge>,
+    /// `--generate-spp`: send Song Position Pointer on Stop and Continue, counted from the clock
+    pub generate_spp: bool,
+    /// `--aftertouch-to-cc`: controller Channel Pressure is sent as
+    pub aftertouch_to_cc: Option<u8>,
+    /// `--normalize-noteoff` (or `-reverse`): send every Note Off in one form
+    pub note_off_style: Option<NoteOffStyle>,
+    /// Periodically report how many messages of each type arrived
+    pub count: bool,
+    /// `--reset-on-start`: sent to the outputs before forwarding begins
+    pub reset: Option<Reset>,
+    /// `--buffer`: queue up to this many messages for a separate sending thread
+    pub buffer: Option<usize>,
+    /// `--buffer-overflow`: which message a full buffer drops
+    pub buffer_overflow: Overflow,
+    /// `--metrics`: address to serve Prometheus metrics on, as host:port
+    pub metrics: Option<String>,
+    /// Open the ports and print the setup, then exit without forwarding
+    pub dry_run: bool,
+    /// `--allow-loop`: forward even when an output loops back into the input
+    pub allow_loop: bool,
+    /// `--detect-stuck`: how long a sent note may stay on, and whether to then release it
+    pub detect_stuck: Option<(Duration, bool)>,
+    /// `--control-note`: Note On of this note toggles forwarding
+    pub control_note: Option<u8>,
+    /// `--keepalive`: send Active Sensing while the outputs are otherwise quiet
+    pub keepalive: bool,
+    /// `--normalize`: turn Note On/Off missing their velocity byte into complete Note Offs
+    pub normalize: bool,
+}
+
+pub const FORWARD_USAGE: &str = "[--exact | --regex] [--channel N]... [--transpose N] [--channel-shift N]
+    [--velocity-scale F] [--velocity-curve linear|exp|log] [--velocity-note-off] [--fixed-velocity N]
+    [--map-cc FROM:TO]... [--bend-scale F] [--bend-invert] [--note-to-cc NOTE:CC]...
+    [--aftertouch-to-cc N] [--mmc-bridge to-realtime|to-mmc] [--generate-spp]
+    [--no-clock] [--no-realtime] [--only TYPES | --except TYPES]
+    [--note-min N] [--note-max N] [--sysex-manufacturer ID]... [--block-note N]... [--block-cc N]...
+    [--no-panic | --panic-mode note-off|all-notes-off|all-sound-off]
+    [--bidir] [--dedup-window MS] [--dedup-cc] [--throttle-cc MS] [--throttle-flush-on-stop]
+    [--preserve-timing [--max-buffer MS]] [--delay MS [--flush-on-stop]]
+    [--humanize-timing MS] [--humanize-velocity N] [--seed N] [--harmonize N,N...] [--latch]
+    [--pedal-to-length] [--cc-scale F [--combine-14bit] [--cc14-pair MSB:LSB]...]
+    [--normalize-noteoff | --normalize-noteoff-reverse]
+    [--echo MS [--echo-repeats N] [--echo-decay F]] [--quantize DIV [--quantize-bpm N]]
+    [--stats] [--count] [--reconnect] [--wait] [--wait-timeout MS]
+    [--reset-on-start] [--reset-type reset|gm|gm2|HEX]
+    [--buffer N [--buffer-overflow oldest|newest]] [--metrics [HOST]:PORT] [--dry-run] [--allow-loop]
+    [--detect-stuck [--stuck-after MS] [--stuck-note-off]] [--control-note NOTE] [--keepalive]
+    [--normalize] <input-port> <output-port>...";
+
+impl ForwardArgs {
+    /// The processing a forward applies, one line per active option in pipeline order,
+    /// for `--dry-run`; empty when messages pass through unchanged
+    pub fn describe(&self) -> Vec<String> {
+        let mut lines = Vec::new();
+        let list = |values: &[u8]| values.iter().map(u8::to_string).collect::<Vec<_>>().join(", ");
+        let pairs = |pairs: &[(u8, u8)]| {
+            pairs
+                .iter()
+                .map(|(from, to)| format!("{}->{}", from, to))
+                .collect::<Vec<_>>()
+                .join(", ")
+        };
+
+        if let Some(note) = self.control_note {
+            lines.push(format!("note {} toggles forwarding", note_name(note)));
+        }
+        if self.normalize {
+            lines.push("complete note offs sent without velocity".to_string());
+        }
+        if self.bidir {
+            lines.push("bidirectional, dropping echoed messages; the return path is unfiltered".to_string());
+        }
+        if let Some(window) = self.dedup_window {
+            lines.push(format!("drop repeats within {} ms", window.as_millis()));
+        }
+        if !self.channels.is_empty() {
+            lines.push(format!("channels {}", list(&self.channels)));
+        }
+        if self.no_realtime {
+            lines.push("drop clock, transport and active sensing".to_string());
+        } else if self.no_clock {
+            lines.push("drop clock".to_string());
+        }
+        match self.types {
+            Some(TypeFilter::Only(mask)) => lines.push(format!("only {}", message_type_names(mask).join(", "))),
+            Some(TypeFilter::Except(mask)) => lines.push(format!("except {}", message_type_names(mask).join(", "))),
+            None => {}
+        }
+        if let Some((min, max)) = self.note_range {
+            lines.push(format!("notes {}-{}", min, max));
+        }
+        if !self.sysex_manufacturers.is_empty() {
+            let ids: Vec<String> = self.sysex_manufacturers.iter().map(|id| hex_bytes(id)).collect();
+            lines.push(format!("sysex from manufacturer {}", ids.join(", ")));
+        }
+        if !self.block_notes.is_empty() {
+            let notes: Vec<String> = self.block_notes.iter().map(|&note| note_name(note)).collect();
+            lines.push(format!("block notes {}", notes.join(", ")));
+        }
+        if !self.block_ccs.is_empty() {
+            lines.push(format!("block cc {}", list(&self.block_ccs)));
+        }
+        if self.transpose != 0 {
+            lines.push(format!("transpose {:+}", self.transpose));
+        }
+        if self.channel_shift != 0 {
+            lines.push(format!("shift channels {:+}", self.channel_shift));
+        }
+        if self.velocity_scale != 1.0 || self.velocity_curve != VelocityCurve::Linear {
+            let curve = match self.velocity_curve {
+                VelocityCurve::Linear => "linear",
+                VelocityCurve::Exp => "exp",
+                VelocityCurve::Log => "log",
+            };
+            let note_off = if self.velocity_note_off { ", Note Off too" } else { "" };
+            lines.push(format!("velocity x{} ({}{})", self.velocity_scale, curve, note_off));
+        }
+        if let Some(velocity) = self.fixed_velocity {
+            lines.push(format!("velocity fixed at {}", velocity));
+        }
+        if !self.cc_map.is_empty() {
+            lines.push(format!("map cc {}", pairs(&self.cc_map)));
+        }
+        if self.bend_scale != 1.0 || self.bend_invert {
+            let invert = if self.bend_invert { ", inverted" } else { "" };
+            lines.push(format!("pitch bend x{}{}", self.bend_scale, invert));
+        }
+        if !self.note_to_cc.is_empty() {
+            lines.push(format!("notes to cc {}", pairs(&self.note_to_cc)));
+        }
+        if let Some(controller) = self.aftertouch_to_cc {
+            lines.push(format!("channel pressure to cc {}", controller));
+        }
+        if let Some(bridge) = self.mmc_bridge {
+            lines.push(format!("mmc bridge {}", bridge));
+        }
+        if self.generate_spp {
+            lines.push("song position after stop and before continue".to_string());
+        }
+        if self.latch {
+            lines.push("latch notes".to_string());
+        }
+        if self.pedal_to_length {
+            lines.push("sustain pedal to note length".to_string());
+        }
+        if self.cc_scale != 1.0 {
+            let pairs = if self.cc14_pairs.is_empty() {
+                String::new()
+            } else if self.cc14_pairs == cc14::default_pairs() {
+                " (14-bit pairs 1-31/33-63)".to_string()
+            } else {
+                let listed: Vec<String> = self.cc14_pairs.iter().map(|(msb, lsb)| format!("{}/{}", msb, lsb)).collect();
+                format!(" (14-bit pairs {})", listed.join(", "))
+            };
+            lines.push(format!("scale cc x{}{}", self.cc_scale, pairs));
+        }
+        if let Some((division, bpm)) = self.quantize {
+            let clock = bpm.map_or("input clock".to_string(), |bpm| format!("{} BPM", bpm));
+            lines.push(format!("quantize notes to {} ({})", division, clock));
+        }
+        if let Some((delay, repeats, decay)) = self.echo {
+            lines.push(format!("echo notes {}x every {} ms, velocity x{}", repeats, delay.as_millis(), decay));
+        }
+        match self.note_off_style {
+            Some(NoteOffStyle::NoteOff) => lines.push("note on velocity 0 as note off".to_string()),
+            Some(NoteOffStyle::NoteOnZero) => lines.push("note off as note on velocity 0".to_string()),
+            None => {}
+        }
+        if !self.harmonize.is_empty() {
+            let intervals: Vec<String> = self.harmonize.iter().map(|i| format!("{:+}", i)).collect();
+            lines.push(format!("harmonize {}", intervals.join(", ")));
+        }
+        if let Some(window) = self.throttle_cc {
+            let flush = if self.throttle_flush_on_stop { ", flushed on stop" } else { "" };
+            lines.push(format!("throttle cc to one per {} ms{}", window.as_millis(), flush));
+        }
+        if self.dedup_cc {
+            lines.push("drop repeated cc values".to_string());
+        }
+        if self.humanize_timing.is_some() || self.humanize_velocity > 0 {
+            let timing = self.humanize_timing.map(|t| t.as_millis()).unwrap_or(0);
+            lines.push(format!("humanize timing up to {} ms, velocity +/-{}", timing, self.humanize_velocity));
+        }
+        if let Some(max_buffer) = self.preserve_timing {
+            lines.push(format!("preserve timing, buffering up to {} ms", max_buffer.as_millis()));
+        }
+        if let Some(delay) = self.delay {
+            let pending = if self.flush_on_stop { "sent" } else { "dropped" };
+            lines.push(format!("delay {} ms, pending messages {} on stop", delay.as_millis(), pending));
+        }
+        if let Some(size) = self.buffer {
+            lines.push(format!("buffer {} messages, dropping the {} when full", size, self.buffer_overflow));
+        }
+        if let Some(reset) = &self.reset {
+            lines.push(format!("send {} on start", reset));
+        }
+        if self.panic_mode != PanicMode::default() {
+            lines.push(format!("release held notes with {} on stop", self.panic_mode));
+        }
+        if let Some((threshold, release)) = self.detect_stuck {
+            let action = if release { "release" } else { "report" };
+            lines.push(format!("{} notes held over {} ms", action, threshold.as_millis()));
+        }
+        if self.keepalive {
+            lines.push("active sensing while idle".to_string());
+        }
+        lines
+    }
+}
+
+/// Default `--max-buffer` for `--preserve-timing`
+pub const DEFAULT_MAX_BUFFER: Duration = Duration::from_millis(20);
+
+/// How long `--wait` waits for a missing port unless `--wait-timeout` is given
+pub const DEFAULT_WAIT_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// `--echo` repeats and per-repeat velocity factor unless given
+pub const DEFAULT_ECHO_REPEATS: u8 = 3;
+pub const DEFAULT_ECHO_DECAY: f32 = 0.6;
+/// Most `--echo-repeats`, so one note can't flood the output
+const MAX_ECHO_REPEATS: u8 = 32;
+
+/// Parses the arguments following `fwd`/`worker`
+/// Flags may appear before or after the two positional port arguments
+pub fn parse_forward_args(args: &[String]) -> Result<ForwardArgs, String> {
+    let mut ports = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut channels = Vec::new();
+    let mut transpose = 0;
+    let mut channel_shift = 0;
+    let mut velocity_scale = 1.0;
+    let mut velocity_curve = VelocityCurve::Linear;
+    let mut velocity_note_off = false;
+    let mut fixed_velocity = None;
+    let mut cc_map = Vec::new();
+    let mut bend_scale = 1.0;
+    let mut bend_invert = false;
+    let mut note_to_cc = Vec::new();
+    let mut no_clock = false;
+    let mut no_realtime = false;
+    let mut types = None;
+    let mut note_min = None;
+    let mut note_max = None;
+    let mut sysex_manufacturers = Vec::new();
+    let mut block_notes = Vec::new();
+    let mut block_ccs = Vec::new();
+    let mut no_panic = false;
+    let mut panic_mode = None;
+    let mut bidir = false;
+    let mut dedup_window = None;
+    let mut dedup_cc = false;
+    let mut throttle_cc = None;
+    let mut throttle_flush_on_stop = false;
+    let mut stats = false;
+    let mut reconnect = false;
+    let mut wait = None;
+    let mut preserve_timing = false;
+    let mut max_buffer = None;
+    let mut delay = None;
+    let mut flush_on_stop = false;
+    let mut control_note = None;
+    let mut keepalive = false;
+    let mut normalize = false;
+    let mut humanize_timing = None;
+    let mut humanize_velocity = 0;
+    let mut seed = None;
+    let mut harmonize = Vec::new();
+    let mut latch = false;
+    let mut pedal_to_length = false;
+    let mut cc_scale = 1.0;
+    let mut combine_14bit = false;
+    let mut cc14_pairs = Vec::new();
+    let mut note_off_style = None;
+    let mut aftertouch_to_cc = None;
+    let mut mmc_bridge = None;
+    let mut generate_spp = false;
+    let mut echo = None;
+    let mut quantize = None;
+    let mut quantize_bpm = None;
+    let mut echo_repeats = None;
+    let mut echo_decay = None;
+    let mut count = false;
+    let mut reset = None;
+    let mut buffer = None;
+    let mut buffer_overflow = None;
+    let mut metrics = None;
+    let mut dry_run = false;
+    let mut allow_loop = false;
+    let mut detect_stuck = false;
+    let mut stuck_after = None;
+    let mut stuck_note_off = false;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--buffer" => {
+                let value = iter.next().ok_or("--buffer requires a value")?;
+                buffer = Some(
+                    value
+                        .parse::<usize>()
+                        .ok()
+                        .filter(|n| *n > 0)
+                        .ok_or_else(|| format!("Invalid buffer size '{}' (expected messages)", value))?,
+                );
+            }
+            "--buffer-overflow" => {
+                let value = iter.next().ok_or("--buffer-overflow requires a value")?;
+                buffer_overflow = Some(value.parse()?);
+            }
+            "--metrics" => {
+                let value = iter.next().ok_or("--metrics requires an address")?;
+                metrics = Some(parse_listen_address(value)?);
+            }
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--preserve-timing" => preserve_timing = true,
+            "--delay" => {
+                let value = iter.next().ok_or("--delay requires a value")?;
+                delay = Some(parse_window(value, "delay")?);
+            }
+            "--flush-on-stop" => flush_on_stop = true,
+            "--keepalive" => keepalive = true,
+            "--normalize" => normalize = true,
+            "--control-note" => {
+                control_note = Some(parse_note(iter.next().ok_or("--control-note requires a value")?)?);
+            }
+            "--max-buffer" => {
+                let value = iter.next().ok_or("--max-buffer requires a value")?;
+                max_buffer = Some(parse_window(value, "max buffer")?);
+            }
+            "--humanize-timing" => {
+                let value = iter.next().ok_or("--humanize-timing requires a value")?;
+                humanize_timing = Some(parse_window(value, "humanize timing")?);
+            }
+            "--humanize-velocity" => {
+                let value = iter.next().ok_or("--humanize-velocity requires a value")?;
+                humanize_velocity = parse_data_byte(value, "humanize velocity")?;
+            }
+            "--seed" => {
+                let value = iter.next().ok_or("--seed requires a value")?;
+                seed = Some(value.parse::<u64>().map_err(|_| format!("Invalid seed '{}'", value))?);
+            }
+            "--latch" => latch = true,
+            "--generate-spp" => generate_spp = true,
+            "--pedal-to-length" => pedal_to_length = true,
+            "--cc-scale" => {
+                let value = iter.next().ok_or("--cc-scale requires a value")?;
+                cc_scale = value
+                    .parse::<f32>()
+                    .ok()
+                    .filter(|f| f.is_finite() && *f > 0.0)
+                    .ok_or_else(|| format!("Invalid cc scale '{}' (expected a positive number)", value))?;
+            }
+            "--combine-14bit" => combine_14bit = true,
+            "--quantize" => {
+                let value = iter.next().ok_or("--quantize requires a value")?;
+                quantize = Some(value.parse::<Division>()?);
+            }
+            "--quantize-bpm" => {
+                let value = iter.next().ok_or("--quantize-bpm requires a value")?;
+                quantize_bpm = Some(parse_bpm(value)?);
+            }
+            "--echo" => {
+                let value = iter.next().ok_or("--echo requires a value")?;
+                echo = Some(parse_window(value, "echo delay")?);
+            }
+            "--echo-repeats" => {
+                let value = iter.next().ok_or("--echo-repeats requires a value")?;
+                echo_repeats = Some(
+                    value
+                        .parse::<u8>()
+                        .ok()
+                        .filter(|n| (1..=MAX_ECHO_REPEATS).contains(n))
+                        .ok_or_else(|| format!("Invalid echo repeats '{}' (expected 1-{})", value, MAX_ECHO_REPEATS))?,
+                );
+            }
+            "--echo-decay" => {
+                let value = iter.next().ok_or("--echo-decay requires a value")?;
+                echo_decay = Some(
+                    value
+                        .parse::<f32>()
+                        .ok()
+                        .filter(|f| *f > 0.0 && *f <= 1.0)
+                        .ok_or_else(|| format!("Invalid echo decay '{}' (expected above 0, up to 1)", value))?,
+                );
+            }
+            "--mmc-bridge" => {
+                let value = iter.next().ok_or("--mmc-bridge requires a value")?;
+                mmc_bridge = Some(value.parse()?);
+            }
+            "--aftertouch-to-cc" => {
+                let value = iter.next().ok_or("--aftertouch-to-cc requires a value")?;
+                aftertouch_to_cc = Some(parse_data_byte(value, "controller")?);
+            }
+            "--normalize-noteoff" | "--normalize-noteoff-reverse" => {
+                let style = if arg == "--normalize-noteoff" {
+                    NoteOffStyle::NoteOff
+                } else {
+                    NoteOffStyle::NoteOnZero
+                };
+                if note_off_style.is_some_and(|current| current != style) {
+                    return Err("--normalize-noteoff and --normalize-noteoff-reverse are exclusive".to_string());
+                }
+                note_off_style = Some(style);
+            }
+            "--cc14-pair" => {
+                let value = iter.next().ok_or("--cc14-pair requires a value")?;
+                let (msb, lsb) = value
+                    .split_once(':')
+                    .ok_or_else(|| format!("Invalid 14-bit pair '{}' (expected MSB:LSB)", value))?;
+                let pair = (parse_data_byte(msb, "controller")?, parse_data_byte(lsb, "controller")?);
+                if pair.0 == pair.1 {
+                    return Err(format!("Invalid 14-bit pair '{}' (MSB and LSB must differ)", value));
+                }
+                cc14_pairs.push(pair);
+            }
+            "--harmonize" => {
+                let value = iter.next().ok_or("--harmonize requires a value")?;
+                harmonize = parse_intervals(value)?;
+            }
+            "--channel" => {
+                let value = iter.next().ok_or("--channel requires a value")?;
+                channels.push(parse_channel(value)?);
+            }
+            "--channel-shift" => {
+                let value = iter.next().ok_or("--channel-shift requires a value")?;
+                channel_shift = value
+                    .parse::<i8>()
+                    .ok()
+                    .filter(|n| (-15..=15).contains(n))
+                    .ok_or_else(|| format!("Invalid channel shift '{}' (expected -15 to 15)", value))?;
+            }
+            "--transpose" => {
+                let value = iter.next().ok_or("--transpose requires a value")?;
+                transpose = parse_transpose(value)?;
+            }
+            "--velocity-scale" => {
+                let value = iter.next().ok_or("--velocity-scale requires a value")?;
+                velocity_scale = value
+                    .parse::<f32>()
+                    .ok()
+                    .filter(|f| f.is_finite() && *f > 0.0)
+                    .ok_or_else(|| format!("Invalid velocity scale '{}' (expected a positive number)", value))?;
+            }
+            "--velocity-curve" => {
+                let value = iter.next().ok_or("--velocity-curve requires a value")?;
+                velocity_curve = value.parse()?;
+            }
+            "--velocity-note-off" => velocity_note_off = true,
+            "--fixed-velocity" => {
+                let value = iter.next().ok_or("--fixed-velocity requires a value")?;
+                fixed_velocity = Some(
+                    value
+                        .parse::<u8>()
+                        .ok()
+                        .filter(|v| (1..=127).contains(v))
+                        .ok_or_else(|| format!("Invalid velocity '{}' (expected 1-127)", value))?,
+                );
+            }
+            "--map-cc" => {
+                let value = iter.next().ok_or("--map-cc requires a value")?;
+                let (from, to) = value
+                    .split_once(':')
+                    .ok_or_else(|| format!("Invalid CC mapping '{}' (expected FROM:TO)", value))?;
+                cc_map.push((parse_data_byte(from, "controller")?, parse_data_byte(to, "controller")?));
+            }
+            "--note-to-cc" => {
+                let value = iter.next().ok_or("--note-to-cc requires a value")?;
+                let (note, controller) = value
+                    .split_once(':')
+                    .ok_or_else(|| format!("Invalid note mapping '{}' (expected NOTE:CC)", value))?;
+                note_to_cc.push((parse_data_byte(note, "note")?, parse_data_byte(controller, "controller")?));
+            }
+            "--bend-scale" => {
+                let value = iter.next().ok_or("--bend-scale requires a value")?;
+                bend_scale = value
+                    .parse::<f32>()
+                    .ok()
+                    .filter(|f| f.is_finite() && *f >= 0.0)
+                    .ok_or_else(|| format!("Invalid bend scale '{}' (expected a number from 0)", value))?;
+            }
+            "--bend-invert" => bend_invert = true,
+            "--note-min" | "--note-max" => {
+                let value = iter.next().ok_or_else(|| format!("{} requires a value", arg))?;
+                let note = parse_data_byte(value, "note")?;
+                if arg == "--note-min" {
+                    note_min = Some(note);
+                } else {
+                    note_max = Some(note);
+                }
+            }
+            "--sysex-manufacturer" => {
+                let value = iter.next().ok_or("--sysex-manufacturer requires a value")?;
+                sysex_manufacturers.push(parse_manufacturer_id(value)?);
+            }
+            "--block-note" => {
+                block_notes.push(parse_note(iter.next().ok_or("--block-note requires a note")?)?);
+            }
+            "--block-cc" => {
+                let value = iter.next().ok_or("--block-cc requires a controller")?;
+                block_ccs.push(parse_data_byte(value, "controller")?);
+            }
+            "--no-clock" => no_clock = true,
+            "--no-realtime" => no_realtime = true,
+            "--no-panic" => no_panic = true,
+            "--panic-mode" => {
+                let value = iter.next().ok_or("--panic-mode requires a value")?;
+                panic_mode = Some(value.parse()?);
+            }
+            "--bidir" => bidir = true,
+            "--stats" => stats = true,
+            "--count" => count = true,
+            "--dry-run" => dry_run = true,
+            "--allow-loop" => allow_loop = true,
+            "--detect-stuck" => detect_stuck = true,
+            "--stuck-after" => {
+                let value = iter.next().ok_or("--stuck-after requires a value")?;
+                stuck_after = Some(parse_window(value, "stuck-note threshold")?);
+            }
+            "--stuck-note-off" => stuck_note_off = true,
+            "--reconnect" => reconnect = true,
+            "--wait" => wait = wait.or(Some(DEFAULT_WAIT_TIMEOUT)),
+            "--wait-timeout" => {
+                let value = iter.next().ok_or("--wait-timeout requires a value")?;
+                wait = Some(parse_window(value, "wait timeout")?);
+            }
+            "--reset-on-start" => reset = reset.or(Some(Reset::System)),
+            "--reset-type" => {
+                let value = iter.next().ok_or("--reset-type requires a value")?;
+                reset = Some(value.parse()?);
+            }
+            "--dedup-window" => {
+                let value = iter.next().ok_or("--dedup-window requires a value")?;
+                dedup_window = Some(parse_window(value, "dedup window")?);
+            }
+            "--throttle-cc" => {
+                let value = iter.next().ok_or("--throttle-cc requires a value")?;
+                throttle_cc = Some(parse_window(value, "throttle window")?);
+            }
+            "--throttle-flush-on-stop" => throttle_flush_on_stop = true,
+            "--dedup-cc" => dedup_cc = true,
+            "--only" | "--except" => {
+                let value = iter.next().ok_or_else(|| format!("{} requires a value", arg))?;
+                if types.is_some() {
+                    return Err("--only and --except are mutually exclusive".to_string());
+                }
+                let mask = parse_message_types(value)?;
+                types = Some(if arg == "--only" {
+                    TypeFilter::Only(mask)
+                } else {
+                    TypeFilter::Except(mask)
+                });
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => ports.push(arg.clone()),
+        }
+    }
+
+    if ports.len() < 2 {
+        return Err("Expected an input port and at least one output port".to_string());
+    }
+    let input = ports.remove(0);
+    let outputs = ports;
+    if bidir && outputs.len() > 1 {
+        return Err("--bidir needs exactly one output port".to_string());
+    }
+
+    if flush_on_stop && delay.is_none() {
+        return Err("--flush-on-stop only applies with --delay".to_string());
+    }
+    if max_buffer.is_some() && !preserve_timing {
+        return Err("--max-buffer only applies with --preserve-timing".to_string());
+    }
+    if quantize.is_none() && quantize_bpm.is_some() {
+        return Err("--quantize-bpm only applies with --quantize".to_string());
+    }
+    let quantize = quantize.map(|division| (division, quantize_bpm));
+    if fixed_velocity.is_some() && (velocity_scale != 1.0 || velocity_curve != VelocityCurve::Linear) {
+        return Err("--fixed-velocity can't be combined with --velocity-scale or --velocity-curve".to_string());
+    }
+    if echo.is_none() && (echo_repeats.is_some() || echo_decay.is_some()) {
+        return Err("--echo-repeats and --echo-decay only apply with --echo".to_string());
+    }
+    let echo = echo.map(|delay| {
+        (delay, echo_repeats.unwrap_or(DEFAULT_ECHO_REPEATS), echo_decay.unwrap_or(DEFAULT_ECHO_DECAY))
+    });
+
+    // Explicit pairs replace the defaults and imply --combine-14bit
+    if combine_14bit && cc14_pairs.is_empty() {
+        cc14_pairs = cc14::default_pairs();
+    }
+
+    let preserve_timing = preserve_timing.then(|| max_buffer.unwrap_or(DEFAULT_MAX_BUFFER));
+    if buffer_overflow.is_some() && buffer.is_none() {
+        return Err("--buffer-overflow only applies with --buffer".to_string());
+    }
+
+    let note_range = match (note_min, note_max) {
+        (None, None) => None,
+        (min, max) => Some((min.unwrap_or(0), max.unwrap_or(127))),
+    };
+    if let Some((min, max)) = note_range.filter(|(min, max)| min > max) {
+        return Err(format!("--note-min {} is above --note-max {}", min, max));
+    }
+    if no_panic && panic_mode.is_some() {
+        return Err("--panic-mode and --no-panic are mutually exclusive".to_string());
+    }
+
+    Ok(ForwardArgs {
+        input,
+        outputs,
+        match_mode,
+        channels,
+        transpose,
+        channel_shift,
+        velocity_scale,
+        velocity_curve,
+        velocity_note_off,
+        fixed_velocity,
+        cc_map,
+        bend_scale,
+        bend_invert,
+        note_to_cc,
+        no_clock,
+        no_realtime,
+        types,
+        note_range,
+        sysex_manufacturers,
+        block_notes,
+        block_ccs,
+        no_panic,
+        panic_mode: panic_mode.unwrap_or_default(),
+        bidir,
+        dedup_window,
+        dedup_cc,
+        throttle_cc,
+        throttle_flush_on_stop,
+        stats,
+        reconnect,
+        wait,
+        preserve_timing,
+        delay,
+        flush_on_stop,
+        humanize_timing,
+        humanize_velocity,
+        seed,
+        harmonize,
+        latch,
+        pedal_to_length,
+        cc_scale,
+        cc14_pairs,
+        aftertouch_to_cc,
+        mmc_bridge,
+        generate_spp,
+        echo,
+        quantize,
+        note_off_style,
+        count,
+        reset,
+        buffer,
+        buffer_overflow: buffer_overflow.unwrap_or_default(),
+        metrics,
+        dry_run,
+        allow_loop,
+        detect_stuck: (detect_stuck || stuck_after.is_some() || stuck_note_off)
+            .then(|| (stuck_after.unwrap_or(DEFAULT_STUCK_AFTER), stuck_note_off)),
+        control_note,
+        keepalive,
+        normalize,
+    })
+}
+
+/// Options for `mc monitor`
+#[derive(Debug, Clone, PartialEq)]
+pub struct MonitorArgs {
+    pub input: String,
+    pub match_mode: PortMatch,
+    /// Also print the raw bytes in hex
+    pub raw: bool,
+    /// `--detect-stuck`: report notes held longer than this
+    pub detect_stuck: Option<Duration>,
+    /// `--histogram`: print Note On velocity counts on exit
+    pub histogram: bool,
+    /// `--histogram-every`: also print them this often
+    pub histogram_interval: Option<Duration>,
+    /// `--meter`: show channel activity in place of the message lines
+    pub meter: bool,
+}
+
+pub const MONITOR_USAGE: &str =
+    "[--exact | --regex] [--raw | --meter] [--detect-stuck [--stuck-after MS]] [--histogram [--histogram-every MS]]
+    <input-port>";
+
+/// Parses the arguments following `monitor`
+pub fn parse_monitor_args(args: &[String]) -> Result<MonitorArgs, String> {
+    let mut ports = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut raw = false;
+    let mut detect_stuck = false;
+    let mut stuck_after = None;
+    let mut histogram = false;
+    let mut histogram_interval = None;
+    let mut meter = false;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--raw" => raw = true,
+            "--meter" => meter = true,
+            "--histogram" => histogram = true,
+            "--histogram-every" => {
+                let value = iter.next().ok_or("--histogram-every requires a value")?;
+                histogram_interval = Some(parse_window(value, "histogram interval")?);
+            }
+            "--detect-stuck" => detect_stuck = true,
+            "--stuck-after" => {
+                let value = iter.next().ok_or("--stuck-after requires a value")?;
+                stuck_after = Some(parse_window(value, "stuck-note threshold")?);
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => ports.push(arg.clone()),
+        }
+    }
+
+    if ports.len() != 1 {
+        return Err("Expected an input port".to_string());
+    }
+    if meter && raw {
+        return Err("--meter replaces the message lines, so --raw has nothing to add".to_string());
+    }
+    if meter && histogram_interval.is_some() {
+        return Err("--histogram-every would print over the --meter display".to_string());
+    }
+
+    Ok(MonitorArgs {
+        input: ports.pop().unwrap(),
+        match_mode,
+        raw,
+        detect_stuck: (detect_stuck || stuck_after.is_some()).then(|| stuck_after.unwrap_or(DEFAULT_STUCK_AFTER)),
+        histogram: histogram || histogram_interval.is_some(),
+        histogram_interval,
+        meter,
+    })
+}
+
+/// Options for `mc rec`
+#[derive(Debug, Clone, PartialEq)]
+pub struct RecordArgs {
+    pub input: String,
+    pub file: String,
+    pub match_mode: PortMatch,
+    /// Tempo written to the file, used to convert time to ticks
+    pub bpm: f64,
+    pub format: RecordFormat,
+    /// `--timestamps`: where message times come from
+    pub timestamps: TimestampSource,
+}
+
+pub const RECORD_USAGE: &str =
+    "[--exact | --regex] [--bpm N] [--format mid|csv|json] [--timestamps driver|clock] <input-port> <file>";
+
+/// Parses the arguments following `rec`
+pub fn parse_record_args(args: &[String]) -> Result<RecordArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut bpm = 120.0;
+    let mut format = RecordFormat::default();
+    let mut timestamps = TimestampSource::default();
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--bpm" => {
+                let value = iter.next().ok_or("--bpm requires a value")?;
+                bpm = parse_bpm(value)?;
+            }
+            "--format" => {
+                let value = iter.next().ok_or("--format requires a value")?;
+                format = value.parse()?;
+            }
+            "--timestamps" => {
+                let value = iter.next().ok_or("--timestamps requires a value")?;
+                timestamps = value.parse()?;
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 2 {
+        return Err("Expected an input port and an output file".to_string());
+    }
+    let file = positional.pop().unwrap();
+    let input = positional.pop().unwrap();
+
+    Ok(RecordArgs {
+        input,
+        file,
+        match_mode,
+        bpm,
+        format,
+        timestamps,
+    })
+}
+
+/// Options for `mc play`
+#[derive(Debug, Clone, PartialEq)]
+pub struct PlayArgs {
+    pub file: String,
+    pub output: String,
+    pub match_mode: PortMatch,
+    /// Restart from the beginning when the file ends
+    pub loop_playback: bool,
+    /// What the file holds: a MIDI file or an `mc rec --format` recording
+    pub format: RecordFormat,
+    /// Playback rate, 2.0 plays twice as fast
+    pub speed: f64,
+}
+
+pub const PLAY_USAGE: &str = "[--exact | --regex] [--loop] [--format mid|csv|json] [--speed F] <file> <output-port>";
+
+/// Parses the arguments following `play`
+pub fn parse_play_args(args: &[String]) -> Result<PlayArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut loop_playback = false;
+    let mut format = RecordFormat::default();
+    let mut speed = 1.0;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--loop" => loop_playback = true,
+            "--format" => {
+                let value = iter.next().ok_or("--format requires a value")?;
+                format = value.parse()?;
+            }
+            "--speed" => {
+                let value = iter.next().ok_or("--speed requires a value")?;
+                speed = value
+                    .parse::<f64>()
+                    .ok()
+                    .filter(|f| f.is_finite() && *f > 0.0)
+                    .ok_or_else(|| format!("Invalid speed '{}' (expected a positive number)", value))?;
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 2 {
+        return Err("Expected a file and an output port".to_string());
+    }
+    let output = positional.pop().unwrap();
+    let file = positional.pop().unwrap();
+
+    Ok(PlayArgs {
+        file,
+        output,
+        match_mode,
+        loop_playback,
+        format,
+        speed,
+    })
+}
+
+/// Options for `mc send`
+#[derive(Debug, Clone, PartialEq)]
+pub struct SendArgs {
+    pub output: String,
+    pub match_mode: PortMatch,
+    /// Pause after each message
+    pub delay: Option<Duration>,
+}
+
+pub const SEND_USAGE: &str = "[--exact | --regex] [--delay MS] <output-port>  (messages on stdin)";
+
+/// Parses the arguments following `send`
+pub fn parse_send_args(args: &[String]) -> Result<SendArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut delay = None;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--delay" => delay = Some(parse_window(iter.next().ok_or("--delay requires a value")?, "delay")?),
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected an output port".to_string());
+    }
+
+    Ok(SendArgs {
+        output: positional.pop().unwrap(),
+        match_mode,
+        delay,
+    })
+}
+
+/// Options for `mc sysex`
+#[derive(Debug, Clone, PartialEq)]
+pub struct SysexArgs {
+    pub output: String,
+    pub file: String,
+    pub match_mode: PortMatch,
+    /// Pause between messages; many synths drop data sent back to back
+    pub delay: Duration,
+}
+
+/// Default `--delay` for `mc sysex`
+pub const SYSEX_DEFAULT_DELAY: Duration = Duration::from_millis(20);
+
+pub const SYSEX_USAGE: &str = "[--exact | --regex] [--delay MS] <output-port> <file.syx>";
+
+/// Parses the arguments following `sysex`
+pub fn parse_sysex_args(args: &[String]) -> Result<SysexArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut delay = SYSEX_DEFAULT_DELAY;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--delay" => delay = parse_window(iter.next().ok_or("--delay requires a value")?, "delay")?,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 2 {
+        return Err("Expected an output port and a .syx file".to_string());
+    }
+    let file = positional.pop().unwrap();
+    let output = positional.pop().unwrap();
+
+    Ok(SysexArgs {
+        output,
+        file,
+        match_mode,
+        delay,
+    })
+}
+
+/// Options for `mc sysex-dump`
+#[derive(Debug, Clone, PartialEq)]
+pub struct SysexDumpArgs {
+    pub input: String,
+    pub file: String,
+    pub match_mode: PortMatch,
+    /// Stop once no SysEx has arrived for this long after the first message
+    pub idle: Option<Duration>,
+}
+
+pub const SYSEX_DUMP_USAGE: &str = "[--exact | --regex] [--idle MS] <input-port> <file.syx>";
+
+/// Parses the arguments following `sysex-dump`
+pub fn parse_sysex_dump_args(args: &[String]) -> Result<SysexDumpArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut idle = None;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--idle" => idle = Some(parse_window(iter.next().ok_or("--idle requires a value")?, "idle timeout")?),
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 2 {
+        return Err("Expected an input port and a .syx file".to_string());
+    }
+    let file = positional.pop().unwrap();
+    let input = positional.pop().unwrap();
+
+    Ok(SysexDumpArgs {
+        input,
+        file,
+        match_mode,
+        idle,
+    })
+}
+
+/// Options for `mc arp`
+#[derive(Debug, Clone, PartialEq)]
+pub struct ArpArgs {
+    pub input: String,
+    pub output: String,
+    pub match_mode: PortMatch,
+    pub bpm: f64,
+    pub pattern: Pattern,
+    /// Octaves the held notes are repeated over (1-4)
+    pub octaves: u8,
+}
+
+pub const ARP_USAGE: &str = "[--exact | --regex] [--bpm N] [--pattern up|down|updown|random] [--octaves N]
+    <input-port> <output-port>";
+
+/// Parses the arguments following `arp`
+pub fn parse_arp_args(args: &[String]) -> Result<ArpArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut bpm = 120.0;
+    let mut pattern = Pattern::Up;
+    let mut octaves = 1;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--bpm" => bpm = parse_bpm(iter.next().ok_or("--bpm requires a value")?)?,
+            "--pattern" => pattern = iter.next().ok_or("--pattern requires a value")?.parse()?,
+            "--octaves" => {
+                let value = iter.next().ok_or("--octaves requires a value")?;
+                octaves = value
+                    .parse::<u8>()
+                    .ok()
+                    .filter(|n| (1..=4).contains(n))
+                    .ok_or_else(|| format!("Invalid octaves '{}' (expected 1-4)", value))?;
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 2 {
+        return Err("Expected an input port and an output port".to_string());
+    }
+    let output = positional.pop().unwrap();
+    let input = positional.pop().unwrap();
+
+    Ok(ArpArgs {
+        input,
+        output,
+        match_mode,
+        bpm,
+        pattern,
+        octaves,
+    })
+}
+
+/// Options for `mc clock`
+#[derive(Debug, Clone, PartialEq)]
+pub struct ClockArgs {
+    pub output: String,
+    pub match_mode: PortMatch,
+    pub bpm: f64,
+    /// Clock pulses per quarter note (24 unless the device expects otherwise)
+    pub ppqn: u32,
+    /// Send Start (0xFA) before the first clock
+    pub send_start: bool,
+    /// Send Stop (0xFC) on ctrl+c
+    pub send_stop: bool,
+}
+
+pub const CLOCK_USAGE: &str =
+    "[--exact | --regex] [--bpm N] [--ppqn N] [--send-start on|off] [--send-stop on|off] <output-port>";
+
+/// Parses the arguments following `clock`
+pub fn parse_clock_args(args: &[String]) -> Result<ClockArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut bpm = 120.0;
+    let mut ppqn = crate::midi::clock::DEFAULT_PPQN;
+    let mut send_start = true;
+    let mut send_stop = true;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--bpm" => {
+                let value = iter.next().ok_or("--bpm requires a value")?;
+                bpm = parse_bpm(value)?;
+            }
+            "--ppqn" => ppqn = parse_ppqn(iter.next().ok_or("--ppqn requires a value")?)?,
+            "--send-start" => send_start = parse_toggle(iter.next().ok_or("--send-start requires on or off")?)?,
+            "--send-stop" => send_stop = parse_toggle(iter.next().ok_or("--send-stop requires on or off")?)?,
+            // Short forms of `--send-start off` and `--send-stop off`
+            "--no-start" => send_start = false,
+            "--no-stop" => send_stop = false,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected an output port".to_string());
+    }
+
+    Ok(ClockArgs {
+        output: positional.pop().unwrap(),
+        match_mode,
+        bpm,
+        ppqn,
+        send_start,
+        send_stop,
+    })
+}
+
+/// Options for `mc tempo`
+#[derive(Debug, Clone, PartialEq)]
+pub struct TempoArgs {
+    pub input: String,
+    pub match_mode: PortMatch,
+    /// Clock pulses per quarter note the sender uses
+    pub ppqn: u32,
+}
+
+pub const TEMPO_USAGE: &str = "[--exact | --regex] [--ppqn N] <input-port>";
+
+/// Parses the arguments following `tempo`
+pub fn parse_tempo_args(args: &[String]) -> Result<TempoArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut ppqn = crate::midi::clock::DEFAULT_PPQN;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--ppqn" => ppqn = parse_ppqn(iter.next().ok_or("--ppqn requires a value")?)?,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected an input port".to_string());
+    }
+
+    Ok(TempoArgs {
+        input: positional.pop().unwrap(),
+        match_mode,
+        ppqn,
+    })
+}
+
+/// Options for `mc mtc`
+#[derive(Debug, Clone, PartialEq)]
+pub struct MtcArgs {
+    pub input: String,
+    pub match_mode: PortMatch,
+}
+
+pub const MTC_USAGE: &str = "[--exact | --regex] <input-port>";
+
+/// Parses the arguments following `mtc`
+pub fn parse_mtc_args(args: &[String]) -> Result<MtcArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+
+    for arg in args {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected an input port".to_string());
+    }
+
+    Ok(MtcArgs {
+        input: positional.pop().unwrap(),
+        match_mode,
+    })
+}
+
+/// Options for `mc spp`
+#[derive(Debug, Clone, PartialEq)]
+pub struct SppArgs {
+    pub input: String,
+    pub match_mode: PortMatch,
+    /// `--time-sig`, for counting bars
+    pub time_signature: TimeSignature,
+}
+
+pub const SPP_USAGE: &str = "[--exact | --regex] [--time-sig N/D] <input-port>";
+
+/// Parses the arguments following `spp`
+pub fn parse_spp_args(args: &[String]) -> Result<SppArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut time_signature = TimeSignature::default();
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--time-sig" => time_signature = iter.next().ok_or("--time-sig requires a value")?.parse()?,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected an input port".to_string());
+    }
+
+    Ok(SppArgs {
+        input: positional.pop().unwrap(),
+        match_mode,
+        time_signature,
+    })
+}
+
+/// Ignore a trigger's event for this long after it fired, so a bouncing pad runs its
+/// command once
+pub const DEFAULT_TRIGGER_DEBOUNCE: Duration = Duration::from_millis(100);
+
+/// Options for `mc trigger`
+#[derive(Debug, Clone, PartialEq)]
+pub struct TriggerArgs {
+    pub input: String,
+    pub match_mode: PortMatch,
+    /// Each `--on` event with the command of the `--run` after it
+    pub triggers: Vec<(TriggerEvent, String)>,
+    pub debounce: Duration,
+}
+
+pub const TRIGGER_USAGE: &str =
+    "[--exact | --regex] [--debounce MS] <input-port> --on EVENT --run CMD [--on EVENT --run CMD]...";
+
+/// Parses the arguments following `trigger`
+pub fn parse_trigger_args(args: &[String]) -> Result<TriggerArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut triggers = Vec::new();
+    let mut pending: Option<TriggerEvent> = None;
+    let mut debounce = DEFAULT_TRIGGER_DEBOUNCE;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--on" => {
+                let value = iter.next().ok_or("--on requires a value")?;
+                if let Some(event) = pending.replace(value.parse()?) {
+                    return Err(format!("--on {} has no --run command", event));
+                }
+            }
+            "--run" => {
+                let value = iter.next().ok_or("--run requires a value")?;
+                let event = pending.take().ok_or("--run must follow an --on event")?;
+                triggers.push((event, value.clone()));
+            }
+            "--debounce" => {
+                let value = iter.next().ok_or("--debounce requires a value")?;
+                debounce = value
+                    .parse::<u64>()
+                    .map(Duration::from_millis)
+                    .map_err(|_| format!("Invalid debounce '{}' (expected milliseconds)", value))?;
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if let Some(event) = pending {
+        return Err(format!("--on {} has no --run command", event));
+    }
+    if positional.len() != 1 {
+        return Err("Expected an input port".to_string());
+    }
+    if triggers.is_empty() {
+        return Err("Expected at least one --on EVENT --run CMD".to_string());
+    }
+
+    Ok(TriggerArgs {
+        input: positional.pop().unwrap(),
+        match_mode,
+        triggers,
+        debounce,
+    })
+}
+
+/// Options for `mc merge`
+#[derive(Debug, Clone, PartialEq)]
+pub struct MergeArgs {
+    pub output: String,
+    pub inputs: Vec<String>,
+    pub match_mode: PortMatch,
+    /// `--channel-per-input`: move the Nth input's channel messages to channel N
+    pub channel_per_input: bool,
+}
+
+pub const MERGE_USAGE: &str = "[--exact | --regex] [--channel-per-input] <output-port> <input-port> <input-port>...";
+
+/// Parses the arguments following `merge`
+pub fn parse_merge_args(args: &[String]) -> Result<MergeArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut channel_per_input = false;
+
+    for arg in args {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--channel-per-input" => channel_per_input = true,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() < 3 {
+        return Err("Expected an output port and at least two input ports".to_string());
+    }
+    let output = positional.remove(0);
+    if channel_per_input && positional.len() > 16 {
+        return Err(format!("--channel-per-input has 16 channels for {} inputs", positional.len()));
+    }
+
+    Ok(MergeArgs {
+        output,
+        inputs: positional,
+        match_mode,
+        channel_per_input,
+    })
+}
+
+/// Options for `mc split`
+#[derive(Debug, Clone, PartialEq)]
+pub struct SplitArgs {
+    pub input: String,
+    pub outputs: Vec<String>,
+    pub match_mode: PortMatch,
+    /// Route channel N to the Nth output instead of copying to all
+    pub channel_split: bool,
+    /// `--zone`: route notes by key range instead; the outputs come from the zones
+    pub zones: Vec<Zone>,
+    /// `--default-output`: where zones send everything but notes, instead of to every zone
+    pub default_output: Option<String>,
+}
+
+pub const SPLIT_USAGE: &str = "[--exact | --regex] [--channel-split | --zone LOW:HIGH=<output-port> [--transpose N]...]
+    [--default-output <output-port>] <input-port> [<output-port> <output-port>...]";
+
+/// Parses the arguments following `split`
+pub fn parse_split_args(args: &[String]) -> Result<SplitArgs, String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    let mut channel_split = false;
+    let mut zones: Vec<Zone> = Vec::new();
+    let mut default_output = None;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--channel-split" => channel_split = true,
+            "--zone" => {
+                let value = iter.next().ok_or("--zone requires a value")?;
+                zones.push(value.parse()?);
+            }
+            "--transpose" => {
+                let value = iter.next().ok_or("--transpose requires a value")?;
+                let zone = zones.last_mut().ok_or("--transpose must follow a --zone")?;
+                zone.transpose = parse_transpose(value)?;
+            }
+            "--default-output" => {
+                default_output = Some(iter.next().ok_or("--default-output requires a port")?.clone());
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if !zones.is_empty() {
+        if channel_split {
+            return Err("--zone and --channel-split can't be combined".to_string());
+        }
+        if positional.len() != 1 {
+            return Err("Expected only an input port with --zone (the zones name the outputs)".to_string());
+        }
+    } else if default_output.is_some() {
+        return Err("--default-output needs --zone".to_string());
+    } else if positional.len() < 3 {
+        return Err("Expected an input port and at least two output ports".to_string());
+    }
+    if positional.len() > 17 {
+        return Err("At most 16 output ports can be given".to_string());
+    }
+    let input = positional.remove(0);
+
+    Ok(SplitArgs {
+        input,
+        outputs: positional,
+        match_mode,
+        channel_split,
+        zones,
+        default_output,
+    })
+}
+
+/// Options for `mc port`
+#[derive(Debug, Clone, PartialEq)]
+pub struct PortArgs {
+    pub port: PortConfig,
+    /// Skip releasing held notes on shutdown
+    pub no_panic: bool,
+    /// `--wait`: how long to wait for the `--to`/`--from` ports before giving up
+    pub wait: Option<Duration>,
+}
+
+pub const PORT_USAGE: &str = "[--exact | --regex] [--to <output-port>] [--from <input-port>]
+    [--in-only | --out-only] [--no-panic | --panic-mode MODE] [--wait] [--wait-timeout MS]
+    [--reset-on-start] [--reset-type reset|gm|gm2|HEX]
+    [--record FILE] [--record-format mid|csv|json] [--client-name NAME] [--keepalive] <name>";
+
+/// Parses the arguments following `port`
+pub fn parse_port_args(args: &[String]) -> Result<PortArgs, String> {
+    let mut positional = Vec::new();
+    let mut to = None;
+    let mut from = None;
+    let mut match_mode = PortMatch::Substring;
+    let mut sides = Sides::Both;
+    let mut no_panic = false;
+    let mut wait = None;
+    let mut reset = None;
+    let mut record = None;
+    let mut record_format = None;
+    let mut client_name = None;
+    let mut keepalive = false;
+    let mut panic_mode = None;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--wait" => wait = wait.or(Some(DEFAULT_WAIT_TIMEOUT)),
+            "--wait-timeout" => {
+                let value = iter.next().ok_or("--wait-timeout requires a value")?;
+                wait = Some(parse_window(value, "wait timeout")?);
+            }
+            "--reset-on-start" => reset = reset.or(Some(Reset::System)),
+            "--reset-type" => {
+                let value = iter.next().ok_or("--reset-type requires a value")?;
+                reset = Some(value.parse()?);
+            }
+            "--to" => to = Some(iter.next().ok_or("--to requires a port")?.clone()),
+            "--from" => from = Some(iter.next().ok_or("--from requires a port")?.clone()),
+            "--in-only" | "--out-only" => {
+                if sides != Sides::Both {
+                    return Err("--in-only and --out-only are mutually exclusive".to_string());
+                }
+                sides = if arg == "--in-only" { Sides::InputOnly } else { Sides::OutputOnly };
+            }
+            "--no-panic" => no_panic = true,
+            "--panic-mode" => {
+                let value = iter.next().ok_or("--panic-mode requires a value")?;
+                panic_mode = Some(value.parse()?);
+            }
+            "--keepalive" => keepalive = true,
+            "--record" => record = Some(iter.next().ok_or("--record requires a file")?.clone()),
+            "--client-name" => {
+                let value = iter.next().ok_or("--client-name requires a name")?;
+                if value.trim().is_empty() {
+                    return Err("--client-name can't be empty".to_string());
+                }
+                client_name = Some(value.clone());
+            }
+            "--record-format" => {
+                let value = iter.next().ok_or("--record-format requires a value")?;
+                record_format = Some(value.parse::<RecordFormat>()?);
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected a port name".to_string());
+    }
+    if record.is_none() && record_format.is_some() {
+        return Err("--record-format requires --record".to_string());
+    }
+    if sides == Sides::InputOnly && from.is_some() {
+        return Err("--from feeds the virtual output, which --in-only doesn't create".to_string());
+    }
+    if sides == Sides::OutputOnly && to.is_some() {
+        return Err("--to forwards the virtual input, which --out-only doesn't create".to_string());
+    }
+    if no_panic && panic_mode.is_some() {
+        return Err("--panic-mode and --no-panic are mutually exclusive".to_string());
+    }
+
+    Ok(PortArgs {
+        port: PortConfig {
+            name: positional.pop().unwrap(),
+            to,
+            from,
+            match_mode,
+            sides,
+            reset,
+            record: record.map(|file| (file, record_format.unwrap_or_default())),
+            client_name,
+            keepalive,
+            panic_mode: panic_mode.unwrap_or_default(),
+        },
+        no_panic,
+        wait,
+    })
+}
+
+/// Options for `mc bench`
+#[derive(Debug, Clone, PartialEq)]
+pub struct BenchArgs {
+    /// `--to`/`--from`: a loopback to measure (e.g. an IAC bus or an `mc port` pair);
+    /// None measures a virtual port of the bench's own
+    pub through: Option<(String, String)>,
+    pub match_mode: PortMatch,
+    /// `--duration`: how long to send probes
+    pub duration: Duration,
+    /// `--rate`: probes per second
+    pub rate: u32,
+}
+
+/// Default `--duration` for `mc bench`
+const DEFAULT_BENCH_DURATION: Duration = Duration::from_secs(10);
+
+/// Default `--rate` for `mc bench`
+const DEFAULT_BENCH_RATE: u32 = 500;
+
+/// Largest `--rate`, several times what a DIN cable carries
+const MAX_BENCH_RATE: u32 = 10_000;
+
+pub const BENCH_USAGE: &str =
+    "[--exact | --regex] [--to <output-port> --from <input-port>] [--duration MS] [--rate N]";
+
+/// Parses the arguments following `bench`
+pub fn parse_bench_args(args: &[String]) -> Result<BenchArgs, String> {
+    let mut match_mode = PortMatch::Substring;
+    let mut to = None;
+    let mut from = None;
+    let mut duration = DEFAULT_BENCH_DURATION;
+    let mut rate = DEFAULT_BENCH_RATE;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--to" => to = Some(iter.next().ok_or("--to requires a port")?.clone()),
+            "--from" => from = Some(iter.next().ok_or("--from requires a port")?.clone()),
+            "--duration" => {
+                let value = iter.next().ok_or("--duration requires a value")?;
+                duration = parse_window(value, "duration")?;
+            }
+            "--rate" => {
+                let value = iter.next().ok_or("--rate requires a value")?;
+                rate = value
+                    .parse::<u32>()
+                    .ok()
+                    .filter(|r| (1..=MAX_BENCH_RATE).contains(r))
+                    .ok_or_else(|| format!("Invalid rate '{}' (expected 1-{} per second)", value, MAX_BENCH_RATE))?;
+            }
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => return Err(format!("Unexpected argument '{}'", arg)),
+        }
+    }
+
+    let through = match (to, from) {
+        (Some(to), Some(from)) => Some((to, from)),
+        (None, None) => None,
+        _ => return Err("--to and --from go together: probes go out one and come back the other".to_string()),
+    };
+
+    Ok(BenchArgs {
+        through,
+        match_mode,
+        duration,
+        rate,
+    })
+}
+
+/// Options for `mc net-send`
+#[derive(Debug, Clone, PartialEq)]
+pub struct NetSendArgs {
+    pub input: String,
+    /// Destination as host:port
+    pub address: String,
+    pub match_mode: PortMatch,
+}
+
+pub const NET_SEND_USAGE: &str = "[--exact | --regex] <input-port> <host:port>";
+
+/// Parses the arguments following `net-send`
+pub fn parse_net_send_args(args: &[String]) -> Result<NetSendArgs, String> {
+    let (mut positional, match_mode) = parse_positional_with_match(args)?;
+    if positional.len() != 2 {
+        return Err("Expected an input port and a host:port address".to_string());
+    }
+    let address = positional.pop().unwrap();
+    if !address.contains(':') {
+        return Err(format!("Invalid address '{}' (expected host:port)", address));
+    }
+
+    Ok(NetSendArgs {
+        input: positional.pop().unwrap(),
+        address,
+        match_mode,
+    })
+}
+
+/// Options for `mc net-recv`
+#[derive(Debug, Clone, PartialEq)]
+pub struct NetRecvArgs {
+    /// UDP port to listen on
+    pub port: u16,
+    pub output: String,
+    pub match_mode: PortMatch,
+}
+
+pub const NET_RECV_USAGE: &str = "[--exact | --regex] <udp-port> <output-port>";
+
+/// Parses the arguments following `net-recv`
+pub fn parse_net_recv_args(args: &[String]) -> Result<NetRecvArgs, String> {
+    let (mut positional, match_mode) = parse_positional_with_match(args)?;
+    if positional.len() != 2 {
+        return Err("Expected a UDP port and an output port".to_string());
+    }
+    let output = positional.pop().unwrap();
+    let port = positional.pop().unwrap();
+    let port = port
+        .parse::<u16>()
+        .ok()
+        .filter(|p| *p != 0)
+        .ok_or_else(|| format!("Invalid UDP port '{}'", port))?;
+
+    Ok(NetRecvArgs {
+        port,
+        output,
+        match_mode,
+    })
+}
+
+/// Options for `mc osc-send`
+#[derive(Debug, Clone, PartialEq)]
+pub struct OscSendArgs {
+    pub input: String,
+    /// Destination as host:port
+    pub address: String,
+    pub match_mode: PortMatch,
+    /// Address prefix, e.g. `/midi` for `/midi/note`
+    pub prefix: String,
+    /// Controllers sent to their own address as a scaled float, at most one per controller
+    pub maps: Vec<CcMapping>,
+}
+
+pub const OSC_SEND_USAGE: &str =
+    "[--prefix /ADDR] [--map ccN=/ADDR[:MIN-MAX]]... [--exact | --regex] <input-port> <host:port>";
+
+/// Parses the arguments following `osc-send`
+pub fn parse_osc_send_args(args: &[String]) -> Result<OscSendArgs, String> {
+    let (rest, prefix) = take_osc_prefix(args)?;
+
+    let mut net_args = Vec::new();
+    let mut maps: Vec<CcMapping> = Vec::new();
+    let mut iter = rest.iter();
+    while let Some(arg) = iter.next() {
+        if arg == "--map" {
+            let mapping: CcMapping = iter.next().ok_or("--map requires a mapping")?.parse()?;
+            if maps.iter().any(|m| m.controller == mapping.controller) {
+                return Err(format!("cc{} is mapped more than once", mapping.controller));
+            }
+            maps.push(mapping);
+        } else {
+            net_args.push(arg.clone());
+        }
+    }
+
+    let net = parse_net_send_args(&net_args)?;
+    Ok(OscSendArgs {
+        input: net.input,
+        address: net.address,
+        match_mode: net.match_mode,
+        prefix,
+        maps,
+    })
+}
+
+/// Options for `mc osc-recv`
+#[derive(Debug, Clone, PartialEq)]
+pub struct OscRecvArgs {
+    /// UDP port to listen on
+    pub port: u16,
+    pub output: String,
+    pub match_mode: PortMatch,
+    pub prefix: String,
+}
+
+pub const OSC_RECV_USAGE: &str = "[--prefix /ADDR] [--exact | --regex] <udp-port> <output-port>";
+
+/// Parses the arguments following `osc-recv`
+pub fn parse_osc_recv_args(args: &[String]) -> Result<OscRecvArgs, String> {
+    let (rest, prefix) = take_osc_prefix(args)?;
+    let net = parse_net_recv_args(&rest)?;
+    Ok(OscRecvArgs {
+        port: net.port,
+        output: net.output,
+        match_mode: net.match_mode,
+        prefix,
+    })
+}
+
+/// Removes `--prefix` from the arguments, returning the rest and the prefix without a trailing slash
+fn take_osc_prefix(args: &[String]) -> Result<(Vec<String>, String), String> {
+    let mut rest = Vec::new();
+    let mut prefix = crate::net::osc::DEFAULT_PREFIX.to_string();
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        if arg == "--prefix" {
+            let value = iter.next().ok_or("--prefix requires an address")?;
+            if !value.starts_with('/') || value.contains(char::is_whitespace) {
+                return Err(format!("Invalid OSC prefix '{}' (expected e.g. /midi)", value));
+            }
+            prefix = value.trim_end_matches('/').to_string();
+        } else {
+            rest.push(arg.clone());
+        }
+    }
+    Ok((rest, prefix))
+}
+
+/// Options for `mc ws`
+#[derive(Debug, Clone, PartialEq)]
+pub struct WsArgs {
+    pub input: String,
+    /// Address to listen on, as host:port
+    pub listen: String,
+    /// Where messages sent by clients go, if anywhere
+    pub output: Option<String>,
+    pub match_mode: PortMatch,
+}
+
+pub const WS_USAGE: &str = "[--listen [HOST]:PORT] [--output <output-port>] [--exact | --regex] <input-port>";
+
+/// Parses the arguments following `ws`
+pub fn parse_ws_args(args: &[String]) -> Result<WsArgs, String> {
+    let mut positional = Vec::new();
+    let mut listen = "0.0.0.0:8080".to_string();
+    let mut output = None;
+    let mut match_mode = PortMatch::Substring;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--listen" => {
+                let value = iter.next().ok_or("--listen requires an address")?;
+                listen = parse_listen_address(value)?;
+            }
+            "--output" => output = Some(iter.next().ok_or("--output requires a port")?.clone()),
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected an input port".to_string());
+    }
+
+    Ok(WsArgs {
+        input: positional.pop().unwrap(),
+        listen,
+        output,
+        match_mode,
+    })
+}
+
+/// Options for `mc rtp`
+#[derive(Debug, Clone, PartialEq)]
+pub struct RtpArgs {
+    /// Session name, also used for the local virtual port
+    pub name: String,
+    /// Control port; the data port is the one after it
+    pub listen: u16,
+    /// Send the session's messages to this port instead of the virtual output
+    pub to: Option<String>,
+    pub match_mode: PortMatch,
+    pub no_panic: bool,
+}
+
+/// Default AppleMIDI control port
+pub const RTP_DEFAULT_PORT: u16 = 5004;
+
+pub const RTP_USAGE: &str = "[--listen PORT] [--exact | --regex] [--to <output-port>] [--no-panic] <name>";
+
+/// Parses the arguments following `rtp`
+pub fn parse_rtp_args(args: &[String]) -> Result<RtpArgs, String> {
+    let mut positional = Vec::new();
+    let mut listen = RTP_DEFAULT_PORT;
+    let mut to = None;
+    let mut match_mode = PortMatch::Substring;
+    let mut no_panic = false;
+
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--listen" => {
+                let value = iter.next().ok_or("--listen requires a port")?;
+                listen = value
+                    .parse::<u16>()
+                    .ok()
+                    // The data port is listen + 1
+                    .filter(|p| *p != 0 && *p != u16::MAX)
+                    .ok_or_else(|| format!("Invalid UDP port '{}'", value))?;
+            }
+            "--to" => to = Some(iter.next().ok_or("--to requires a port")?.clone()),
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            "--no-panic" => no_panic = true,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+
+    if positional.len() != 1 {
+        return Err("Expected a session name".to_string());
+    }
+
+    Ok(RtpArgs {
+        name: positional.pop().unwrap(),
+        listen,
+        to,
+        match_mode,
+        no_panic,
+    })
+}
+
+/// Collects positional arguments for commands whose only options are `--exact` / `--regex`
+fn parse_positional_with_match(args: &[String]) -> Result<(Vec<String>, PortMatch), String> {
+    let mut positional = Vec::new();
+    let mut match_mode = PortMatch::Substring;
+    for arg in args {
+        match arg.as_str() {
+            "--exact" => match_mode = PortMatch::Exact,
+            "--regex" => match_mode = PortMatch::Regex,
+            flag if flag.starts_with("--") => {
+                return Err(format!("Unknown option '{}'", flag));
+            }
+            _ => positional.push(arg.clone()),
+        }
+    }
+    Ok((positional, match_mode))
+}
+
+/// Parses a tempo in beats per minute
+fn parse_bpm(value: &str) -> Result<f64, String> {
+    value
+        .parse::<f64>()
+        .ok()
+        .filter(|bpm| bpm.is_finite() && (1.0..=999.0).contains(bpm))
+        .ok_or_else(|| format!("Invalid BPM '{}' (expected 1-999)", value))
+}
+
+/// Parses clock pulses per quarter note
+fn parse_ppqn(value: &str) -> Result<u32, String> {
+    value
+        .parse::<u32>()
+        .ok()
+        .filter(|ppqn| (1..=960).contains(ppqn))
+        .ok_or_else(|| format!("Invalid PPQN '{}' (expected 1-960)", value))
+}
+
+/// Parses a positive number of milliseconds
+fn parse_window(value: &str, what: &str) -> Result<Duration, String> {
+    value
+        .parse::<u64>()
+        .ok()
+        .filter(|ms| *ms > 0)
+        .map(Duration::from_millis)
+        .ok_or_else(|| format!("Invalid {} '{}' (expected milliseconds)", what, value))
+}
+
+/// Parses a note as a number or a name such as `C4` or `C-1`
+fn parse_note(value: &str) -> Result<u8, String> {
+    parse_data_byte(value, "note").or_else(|_| {
+        parse_note_name(value).ok_or_else(|| format!("Invalid note '{}' (expected 0-127 or a name like C4)", value))
+    })
+}
+
+/// Parses the `on|off` of a toggle such as `--send-start`
+fn parse_toggle(value: &str) -> Result<bool, String> {
+    match value {
+        "on" => Ok(true),
+        "off" => Ok(false),
+        _ => Err(format!("Invalid value '{}' (expected on or off)", value)),
+    }
+}
+
+/// Parses a `--transpose` in semitones
+fn parse_transpose(value: &str) -> Result<i8, String> {
+    value
+        .parse::<i8>()
+        .ok()
+        .filter(|n| (-127..=127).contains(n))
+        .ok_or_else(|| format!("Invalid transpose '{}' (expected -127 to 127)", value))
+}
+
+/// Parses a `[host]:port` to listen on; ":8080" listens on every interface
+fn parse_listen_address(value: &str) -> Result<String, String> {
+    match value.rsplit_once(':') {
+        Some(("", port)) => Ok(format!("0.0.0.0:{}", port)),
+        Some(_) => Ok(value.to_string()),
+        None => Err(format!("Invalid listen address '{}' (expected [host]:port)", value)),
+    }
+}
+
+/// Parses `--harmonize` intervals: comma-separated semitone offsets such as `4,7` or `-12`
+fn parse_intervals(value: &str) -> Result<Vec<i8>, String> {
+    value
+        .split(',')
+        .map(|part| {
+            part.trim()
+                .parse::<i8>()
+                .ok()
+                .filter(|n| *n != 0 && (-127..=127).contains(n))
+                .ok_or_else(|| format!("Invalid interval '{}' (expected -127 to 127, not 0)", part))
+        })
+        .collect()
+}
+
+/// Parses a 0-127 data value such as a note or controller number
+fn parse_data_byte(value: &str, what: &str) -> Result<u8, String> {
+    match value.parse::<u8>() {
+        Ok(byte) if byte <= 127 => Ok(byte),
+        _ => Err(format!("Invalid {} '{}' (expected 0-127)", what, value)),
+    }
+}
+
+/// Parses a 1-based MIDI channel number
+fn parse_channel(value: &str) -> Result<u8, String> {
+    match value.parse::<u8>() {
+        Ok(channel) if (1..=16).contains(&channel) => Ok(channel),
+        _ => Err(format!("Invalid channel '{}' (expected 1-16)", value)),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn args(list: &[&str]) -> Vec<String> {
+        list.iter().map(|s| s.to_string()).collect()
+    }
+
+    #[test]
+    fn test_positional_ports() {
+        let parsed = parse_forward_args(&args(&["IAC Driver Bus 1", "synth"])).unwrap();
+        assert_eq!(parsed.input, "IAC Driver Bus 1");
+        assert_eq!(parsed.outputs, vec!["synth"]);
+        assert_eq!(parsed.match_mode, PortMatch::Substring);
+        assert!(parsed.channels.is_empty());
+
+        assert!(parse_forward_args(&args(&["only-one"])).is_err());
+    }
+
+    #[test]
+    fn test_multiple_outputs() {
+        let parsed = parse_forward_args(&args(&["keys", "synth", "--channel", "1", "drums"])).unwrap();
+        assert_eq!(parsed.input, "keys");
+        assert_eq!(parsed.outputs, vec!["synth", "drums"]);
+        assert!(parse_forward_args(&args(&["--bidir", "keys", "synth", "drums"])).is_err());
+    }
+
+    #[test]
+    fn test_flags_anywhere() {
+        let parsed = parse_forward_args(&args(&[
+            "--channel", "1", "in", "--exact", "out", "--channel", "16",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.input, "in");
+        assert_eq!(parsed.outputs, vec!["out"]);
+        assert_eq!(parsed.match_mode, PortMatch::Exact);
+        assert_eq!(parsed.channels, vec![1, 16]);
+        assert!(!parsed.no_panic);
+        assert!(parse_forward_args(&args(&["in", "out", "--no-panic"])).unwrap().no_panic);
+        assert!(parse_forward_args(&args(&["--bidir", "in", "out"])).unwrap().bidir);
+
+        assert!(parse_forward_args(&args(&["in", "out", "--bogus"])).is_err());
+    }
+
+    #[test]
+    fn test_channel_range() {
+        assert!(parse_forward_args(&args(&["in", "out", "--channel", "0"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--channel", "17"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--channel", "x"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--channel"])).is_err());
+    }
+
+    #[test]
+    fn test_transpose() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--transpose", "-12"])).unwrap();
+        assert_eq!(parsed.transpose, -12);
+
+        assert!(parse_forward_args(&args(&["in", "out", "--transpose", "200"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--transpose", "up"])).is_err());
+    }
+
+    #[test]
+    fn test_channel_shift() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--channel-shift", "-4"])).unwrap();
+        assert_eq!(parsed.channel_shift, -4);
+        assert_eq!(parsed.describe(), vec!["shift channels -4"]);
+        assert!(parse_forward_args(&args(&["in", "out", "--channel-shift", "16"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--channel-shift"])).is_err());
+    }
+
+    #[test]
+    fn test_velocity_options() {
+        let parsed = parse_forward_args(&args(&[
+            "in", "out", "--velocity-scale", "1.5", "--velocity-curve", "exp", "--velocity-note-off",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.velocity_scale, 1.5);
+        assert_eq!(parsed.velocity_curve, VelocityCurve::Exp);
+        assert!(parsed.velocity_note_off);
+
+        assert!(parse_forward_args(&args(&["in", "out", "--velocity-scale", "0"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--velocity-scale", "-1"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--velocity-curve", "cubic"])).is_err());
+    }
+
+    #[test]
+    fn test_fixed_velocity() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--fixed-velocity", "100"])).unwrap();
+        assert_eq!(parsed.fixed_velocity, Some(100));
+        assert_eq!(parse_forward_args(&args(&["in", "out"])).unwrap().fixed_velocity, None);
+
+        assert!(parse_forward_args(&args(&["in", "out", "--fixed-velocity", "0"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--fixed-velocity", "128"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--fixed-velocity", "100", "--velocity-scale", "2"])).is_err());
+    }
+
+    #[test]
+    fn test_only_except_exclusive() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--only", "note,cc"])).unwrap();
+        assert!(matches!(parsed.types, Some(TypeFilter::Only(_))));
+
+        let parsed = parse_forward_args(&args(&["in", "out", "--except", "sysex"])).unwrap();
+        assert!(matches!(parsed.types, Some(TypeFilter::Except(_))));
+
+        assert!(parse_forward_args(&args(&["in", "out", "--only", "note", "--except", "sysex"])).is_err());
+    }
+
+    #[test]
+    fn test_monitor_args() {
+        let parsed = parse_monitor_args(&args(&["--raw", "launchpad"])).unwrap();
+        assert_eq!(parsed.input, "launchpad");
+        assert!(parsed.raw);
+
+        assert!(parse_monitor_args(&args(&[])).is_err());
+        assert!(parse_monitor_args(&args(&["a", "b"])).is_err());
+    }
+
+    #[test]
+    fn test_monitor_histogram() {
+        let parsed = parse_monitor_args(&args(&["keys"])).unwrap();
+        assert!(!parsed.histogram);
+        let parsed = parse_monitor_args(&args(&["keys", "--histogram"])).unwrap();
+        assert!(parsed.histogram);
+        assert_eq!(parsed.histogram_interval, None);
+        let parsed = parse_monitor_args(&args(&["keys", "--histogram-every", "30000"])).unwrap();
+        assert!(parsed.histogram);
+        assert_eq!(parsed.histogram_interval, Some(Duration::from_secs(30)));
+        assert!(parse_monitor_args(&args(&["keys", "--histogram-every", "0"])).is_err());
+    }
+
+    #[test]
+    fn test_monitor_meter() {
+        assert!(!parse_monitor_args(&args(&["keys"])).unwrap().meter);
+        let parsed = parse_monitor_args(&args(&["keys", "--meter", "--histogram"])).unwrap();
+        assert!(parsed.meter && parsed.histogram);
+        assert!(parse_monitor_args(&args(&["keys", "--meter", "--raw"])).is_err());
+        assert!(parse_monitor_args(&args(&["keys", "--meter", "--histogram-every", "1000"])).is_err());
+    }
+
+    #[test]
+    fn test_detect_stuck() {
+        let parsed = parse_monitor_args(&args(&["keys", "--detect-stuck"])).unwrap();
+        assert_eq!(parsed.detect_stuck, Some(DEFAULT_STUCK_AFTER));
+        let parsed = parse_monitor_args(&args(&["keys", "--stuck-after", "2000"])).unwrap();
+        assert_eq!(parsed.detect_stuck, Some(Duration::from_secs(2)));
+        assert_eq!(parse_monitor_args(&args(&["keys"])).unwrap().detect_stuck, None);
+        // There's nowhere to send a Note Off from monitor
+        assert!(parse_monitor_args(&args(&["keys", "--stuck-note-off"])).is_err());
+
+        let parsed = parse_forward_args(&args(&["in", "out", "--stuck-note-off"])).unwrap();
+        assert_eq!(parsed.detect_stuck, Some((DEFAULT_STUCK_AFTER, true)));
+        let parsed = parse_forward_args(&args(&["in", "out", "--detect-stuck", "--stuck-after", "500"])).unwrap();
+        assert_eq!(parsed.detect_stuck, Some((Duration::from_millis(500), false)));
+        assert!(parse_forward_args(&args(&["in", "out", "--stuck-after", "0"])).is_err());
+    }
+
+    #[test]
+    fn test_record_args() {
+        let parsed = parse_record_args(&args(&["keys", "take1.mid", "--bpm", "90"])).unwrap();
+        assert_eq!(parsed.input, "keys");
+        assert_eq!(parsed.file, "take1.mid");
+        assert_eq!(parsed.bpm, 90.0);
+
+        assert_eq!(parse_record_args(&args(&["keys", "take1.mid"])).unwrap().bpm, 120.0);
+        assert!(parse_record_args(&args(&["keys", "take1.mid", "--bpm", "0"])).is_err());
+        assert!(parse_record_args(&args(&["keys"])).is_err());
+
+        let parsed = parse_record_args(&args(&["--format", "csv", "keys", "take1.csv"])).unwrap();
+        assert_eq!(parsed.format, RecordFormat::Csv);
+        assert_eq!(parse_record_args(&args(&["keys", "take1.mid"])).unwrap().format, RecordFormat::Smf);
+        assert!(parse_record_args(&args(&["--format", "wav", "keys", "take1.wav"])).is_err());
+
+        let parsed = parse_record_args(&args(&["--timestamps", "clock", "keys", "take1.mid"])).unwrap();
+        assert_eq!(parsed.timestamps, TimestampSource::Clock);
+        assert_eq!(parse_record_args(&args(&["keys", "take1.mid"])).unwrap().timestamps, TimestampSource::Driver);
+        assert!(parse_record_args(&args(&["--timestamps", "host", "keys", "take1.mid"])).is_err());
+    }
+
+    #[test]
+    fn test_play_args() {
+        let parsed = parse_play_args(&args(&["song.mid", "synth", "--loop"])).unwrap();
+        assert_eq!(parsed.file, "song.mid");
+        assert_eq!(parsed.output, "synth");
+        assert!(parsed.loop_playback);
+
+        assert!(!parse_play_args(&args(&["song.mid", "synth"])).unwrap().loop_playback);
+        assert!(parse_play_args(&args(&["song.mid"])).is_err());
+
+        let parsed = parse_play_args(&args(&["--format", "csv", "--speed", "0.5", "take.csv", "synth"])).unwrap();
+        assert_eq!((parsed.format, parsed.speed), (RecordFormat::Csv, 0.5));
+        assert_eq!(parse_play_args(&args(&["song.mid", "synth"])).unwrap().speed, 1.0);
+        assert!(parse_play_args(&args(&["--speed", "0", "song.mid", "synth"])).is_err());
+    }
+
+    #[test]
+    fn test_merge_args() {
+        let parsed = parse_merge_args(&args(&["synth", "keys", "pads", "--exact"])).unwrap();
+        assert_eq!(parsed.output, "synth");
+        assert_eq!(parsed.inputs, vec!["keys", "pads"]);
+        assert_eq!(parsed.match_mode, PortMatch::Exact);
+
+        assert!(parse_merge_args(&args(&["synth", "keys"])).is_err());
+        assert!(!parsed.channel_per_input);
+
+        let parsed = parse_merge_args(&args(&["synth", "keys", "pads", "--channel-per-input"])).unwrap();
+        assert!(parsed.channel_per_input);
+        let mut many = vec!["--channel-per-input", "synth"];
+        many.extend(["in"; 17]);
+        assert!(parse_merge_args(&args(&many)).is_err());
+    }
+
+    #[test]
+    fn test_split_args() {
+        let parsed = parse_split_args(&args(&["keys", "bass", "lead", "--channel-split"])).unwrap();
+        assert_eq!(parsed.input, "keys");
+        assert_eq!(parsed.outputs, vec!["bass", "lead"]);
+        assert!(parsed.channel_split);
+
+        assert!(parse_split_args(&args(&["keys", "bass"])).is_err());
+    }
+
+    #[test]
+    fn test_split_zones() {
+        let parsed = parse_split_args(&args(&[
+            "keys", "--zone", ":59=bass", "--transpose", "12", "--zone", "C4:=lead", "--default-output", "fx",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.input, "keys");
+        assert!(parsed.outputs.is_empty());
+        let zones: Vec<_> = parsed.zones.iter().map(|z| (z.low, z.high, z.output.as_str(), z.transpose)).collect();
+        assert_eq!(zones, vec![(0, 59, "bass", 12), (60, 127, "lead", 0)]);
+        assert_eq!(parsed.default_output.as_deref(), Some("fx"));
+
+        assert!(parse_split_args(&args(&["keys", "--transpose", "12", "--zone", ":59=bass"])).is_err());
+        assert!(parse_split_args(&args(&["keys", "extra", "--zone", ":59=bass"])).is_err());
+        assert!(parse_split_args(&args(&["keys", "--zone", ":59=bass", "--channel-split"])).is_err());
+        assert!(parse_split_args(&args(&["keys", "bass", "lead", "--default-output", "fx"])).is_err());
+        assert!(parse_split_args(&args(&["keys", "--zone", "59=bass"])).is_err());
+    }
+
+    #[test]
+    fn test_dedup_window() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--dedup-window", "30"])).unwrap();
+        assert_eq!(parsed.dedup_window, Some(Duration::from_millis(30)));
+
+        assert_eq!(parse_forward_args(&args(&["in", "out"])).unwrap().dedup_window, None);
+        assert!(parse_forward_args(&args(&["in", "out", "--dedup-window", "0"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--dedup-window", "soon"])).is_err());
+    }
+
+    #[test]
+    fn test_bench_args() {
+        let parsed = parse_bench_args(&args(&[])).unwrap();
+        assert_eq!(parsed.through, None);
+        assert_eq!((parsed.duration, parsed.rate), (DEFAULT_BENCH_DURATION, DEFAULT_BENCH_RATE));
+
+        let parsed = parse_bench_args(&args(&[
+            "--to", "IAC Bus 1", "--from", "IAC Bus 1", "--duration", "2000", "--rate", "1000",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.through, Some(("IAC Bus 1".to_string(), "IAC Bus 1".to_string())));
+        assert_eq!((parsed.duration, parsed.rate), (Duration::from_secs(2), 1000));
+
+        assert!(parse_bench_args(&args(&["--to", "bus"])).is_err());
+        assert!(parse_bench_args(&args(&["--rate", "0"])).is_err());
+        assert!(parse_bench_args(&args(&["--rate", "20000"])).is_err());
+        assert!(parse_bench_args(&args(&["bus"])).is_err());
+    }
+
+    #[test]
+    fn test_usage_lookup() {
+        assert_eq!(usage("fwd"), Some(FORWARD_USAGE));
+        assert_eq!(usage("worker"), Some(FORWARD_USAGE));
+        assert_eq!(usage("run"), Some(RUN_USAGE));
+        assert_eq!(usage("fwdd"), None);
+    }
+
+    #[test]
+    fn test_wants_help() {
+        assert!(wants_help(&args(&["in", "-h"])));
+        assert!(wants_help(&args(&["--help"])));
+        assert!(!wants_help(&args(&["in", "out"])));
+    }
+
+    #[test]
+    fn test_list_and_run_args() {
+        assert!(parse_list_args(&args(&["--json"])).unwrap().json);
+        assert!(!parse_list_args(&args(&[])).unwrap().json);
+        assert!(parse_list_args(&args(&["--jsn"])).is_err());
+
+        let parsed = parse_list_args(&args(&["--watch"])).unwrap();
+        assert!(parsed.watch);
+        assert_eq!(parsed.interval, Duration::from_secs(1));
+        let parsed = parse_list_args(&args(&["--watch", "--interval", "250"])).unwrap();
+        assert_eq!(parsed.interval, Duration::from_millis(250));
+        assert!(parse_list_args(&args(&["--interval", "250"])).is_err());
+        assert!(parse_list_args(&args(&["-v"])).unwrap().verbose);
+        assert!(parse_list_args(&args(&["--drivers", "--json"])).unwrap().drivers);
+        assert!(parse_list_args(&args(&["--drivers", "--watch"])).is_err());
+
+        assert_eq!(parse_run_args(&args(&["routes.toml"])).unwrap().routes, "routes.toml");
+        assert_eq!(parse_run_args(&args(&["-"])).unwrap().routes, "-");
+        assert!(parse_run_args(&args(&[])).is_err());
+        assert!(parse_run_args(&args(&["a.toml", "b.toml"])).is_err());
+        assert!(parse_run_args(&args(&["--verbose", "routes.toml"])).is_err());
+
+        let parsed = parse_run_args(&args(&["--control-socket", "/tmp/mc.sock", "routes.toml"])).unwrap();
+        assert_eq!(parsed.control_socket.as_deref(), Some("/tmp/mc.sock"));
+        assert!(parse_run_args(&args(&["routes.toml", "--control-socket"])).is_err());
+    }
+
+    #[test]
+    fn test_port_args() {
+        let parsed = parse_port_args(&args(&["Synth", "--to", "Moog"])).unwrap().port;
+        assert_eq!(parsed.name, "Synth");
+        assert_eq!(parsed.to.as_deref(), Some("Moog"));
+        assert_eq!(parsed.from, None);
+        assert_eq!(parsed.sides, Sides::Both);
+
+        let parsed = parse_port_args(&args(&["--from", "Keys", "Keys In"])).unwrap().port;
+        assert_eq!(parsed.from.as_deref(), Some("Keys"));
+        assert_eq!(parsed.name, "Keys In");
+
+        assert!(parse_port_args(&args(&[])).is_err());
+        assert!(parse_port_args(&args(&["Synth", "--to"])).is_err());
+    }
+
+    #[test]
+    fn test_port_sides() {
+        let parsed = parse_port_args(&args(&["Synth", "--in-only", "--to", "Moog"])).unwrap().port;
+        assert_eq!(parsed.sides, Sides::InputOnly);
+        assert_eq!(parse_port_args(&args(&["Synth", "--out-only"])).unwrap().port.sides, Sides::OutputOnly);
+
+        assert!(parse_port_args(&args(&["Synth", "--in-only", "--out-only"])).is_err());
+        assert!(parse_port_args(&args(&["Synth", "--in-only", "--from", "Keys"])).is_err());
+        assert!(parse_port_args(&args(&["Synth", "--out-only", "--to", "Moog"])).is_err());
+    }
+
+    #[test]
+    fn test_port_record() {
+        let parsed = parse_port_args(&args(&["Bus", "--record", "bus.mid"])).unwrap().port;
+        assert_eq!(parsed.record, Some(("bus.mid".to_string(), RecordFormat::Smf)));
+        let parsed = parse_port_args(&args(&["Bus", "--record-format", "json", "--record", "bus.json"])).unwrap().port;
+        assert_eq!(parsed.record, Some(("bus.json".to_string(), RecordFormat::Json)));
+        assert_eq!(parse_port_args(&args(&["Bus"])).unwrap().port.record, None);
+
+        assert!(parse_port_args(&args(&["Bus", "--record"])).is_err());
+        assert!(parse_port_args(&args(&["Bus", "--record-format", "json"])).is_err());
+        assert!(parse_port_args(&args(&["Bus", "--record", "bus.txt", "--record-format", "txt"])).is_err());
+    }
+
+    #[test]
+    fn test_port_client_name() {
+        let parsed = parse_port_args(&args(&["Keys", "--client-name", "Studio"])).unwrap().port;
+        assert_eq!(parsed.client_name.as_deref(), Some("Studio"));
+        assert_eq!(parse_port_args(&args(&["Keys"])).unwrap().port.client_name, None);
+
+        assert!(parse_port_args(&args(&["Keys", "--client-name"])).is_err());
+        assert!(parse_port_args(&args(&["Keys", "--client-name", " "])).is_err());
+    }
+
+    #[test]
+    fn test_net_args() {
+        let parsed = parse_net_send_args(&args(&["keys", "pi.local:5004"])).unwrap();
+        assert_eq!(parsed.input, "keys");
+        assert_eq!(parsed.address, "pi.local:5004");
+        assert!(parse_net_send_args(&args(&["keys", "pi.local"])).is_err());
+
+        let parsed = parse_net_recv_args(&args(&["5004", "synth", "--exact"])).unwrap();
+        assert_eq!(parsed.port, 5004);
+        assert_eq!(parsed.output, "synth");
+        assert_eq!(parsed.match_mode, PortMatch::Exact);
+        assert!(parse_net_recv_args(&args(&["0", "synth"])).is_err());
+        assert!(parse_net_recv_args(&args(&["synth"])).is_err());
+    }
+
+    #[test]
+    fn test_rtp_args() {
+        let parsed = parse_rtp_args(&args(&["studio"])).unwrap();
+        assert_eq!(parsed.name, "studio");
+        assert_eq!(parsed.listen, RTP_DEFAULT_PORT);
+        assert_eq!(parsed.to, None);
+
+        let parsed = parse_rtp_args(&args(&["--listen", "5100", "studio", "--to", "synth"])).unwrap();
+        assert_eq!(parsed.listen, 5100);
+        assert_eq!(parsed.to.as_deref(), Some("synth"));
+
+        assert!(parse_rtp_args(&args(&["--listen", "65535", "studio"])).is_err());
+        assert!(parse_rtp_args(&args(&[])).is_err());
+    }
+
+    #[test]
+    fn test_osc_args() {
+        let parsed = parse_osc_send_args(&args(&["keys", "127.0.0.1:57120"])).unwrap();
+        assert_eq!(parsed.prefix, "/midi");
+        assert_eq!(parsed.address, "127.0.0.1:57120");
+
+        let parsed = parse_osc_recv_args(&args(&["--prefix", "/synth/", "9000", "synth"])).unwrap();
+        assert_eq!(parsed.prefix, "/synth");
+        assert_eq!(parsed.port, 9000);
+        // The root prefix gives plain /note, /cc, ...
+        assert_eq!(parse_osc_recv_args(&args(&["--prefix", "/", "9000", "synth"])).unwrap().prefix, "");
+
+        assert!(parse_osc_send_args(&args(&["--prefix", "midi", "keys", "host:1"])).is_err());
+        assert!(parse_osc_send_args(&args(&["keys", "host:1", "--prefix"])).is_err());
+    }
+
+    #[test]
+    fn test_osc_send_maps() {
+        let parsed = parse_osc_send_args(&args(&[
+            "keys", "host:1", "--map", "cc74=/synth/cutoff:0.0-1.0", "--map", "cc1=/mod",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.maps.len(), 2);
+        assert_eq!(parsed.maps[0].address, "/synth/cutoff");
+        assert_eq!(parsed.maps[1].controller, 1);
+        assert!(parse_osc_send_args(&args(&["keys", "host:1"])).unwrap().maps.is_empty());
+
+        assert!(parse_osc_send_args(&args(&["keys", "host:1", "--map"])).is_err());
+        assert!(parse_osc_send_args(&args(&["keys", "host:1", "--map", "cc74=cutoff"])).is_err());
+        assert!(parse_osc_send_args(&args(&["keys", "host:1", "--map", "cc1=/a", "--map", "cc1=/b"])).is_err());
+    }
+
+    #[test]
+    fn test_ws_args() {
+        let parsed = parse_ws_args(&args(&["keys"])).unwrap();
+        assert_eq!(parsed.listen, "0.0.0.0:8080");
+        assert_eq!(parsed.output, None);
+
+        let parsed = parse_ws_args(&args(&["keys", "--listen", ":9000", "--output", "synth"])).unwrap();
+        assert_eq!(parsed.listen, "0.0.0.0:9000");
+        assert_eq!(parsed.output.as_deref(), Some("synth"));
+        assert_eq!(parse_ws_args(&args(&["--listen", "127.0.0.1:9000", "keys"])).unwrap().listen, "127.0.0.1:9000");
+
+        assert!(parse_ws_args(&args(&["--listen", "9000", "keys"])).is_err());
+        assert!(parse_ws_args(&args(&["keys", "synth"])).is_err());
+    }
+
+    #[test]
+    fn test_clock_args() {
+        let parsed = parse_clock_args(&args(&["synth"])).unwrap();
+        assert_eq!(parsed.bpm, 120.0);
+        assert_eq!(parsed.ppqn, 24);
+        assert!(parsed.send_start && parsed.send_stop);
+
+        let parsed = parse_clock_args(&args(&["--bpm", "98.5", "--ppqn", "48", "--send-start", "off", "synth"])).unwrap();
+        assert_eq!(parsed.bpm, 98.5);
+        assert_eq!(parsed.ppqn, 48);
+        assert!(!parsed.send_start && parsed.send_stop);
+
+        let parsed = parse_clock_args(&args(&["--send-stop", "off", "--send-start", "on", "synth"])).unwrap();
+        assert!(parsed.send_start && !parsed.send_stop);
+        let parsed = parse_clock_args(&args(&["--no-start", "--no-stop", "synth"])).unwrap();
+        assert!(!parsed.send_start && !parsed.send_stop);
+        assert!(parse_clock_args(&args(&["--send-start", "maybe", "synth"])).is_err());
+        assert!(parse_clock_args(&args(&["synth", "--send-stop"])).is_err());
+
+        assert!(parse_clock_args(&args(&["--ppqn", "0", "synth"])).is_err());
+        assert!(parse_clock_args(&args(&[])).is_err());
+    }
+
+    #[test]
+    fn test_tempo_args() {
+        let parsed = parse_tempo_args(&args(&["--ppqn", "48", "drum machine"])).unwrap();
+        assert_eq!(parsed.input, "drum machine");
+        assert_eq!(parsed.ppqn, 48);
+        assert!(parse_tempo_args(&args(&["--ppqn", "x", "drums"])).is_err());
+    }
+
+    #[test]
+    fn test_note_range() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--note-min", "36", "--note-max", "59"])).unwrap();
+        assert_eq!(parsed.note_range, Some((36, 59)));
+        let parsed = parse_forward_args(&args(&["in", "out", "--note-min", "60"])).unwrap();
+        assert_eq!(parsed.note_range, Some((60, 127)));
+        assert_eq!(parse_forward_args(&args(&["in", "out"])).unwrap().note_range, None);
+
+        assert!(parse_forward_args(&args(&["in", "out", "--note-min", "128"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--note-min", "60", "--note-max", "59"])).is_err());
+    }
+
+    #[test]
+    fn test_map_cc() {
+        let parsed = parse_forward_args(&args(&["--map-cc", "1:74", "in", "out", "--map-cc", "11:7"])).unwrap();
+        assert_eq!(parsed.cc_map, vec![(1, 74), (11, 7)]);
+        assert!(parse_forward_args(&args(&["--map-cc", "1", "in", "out"])).is_err());
+        assert!(parse_forward_args(&args(&["--map-cc", "1:128", "in", "out"])).is_err());
+    }
+
+    #[test]
+    fn test_bend_args() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--bend-scale", "0.5", "--bend-invert"])).unwrap();
+        assert_eq!(parsed.bend_scale, 0.5);
+        assert!(parsed.bend_invert);
+        assert!(parse_forward_args(&args(&["in", "out", "--bend-scale", "-1"])).is_err());
+    }
+
+    #[test]
+    fn test_note_to_cc_args() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--note-to-cc", "36:64"])).unwrap();
+        assert_eq!(parsed.note_to_cc, vec![(36, 64)]);
+        assert!(parse_forward_args(&args(&["in", "out", "--note-to-cc", "36"])).is_err());
+    }
+
+    #[test]
+    fn test_throttle_args() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--throttle-cc", "20", "--throttle-flush-on-stop"])).unwrap();
+        assert_eq!(parsed.throttle_cc, Some(Duration::from_millis(20)));
+        assert!(parsed.throttle_flush_on_stop);
+        assert!(!parsed.dedup_cc);
+        assert!(parse_forward_args(&args(&["in", "out", "--dedup-cc"])).unwrap().dedup_cc);
+        assert_eq!(parse_forward_args(&args(&["in", "out"])).unwrap().throttle_cc, None);
+        assert!(parse_forward_args(&args(&["in", "out", "--throttle-cc", "0"])).is_err());
+    }
+
+    #[test]
+    fn test_send_args() {
+        let parsed = parse_send_args(&args(&["synth"])).unwrap();
+        assert_eq!(parsed.output, "synth");
+        assert_eq!(parsed.delay, None);
+        let parsed = parse_send_args(&args(&["--delay", "50", "synth"])).unwrap();
+        assert_eq!(parsed.delay, Some(Duration::from_millis(50)));
+        assert!(parse_send_args(&args(&["synth", "extra"])).is_err());
+    }
+
+    #[test]
+    fn test_sysex_args() {
+        let parsed = parse_sysex_args(&args(&["synth", "patch.syx"])).unwrap();
+        assert_eq!(parsed.output, "synth");
+        assert_eq!(parsed.file, "patch.syx");
+        assert_eq!(parsed.delay, SYSEX_DEFAULT_DELAY);
+        let parsed = parse_sysex_args(&args(&["--delay", "100", "synth", "patch.syx"])).unwrap();
+        assert_eq!(parsed.delay, Duration::from_millis(100));
+        assert!(parse_sysex_args(&args(&["synth"])).is_err());
+        assert!(parse_sysex_args(&args(&["--delay", "0", "synth", "patch.syx"])).is_err());
+    }
+
+    #[test]
+    fn test_sysex_dump_args() {
+        let parsed = parse_sysex_dump_args(&args(&["synth", "backup.syx"])).unwrap();
+        assert_eq!(parsed.input, "synth");
+        assert_eq!(parsed.file, "backup.syx");
+        assert_eq!(parsed.idle, None);
+        let parsed = parse_sysex_dump_args(&args(&["--idle", "2000", "synth", "backup.syx"])).unwrap();
+        assert_eq!(parsed.idle, Some(Duration::from_secs(2)));
+        assert!(parse_sysex_dump_args(&args(&["--idle", "synth", "backup.syx"])).is_err());
+    }
+
+    #[test]
+    fn test_wait_args() {
+        let parsed = parse_forward_args(&args(&["a", "b"])).unwrap();
+        assert_eq!(parsed.wait, None);
+        let parsed = parse_forward_args(&args(&["--wait", "a", "b"])).unwrap();
+        assert_eq!(parsed.wait, Some(DEFAULT_WAIT_TIMEOUT));
+        // --wait-timeout implies --wait, in either order
+        let parsed = parse_forward_args(&args(&["--wait-timeout", "5000", "--wait", "a", "b"])).unwrap();
+        assert_eq!(parsed.wait, Some(Duration::from_secs(5)));
+
+        let parsed = parse_port_args(&args(&["--to", "synth", "--wait", "mc"])).unwrap();
+        assert_eq!(parsed.wait, Some(DEFAULT_WAIT_TIMEOUT));
+        assert!(parse_port_args(&args(&["--wait-timeout", "0", "mc"])).is_err());
+    }
+
+    #[test]
+    fn test_preserve_timing_args() {
+        assert_eq!(parse_forward_args(&args(&["a", "b"])).unwrap().preserve_timing, None);
+        let parsed = parse_forward_args(&args(&["--preserve-timing", "a", "b"])).unwrap();
+        assert_eq!(parsed.preserve_timing, Some(DEFAULT_MAX_BUFFER));
+        let parsed = parse_forward_args(&args(&["--preserve-timing", "--max-buffer", "50", "a", "b"])).unwrap();
+        assert_eq!(parsed.preserve_timing, Some(Duration::from_millis(50)));
+        assert!(parse_forward_args(&args(&["--max-buffer", "50", "a", "b"])).is_err());
+    }
+
+    #[test]
+    fn test_humanize_args() {
+        let parsed = parse_forward_args(&args(&["a", "b"])).unwrap();
+        assert_eq!((parsed.humanize_timing, parsed.humanize_velocity, parsed.seed), (None, 0, None));
+        let parsed = parse_forward_args(&args(&[
+            "--humanize-timing", "15", "--humanize-velocity", "10", "--seed", "42", "a", "b",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.humanize_timing, Some(Duration::from_millis(15)));
+        assert_eq!(parsed.humanize_velocity, 10);
+        assert_eq!(parsed.seed, Some(42));
+        assert!(parse_forward_args(&args(&["--humanize-velocity", "200", "a", "b"])).is_err());
+        assert!(parse_forward_args(&args(&["--seed", "x", "a", "b"])).is_err());
+    }
+
+    #[test]
+    fn test_arp_args() {
+        let parsed = parse_arp_args(&args(&["keys", "synth"])).unwrap();
+        assert_eq!((parsed.input.as_str(), parsed.output.as_str()), ("keys", "synth"));
+        assert_eq!((parsed.bpm, parsed.pattern, parsed.octaves), (120.0, Pattern::Up, 1));
+
+        let parsed = parse_arp_args(&args(&[
+            "--bpm", "90", "--pattern", "updown", "--octaves", "3", "keys", "synth",
+        ]))
+        .unwrap();
+        assert_eq!((parsed.bpm, parsed.pattern, parsed.octaves), (90.0, Pattern::UpDown, 3));
+
+        assert!(parse_arp_args(&args(&["--pattern", "sideways", "keys", "synth"])).is_err());
+        assert!(parse_arp_args(&args(&["--octaves", "5", "keys", "synth"])).is_err());
+        assert!(parse_arp_args(&args(&["keys"])).is_err());
+    }
+
+    #[test]
+    fn test_harmonize_args() {
+        assert!(parse_forward_args(&args(&["a", "b"])).unwrap().harmonize.is_empty());
+        let parsed = parse_forward_args(&args(&["--harmonize", "4,7", "a", "b"])).unwrap();
+        assert_eq!(parsed.harmonize, vec![4, 7]);
+        let parsed = parse_forward_args(&args(&["--harmonize", "-12", "a", "b"])).unwrap();
+        assert_eq!(parsed.harmonize, vec![-12]);
+        assert!(parse_forward_args(&args(&["--harmonize", "4,0", "a", "b"])).is_err());
+        assert!(parse_forward_args(&args(&["--harmonize", "4,x", "a", "b"])).is_err());
+    }
+
+    #[test]
+    fn test_note_mode_args() {
+        assert!(!parse_forward_args(&args(&["a", "b"])).unwrap().latch);
+        assert!(parse_forward_args(&args(&["a", "b", "--latch"])).unwrap().latch);
+        assert!(parse_forward_args(&args(&["--pedal-to-length", "a", "b"])).unwrap().pedal_to_length);
+        assert!(parse_forward_args(&args(&["--count", "a", "b"])).unwrap().count);
+    }
+
+    #[test]
+    fn test_reset_args() {
+        let parsed = parse_forward_args(&args(&["a", "b"])).unwrap();
+        assert_eq!(parsed.reset, None);
+        let parsed = parse_forward_args(&args(&["--reset-on-start", "a", "b"])).unwrap();
+        assert_eq!(parsed.reset, Some(Reset::System));
+        // --reset-type implies --reset-on-start, in either order
+        let parsed = parse_forward_args(&args(&["--reset-type", "gm", "--reset-on-start", "a", "b"])).unwrap();
+        assert_eq!(parsed.reset, Some(Reset::GmOn));
+        let parsed = parse_port_args(&args(&["--reset-type", "F0 7E 7F 09 03 F7", "mc"])).unwrap();
+        assert_eq!(parsed.port.reset, Some(Reset::Custom(vec![0xF0, 0x7E, 0x7F, 0x09, 0x03, 0xF7])));
+        assert!(parse_port_args(&args(&["--reset-type", "xyz", "mc"])).is_err());
+        assert!(parse_forward_args(&args(&["a", "b", "--reset-type"])).is_err());
+    }
+
+    #[test]
+    fn test_buffer_args() {
+        let parsed = parse_forward_args(&args(&["a", "b"])).unwrap();
+        assert_eq!((parsed.buffer, parsed.buffer_overflow), (None, Overflow::DropOldest));
+        let parsed = parse_forward_args(&args(&["--buffer", "256", "--buffer-overflow", "newest", "a", "b"])).unwrap();
+        assert_eq!((parsed.buffer, parsed.buffer_overflow), (Some(256), Overflow::DropNewest));
+        assert!(parse_forward_args(&args(&["--buffer", "0", "a", "b"])).is_err());
+        assert!(parse_forward_args(&args(&["--buffer", "10", "--buffer-overflow", "middle", "a", "b"])).is_err());
+        assert!(parse_forward_args(&args(&["--buffer-overflow", "oldest", "a", "b"])).is_err());
+    }
+
+    #[test]
+    fn test_metrics_args() {
+        let parsed = parse_forward_args(&args(&["a", "b"])).unwrap();
+        assert_eq!(parsed.metrics, None);
+        let parsed = parse_forward_args(&args(&["--metrics", ":9100", "a", "b"])).unwrap();
+        assert_eq!(parsed.metrics.as_deref(), Some("0.0.0.0:9100"));
+        let parsed = parse_forward_args(&args(&["a", "b", "--metrics", "127.0.0.1:9100"])).unwrap();
+        assert_eq!(parsed.metrics.as_deref(), Some("127.0.0.1:9100"));
+        assert!(parse_forward_args(&args(&["--metrics", "9100", "a", "b"])).is_err());
+    }
+
+    #[test]
+    fn test_dry_run_args() {
+        let parsed = parse_forward_args(&args(&["a", "b"])).unwrap();
+        assert!(!parsed.dry_run);
+        assert!(parsed.describe().is_empty());
+
+        let parsed = parse_forward_args(&args(&[
+            "--dry-run", "--channel", "1", "--channel", "10", "--transpose", "-12", "--only", "note,cc",
+            "--map-cc", "1:74", "--reset-type", "gm", "a", "b",
+        ]))
+        .unwrap();
+        assert!(parsed.dry_run);
+        assert_eq!(
+            parsed.describe(),
+            vec![
+                "channels 1, 10",
+                "only note, cc",
+                "transpose -12",
+                "map cc 1->74",
+                "send GM System On (F0 7E 7F 09 01 F7) on start",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_forward_allow_loop() {
+        assert!(!parse_forward_args(&args(&["bus", "bus"])).unwrap().allow_loop);
+        assert!(parse_forward_args(&args(&["--allow-loop", "bus", "bus"])).unwrap().allow_loop);
+    }
+
+    #[test]
+    fn test_cc_scale_and_14bit_pairs() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--cc-scale", "0.5"])).unwrap();
+        assert_eq!((parsed.cc_scale, parsed.cc14_pairs.len()), (0.5, 0));
+
+        let parsed = parse_forward_args(&args(&["in", "out", "--cc-scale", "0.5", "--combine-14bit"])).unwrap();
+        assert_eq!(parsed.cc14_pairs, cc14::default_pairs());
+
+        // Explicit pairs replace the defaults
+        let parsed = parse_forward_args(&args(&["in", "out", "--cc14-pair", "0:32", "--cc14-pair", "7:39"])).unwrap();
+        assert_eq!(parsed.cc14_pairs, vec![(0, 32), (7, 39)]);
+
+        assert!(parse_forward_args(&args(&["in", "out", "--cc-scale", "0"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--cc14-pair", "7"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--cc14-pair", "7:7"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--cc14-pair", "7:128"])).is_err());
+    }
+
+    #[test]
+    fn test_normalize_noteoff() {
+        assert_eq!(parse_forward_args(&args(&["in", "out"])).unwrap().note_off_style, None);
+        let parsed = parse_forward_args(&args(&["in", "out", "--normalize-noteoff"])).unwrap();
+        assert_eq!(parsed.note_off_style, Some(NoteOffStyle::NoteOff));
+        let parsed = parse_forward_args(&args(&["--normalize-noteoff-reverse", "in", "out"])).unwrap();
+        assert_eq!(parsed.note_off_style, Some(NoteOffStyle::NoteOnZero));
+        assert!(parse_forward_args(&args(&[
+            "in", "out", "--normalize-noteoff", "--normalize-noteoff-reverse",
+        ]))
+        .is_err());
+    }
+
+    #[test]
+    fn test_aftertouch_to_cc() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--aftertouch-to-cc", "1"])).unwrap();
+        assert_eq!(parsed.aftertouch_to_cc, Some(1));
+        assert!(parse_forward_args(&args(&["in", "out", "--aftertouch-to-cc", "128"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--aftertouch-to-cc"])).is_err());
+    }
+
+    #[test]
+    fn test_echo() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--echo", "250"])).unwrap();
+        assert_eq!(parsed.echo, Some((Duration::from_millis(250), DEFAULT_ECHO_REPEATS, DEFAULT_ECHO_DECAY)));
+
+        let parsed = parse_forward_args(&args(&[
+            "in", "out", "--echo", "100", "--echo-repeats", "5", "--echo-decay", "0.8",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.echo, Some((Duration::from_millis(100), 5, 0.8)));
+
+        assert!(parse_forward_args(&args(&["in", "out", "--echo-repeats", "5"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--echo", "0"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--echo", "100", "--echo-repeats", "0"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--echo", "100", "--echo-decay", "1.5"])).is_err());
+    }
+
+    #[test]
+    fn test_quantize() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--quantize", "16"])).unwrap();
+        assert_eq!(parsed.quantize, Some(("16".parse().unwrap(), None)));
+        let parsed = parse_forward_args(&args(&["in", "out", "--quantize", "8t", "--quantize-bpm", "90"])).unwrap();
+        assert_eq!(parsed.quantize, Some(("8t".parse().unwrap(), Some(90.0))));
+
+        assert!(parse_forward_args(&args(&["in", "out", "--quantize", "12"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--quantize-bpm", "90"])).is_err());
+    }
+
+    #[test]
+    fn test_sysex_manufacturer() {
+        let parsed = parse_forward_args(&args(&[
+            "in", "out", "--sysex-manufacturer", "41", "--sysex-manufacturer", "00 20 29",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.sysex_manufacturers, vec![vec![0x41], vec![0x00, 0x20, 0x29]]);
+        assert!(parse_forward_args(&args(&["in", "out", "--sysex-manufacturer", "0020"])).is_err());
+    }
+
+    #[test]
+    fn test_block_notes_and_ccs() {
+        let parsed = parse_forward_args(&args(&[
+            "in", "out", "--block-note", "60", "--block-note", "C#2", "--block-cc", "1", "--block-cc", "74",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.block_notes, vec![60, 37]);
+        assert_eq!(parsed.block_ccs, vec![1, 74]);
+        assert_eq!(parsed.describe(), vec!["block notes C4, C#2", "block cc 1, 74"]);
+        assert!(parse_forward_args(&args(&["in", "out", "--block-cc", "128"])).is_err());
+        assert!(parse_forward_args(&args(&["in", "out", "--block-note"])).is_err());
+    }
+
+    #[test]
+    fn test_mmc_bridge() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--mmc-bridge", "to-realtime"])).unwrap();
+        assert_eq!(parsed.mmc_bridge, Some(MmcBridge::ToRealtime));
+        assert!(parse_forward_args(&args(&["in", "out", "--mmc-bridge", "both"])).is_err());
+    }
+
+    #[test]
+    fn test_mtc_args() {
+        let parsed = parse_mtc_args(&args(&["--exact", "deck"])).unwrap();
+        assert_eq!(parsed.input, "deck");
+        assert_eq!(parsed.match_mode, PortMatch::Exact);
+        assert!(parse_mtc_args(&args(&[])).is_err());
+        assert!(parse_mtc_args(&args(&["deck", "--fps", "25"])).is_err());
+    }
+
+    #[test]
+    fn test_spp_args() {
+        let parsed = parse_spp_args(&args(&["seq"])).unwrap();
+        assert_eq!(parsed.time_signature, TimeSignature { beats: 4, unit: 4 });
+        let parsed = parse_spp_args(&args(&["seq", "--time-sig", "7/8"])).unwrap();
+        assert_eq!(parsed.time_signature, TimeSignature { beats: 7, unit: 8 });
+        assert!(parse_spp_args(&args(&["seq", "--time-sig", "7"])).is_err());
+        assert!(parse_spp_args(&args(&["seq", "--time-sig"])).is_err());
+        assert!(parse_spp_args(&args(&[])).is_err());
+    }
+
+    #[test]
+    fn test_generate_spp() {
+        let parsed = parse_forward_args(&args(&["in", "out", "--generate-spp"])).unwrap();
+        assert!(parsed.generate_spp);
+        assert!(parsed.describe().contains(&"song position after stop and before continue".to_string()));
+    }
+
+    #[test]
+    fn test_delay_args() {
+        let parsed = parse_forward_args(&args(&["a", "b", "--delay", "25"])).unwrap();
+        assert_eq!(parsed.delay, Some(Duration::from_millis(25)));
+        assert!(!parsed.flush_on_stop);
+        assert!(parsed.describe().contains(&"delay 25 ms, pending messages dropped on stop".to_string()));
+        let parsed = parse_forward_args(&args(&["a", "b", "--delay", "25", "--flush-on-stop"])).unwrap();
+        assert!(parsed.flush_on_stop);
+        assert!(parse_forward_args(&args(&["a", "b", "--delay", "0"])).is_err());
+        assert!(parse_forward_args(&args(&["a", "b", "--flush-on-stop"])).is_err());
+    }
+
+    #[test]
+    fn test_control_note() {
+        let parsed = parse_forward_args(&args(&["a", "b", "--control-note", "C-1"])).unwrap();
+        assert_eq!(parsed.control_note, Some(0));
+        assert!(parsed.describe().contains(&"note C-1 toggles forwarding".to_string()));
+        let parsed = parse_forward_args(&args(&["a", "b", "--control-note", "127"])).unwrap();
+        assert_eq!(parsed.control_note, Some(127));
+        assert!(parse_forward_args(&args(&["a", "b", "--control-note", "H2"])).is_err());
+        assert!(parse_forward_args(&args(&["a", "b", "--control-note", "128"])).is_err());
+    }
+
+    #[test]
+    fn test_panic_mode() {
+        assert_eq!(parse_forward_args(&args(&["a", "b"])).unwrap().panic_mode, PanicMode::NoteOff);
+        let parsed = parse_forward_args(&args(&["a", "b", "--panic-mode", "all-sound-off"])).unwrap();
+        assert_eq!(parsed.panic_mode, PanicMode::AllSoundOff);
+        assert_eq!(parsed.describe(), vec!["release held notes with all-sound-off on stop"]);
+        assert!(parse_forward_args(&args(&["a", "b", "--panic-mode", "loud"])).is_err());
+        assert!(parse_forward_args(&args(&["a", "b", "--panic-mode", "note-off", "--no-panic"])).is_err());
+
+        let parsed = parse_port_args(&args(&["synth", "--panic-mode", "all-notes-off"])).unwrap();
+        assert_eq!(parsed.port.panic_mode, PanicMode::AllNotesOff);
+        assert!(parse_port_args(&args(&["synth", "--no-panic", "--panic-mode", "note-off"])).is_err());
+    }
+
+    #[test]
+    fn test_normalize() {
+        assert!(!parse_forward_args(&args(&["a", "b"])).unwrap().normalize);
+        let parsed = parse_forward_args(&args(&["a", "b", "--normalize"])).unwrap();
+        assert!(parsed.normalize);
+        assert_eq!(parsed.describe(), vec!["complete note offs sent without velocity"]);
+    }
+
+    #[test]
+    fn test_keepalive() {
+        let parsed = parse_forward_args(&args(&["a", "b", "--keepalive"])).unwrap();
+        assert!(parsed.keepalive);
+        assert!(parsed.describe().contains(&"active sensing while idle".to_string()));
+        assert!(!parse_forward_args(&args(&["a", "b"])).unwrap().keepalive);
+        let parsed = parse_port_args(&args(&["synth", "--to", "juno", "--keepalive"])).unwrap();
+        assert!(parsed.port.keepalive);
+    }
+
+    #[test]
+    fn test_trigger_args() {
+        let parsed = parse_trigger_args(&args(&[
+            "pads", "--on", "noteon:C4", "--run", "echo hi", "--on", "cc:64>63", "--run", "next",
+        ]))
+        .unwrap();
+        assert_eq!(parsed.input, "pads");
+        assert_eq!(parsed.debounce, DEFAULT_TRIGGER_DEBOUNCE);
+        assert_eq!(
+            parsed.triggers,
+            vec![
+                (TriggerEvent::NoteOn(60), "echo hi".to_string()),
+                (TriggerEvent::CcAbove { controller: 64, threshold: 63 }, "next".to_string()),
+            ]
+        );
+
+        let parsed = parse_trigger_args(&args(&["pads", "--debounce", "0", "--on", "program:3", "--run", "x"])).unwrap();
+        assert_eq!(parsed.debounce, Duration::ZERO);
+    }
+
+    #[test]
+    fn test_trigger_args_errors() {
+        assert!(parse_trigger_args(&args(&["pads"])).is_err());
+        assert!(parse_trigger_args(&args(&["pads", "--run", "x"])).is_err());
+        assert!(parse_trigger_args(&args(&["pads", "--on", "noteon:C4"])).is_err());
+        assert!(parse_trigger_args(&args(&["pads", "--on", "noteon:C4", "--on", "noteon:D4", "--run", "x"])).is_err());
+        assert!(parse_trigger_args(&args(&["pads", "--on", "pitch:1", "--run", "x"])).is_err());
+        assert!(parse_trigger_args(&args(&["--on", "noteon:C4", "--run", "x"])).is_err());
+        assert!(parse_trigger_args(&args(&["pads", "--debounce", "soon", "--on", "program:1", "--run", "x"])).is_err());
+    }
+}
@@ -0,0 +1,197 @@
+use crate::midi::ports::{select_port, PortMatch};
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::io::Read;
+
+/// A routes file for `mc run`, e.g.
+///
+/// ```toml
+/// [[route]]
+/// input = "Launchpad"
+/// output = "IAC Driver Bus 1"
+/// channels = [1, 2]
+/// channel_map = { 2 = 10 }
+/// transpose = -12
+/// ```
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct RoutesFile {
+    #[serde(default)]
+    route: Vec<RouteEntry>,
+}
+
+/// One `[[route]]` table as written in the file
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct RouteEntry {
+    input: String,
+    output: String,
+    #[serde(default)]
+    channels: Vec<u8>,
+    #[serde(default)]
+    channel_map: BTreeMap<String, u8>,
+    #[serde(default)]
+    transpose: i8,
+}
+
+/// A validated route
+#[derive(Debug, Clone, PartialEq)]
+pub struct Route {
+    pub input: String,
+    pub output: String,
+    /// MIDI channels to forward (1-16), empty means all
+    pub channels: Vec<u8>,
+    /// Output channel (0-based) for each input channel
+    pub channel_map: Option<[u8; 16]>,
+    pub transpose: i8,
+}
+
+/// Parses and validates the contents of a routes file
+pub fn parse_routes(contents: &str) -> Result<Vec<Route>, String> {
+    let file: RoutesFile = toml::from_str(contents).map_err(|e| e.to_string())?;
+    if file.route.is_empty() {
+        return Err("No [[route]] entries found".to_string());
+    }
+
+    file.route
+        .into_iter()
+        .enumerate()
+        .map(|(idx, entry)| route_from_entry(entry).map_err(|e| format!("route {}: {}", idx + 1, e)))
+        .collect()
+}
+
+/// Reads a routes file from `reader` (a file, or stdin for `mc run -`) and parses it,
+/// naming the source `name` in errors
+pub fn read_routes(mut reader: impl Read, name: &str) -> Result<Vec<Route>, String> {
+    let mut contents = String::new();
+    reader
+        .read_to_string(&mut contents)
+        .map_err(|e| format!("{}: {}", name, e))?;
+    parse_routes(&contents).map_err(|e| format!("{}: {}", name, e))
+}
+
+fn route_from_entry(entry: RouteEntry) -> Result<Route, String> {
+    if let Some(channel) = entry.channels.iter().find(|ch| !(1..=16).contains(*ch)) {
+        return Err(format!("Invalid channel {} (expected 1-16)", channel));
+    }
+    if entry.transpose == i8::MIN {
+        return Err("Invalid transpose (expected -127 to 127)".to_string());
+    }
+
+    let channel_map = if entry.channel_map.is_empty() {
+        None
+    } else {
+        let mut map: [u8; 16] = std::array::from_fn(|ch| ch as u8);
+        for (from, to) in &entry.channel_map {
+            let from = from
+                .parse::<u8>()
+                .ok()
+                .filter(|ch| (1..=16).contains(ch))
+                .ok_or_else(|| format!("Invalid channel_map key '{}' (expected 1-16)", from))?;
+            if !(1..=16).contains(to) {
+                return Err(format!("Invalid channel_map target {} (expected 1-16)", to));
+            }
+            map[(from - 1) as usize] = to - 1;
+        }
+        Some(map)
+    };
+
+    Ok(Route {
+        input: entry.input,
+        output: entry.output,
+        channels: entry.channels,
+        channel_map,
+        transpose: entry.transpose,
+    })
+}
+
+/// Checks every route's ports against the driver's names
+/// All problems are reported together so a broken setup can be fixed in one pass
+pub fn check_ports(routes: &[Route], inputs: &[String], outputs: &[String]) -> Result<(), String> {
+    let mut errors = Vec::new();
+    for (idx, route) in routes.iter().enumerate() {
+        if let Err(e) = select_port(inputs, &route.input, "Input", PortMatch::Substring) {
+            errors.push(format!("route {}: {}", idx + 1, e));
+        }
+        if let Err(e) = select_port(outputs, &route.output, "Output", PortMatch::Substring) {
+            errors.push(format!("route {}: {}", idx + 1, e));
+        }
+    }
+
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(errors.join("\n"))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_routes() {
+        let routes = parse_routes(
+            r#"
+            [[route]]
+            input = "Launchpad"
+            output = "IAC Driver Bus 1"
+
+            [[route]]
+            input = "Keys"
+            output = "Synth"
+            channels = [1, 2]
+            channel_map = { 2 = 10 }
+            transpose = -12
+            "#,
+        )
+        .unwrap();
+
+        assert_eq!(routes.len(), 2);
+        assert_eq!(routes[0].input, "Launchpad");
+        assert!(routes[0].channels.is_empty());
+        assert_eq!(routes[0].channel_map, None);
+
+        assert_eq!(routes[1].channels, vec![1, 2]);
+        assert_eq!(routes[1].transpose, -12);
+        let map = routes[1].channel_map.unwrap();
+        assert_eq!((map[0], map[1]), (0, 9));
+    }
+
+    #[test]
+    fn test_invalid_routes() {
+        assert!(parse_routes("").is_err());
+        assert!(parse_routes("[[route]]\ninput = \"a\"").is_err());
+        assert!(parse_routes("[[route]]\ninput = \"a\"\noutput = \"b\"\nbogus = 1").is_err());
+
+        let err = parse_routes("[[route]]\ninput = \"a\"\noutput = \"b\"\nchannels = [17]").unwrap_err();
+        assert!(err.starts_with("route 1:"));
+        assert!(parse_routes("[[route]]\ninput = \"a\"\noutput = \"b\"\nchannel_map = { 0 = 1 }").is_err());
+    }
+
+    #[test]
+    fn test_read_routes() {
+        let routes = read_routes(&b"[[route]]\ninput = \"a\"\noutput = \"b\""[..], "stdin").unwrap();
+        assert_eq!(routes[0].output, "b");
+        let err = read_routes(&b"[[route]]\ninput = \"a\""[..], "stdin").unwrap_err();
+        assert!(err.starts_with("stdin: "), "{}", err);
+        assert!(read_routes(&[0xFF, 0xFE][..], "stdin").is_err());
+    }
+
+    #[test]
+    fn test_check_ports_lists_every_problem() {
+        let routes = parse_routes(
+            "[[route]]\ninput = \"keys\"\noutput = \"synth\"\n\
+             [[route]]\ninput = \"pads\"\noutput = \"drums\"",
+        )
+        .unwrap();
+
+        let inputs = vec!["Keys".to_string()];
+        let outputs = vec!["Synth".to_string()];
+        assert!(check_ports(&routes[..1], &inputs, &outputs).is_ok());
+
+        let err = check_ports(&routes, &inputs, &outputs).unwrap_err();
+        assert_eq!(err.lines().count(), 2);
+        assert!(err.contains("'pads'") && err.contains("'drums'"));
+    }
+}
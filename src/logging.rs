@@ -0,0 +1,221 @@
+/// Log levels and format shared by every CLI command (`--log-level`, `--quiet`, `--log-format`)
+/// Messages go to stderr; fatal errors are returned from `main` and always shown
+use crate::midi::decode::{hex_bytes, message_json};
+use std::str::FromStr;
+use std::sync::atomic::{AtomicBool, AtomicU8, Ordering};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Level {
+    Debug,
+    Info,
+    Error,
+    /// Set by `--quiet`
+    Off,
+}
+
+static LEVEL: AtomicU8 = AtomicU8::new(Level::Info as u8);
+
+/// Output format for per-message logs
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Format {
+    Text,
+    /// One JSON object per line, see `decode::message_json`
+    Json,
+}
+
+static JSON: AtomicBool = AtomicBool::new(false);
+
+/// Logging settings taken from the command line
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct LogConfig {
+    pub level: Level,
+    pub format: Format,
+}
+
+impl FromStr for Level {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "debug" => Ok(Level::Debug),
+            "info" => Ok(Level::Info),
+            "error" => Ok(Level::Error),
+            _ => Err(format!("Invalid log level '{}' (expected debug, info or error)", s)),
+        }
+    }
+}
+
+impl FromStr for Format {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "text" => Ok(Format::Text),
+            "json" => Ok(Format::Json),
+            _ => Err(format!("Invalid log format '{}' (expected text or json)", s)),
+        }
+    }
+}
+
+pub fn init(config: LogConfig) {
+    LEVEL.store(config.level as u8, Ordering::Relaxed);
+    JSON.store(config.format == Format::Json, Ordering::Relaxed);
+}
+
+/// Returns true if `--log-format json` was given
+pub fn json_format() -> bool {
+    JSON.load(Ordering::Relaxed)
+}
+
+/// Current time in seconds since the Unix epoch, the `ts` of JSON logs
+pub fn unix_time() -> f64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs_f64())
+        .unwrap_or(0.0)
+}
+
+/// Logs a received message at debug level, as text or JSON
+pub fn message(msg: &[u8]) {
+    if !enabled(Level::Debug) {
+        return;
+    }
+    if json_format() {
+        eprintln!("{}", message_json(unix_time(), msg));
+    } else {
+        eprintln!("Received MIDI message: {}", hex_bytes(msg));
+    }
+}
+
+/// Returns true if messages at `level` should be printed
+pub fn enabled(level: Level) -> bool {
+    level != Level::Off && level as u8 >= LEVEL.load(Ordering::Relaxed)
+}
+
+/// Removes `--log-level LEVEL`, `--log-format FORMAT` and `--quiet` from the arguments,
+/// wherever they appear, and returns the settings they select along with the remaining arguments
+/// Defaults come from `MC_LOG_LEVEL`, `MC_LOG_FORMAT` and `MC_QUIET`; flags override them
+pub fn take_log_args(args: Vec<String>) -> Result<(LogConfig, Vec<String>), String> {
+    take_log_args_with_env(args, |name| std::env::var(name).ok())
+}
+
+fn take_log_args_with_env(
+    args: Vec<String>,
+    env: impl Fn(&str) -> Option<String>,
+) -> Result<(LogConfig, Vec<String>), String> {
+    let mut level = match env("MC_LOG_LEVEL") {
+        Some(value) => value.parse().map_err(|e| format!("MC_LOG_LEVEL: {}", e))?,
+        None => Level::Info,
+    };
+    let mut format = match env("MC_LOG_FORMAT") {
+        Some(value) => value.parse().map_err(|e| format!("MC_LOG_FORMAT: {}", e))?,
+        None => Format::Text,
+    };
+    let mut quiet = env("MC_QUIET").is_some_and(|value| !value.is_empty() && value != "0");
+    let mut rest = Vec::with_capacity(args.len());
+
+    let mut iter = args.into_iter();
+    while let Some(arg) = iter.next() {
+        match arg.as_str() {
+            "--log-level" => {
+                let value = iter.next().ok_or("--log-level requires a value")?;
+                level = value.parse()?;
+            }
+            "--log-format" => {
+                let value = iter.next().ok_or("--log-format requires a value")?;
+                format = value.parse()?;
+            }
+            "--quiet" => quiet = true,
+            _ => rest.push(arg),
+        }
+    }
+
+    let level = if quiet { Level::Off } else { level };
+    Ok((LogConfig { level, format }, rest))
+}
+
+macro_rules! debug {
+    ($($arg:tt)*) => {
+        if $crate::logging::enabled($crate::logging::Level::Debug) {
+            eprintln!($($arg)*);
+        }
+    };
+}
+
+macro_rules! info {
+    ($($arg:tt)*) => {
+        if $crate::logging::enabled($crate::logging::Level::Info) {
+            eprintln!($($arg)*);
+        }
+    };
+}
+
+macro_rules! error {
+    ($($arg:tt)*) => {
+        if $crate::logging::enabled($crate::logging::Level::Error) {
+            eprintln!($($arg)*);
+        }
+    };
+}
+
+pub(crate) use {debug, error, info};
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn args(list: &[&str]) -> Vec<String> {
+        list.iter().map(|s| s.to_string()).collect()
+    }
+
+    #[test]
+    fn test_take_log_args() {
+        // The real environment could hold MC_LOG_LEVEL and friends
+        let no_env = |_: &str| None;
+        let (config, rest) =
+            take_log_args_with_env(args(&["mc", "fwd", "a", "--log-level", "debug", "b"]), no_env).unwrap();
+        assert_eq!(config.level, Level::Debug);
+        assert_eq!(config.format, Format::Text);
+        assert_eq!(rest, args(&["mc", "fwd", "a", "b"]));
+
+        let (config, _) =
+            take_log_args_with_env(args(&["mc", "fwd", "--quiet", "--log-level", "info"]), no_env).unwrap();
+        assert_eq!(config.level, Level::Off);
+
+        let (config, _) =
+            take_log_args_with_env(args(&["mc", "monitor", "--log-format", "json", "a"]), no_env).unwrap();
+        assert_eq!(config.format, Format::Json);
+
+        assert_eq!(take_log_args_with_env(args(&["mc"]), no_env).unwrap().0.level, Level::Info);
+        assert!(take_log_args_with_env(args(&["mc", "--log-format", "xml"]), no_env).is_err());
+        assert!(take_log_args_with_env(args(&["mc", "--log-level", "loud"]), no_env).is_err());
+        assert!(take_log_args_with_env(args(&["mc", "--log-level"]), no_env).is_err());
+    }
+
+    #[test]
+    fn test_level_order() {
+        assert!(Level::Debug < Level::Info && Level::Info < Level::Error);
+    }
+
+    #[test]
+    fn test_env_defaults() {
+        let env = |name: &str| match name {
+            "MC_LOG_LEVEL" => Some("error".to_string()),
+            "MC_LOG_FORMAT" => Some("json".to_string()),
+            _ => None,
+        };
+        let (config, _) = take_log_args_with_env(args(&["mc", "fwd"]), env).unwrap();
+        assert_eq!(config, LogConfig { level: Level::Error, format: Format::Json });
+
+        // Flags win over the environment
+        let (config, _) = take_log_args_with_env(args(&["mc", "--log-level", "debug"]), env).unwrap();
+        assert_eq!(config.level, Level::Debug);
+
+        let quiet = |name: &str| (name == "MC_QUIET").then(|| "1".to_string());
+        assert_eq!(take_log_args_with_env(args(&["mc"]), quiet).unwrap().0.level, Level::Off);
+
+        let bad = |name: &str| (name == "MC_LOG_LEVEL").then(|| "loud".to_string());
+        assert!(take_log_args_with_env(args(&["mc"]), bad).unwrap_err().starts_with("MC_LOG_LEVEL"));
+    }
+}
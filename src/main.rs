@@ -1,10 +1,17 @@
 mod app;
+mod cli;
+mod config;
 mod connection;
 mod events;
+mod logging;
 mod midi;
+mod net;
+mod signal;
 mod ui;
 
 use app::App;
+use logging::{debug, error, info};
+use midi::error::{connect_error, exit_code, PortError, EXIT_FAILURE};
 use crossterm::{
     event::{self, DisableMouseCapture, EnableMouseCapture, Event, KeyCode, KeyModifiers},
     execute,
@@ -17,25 +24,75 @@ use std::time::Duration;
 fn main() -> Result<(), Box<dyn std::error::Error>> {
     // Check for CLI mode
     let args: Vec<String> = std::env::args().collect();
+    let (log_config, args) = logging::take_log_args(args)?;
+    logging::init(log_config);
     if args.len() > 1 {
-        match args[1].as_str() {
+        let program = args[0].as_str();
+        let command = args[1].as_str();
+        let rest = &args[2..];
+
+        match command {
             "--list-ports" => return list_ports_and_exit(),
-            "worker" => {
-                if args.len() < 4 {
-                    eprintln!("Usage: {} worker <input-port> <output-port>", args[0]);
-                    return Err("Missing arguments for worker mode".into());
-                }
-                return run_worker(&args[2], &args[3]);
-            }
-            "pipe-worker" => {
-                if args.len() < 3 {
-                    eprintln!("Usage: {} pipe-worker <output-port>", args[0]);
-                    return Err("Missing arguments for pipe-worker mode".into());
-                }
-                return run_pipe_worker(&args[2]);
+            "help" | "-h" | "--help" => {
+                print!("{}", cli::help_text(program));
+                return Ok(());
             }
             _ => {}
         }
+
+        let usage = cli::usage(command)
+            .ok_or_else(|| format!("Unknown command '{}' (see '{} help')", command, program))?;
+        if cli::wants_help(rest) {
+            println!("Usage: {} {} {}", program, command, usage);
+            return Ok(());
+        }
+
+        // Parse errors are shown along with the command's usage
+        let usage_error = |e: String| -> Box<dyn std::error::Error> {
+            eprintln!("Usage: {} {} {}", program, command, usage);
+            e.into()
+        };
+
+        let result = match command {
+            "list" => list_ports(&cli::parse_list_args(rest).map_err(usage_error)?),
+            "worker" | "fwd" => run_worker(&cli::parse_forward_args(rest).map_err(usage_error)?),
+            "monitor" => run_monitor(&cli::parse_monitor_args(rest).map_err(usage_error)?),
+            "rec" => run_record(&cli::parse_record_args(rest).map_err(usage_error)?),
+            "play" => run_play(&cli::parse_play_args(rest).map_err(usage_error)?),
+            "send" => run_send(&cli::parse_send_args(rest).map_err(usage_error)?),
+            "sysex" => run_sysex(&cli::parse_sysex_args(rest).map_err(usage_error)?),
+            "sysex-dump" => run_sysex_dump(&cli::parse_sysex_dump_args(rest).map_err(usage_error)?),
+            "arp" => run_arp(&cli::parse_arp_args(rest).map_err(usage_error)?),
+            "clock" => run_clock(&cli::parse_clock_args(rest).map_err(usage_error)?),
+            "tempo" => run_tempo(&cli::parse_tempo_args(rest).map_err(usage_error)?),
+            "mtc" => run_mtc(&cli::parse_mtc_args(rest).map_err(usage_error)?),
+            "spp" => run_spp(&cli::parse_spp_args(rest).map_err(usage_error)?),
+            "trigger" => run_trigger(&cli::parse_trigger_args(rest).map_err(usage_error)?),
+            "merge" => run_merge(&cli::parse_merge_args(rest).map_err(usage_error)?),
+            "split" => run_split(&cli::parse_split_args(rest).map_err(usage_error)?),
+            "port" => run_port(&cli::parse_port_args(rest).map_err(usage_error)?),
+            "bench" => run_bench(&cli::parse_bench_args(rest).map_err(usage_error)?),
+            "net-send" => run_net_send(&cli::parse_net_send_args(rest).map_err(usage_error)?),
+            "net-recv" => run_net_recv(&cli::parse_net_recv_args(rest).map_err(usage_error)?),
+            "osc-send" => run_osc_send(&cli::parse_osc_send_args(rest).map_err(usage_error)?),
+            "osc-recv" => run_osc_recv(&cli::parse_osc_recv_args(rest).map_err(usage_error)?),
+            "ws" => run_ws(&cli::parse_ws_args(rest).map_err(usage_error)?),
+            "rtp" => run_rtp(&cli::parse_rtp_args(rest).map_err(usage_error)?),
+            "run" => run_routes(&cli::parse_run_args(rest).map_err(usage_error)?),
+            "pipe-worker" => run_pipe_worker(&cli::parse_pipe_worker_args(rest).map_err(usage_error)?),
+            _ => Err(format!("Unknown command '{}'", command).into()),
+        };
+
+        // Port and driver errors get a plain message and their own exit status, so scripts
+        // can tell a missing port or one held by another application from other failures
+        if let Err(e) = &result {
+            let code = exit_code(e.as_ref());
+            if code != EXIT_FAILURE {
+                eprintln!("Error: {}", e);
+                std::process::exit(code);
+            }
+        }
+        return result;
     }
 
     // Create app
@@ -48,8 +105,9 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
         return Err(Box::new(std::io::Error::new(std::io::ErrorKind::Other, format!("{}", e))));
     }
 
-    // Setup terminal
+    // Setup terminal; the guard restores it on every way out, including errors and panics
     enable_raw_mode()?;
+    let terminal_guard = TerminalGuard;
     let mut stdout = io::stdout();
     execute!(stdout, EnterAlternateScreen, EnableMouseCapture)?;
     let backend = CrosstermBackend::new(stdout);
@@ -58,30 +116,40 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
     // Run the app
     let result = run_app(&mut terminal, &mut app);
 
-    // Restore terminal
-    disable_raw_mode()?;
-    execute!(
-        terminal.backend_mut(),
-        LeaveAlternateScreen,
-        DisableMouseCapture
-    )?;
-    terminal.show_cursor()?;
+    // Restore terminal before printing anything
+    drop(terminal_guard);
 
     if let Err(e) = result {
         eprintln!("Application error: {}", e);
         return Err(Box::new(e));
     }
 
+    // Dropping the app stops its workers, which release their notes and close their ports
     Ok(())
 }
 
+/// Leaves raw mode and the alternate screen when dropped
+struct TerminalGuard;
+
+impl Drop for TerminalGuard {
+    fn drop(&mut self) {
+        let _ = disable_raw_mode();
+        let _ = execute!(
+            io::stdout(),
+            LeaveAlternateScreen,
+            DisableMouseCapture,
+            crossterm::cursor::Show
+        );
+    }
+}
+
 /// Pipe worker mode: read MIDI messages from stdin and forward to output port
 /// Used for virtual input connections - stdin receives data from virtual input callback
 fn run_pipe_worker(output_port_name: &str) -> Result<(), Box<dyn std::error::Error>> {
     use midir::MidiOutput;
     use std::io::{self, Read};
 
-    eprintln!("Pipe worker starting for output: {}", output_port_name);
+    info!("Pipe worker starting for output: {}", output_port_name);
 
     // Create MIDI output
     let midi_out = MidiOutput::new("mc-pipe-worker")?;
@@ -94,145 +162,2417 @@ fn run_pipe_worker(output_port_name: &str) -> Result<(), Box<dyn std::error::Err
         .ok_or_else(|| format!("Output port '{}' not found", output_port_name))?;
 
     // Connect to output
-    let mut out_conn = midi_out.connect(out_port, "mc-pipe-worker-out")?;
+    let mut out_conn = midi_out
+        .connect(out_port, "mc-pipe-worker-out")
+        .map_err(connect_error("Output", output_port_name))?;
 
-    eprintln!("Pipe worker connected to: {}", output_port_name);
+    info!("Pipe worker connected to: {}", output_port_name);
 
     // Read MIDI messages from stdin and forward to output
     let stdin = io::stdin();
     let mut stdin_lock = stdin.lock();
     let mut buffer = [0u8; 1024];
+    let mut parser = midi::parser::MessageParser::new();
+    let mut active_notes = midi::notes::ActiveNotes::new();
 
     loop {
         match stdin_lock.read(&mut buffer) {
             Ok(0) => {
                 // EOF - parent closed pipe
-                eprintln!("Pipe worker: stdin closed, exiting");
+                info!("Pipe worker: stdin closed, exiting");
                 break;
             }
             Ok(n) => {
-                // Forward MIDI message
-                if let Err(e) = out_conn.send(&buffer[..n]) {
-                    eprintln!("Pipe worker error forwarding: {}", e);
+                // A read may return several messages written back to back
+                for message in parser.push(&buffer[..n]) {
+                    match out_conn.send(&message) {
+                        Ok(()) => active_notes.track(&message),
+                        Err(e) => error!("Pipe worker error forwarding: {}", e),
+                    }
                 }
             }
             Err(e) => {
-                eprintln!("Pipe worker error reading stdin: {}", e);
+                error!("Pipe worker error reading stdin: {}", e);
                 break;
             }
         }
     }
 
+    // Release notes still held when the connection was removed
+    for message in active_notes.note_offs() {
+        let _ = out_conn.send(&message);
+    }
+
+    Ok(())
+}
+
+/// The input and output port arguments a forward opens
+/// --bidir also reads from the first output and writes to the input
+fn forward_ports(options: &cli::ForwardArgs) -> (Vec<&str>, Vec<&str>) {
+    let mut inputs = vec![options.input.as_str()];
+    let mut outputs: Vec<&str> = options.outputs.iter().map(String::as_str).collect();
+    if options.bidir {
+        inputs.push(&options.outputs[0]);
+        outputs.push(&options.input);
+    }
+    (inputs, outputs)
+}
+
+/// `mc fwd --dry-run`: resolves and opens every port a forward would use, prints the
+/// routing and processing, then closes the ports without forwarding anything
+/// Resolution and open failures are returned like a real run's, so the exit status matches
+fn dry_run(options: &cli::ForwardArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::pipeline::check_feedback;
+    use midi::ports::{find_input_port, find_output_port};
+    use midir::{MidiInput, MidiOutput};
+
+    let (inputs, outputs) = forward_ports(options);
+
+    let mut input_names = Vec::new();
+    for spec in inputs {
+        let midi_in = MidiInput::new("mc-dry-run")?;
+        let port = find_input_port(&midi_in, spec, options.match_mode)?;
+        let name = midi_in.port_name(&port)?;
+        midi_in
+            .connect(&port, "mc-dry-run-in", |_, _, _| {}, ())
+            .map_err(connect_error("Input", &name))?
+            .close();
+        input_names.push(name);
+    }
+
+    let mut output_names = Vec::new();
+    for spec in outputs {
+        let midi_out = MidiOutput::new("mc-dry-run")?;
+        let port = find_output_port(&midi_out, spec, options.match_mode)?;
+        let name = midi_out.port_name(&port)?;
+        midi_out
+            .connect(&port, "mc-dry-run-out")
+            .map_err(connect_error("Output", &name))?
+            .close();
+        output_names.push(name);
+    }
+
+    for output in &output_names[..options.outputs.len()] {
+        check_feedback(&input_names[0], output, options.allow_loop)?;
+    }
+    if options.bidir {
+        check_feedback(&input_names[1], &output_names[options.outputs.len()], options.allow_loop)?;
+    }
+
+    println!("{} -> {}", input_names[0], output_names[..options.outputs.len()].join(", "));
+    if options.bidir {
+        println!("{} -> {}", input_names[1], output_names[options.outputs.len()]);
+    }
+    let steps = options.describe();
+    if steps.is_empty() {
+        println!("  everything, unchanged");
+    }
+    for step in steps {
+        println!("  {}", step);
+    }
+    println!("Ports OK (dry run, nothing forwarded)");
+
     Ok(())
 }
 
+/// How often `mc fwd --stats` reports throughput and latency
+const STATS_INTERVAL: Duration = Duration::from_secs(5);
+
 /// Worker mode: create a MIDI connection and forward messages until killed
 /// This runs in a subprocess with fresh MIDI context that sees current system state
-fn run_worker(input_port_name: &str, output_port_name: &str) -> Result<(), Box<dyn std::error::Error>> {
+/// Also exposed as `mc fwd`, where ports may be given by `mc list` index, by a
+/// case-insensitive part of the name, by exact name with `--exact`, or by pattern with `--regex`
+fn run_worker(options: &cli::ForwardArgs) -> Result<(), Box<dyn std::error::Error>> {
     use midir::{MidiInput, MidiOutput};
     use std::sync::{Arc, Mutex};
-    use midi::validation::{is_program_change, is_valid_midi_message, normalize_program_change};
+    use midi::cc14::CcScaler;
+    use midi::delay::NoteDelay;
+    use midi::echo::EchoGuard;
+    use midi::filter::Filter;
+    use midi::humanize::{time_seed, Humanize};
+    use midi::pipeline::{EchoGuards, Pipeline, PipelineConfig};
+    use midi::quantize::Quantizer;
+    use midi::stats::{LatencyStats, MessageCounts, Metrics};
+    use midi::transform::Transform;
+    use net::metrics::serve as serve_metrics;
+    use std::net::TcpListener;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::time::Instant;
 
-    // Create MIDI input and output (worker runs after ports verified to exist)
+    // Log what ports the worker actually sees (CoreMIDI caching issues show up here)
     let midi_in = MidiInput::new("mc-worker")?;
     let midi_out = MidiOutput::new("mc-worker")?;
-
-    // DEBUG: Log what ports the worker actually sees
-    eprintln!("Worker input ports:");
+    debug!("Worker input ports:");
     for port in midi_in.ports() {
         if let Ok(name) = midi_in.port_name(&port) {
-            eprintln!("  - {}", name);
+            debug!("  - {}", name);
         }
     }
-    eprintln!("Worker output ports:");
+    debug!("Worker output ports:");
     for port in midi_out.ports() {
         if let Ok(name) = midi_out.port_name(&port) {
-            eprintln!("  - {}", name);
+            debug!("  - {}", name);
         }
     }
 
-    // Find input port
-    let in_ports = midi_in.ports();
-    let in_port = in_ports
-        .iter()
-        .find(|p| midi_in.port_name(p).ok().as_deref() == Some(input_port_name))
-        .ok_or_else(|| format!("Input port '{}' not found", input_port_name))?;
+    let filter = Filter::new(&options.channels)
+        .with_realtime_filter(options.no_clock, options.no_realtime)
+        .with_types(options.types)
+        .with_note_range(options.note_range)
+        .with_sysex_manufacturers(&options.sysex_manufacturers)
+        .with_blocked(&options.block_notes, &options.block_ccs);
+    let transform = Transform::new()
+        .with_transpose(options.transpose)
+        .with_channel_shift(options.channel_shift)
+        .with_velocity(options.velocity_curve, options.velocity_scale, options.velocity_note_off)
+        .with_fixed_velocity(options.fixed_velocity)
+        .with_cc_map(&options.cc_map)
+        .with_bend(options.bend_scale, options.bend_invert)
+        .with_note_to_cc(&options.note_to_cc)
+        .with_aftertouch_to_cc(options.aftertouch_to_cc)
+        .with_mmc_bridge(options.mmc_bridge);
 
-    // Find output port
-    let out_ports = midi_out.ports();
-    let out_port = out_ports
-        .iter()
-        .find(|p| midi_out.port_name(p).ok().as_deref() == Some(output_port_name))
-        .ok_or_else(|| format!("Output port '{}' not found", output_port_name))?;
+    let humanize = (options.humanize_timing.is_some() || options.humanize_velocity > 0).then(|| {
+        // Without --seed, log the one picked so a run can be repeated
+        let seed = options.seed.unwrap_or_else(time_seed);
+        info!("Humanize seed: {}", seed);
+        Humanize::new(options.humanize_timing.unwrap_or_default(), options.humanize_velocity, seed)
+    });
 
-    // Connect to output
-    let out_conn = midi_out.connect(out_port, "mc-worker-out")?;
-    let out_conn_shared = Arc::new(Mutex::new(out_conn));
-    let out_conn_clone = Arc::clone(&out_conn_shared);
-
-    // Connect to input with forwarding callback
-    let _in_conn = midi_in.connect(
-        in_port,
-        "mc-worker-in",
-        move |_timestamp, message, _| {
-            if message.is_empty() {
-                return;
+    let interrupted = signal::interrupt_flag()?;
+
+    if let Some(timeout) = options.wait {
+        let (inputs, outputs) = forward_ports(options);
+        if !wait_for_ports(&inputs, &outputs, options.match_mode, timeout, &interrupted) {
+            return Ok(());
+        }
+    }
+
+    if options.dry_run {
+        return dry_run(options);
+    }
+
+    // With --bidir, each direction remembers what it sent so the other can drop echoes
+    let (forward_echo, reverse_echo) = if options.bidir {
+        let a_to_b = Arc::new(Mutex::new(EchoGuard::new()));
+        let b_to_a = Arc::new(Mutex::new(EchoGuard::new()));
+        (
+            EchoGuards { sent: Some(Arc::clone(&a_to_b)), received: Some(Arc::clone(&b_to_a)) },
+            EchoGuards { sent: Some(b_to_a), received: Some(a_to_b) },
+        )
+    } else {
+        (EchoGuards::default(), EchoGuards::default())
+    };
+
+    // Interval counters are reset on every report, totals are kept for the final summary
+    let interval_stats = options.stats.then(|| Arc::new(LatencyStats::new()));
+    let total_stats = options.stats.then(|| Arc::new(LatencyStats::new()));
+    let counts = options.count.then(|| Arc::new(MessageCounts::new()));
+
+    let metrics = match &options.metrics {
+        Some(address) => {
+            let listener =
+                TcpListener::bind(address).map_err(|e| format!("Failed to listen on {}: {}", address, e))?;
+            let metrics = Arc::new(Metrics::new());
+            let served = Arc::clone(&metrics);
+            std::thread::spawn(move || serve_metrics(listener, &served));
+            info!("Serving metrics on http://{}/metrics", address);
+            Some(metrics)
+        }
+        None => None,
+    };
+
+    let config = PipelineConfig {
+        filter,
+        transform,
+        dedup_window: options.dedup_window,
+        dedup_cc: options.dedup_cc,
+        stats: interval_stats.clone(),
+        throttle_window: options.throttle_cc,
+        throttle_flush_on_stop: options.throttle_flush_on_stop,
+        preserve_timing: options.preserve_timing,
+        humanize,
+        harmonize: options.harmonize.clone(),
+        latch: options.latch,
+        pedal_to_length: options.pedal_to_length,
+        cc_scaler: (options.cc_scale != 1.0).then(|| CcScaler::new(options.cc_scale, &options.cc14_pairs)),
+        note_off_style: options.note_off_style,
+        note_delay: options.echo.map(|(delay, repeats, decay)| NoteDelay::new(delay, repeats, decay)),
+        quantizer: options.quantize.map(|(division, bpm)| Quantizer::new(division, bpm)),
+        counts: counts.clone(),
+        reset: options.reset.clone(),
+        buffer: options.buffer,
+        buffer_overflow: options.buffer_overflow,
+        metrics: metrics.clone(),
+        allow_loop: options.allow_loop,
+        detect_stuck: options.detect_stuck,
+        generate_spp: options.generate_spp,
+        delay: options.delay,
+        delay_flush_on_stop: options.flush_on_stop,
+        control_note: options.control_note.map(|note| (note, Arc::new(AtomicBool::new(false)))),
+        keepalive: options.keepalive,
+        normalize: options.normalize,
+        panic_mode: options.panic_mode,
+        ..PipelineConfig::default()
+    };
+
+    let connect = || -> Result<Vec<Pipeline>, Box<dyn std::error::Error>> {
+        let mut pipelines = vec![Pipeline::connect(
+            &options.input,
+            &options.outputs,
+            options.match_mode,
+            PipelineConfig { echo: forward_echo.clone(), ..config.clone() },
+        )?];
+
+        // The reverse direction reads from B's input and writes to A's output
+        if options.bidir {
+            pipelines.push(Pipeline::connect(
+                &options.outputs[0],
+                std::slice::from_ref(&options.input),
+                options.match_mode,
+                config.reverse(reverse_echo.clone()),
+            )?);
+        }
+
+        for pipeline in &pipelines {
+            info!("Worker started: {} -> {}", pipeline.input_name, pipeline.output_names.join(", "));
+        }
+        Ok(pipelines)
+    };
+
+    let mut pipelines = match connect() {
+        Ok(pipelines) => pipelines,
+        Err(e) if options.reconnect => {
+            error!("Failed to connect: {}", e);
+            match reconnect_with_backoff(&connect, &interrupted) {
+                Some(pipelines) => pipelines,
+                None => return Ok(()),
+            }
+        }
+        Err(e) => return Err(e),
+    };
+
+    // Keep the worker alive until Ctrl+C or SIGTERM, reporting stats periodically
+    // and, with --reconnect, checking that the ports are still there
+    let started = Instant::now();
+    let mut period_start = Instant::now();
+    let mut last_count_report = Instant::now();
+    let mut last_port_check = Instant::now();
+    while !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(Duration::from_millis(50));
+
+        for pipeline in &pipelines {
+            pipeline.check_stuck_notes();
+        }
+
+        if let (Some(interval), Some(total)) = (&interval_stats, &total_stats) {
+            if period_start.elapsed() >= STATS_INTERVAL {
+                let summary = interval.take(period_start);
+                total.add(&summary);
+                info!("Stats: {}", summary);
+                period_start = Instant::now();
             }
+        }
+
+        if let Some(counts) = &counts {
+            if last_count_report.elapsed() >= STATS_INTERVAL {
+                info!("Counts: {}", counts.summary());
+                last_count_report = Instant::now();
+            }
+        }
 
-            // Handle Program Change messages
-            if is_program_change(message) {
-                let normalized = normalize_program_change(message);
-                if let Ok(mut out) = out_conn_clone.lock() {
-                    if let Err(e) = out.send(&normalized) {
-                        eprintln!("Error forwarding program change: {}", e);
+        if options.reconnect && last_port_check.elapsed() >= PORT_CHECK_INTERVAL {
+            last_port_check = Instant::now();
+            if !pipelines.iter().all(ports_present) {
+                info!("Port disappeared, reconnecting");
+                for pipeline in pipelines.drain(..) {
+                    pipeline.close(true);
+                }
+                match reconnect_with_backoff(&connect, &interrupted) {
+                    Some(reconnected) => {
+                        pipelines = reconnected;
+                        if let Some(metrics) = &metrics {
+                            metrics.record_reconnect();
+                        }
                     }
+                    None => break,
                 }
-                return;
             }
+        }
+    }
 
-            // Validate and forward other messages
-            if is_valid_midi_message(message) {
-                if let Ok(mut out) = out_conn_clone.lock() {
-                    if let Err(e) = out.send(message) {
-                        eprintln!("Error forwarding message: {}", e);
-                    }
+    // Release held notes so they don't hang on the receiving synth
+    for pipeline in pipelines {
+        pipeline.close(options.no_panic);
+    }
+
+    if let (Some(interval), Some(total)) = (&interval_stats, &total_stats) {
+        total.add(&interval.take(period_start));
+        info!("Total: {}", total.take(started));
+    }
+    if let Some(counts) = &counts {
+        info!("Total counts: {}", counts.summary());
+    }
+
+    Ok(())
+}
+
+/// How often `mc fwd --reconnect` checks that its ports still exist
+const PORT_CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Longest wait between reconnection attempts
+const MAX_RECONNECT_DELAY: Duration = Duration::from_secs(30);
+
+/// How often `--wait` checks for missing ports
+const WAIT_POLL_INTERVAL: Duration = Duration::from_millis(500);
+
+/// Blocks until every input and output spec resolves to a port (`--wait`)
+/// Returns false if interrupted. After `timeout` it returns true anyway, so the
+/// connect that follows reports which port is missing
+fn wait_for_ports(
+    inputs: &[&str],
+    outputs: &[&str],
+    mode: midi::ports::PortMatch,
+    timeout: Duration,
+    interrupted: &std::sync::atomic::AtomicBool,
+) -> bool {
+    use midi::ports::{input_ports, output_ports, port_resolves};
+    use std::sync::atomic::Ordering;
+    use std::time::Instant;
+
+    let deadline = Instant::now() + timeout;
+    let mut attempt = 1;
+    loop {
+        let ins = input_ports().unwrap_or_default();
+        let outs = output_ports().unwrap_or_default();
+        let missing: Vec<&str> = inputs
+            .iter()
+            .filter(|spec| !port_resolves(&ins, spec, mode))
+            .chain(outputs.iter().filter(|spec| !port_resolves(&outs, spec, mode)))
+            .copied()
+            .collect();
+        if missing.is_empty() {
+            return true;
+        }
+        if attempt == 1 {
+            info!("Waiting up to {:?} for {}", timeout, missing.join(", "));
+        }
+        debug!("Wait attempt {}: still missing {}", attempt, missing.join(", "));
+        if Instant::now() >= deadline {
+            error!("Gave up waiting for {}", missing.join(", "));
+            return true;
+        }
+
+        let retry_at = Instant::now() + WAIT_POLL_INTERVAL;
+        while Instant::now() < retry_at {
+            if interrupted.load(Ordering::Relaxed) {
+                return false;
+            }
+            std::thread::sleep(Duration::from_millis(50));
+        }
+        attempt += 1;
+    }
+}
+
+/// Returns true if both of a pipeline's ports are still listed by the driver
+fn ports_present(pipeline: &midi::pipeline::Pipeline) -> bool {
+    use midi::ports::{input_port_names, output_port_names};
+
+    let input_ok = input_port_names().is_ok_and(|names| names.contains(&pipeline.input_name));
+    let output_ok = output_port_names()
+        .is_ok_and(|names| pipeline.output_names.iter().all(|name| names.contains(name)));
+    input_ok && output_ok
+}
+
+/// Calls `connect` until it succeeds, doubling the delay after each failure
+/// Returns None if interrupted while waiting
+fn reconnect_with_backoff<T>(
+    connect: &dyn Fn() -> Result<T, Box<dyn std::error::Error>>,
+    interrupted: &std::sync::atomic::AtomicBool,
+) -> Option<T> {
+    use std::sync::atomic::Ordering;
+    use std::time::Instant;
+
+    let mut delay = Duration::from_millis(500);
+    loop {
+        let retry_at = Instant::now() + delay;
+        while Instant::now() < retry_at {
+            if interrupted.load(Ordering::Relaxed) {
+                return None;
+            }
+            std::thread::sleep(Duration::from_millis(50));
+        }
+
+        match connect() {
+            Ok(connected) => return Some(connected),
+            Err(e) => {
+                delay = (delay * 2).min(MAX_RECONNECT_DELAY);
+                info!("Reconnect failed: {} (retrying in {:?})", e, delay);
+            }
+        }
+    }
+}
+
+/// Monitor mode: print a decoded line for every message received on an input
+fn run_monitor(options: &cli::MonitorArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::decode::{decode, hex_bytes, message_json};
+    use midi::histogram::VelocityHistogram;
+    use midi::meter::ActivityMeter;
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midi::stuck::StuckNotes;
+    use midir::MidiInput;
+    use std::io::IsTerminal;
+    use std::sync::atomic::Ordering;
+    use std::sync::{Arc, Mutex};
+    use std::time::Instant;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-monitor")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    let raw = options.raw;
+    let json = logging::json_format();
+    let mut parser = MessageParser::new();
+    let stuck = options.detect_stuck.map(|threshold| Arc::new(Mutex::new(StuckNotes::new(threshold))));
+    let callback_stuck = stuck.clone();
+    let histogram = options.histogram.then(|| Arc::new(Mutex::new(VelocityHistogram::new())));
+    let callback_histogram = histogram.clone();
+    let meter = options.meter.then(|| Arc::new(Mutex::new(ActivityMeter::new())));
+    let callback_meter = meter.clone();
+
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-monitor-in",
+        move |timestamp, bytes, _| {
+            // midir timestamps are in microseconds
+            let ms = timestamp as f64 / 1000.0;
+            for message in parser.push(bytes) {
+                if let Some(Ok(mut stuck)) = callback_stuck.as_ref().map(|s| s.lock()) {
+                    stuck.observe(&message, Instant::now());
+                }
+                if let Some(Ok(mut histogram)) = callback_histogram.as_ref().map(|h| h.lock()) {
+                    histogram.record(&message);
+                }
+                // The meter replaces the message lines
+                if let Some(Ok(mut meter)) = callback_meter.as_ref().map(|m| m.lock()) {
+                    meter.record(&message, Instant::now());
+                    continue;
+                }
+                if json {
+                    println!("{}", message_json(logging::unix_time(), &message));
+                } else if raw {
+                    println!("{:>12.3} ms  {:<40} [{}]", ms, decode(&message).to_string(), hex_bytes(&message));
+                } else {
+                    println!("{:>12.3} ms  {}", ms, decode(&message));
                 }
             }
         },
         (),
-    )?;
+    )
+    .map_err(connect_error("Input", &port_name))?;
 
-    eprintln!("Worker started: {} -> {}", input_port_name, output_port_name);
+    info!("Monitoring {} (ctrl+c to stop)", port_name);
 
-    // Keep the worker alive until killed
-    loop {
-        std::thread::sleep(Duration::from_secs(1));
+    let mut histogram_at = Instant::now();
+    // Redrawn in place on a terminal; piped output gets a line when the summary changes
+    let meter_live = std::io::stdout().is_terminal();
+    let mut meter_shown: Option<[String; 3]> = None;
+    let mut meter_summary = LiveLine::new();
+    let mut meter_at = Instant::now();
+    while !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(Duration::from_millis(50));
+        // Rendered from here rather than the callback, so heavy traffic costs no extra redraws
+        if let Some(meter) = &meter {
+            let now = Instant::now();
+            if meter_live {
+                if let Ok(lines) = meter.lock().map(|m| m.lines(now)) {
+                    if meter_shown.as_ref() != Some(&lines) {
+                        draw_meter(&lines, meter_shown.is_some())?;
+                        meter_shown = Some(lines);
+                    }
+                }
+            } else if now.duration_since(meter_at) >= METER_SUMMARY_INTERVAL {
+                meter_at += METER_SUMMARY_INTERVAL;
+                if let Some(summary) = meter.lock().ok().map(|m| m.summary(now, METER_SUMMARY_INTERVAL)) {
+                    meter_summary.show(summary)?;
+                }
+            }
+        }
+        if let Some(Ok(mut stuck)) = stuck.as_ref().map(|s| s.lock()) {
+            for note in stuck.check(Instant::now()) {
+                error!("Stuck note: {}", note);
+            }
+        }
+        if let Some(interval) = options.histogram_interval.filter(|&i| histogram_at.elapsed() >= i) {
+            histogram_at += interval;
+            if let Some(Ok(histogram)) = histogram.as_ref().map(|h| h.lock()) {
+                print!("{}", histogram.report());
+            }
+        }
     }
+    in_conn.close();
+
+    if let Some(Ok(histogram)) = histogram.as_ref().map(|h| h.lock()) {
+        print!("{}", histogram.report());
+    }
+
+    if let Some(Ok(stuck)) = stuck.as_ref().map(|s| s.lock()) {
+        let summary = stuck.summary(Instant::now());
+        info!("{} stuck notes", summary.len());
+        for note in summary {
+            info!("  {}", note);
+        }
+    }
+
+    Ok(())
 }
 
-/// CLI mode: list all MIDI ports and exit
-/// This creates a fresh MIDI context that sees current system state
-fn list_ports_and_exit() -> Result<(), Box<dyn std::error::Error>> {
-    use midi::MidiManager;
+/// How often `mc monitor --meter` prints a summary when output isn't a terminal
+const METER_SUMMARY_INTERVAL: Duration = Duration::from_secs(1);
 
-    let inputs = MidiManager::list_input_ports();
-    let outputs = MidiManager::list_output_ports();
+/// Draws the meter's lines, first moving back up over the previous drawing
+fn draw_meter(lines: &[String], redraw: bool) -> std::io::Result<()> {
+    use std::io::Write;
+    let mut out = std::io::stdout().lock();
+    if redraw {
+        write!(out, "\x1b[{}A", lines.len())?;
+    }
+    for line in lines {
+        write!(out, "\r\x1b[2K{}\n", line)?;
+    }
+    out.flush()
+}
 
-    // Print in JSON format for easy parsing
-    println!("{{");
-    println!("  \"inputs\": [");
-    for (i, port) in inputs.iter().enumerate() {
-        let comma = if i < inputs.len() - 1 { "," } else { "" };
-        println!("    \"{}\"{}",port.name, comma);
+/// The filter and transform a route's settings call for
+fn route_processing(route: &config::Route) -> (midi::filter::Filter, midi::transform::Transform) {
+    let filter = midi::filter::Filter::new(&route.channels);
+    let transform = midi::transform::Transform::new()
+        .with_transpose(route.transpose)
+        .with_channel_map(route.channel_map);
+    (filter, transform)
+}
+
+/// Carries out a control socket command on the running routes, returning the reply line
+fn control_reply(
+    command: net::control::ControlCommand,
+    routes: &mut [config::Route],
+    pipelines: &[midi::pipeline::Pipeline],
+) -> String {
+    use net::control::{error_reply, ok_reply, routes_reply, ControlCommand};
+
+    let id = match &command {
+        ControlCommand::Routes => {
+            let states: Vec<_> = routes.iter().zip(pipelines).map(|(r, p)| (r, p.paused())).collect();
+            return routes_reply(&states);
+        }
+        ControlCommand::Pause(id)
+        | ControlCommand::Resume(id)
+        | ControlCommand::Channels(id, _)
+        | ControlCommand::Transpose(id, _) => *id,
+    };
+    let (Some(route), Some(pipeline)) = (routes.get_mut(id - 1), pipelines.get(id - 1)) else {
+        return error_reply(&format!("No route {} (there are {})", id, pipelines.len()));
+    };
+    match command {
+        ControlCommand::Pause(_) | ControlCommand::Resume(_) => {
+            let paused = matches!(command, ControlCommand::Pause(_));
+            pipeline.set_paused(paused);
+            info!("Route {} {}", id, if paused { "paused" } else { "resumed" });
+        }
+        ControlCommand::Channels(_, channels) => {
+            route.channels = channels;
+            let (filter, transform) = route_processing(route);
+            pipeline.update(filter, transform);
+            info!("Route {} channels: {:?}", id, route.channels);
+        }
+        ControlCommand::Transpose(_, semitones) => {
+            route.transpose = semitones;
+            let (filter, transform) = route_processing(route);
+            pipeline.update(filter, transform);
+            info!("Route {} transpose: {}", id, semitones);
+        }
+        ControlCommand::Routes => {}
     }
-    println!("  ],");
-    println!("  \"outputs\": [");
-    for (i, port) in outputs.iter().enumerate() {
-        let comma = if i < outputs.len() - 1 { "," } else { "" };
-        println!("    \"{}\"{}",port.name, comma);
+    ok_reply()
+}
+
+/// Run mode: start every route from a routes file, like several `mc fwd` at once
+/// All ports are checked before any route starts so a typo doesn't leave a half-built patchbay
+fn run_routes(options: &cli::RunArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::pipeline::{Pipeline, PipelineConfig};
+    use midi::ports::{input_port_names, output_port_names, PortMatch};
+    use std::sync::atomic::Ordering;
+    use std::sync::Arc;
+
+    // `-` reads the routes from stdin, so another program can generate them
+    let path = &options.routes;
+    let mut routes = if path == "-" {
+        config::read_routes(io::stdin().lock(), "stdin")?
+    } else {
+        config::read_routes(std::fs::File::open(path)?, path)?
+    };
+    config::check_ports(&routes, &input_port_names()?, &output_port_names()?).map_err(PortError::NotFound)?;
+
+    let interrupted = signal::interrupt_flag()?;
+    let requests = match &options.control_socket {
+        Some(socket) => Some(net::control::listen(socket, Arc::clone(&interrupted))?),
+        None => None,
+    };
+
+    let mut pipelines = Vec::new();
+    for route in &routes {
+        let (filter, transform) = route_processing(route);
+        let config = PipelineConfig {
+            filter,
+            transform,
+            ..PipelineConfig::default()
+        };
+        let output = std::slice::from_ref(&route.output);
+        let pipeline = Pipeline::connect(&route.input, output, PortMatch::Substring, config)?;
+        info!("Route started: {} -> {}", pipeline.input_name, pipeline.output_names.join(", "));
+        pipelines.push(pipeline);
+    }
+
+    match requests {
+        // Commands run here, one at a time, so the routes need no more locking than
+        // each pipeline already does
+        Some(requests) => {
+            while !interrupted.load(Ordering::Relaxed) {
+                if let Ok(request) = requests.recv_timeout(Duration::from_millis(50)) {
+                    let reply = control_reply(request.command.clone(), &mut routes, &pipelines);
+                    request.reply(reply);
+                }
+            }
+        }
+        None => signal::wait_for_interrupt(&interrupted),
+    }
+    for pipeline in pipelines {
+        pipeline.close(false);
+    }
+
+    Ok(())
+}
+
+/// Port mode: create a named virtual port pair until Ctrl+C
+/// See `VirtualPort` for how `--to` and `--from` bridge it to real devices
+fn run_port(options: &cli::PortArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::port::{Sides, VirtualPort};
+
+    let interrupted = signal::interrupt_flag()?;
+    let config = &options.port;
+    if let Some(timeout) = options.wait {
+        let inputs: Vec<&str> = config.from.iter().map(String::as_str).collect();
+        let outputs: Vec<&str> = config.to.iter().map(String::as_str).collect();
+        if !wait_for_ports(&inputs, &outputs, config.match_mode, timeout, &interrupted) {
+            return Ok(());
+        }
+    }
+    let port = VirtualPort::open(config)?;
+
+    let sides = match config.sides {
+        Sides::Both => "",
+        Sides::InputOnly => " (input only)",
+        Sides::OutputOnly => " (output only)",
+    };
+    info!("Virtual port {}{} ready (ctrl+c to stop)", config.name, sides);
+    if let Some(to) = &config.to {
+        info!("  {} -> {}", config.name, to);
+    }
+    if let Some(from) = &config.from {
+        info!("  {} -> {}", from, config.name);
+    }
+    if config.to.is_none() && config.from.is_none() && config.sides == Sides::Both {
+        info!("  looping input to output");
+    }
+    if let Some((file, _)) = &config.record {
+        info!("  recording to {}", file);
+    }
+
+    signal::wait_for_interrupt(&interrupted);
+    port.close(options.no_panic);
+
+    Ok(())
+}
+
+/// Net send mode: send each message from an input to a UDP address, one datagram per message
+fn run_net_send(options: &cli::NetSendArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midir::MidiInput;
+    use net::udp::encode_packet;
+    use std::net::UdpSocket;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let socket = UdpSocket::bind("0.0.0.0:0")?;
+    socket
+        .connect(&options.address)
+        .map_err(|e| format!("Invalid address '{}': {}", options.address, e))?;
+
+    let midi_in = MidiInput::new("mc-net-send")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    let mut parser = MessageParser::new();
+    let mut seq: u32 = 0;
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-net-send-in",
+        move |timestamp, bytes, _| {
+            for message in parser.push(bytes) {
+                // Skipped without using a sequence number, so the receiver doesn't count it lost
+                let packet = match encode_packet(seq, timestamp, &message) {
+                    Ok(packet) => packet,
+                    Err(e) => {
+                        error!("Skipping message: {}", e);
+                        continue;
+                    }
+                };
+                if let Err(e) = socket.send(&packet) {
+                    error!("Error sending datagram: {}", e);
+                }
+                seq = seq.wrapping_add(1);
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!("Sending {} to udp://{} (ctrl+c to stop)", port_name, options.address);
+    signal::wait_for_interrupt(&interrupted);
+    in_conn.close();
+
+    Ok(())
+}
+
+/// Net receive mode: send MIDI messages from UDP datagrams (see `net::udp`) to an output
+/// Gaps in the sequence numbers are logged as dropped datagrams
+fn run_net_recv(options: &cli::NetRecvArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::notes::ActiveNotes;
+    use midi::ports::find_output_port;
+    use midi::validation::is_valid_midi_message;
+    use midir::MidiOutput;
+    use net::udp::{decode_packet, Sequence, SequenceTracker};
+    use std::net::UdpSocket;
+    use std::sync::atomic::Ordering;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_out = MidiOutput::new("mc-net-recv")?;
+    let out_port = find_output_port(&midi_out, &options.output, options.match_mode)?;
+    let port_name = midi_out.port_name(&out_port)?;
+    let mut out_conn = midi_out
+        .connect(&out_port, "mc-net-recv-out")
+        .map_err(connect_error("Output", &port_name))?;
+
+    let socket = UdpSocket::bind(("0.0.0.0", options.port))?;
+    // Wake up regularly to notice Ctrl+C
+    socket.set_read_timeout(Some(Duration::from_millis(100)))?;
+
+    info!("Receiving udp port {} -> {} (ctrl+c to stop)", options.port, port_name);
+
+    let mut tracker = SequenceTracker::new();
+    let mut active_notes = ActiveNotes::new();
+    let mut buffer = [0u8; 65536];
+    while !interrupted.load(Ordering::Relaxed) {
+        let (len, sender) = match socket.recv_from(&mut buffer) {
+            Ok(received) => received,
+            Err(e) if matches!(e.kind(), io::ErrorKind::WouldBlock | io::ErrorKind::TimedOut) => continue,
+            Err(e) => return Err(e.into()),
+        };
+
+        let packet = match decode_packet(&buffer[..len]) {
+            Ok(packet) => packet,
+            Err(e) => {
+                error!("Ignoring datagram from {}: {}", sender, e);
+                continue;
+            }
+        };
+
+        match tracker.observe(packet.seq) {
+            Sequence::InOrder => {}
+            Sequence::Dropped(count) => info!("{} datagram(s) from {} were lost", count, sender),
+            Sequence::Late => info!("Datagram {} from {} arrived out of order", packet.seq, sender),
+        }
+
+        if is_valid_midi_message(&packet.message) {
+            match out_conn.send(&packet.message) {
+                Ok(()) => active_notes.track(&packet.message),
+                Err(e) => error!("Error forwarding message: {}", e),
+            }
+        }
+    }
+
+    for message in active_notes.note_offs() {
+        let _ = out_conn.send(&message);
+    }
+
+    Ok(())
+}
+
+/// OSC send mode: send each message from an input as OSC (see `net::osc` for the addresses)
+fn run_osc_send(options: &cli::OscSendArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midir::MidiInput;
+    use net::osc::{encode_message, mapped_cc, midi_to_osc};
+    use std::collections::HashMap;
+    use std::net::UdpSocket;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let socket = UdpSocket::bind("0.0.0.0:0")?;
+    socket
+        .connect(&options.address)
+        .map_err(|e| format!("Invalid address '{}': {}", options.address, e))?;
+
+    let midi_in = MidiInput::new("mc-osc-send")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    let prefix = options.prefix.clone();
+    let mappings: HashMap<u8, _> = options.maps.iter().map(|m| (m.controller, m.clone())).collect();
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-osc-send-in",
+        move |_timestamp, bytes, _| {
+            for message in parser.push(bytes) {
+                let osc = mapped_cc(&mappings, &message).or_else(|| midi_to_osc(&prefix, &message));
+                let Some(osc) = osc else {
+                    continue;
+                };
+                if let Err(e) = socket.send(&encode_message(&osc)) {
+                    error!("Error sending OSC: {}", e);
+                }
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!(
+        "Sending {} as OSC {}/... to {} (ctrl+c to stop)",
+        port_name, options.prefix, options.address
+    );
+    for mapping in &options.maps {
+        info!(
+            "  cc{} -> {} ({} to {})",
+            mapping.controller, mapping.address, mapping.min, mapping.max
+        );
+    }
+    signal::wait_for_interrupt(&interrupted);
+    in_conn.close();
+
+    Ok(())
+}
+
+/// OSC receive mode: send OSC messages under the prefix to an output as MIDI
+fn run_osc_recv(options: &cli::OscRecvArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::notes::ActiveNotes;
+    use midi::ports::find_output_port;
+    use midi::validation::is_valid_midi_message;
+    use midir::MidiOutput;
+    use net::osc::{osc_to_midi, parse_packet};
+    use std::net::UdpSocket;
+    use std::sync::atomic::Ordering;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_out = MidiOutput::new("mc-osc-recv")?;
+    let out_port = find_output_port(&midi_out, &options.output, options.match_mode)?;
+    let port_name = midi_out.port_name(&out_port)?;
+    let mut out_conn = midi_out
+        .connect(&out_port, "mc-osc-recv-out")
+        .map_err(connect_error("Output", &port_name))?;
+
+    let socket = UdpSocket::bind(("0.0.0.0", options.port))?;
+    // Wake up regularly to notice Ctrl+C
+    socket.set_read_timeout(Some(Duration::from_millis(100)))?;
+
+    info!(
+        "Receiving OSC {}/... on udp port {} -> {} (ctrl+c to stop)",
+        options.prefix, options.port, port_name
+    );
+
+    let mut active_notes = ActiveNotes::new();
+    let mut buffer = [0u8; 65536];
+    while !interrupted.load(Ordering::Relaxed) {
+        let (len, sender) = match socket.recv_from(&mut buffer) {
+            Ok(received) => received,
+            Err(e) if matches!(e.kind(), io::ErrorKind::WouldBlock | io::ErrorKind::TimedOut) => continue,
+            Err(e) => return Err(e.into()),
+        };
+
+        let messages = match parse_packet(&buffer[..len]) {
+            Ok(messages) => messages,
+            Err(e) => {
+                error!("Ignoring OSC packet from {}: {}", sender, e);
+                continue;
+            }
+        };
+
+        for osc in messages {
+            let Some(message) = osc_to_midi(&options.prefix, &osc).filter(|m| is_valid_midi_message(m)) else {
+                debug!("Ignoring OSC message {} from {}", osc.address, sender);
+                continue;
+            };
+            match out_conn.send(&message) {
+                Ok(()) => active_notes.track(&message),
+                Err(e) => error!("Error forwarding message: {}", e),
+            }
+        }
+    }
+
+    for message in active_notes.note_offs() {
+        let _ = out_conn.send(&message);
+    }
+
+    Ok(())
+}
+
+/// WebSocket mode: stream an input's messages to every connected client in the `monitor`
+/// JSON schema; with `--output`, messages clients send back (same schema, `raw` is used)
+/// go to that port
+fn run_ws(options: &cli::WsArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::decode::{message_from_json, message_json};
+    use midi::parser::MessageParser;
+    use midi::ports::{find_input_port, find_output_port};
+    use midi::validation::is_valid_midi_message;
+    use midir::{MidiInput, MidiOutput};
+    use net::ws::{serve, Clients};
+    use std::net::TcpListener;
+    use std::sync::{Arc, Mutex};
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-ws")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    let output = match &options.output {
+        Some(spec) => {
+            let midi_out = MidiOutput::new("mc-ws")?;
+            let out_port = find_output_port(&midi_out, spec, options.match_mode)?;
+            info!("  clients -> {}", midi_out.port_name(&out_port)?);
+            let conn = midi_out
+                .connect(&out_port, "mc-ws-out")
+                .map_err(connect_error("Output", spec))?;
+            Some(Mutex::new(conn))
+        }
+        None => None,
+    };
+
+    let listener = TcpListener::bind(&options.listen)
+        .map_err(|e| format!("Failed to listen on {}: {}", options.listen, e))?;
+
+    let clients = Clients::new();
+    let broadcast = clients.clone();
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-ws-in",
+        move |_timestamp, bytes, _| {
+            for message in parser.push(bytes) {
+                broadcast.broadcast(&message_json(logging::unix_time(), &message));
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    let on_text = Arc::new(move |text: &str| {
+        let Some(output) = &output else {
+            return;
+        };
+        match message_from_json(text) {
+            Ok(message) if is_valid_midi_message(&message) => {
+                if let Ok(mut out) = output.lock() {
+                    if let Err(e) = out.send(&message) {
+                        error!("Error forwarding message: {}", e);
+                    }
+                }
+            }
+            Ok(message) => debug!("Ignoring invalid message from client: {:02X?}", message),
+            Err(e) => debug!("Ignoring client message '{}': {}", text, e),
+        }
+    });
+
+    info!("Streaming {} on ws://{} (ctrl+c to stop)", port_name, options.listen);
+    serve(listener, &clients, on_text, &interrupted)?;
+
+    in_conn.close();
+    clients.close_all();
+
+    Ok(())
+}
+
+/// RTP mode: accept an AppleMIDI session (e.g. macOS Network MIDI) and expose it as a
+/// virtual port; messages sent to the virtual input go to the session, and messages from
+/// the session come out of the virtual output (or a real output with `--to`)
+fn run_rtp(options: &cli::RtpArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::notes::ActiveNotes;
+    use midi::port::{PortConfig, Sides, VirtualPort};
+    use midi::ports::find_output_port;
+    use midi::validation::is_valid_midi_message;
+    use midir::MidiOutput;
+    use net::rtp::Session;
+    use std::sync::atomic::Ordering;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let mut session = Session::bind(&options.name, options.listen)
+        .map_err(|e| format!("Failed to listen on UDP ports {}-{}: {}", options.listen, options.listen + 1, e))?;
+    let mut sender = session.sender()?;
+
+    let config = PortConfig {
+        name: options.name.clone(),
+        to: None,
+        from: None,
+        match_mode: options.match_mode,
+        sides: if options.to.is_some() { Sides::InputOnly } else { Sides::Both },
+        reset: None,
+        record: None,
+        client_name: None,
+        keepalive: false,
+        panic_mode: Default::default(),
+    };
+    let port = VirtualPort::open_with_sink(
+        &config,
+        Box::new(move |message| {
+            if let Err(e) = sender.send(message) {
+                error!("Error sending to RTP-MIDI peer: {}", e);
+            }
+        }),
+    )?;
+
+    let mut output = match &options.to {
+        Some(spec) => {
+            let midi_out = MidiOutput::new("mc-rtp")?;
+            let out_port = find_output_port(&midi_out, spec, options.match_mode)?;
+            info!("  session -> {}", midi_out.port_name(&out_port)?);
+            Some(midi_out.connect(&out_port, "mc-rtp-out").map_err(connect_error("Output", spec))?)
+        }
+        None => None,
+    };
+
+    info!(
+        "RTP-MIDI session '{}' listening on UDP ports {}-{} (ctrl+c to stop)",
+        options.name,
+        options.listen,
+        options.listen + 1
+    );
+
+    let mut active_notes = ActiveNotes::new();
+    let mut deliver = |message: &[u8]| {
+        logging::message(message);
+        if !is_valid_midi_message(message) {
+            return;
+        }
+        match output.as_mut() {
+            Some(out) => match out.send(message) {
+                Ok(()) => active_notes.track(message),
+                Err(e) => error!("Error forwarding message: {}", e),
+            },
+            None => port.send(message),
+        }
+    };
+    while !interrupted.load(Ordering::Relaxed) {
+        session.poll(&mut deliver)?;
+    }
+
+    if let Some(mut out) = output.filter(|_| !options.no_panic) {
+        for message in active_notes.note_offs() {
+            let _ = out.send(&message);
+        }
+    }
+    session.close();
+    port.close(options.no_panic);
+
+    Ok(())
+}
+
+/// Send mode: read one message per line from stdin and send it to an output
+/// Invalid lines are reported with their line number and skipped
+fn run_send(options: &cli::SendArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::ports::find_output_port;
+    use midi::send::parse_line;
+    use midir::MidiOutput;
+    use std::io::BufRead;
+    use std::sync::atomic::Ordering;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_out = MidiOutput::new("mc-send")?;
+    let out_port = find_output_port(&midi_out, &options.output, options.match_mode)?;
+    let port_name = midi_out.port_name(&out_port)?;
+    let mut out = midi_out
+        .connect(&out_port, "mc-send-out")
+        .map_err(connect_error("Output", &port_name))?;
+
+    debug!("Sending stdin to {}", port_name);
+
+    for (i, line) in io::stdin().lock().lines().enumerate() {
+        if interrupted.load(Ordering::Relaxed) {
+            break;
+        }
+        let message = match parse_line(&line?) {
+            Ok(Some(message)) => message,
+            Ok(None) => continue,
+            Err(e) => {
+                error!("line {}: {}", i + 1, e);
+                continue;
+            }
+        };
+
+        if let Err(e) = out.send(&message) {
+            error!("line {}: failed to send: {}", i + 1, e);
+        }
+        if let Some(delay) = options.delay {
+            std::thread::sleep(delay);
+        }
+    }
+
+    Ok(())
+}
+
+/// SysEx mode: send every message in a .syx file, pausing between them
+/// Malformed chunks are reported and skipped
+fn run_sysex(options: &cli::SysexArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::ports::find_output_port;
+    use midi::sysex::split_syx;
+    use midir::MidiOutput;
+    use std::sync::atomic::Ordering;
+
+    let data = std::fs::read(&options.file)?;
+    let chunks = split_syx(&data);
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_out = MidiOutput::new("mc-sysex")?;
+    let out_port = find_output_port(&midi_out, &options.output, options.match_mode)?;
+    let port_name = midi_out.port_name(&out_port)?;
+    let mut out = midi_out
+        .connect(&out_port, "mc-sysex-out")
+        .map_err(connect_error("Output", &port_name))?;
+
+    let mut sent = 0;
+    let mut bytes = 0;
+    for chunk in chunks {
+        if interrupted.load(Ordering::Relaxed) {
+            break;
+        }
+        let message = match chunk {
+            Ok(message) => message,
+            Err(e) => {
+                error!("{}: {}", options.file, e);
+                continue;
+            }
+        };
+
+        // Pause before every message after the first
+        if sent > 0 {
+            std::thread::sleep(options.delay);
+        }
+        out.send(&message)?;
+        sent += 1;
+        bytes += message.len();
+    }
+
+    info!("Sent {} SysEx message(s), {} bytes, to {}", sent, bytes, port_name);
+    Ok(())
+}
+
+/// SysEx dump mode: save complete SysEx messages from an input to a .syx file
+/// Runs until Ctrl+C, or until `--idle` passes without SysEx once a dump has started
+fn run_sysex_dump(options: &cli::SysexDumpArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midir::MidiInput;
+    use std::sync::atomic::Ordering;
+    use std::sync::{Arc, Mutex};
+    use std::time::Instant;
+
+    // Register before connecting so an early Ctrl+C still writes the file
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-sysex-dump")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    // Captured bytes, message count and when the last one arrived
+    let captured: Arc<Mutex<(Vec<u8>, usize, Option<Instant>)>> = Arc::new(Mutex::new((Vec::new(), 0, None)));
+    let captured_clone = Arc::clone(&captured);
+    let mut parser = MessageParser::new();
+
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-sysex-dump-in",
+        move |_timestamp, bytes, _| {
+            // The parser reassembles SysEx split across callbacks
+            for message in parser.push(bytes) {
+                if message.first() != Some(&0xF0) {
+                    continue;
+                }
+                if let Ok(mut captured) = captured_clone.lock() {
+                    captured.0.extend_from_slice(&message);
+                    captured.1 += 1;
+                    captured.2 = Some(Instant::now());
+                }
+                debug!("Captured SysEx ({} bytes)", message.len());
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!("Capturing SysEx from {} to {} (ctrl+c to stop)", port_name, options.file);
+    while !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(Duration::from_millis(50));
+        if let Some(idle) = options.idle {
+            let last = captured.lock().ok().and_then(|captured| captured.2);
+            if last.is_some_and(|last| last.elapsed() >= idle) {
+                break;
+            }
+        }
+    }
+    in_conn.close();
+
+    let captured = captured.lock().map_err(|_| "Capture buffer poisoned")?;
+    if captured.1 == 0 {
+        info!("No SysEx received, {} not written", options.file);
+        return Ok(());
+    }
+    std::fs::write(&options.file, &captured.0)?;
+
+    info!(
+        "Wrote {} SysEx message(s), {} bytes, to {}",
+        captured.1,
+        captured.0.len(),
+        options.file
+    );
+    Ok(())
+}
+
+/// Arp mode: play the notes held on an input one at a time, in sixteenths at `--bpm`
+/// Everything other than notes is passed straight through
+fn run_arp(options: &cli::ArpArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::arp::Arpeggiator;
+    use midi::clock::{sleep_until, ClockSchedule};
+    use midi::humanize::time_seed;
+    use midi::parser::MessageParser;
+    use midi::ports::{find_input_port, find_output_port};
+    use midir::{MidiInput, MidiOutput};
+    use std::sync::atomic::Ordering;
+    use std::sync::{Arc, Mutex};
+    use std::time::Instant;
+
+    /// Arp steps per quarter note
+    const STEPS_PER_BEAT: u32 = 4;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_out = MidiOutput::new("mc-arp")?;
+    let out_port = find_output_port(&midi_out, &options.output, options.match_mode)?;
+    let out_name = midi_out.port_name(&out_port)?;
+    let out_conn = midi_out
+        .connect(&out_port, "mc-arp-out")
+        .map_err(connect_error("Output", &out_name))?;
+    let out_conn = Arc::new(Mutex::new(out_conn));
+
+    let arp = Arc::new(Mutex::new(Arpeggiator::new(options.pattern, options.octaves, time_seed())));
+
+    let midi_in = MidiInput::new("mc-arp")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let in_name = midi_in.port_name(&in_port)?;
+
+    let callback_arp = Arc::clone(&arp);
+    let callback_out = Arc::clone(&out_conn);
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in
+        .connect(
+            &in_port,
+            "mc-arp-in",
+            move |_timestamp, bytes, _| {
+                for message in parser.push(bytes) {
+                    let taken = callback_arp.lock().map(|mut arp| arp.input(&message)).unwrap_or(false);
+                    if !taken {
+                        if let Ok(mut out) = callback_out.lock() {
+                            if let Err(e) = out.send(&message) {
+                                error!("Error forwarding message: {}", e);
+                            }
+                        }
+                    }
+                }
+            },
+            (),
+        )
+        .map_err(connect_error("Input", &in_name))?;
+
+    info!("Arpeggiating {} -> {} at {} BPM (ctrl+c to stop)", in_name, out_name, options.bpm);
+
+    let schedule = ClockSchedule::new(Instant::now(), options.bpm, STEPS_PER_BEAT);
+    let mut step = 0;
+    while !interrupted.load(Ordering::Relaxed) {
+        sleep_until(schedule.deadline(step));
+        step += 1;
+
+        let messages = arp.lock().map(|mut arp| arp.tick()).unwrap_or_default();
+        if let Ok(mut out) = out_conn.lock() {
+            for message in messages {
+                if let Err(e) = out.send(&message) {
+                    error!("Error sending arp note: {}", e);
+                }
+            }
+        }
+    }
+
+    in_conn.close();
+    let release = arp.lock().map(|mut arp| arp.release()).unwrap_or_default();
+    if let Ok(mut out) = out_conn.lock() {
+        for message in release {
+            let _ = out.send(&message);
+        }
+    }
+    Ok(())
+}
+
+/// Clock mode: send Timing Clock to an output at a fixed tempo, framed by Start and Stop
+fn run_clock(options: &cli::ClockArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::clock::{sleep_until, ClockSchedule, CLOCK, START, STOP};
+    use midi::ports::find_output_port;
+    use midir::MidiOutput;
+    use std::sync::atomic::Ordering;
+    use std::time::Instant;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_out = MidiOutput::new("mc-clock")?;
+    let out_port = find_output_port(&midi_out, &options.output, options.match_mode)?;
+    let port_name = midi_out.port_name(&out_port)?;
+    let mut out = midi_out
+        .connect(&out_port, "mc-clock-out")
+        .map_err(connect_error("Output", &port_name))?;
+
+    info!(
+        "Sending clock at {} BPM ({} PPQN) to {} (ctrl+c to stop)",
+        options.bpm, options.ppqn, port_name
+    );
+
+    if options.send_start {
+        out.send(&[START])?;
+    }
+
+    let schedule = ClockSchedule::new(Instant::now(), options.bpm, options.ppqn);
+    let mut tick = 0;
+    while !interrupted.load(Ordering::Relaxed) {
+        sleep_until(schedule.deadline(tick));
+        if let Err(e) = out.send(&[CLOCK]) {
+            error!("Failed to send clock: {}", e);
+        }
+        tick += 1;
+    }
+
+    if options.send_stop {
+        out.send(&[STOP])?;
+    }
+
+    Ok(())
+}
+
+/// How often `mc tempo` prints the current estimate
+const TEMPO_REPORT_INTERVAL: Duration = Duration::from_millis(500);
+
+/// Tempo mode: print the BPM and jitter implied by an input's Timing Clock
+fn run_tempo(options: &cli::TempoArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::clock::TempoTracker;
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midir::MidiInput;
+    use std::sync::atomic::Ordering;
+    use std::sync::{Arc, Mutex};
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-tempo")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    let tracker = Arc::new(Mutex::new(TempoTracker::new(options.ppqn)));
+    let callback_tracker = Arc::clone(&tracker);
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-tempo-in",
+        move |timestamp, bytes, _| {
+            if let Ok(mut tracker) = callback_tracker.lock() {
+                for message in parser.push(bytes) {
+                    tracker.push(timestamp, &message);
+                }
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!("Listening for clock on {} (ctrl+c to stop)", port_name);
+
+    let mut waiting = false;
+    while !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(TEMPO_REPORT_INTERVAL);
+        let estimate = tracker.lock().ok().and_then(|tracker| tracker.estimate());
+        match estimate {
+            Some(estimate) => {
+                waiting = false;
+                println!(
+                    "{:>7.2} BPM  jitter {:.3} ms  ({} clocks)",
+                    estimate.bpm,
+                    estimate.jitter_us / 1000.0,
+                    estimate.samples
+                );
+            }
+            // Say so once rather than every interval
+            None if !waiting => {
+                waiting = true;
+                println!("Waiting for clock...");
+            }
+            None => {}
+        }
+    }
+
+    in_conn.close();
+
+    Ok(())
+}
+
+/// A status line redrawn in place on a terminal, or printed each time it changes when
+/// output is piped, for `mc mtc` and `mc spp`
+struct LiveLine {
+    live: bool,
+    shown: String,
+}
+
+impl LiveLine {
+    fn new() -> Self {
+        use std::io::IsTerminal;
+        Self {
+            live: std::io::stdout().is_terminal(),
+            shown: String::new(),
+        }
+    }
+
+    fn show(&mut self, line: String) -> std::io::Result<()> {
+        use std::io::Write;
+        if line == self.shown {
+            return Ok(());
+        }
+        if self.live {
+            // Pad over the rest of a longer previous line
+            print!("\r{:<width$}", line, width = self.shown.len());
+            std::io::stdout().flush()?;
+        } else {
+            println!("{}", line);
+        }
+        self.shown = line;
+        Ok(())
+    }
+
+    /// Ends a line left open on the terminal
+    fn finish(&self) {
+        if self.live && !self.shown.is_empty() {
+            println!();
+        }
+    }
+}
+
+/// How often `mc mtc` and `mc spp` redraw
+const LIVE_LINE_INTERVAL: Duration = Duration::from_millis(40);
+
+/// Quarter Frames arrive about every 10 ms while running; a gap this long means stopped
+const MTC_STOPPED_AFTER: Duration = Duration::from_millis(250);
+
+/// MTC mode: show the time code an input is sending
+/// On a terminal the time is redrawn in place; otherwise each new time is a line
+fn run_mtc(options: &cli::MtcArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::mtc::{Direction, MtcReader, Timecode};
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midir::MidiInput;
+    use std::sync::atomic::Ordering;
+    use std::sync::{Arc, Mutex};
+    use std::time::Instant;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-mtc")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    // The latest time, with its direction and when it arrived
+    let latest: Arc<Mutex<Option<(Timecode, Option<Direction>, Instant)>>> = Arc::new(Mutex::new(None));
+    let callback_latest = Arc::clone(&latest);
+    let mut reader = MtcReader::new();
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-mtc-in",
+        move |_, bytes, _| {
+            for message in parser.push(bytes) {
+                if let Some((timecode, direction)) = reader.push(&message) {
+                    if let Ok(mut latest) = callback_latest.lock() {
+                        *latest = Some((timecode, direction, Instant::now()));
+                    }
+                }
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!("Listening for MTC on {} (ctrl+c to stop)", port_name);
+
+    let mut display = LiveLine::new();
+    while !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(LIVE_LINE_INTERVAL);
+        let Some((timecode, direction, at)) = *latest.lock().unwrap() else {
+            continue;
+        };
+        let state = match direction {
+            _ if at.elapsed() >= MTC_STOPPED_AFTER => "stopped",
+            Some(Direction::Forward) => "running",
+            Some(Direction::Reverse) => "reverse",
+            // A Full Frame on its own: the source located and hasn't started
+            None => "located",
+        };
+        display.show(format!("{}  {}  {}", timecode, timecode.rate, state))?;
+    }
+    display.finish();
+
+    in_conn.close();
+
+    Ok(())
+}
+
+/// SPP mode: show where a sequencer's song is, from its pointers and clock
+/// The position advances with the clock between pointers, so it runs while playing
+fn run_spp(options: &cli::SppArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midi::spp::SongPosition;
+    use midir::MidiInput;
+    use std::sync::atomic::Ordering;
+    use std::sync::{Arc, Mutex};
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-spp")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    // None until a pointer, transport or clock message says anything
+    let position: Arc<Mutex<Option<SongPosition>>> = Arc::new(Mutex::new(None));
+    let callback_position = Arc::clone(&position);
+    let mut tracker = SongPosition::new();
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-spp-in",
+        move |_, bytes, _| {
+            for message in parser.push(bytes) {
+                if tracker.observe(&message) {
+                    if let Ok(mut position) = callback_position.lock() {
+                        *position = Some(tracker.clone());
+                    }
+                }
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!(
+        "Listening for song position on {} in {} (ctrl+c to stop)",
+        port_name, options.time_signature
+    );
+
+    let mut display = LiveLine::new();
+    while !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(LIVE_LINE_INTERVAL);
+        let Some(position) = position.lock().unwrap().clone() else {
+            continue;
+        };
+        let sixteenths = position.sixteenths();
+        display.show(format!(
+            "{}  (SPP {})  {}",
+            options.time_signature.bar_position(sixteenths),
+            sixteenths,
+            if position.running() { "running" } else { "stopped" }
+        ))?;
+    }
+    display.finish();
+
+    in_conn.close();
+
+    Ok(())
+}
+
+/// Trigger mode: run a shell command whenever a matching message arrives
+/// Commands run on their own threads, so a slow one doesn't hold up the callback
+fn run_trigger(options: &cli::TriggerArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midi::trigger::{spawn, Trigger};
+    use midir::MidiInput;
+    use std::time::Instant;
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-trigger")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    let mut triggers: Vec<Trigger> = options
+        .triggers
+        .iter()
+        .map(|(event, command)| Trigger::new(*event, command, options.debounce))
+        .collect();
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-trigger-in",
+        move |_, bytes, _| {
+            let now = Instant::now();
+            for message in parser.push(bytes) {
+                for trigger in triggers.iter_mut() {
+                    if trigger.fires(&message, now) {
+                        debug!("{} matched {}", trigger.event, midi::decode::hex_bytes(&message));
+                        spawn(&trigger.command);
+                    }
+                }
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!(
+        "Watching {} for {} trigger(s) (ctrl+c to stop)",
+        port_name,
+        options.triggers.len()
+    );
+    signal::wait_for_interrupt(&interrupted);
+
+    in_conn.close();
+
+    Ok(())
+}
+
+/// Name of the virtual port `mc bench` measures when not given a loopback
+const BENCH_PORT: &str = "mc-bench";
+
+/// How long `mc bench` waits for the last probes to come back
+const BENCH_DRAIN: Duration = Duration::from_millis(500);
+
+/// Bench mode: send probes out through a port and time them coming back
+/// Without `--to`/`--from` the path is a virtual input of our own, so the numbers are the
+/// driver's cost for one hop through a virtual port, as with `mc port`
+fn run_bench(options: &cli::BenchArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::bench::{probe, LatencySummary, Probes, PROBE_IDS};
+    use midi::clock::sleep_until;
+    use midi::parser::MessageParser;
+    use midi::ports::{find_input_port, find_output_port, PortMatch};
+    use midir::{MidiInput, MidiOutput};
+    use std::sync::atomic::Ordering;
+    use std::sync::{Arc, Mutex};
+    use std::time::Instant;
+
+    let interrupted = signal::interrupt_flag()?;
+    let probes = Arc::new(Mutex::new(Probes::new()));
+    let samples = Arc::new(Mutex::new(Vec::new()));
+    let receiver = || {
+        let probes = Arc::clone(&probes);
+        let samples = Arc::clone(&samples);
+        let mut parser = MessageParser::new();
+        move |_timestamp: u64, bytes: &[u8], _: &mut ()| {
+            let at = Instant::now();
+            for message in parser.push(bytes) {
+                if let Some(round_trip) = probes.lock().ok().and_then(|mut p| p.receive(&message, at)) {
+                    if let Ok(mut samples) = samples.lock() {
+                        samples.push(round_trip.as_micros() as u64);
+                    }
+                }
+            }
+        }
+    };
+
+    let midi_out = MidiOutput::new("mc-bench")?;
+    let (in_conn, out_port, path) = match &options.through {
+        Some((to, from)) => {
+            let midi_in = MidiInput::new("mc-bench")?;
+            let in_port = find_input_port(&midi_in, from, options.match_mode)?;
+            let in_name = midi_in.port_name(&in_port)?;
+            let in_conn = midi_in
+                .connect(&in_port, "mc-bench-in", receiver(), ())
+                .map_err(connect_error("Input", &in_name))?;
+            let out_port = find_output_port(&midi_out, to, options.match_mode)?;
+            let path = format!("{} -> {}", midi_out.port_name(&out_port)?, in_name);
+            (in_conn, out_port, path)
+        }
+        None => {
+            let in_conn = bench_virtual_input(receiver())?;
+            let out_port = find_output_port(&midi_out, BENCH_PORT, PortMatch::Substring)?;
+            (in_conn, out_port, format!("virtual port {}", BENCH_PORT))
+        }
+    };
+    let out_name = midi_out.port_name(&out_port)?;
+    let mut out_conn = midi_out
+        .connect(&out_port, "mc-bench-out")
+        .map_err(connect_error("Output", &out_name))?;
+
+    info!(
+        "Sending {} probes/s through {} for {} ms (ctrl+c stops early)",
+        options.rate,
+        path,
+        options.duration.as_millis()
+    );
+    let interval = Duration::from_secs(1) / options.rate;
+    let start = Instant::now();
+    let mut due = start;
+    let mut sent = 0u64;
+    while !interrupted.load(Ordering::Relaxed) && due - start < options.duration {
+        sleep_until(due);
+        let id = (sent % PROBE_IDS as u64) as u16;
+        // Noted before sending, so a fast loopback can't answer first
+        if let Ok(mut probes) = probes.lock() {
+            probes.send(id, Instant::now());
+        }
+        if let Err(e) = out_conn.send(&probe(id)) {
+            error!("Error sending probe to {}: {}", out_name, e);
+        }
+        sent += 1;
+        due += interval;
+    }
+    if !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(BENCH_DRAIN);
+    }
+    in_conn.close();
+    out_conn.close();
+
+    let samples = samples.lock().map(|s| s.clone()).unwrap_or_default();
+    println!("Sent {}, received {} ({} lost)", sent, samples.len(), sent.saturating_sub(samples.len() as u64));
+    match LatencySummary::from_samples(samples) {
+        Some(summary) => println!("{}", summary),
+        None => return Err(format!("No probes came back through {}; is the input connected to the output?", path).into()),
+    }
+    Ok(())
+}
+
+#[cfg(unix)]
+fn bench_virtual_input(
+    callback: impl FnMut(u64, &[u8], &mut ()) + Send + 'static,
+) -> Result<midir::MidiInputConnection<()>, Box<dyn std::error::Error>> {
+    use midir::os::unix::VirtualInput;
+    midir::MidiInput::new("mc-bench")?
+        .create_virtual(BENCH_PORT, callback, ())
+        .map_err(|e| {
+            format!("Failed to create virtual input '{}': {}{}", BENCH_PORT, e, midi::ports::virtual_port_hint()).into()
+        })
+}
+
+#[cfg(not(unix))]
+fn bench_virtual_input(
+    _callback: impl FnMut(u64, &[u8], &mut ()) + Send + 'static,
+) -> Result<midir::MidiInputConnection<()>, Box<dyn std::error::Error>> {
+    Err(midi::ports::VIRTUAL_PORTS_UNSUPPORTED.into())
+}
+
+/// Merge mode: forward every message from several inputs to one output
+/// Each input has its own callback and parser, which knows its input's name and place in
+/// the list; sends are serialized through a shared lock
+fn run_merge(options: &cli::MergeArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::decode::decode;
+    use midi::parser::MessageParser;
+    use midi::ports::{find_input_port, find_output_port};
+    use midi::transform::Transform;
+    use midi::validation::is_valid_midi_message;
+    use midir::{MidiInput, MidiOutput};
+    use std::sync::{Arc, Mutex};
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_out = MidiOutput::new("mc-merge")?;
+    let out_port = find_output_port(&midi_out, &options.output, options.match_mode)?;
+    let out_name = midi_out.port_name(&out_port)?;
+    let out_conn = midi_out
+        .connect(&out_port, "mc-merge-out")
+        .map_err(connect_error("Output", &out_name))?;
+    let out_conn = Arc::new(Mutex::new(out_conn));
+
+    let mut in_conns = Vec::new();
+    for (idx, input) in options.inputs.iter().enumerate() {
+        // midir consumes the client on connect, so each input needs its own
+        let midi_in = MidiInput::new("mc-merge")?;
+        let in_port = find_input_port(&midi_in, input, options.match_mode)?;
+        let in_name = midi_in.port_name(&in_port)?;
+
+        // --channel-per-input: every channel of input N goes to channel N
+        let channel = options.channel_per_input.then_some(idx as u8);
+        let transform = Transform::new().with_channel_map(channel.map(|ch| [ch; 16]));
+        let source = in_name.clone();
+        let out_conn = Arc::clone(&out_conn);
+        let mut parser = MessageParser::new();
+        let in_conn = midi_in.connect(
+            &in_port,
+            "mc-merge-in",
+            move |_timestamp, bytes, _| {
+                for message in parser.push(bytes) {
+                    if !is_valid_midi_message(&message) {
+                        continue;
+                    }
+                    let Some(message) = transform.apply(&message) else {
+                        continue;
+                    };
+                    debug!("{}: {}", source, decode(&message));
+                    if let Ok(mut out) = out_conn.lock() {
+                        if let Err(e) = out.send(&message) {
+                            error!("Error forwarding message: {}", e);
+                        }
+                    }
+                }
+            },
+            (),
+        )
+        .map_err(connect_error("Input", &in_name))?;
+
+        match channel {
+            Some(ch) => info!("Merging {} -> {} (channel {})", in_name, out_name, ch + 1),
+            None => info!("Merging {} -> {}", in_name, out_name),
+        }
+        in_conns.push(in_conn);
+    }
+
+    signal::wait_for_interrupt(&interrupted);
+    for in_conn in in_conns {
+        in_conn.close();
+    }
+
+    Ok(())
+}
+
+/// Split mode: copy every message from one input to several outputs
+/// With `--channel-split`, channel messages on channel N only go to the Nth output
+/// (and are dropped if there is no such output); system messages go to every output
+fn run_split(options: &cli::SplitArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::parser::MessageParser;
+    use midi::ports::{find_input_port, find_output_port};
+    use midi::validation::is_valid_midi_message;
+    use midir::{MidiInput, MidiOutput};
+
+    if !options.zones.is_empty() {
+        return split_zones(options);
+    }
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-split")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let in_name = midi_in.port_name(&in_port)?;
+
+    let mut outputs = Vec::new();
+    for output in &options.outputs {
+        // midir consumes the client on connect, so each output needs its own
+        let midi_out = MidiOutput::new("mc-split")?;
+        let out_port = find_output_port(&midi_out, output, options.match_mode)?;
+        let out_name = midi_out.port_name(&out_port)?;
+        let out_conn = midi_out
+            .connect(&out_port, "mc-split-out")
+            .map_err(connect_error("Output", &out_name))?;
+        info!("Splitting {} -> {}", in_name, out_name);
+        outputs.push((out_name, out_conn));
+    }
+
+    let channel_split = options.channel_split;
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-split-in",
+        move |_timestamp, bytes, _| {
+            for message in parser.push(bytes) {
+                if !is_valid_midi_message(&message) {
+                    continue;
+                }
+
+                let target = if channel_split && message[0] < 0xF0 {
+                    Some((message[0] & 0x0F) as usize)
+                } else {
+                    None
+                };
+
+                for (idx, (name, out)) in outputs.iter_mut().enumerate() {
+                    if target.is_some_and(|channel| channel != idx) {
+                        continue;
+                    }
+                    // An error on one output shouldn't stop delivery to the rest
+                    if let Err(e) = out.send(&message) {
+                        error!("Error forwarding message to {}: {}", name, e);
+                    }
+                }
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &in_name))?;
+
+    signal::wait_for_interrupt(&interrupted);
+
+    // Closing the input drops the callback, which closes every output it owns
+    in_conn.close();
+
+    Ok(())
+}
+
+/// `mc split --zone`: route notes to outputs by key range
+fn split_zones(options: &cli::SplitArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::parser::MessageParser;
+    use midi::ports::{find_input_port, find_output_port};
+    use midi::validation::is_valid_midi_message;
+    use midi::zones::ZoneRouter;
+    use midir::{MidiInput, MidiOutput};
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-split")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let in_name = midi_in.port_name(&in_port)?;
+
+    let mut router = ZoneRouter::new(&options.zones, options.default_output.as_deref());
+    let mut outputs = Vec::new();
+    for output in router.outputs() {
+        let midi_out = MidiOutput::new("mc-split")?;
+        let out_port = find_output_port(&midi_out, output, options.match_mode)?;
+        let out_name = midi_out.port_name(&out_port)?;
+        let out_conn = midi_out
+            .connect(&out_port, "mc-split-out")
+            .map_err(connect_error("Output", &out_name))?;
+        outputs.push((out_name, out_conn));
+    }
+    // Logged with the names the ports resolved to
+    let port_name = |given: &str| match router.outputs().iter().position(|output| output == given) {
+        Some(idx) => outputs[idx].0.clone(),
+        None => given.to_string(),
+    };
+    for zone in &options.zones {
+        let transpose = match zone.transpose {
+            0 => String::new(),
+            semitones => format!(" (transpose {:+})", semitones),
+        };
+        info!("Splitting {} {} -> {}{}", in_name, zone.range(), port_name(&zone.output), transpose);
+    }
+    if let Some(default_output) = &options.default_output {
+        info!("Sending everything but notes to {}", port_name(default_output));
+    }
+
+    let mut parser = MessageParser::new();
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-split-in",
+        move |_timestamp, bytes, _| {
+            for message in parser.push(bytes) {
+                if !is_valid_midi_message(&message) {
+                    continue;
+                }
+                for (idx, routed) in router.route(&message) {
+                    let (name, out) = &mut outputs[idx];
+                    // An error on one output shouldn't stop delivery to the rest
+                    if let Err(e) = out.send(&routed) {
+                        error!("Error forwarding message to {}: {}", name, e);
+                    }
+                }
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &in_name))?;
+
+    signal::wait_for_interrupt(&interrupted);
+    in_conn.close();
+
+    Ok(())
+}
+
+/// Record mode: capture messages from an input and write them as a type-0 SMF
+/// Recording stops on Ctrl+C, after which the file is written with an end-of-track event
+fn run_record(options: &cli::RecordArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::eventlog::RecordFormat;
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midi::smf::{bpm_to_tempo, write_type0, TimedMessage, DEFAULT_DIVISION};
+    use midi::timeline::Timeline;
+    use midir::MidiInput;
+    use std::sync::{Arc, Mutex};
+    use std::time::Instant;
+
+    if options.format != RecordFormat::Smf {
+        return record_events(options);
+    }
+
+    // Register before connecting so an early Ctrl+C still writes the file
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-rec")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    let recorded: Arc<Mutex<Vec<TimedMessage>>> = Arc::new(Mutex::new(Vec::new()));
+    let recorded_clone = Arc::clone(&recorded);
+    let mut parser = MessageParser::new();
+    let mut timeline = Timeline::new(options.timestamps);
+
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-rec-in",
+        move |timestamp, bytes, _| {
+            // Time is measured from the first message so the file has no leading silence
+            let time_us = timeline.elapsed_us(timestamp, Instant::now());
+            if let Ok(mut recorded) = recorded_clone.lock() {
+                for message in parser.push(bytes) {
+                    recorded.push(TimedMessage {
+                        time_us,
+                        bytes: message,
+                    });
+                }
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!("Recording {} to {} (ctrl+c to stop)", port_name, options.file);
+    signal::wait_for_interrupt(&interrupted);
+    in_conn.close();
+
+    let recorded = recorded.lock().map_err(|_| "Recording buffer poisoned")?;
+    let mut file = std::io::BufWriter::new(std::fs::File::create(&options.file)?);
+    write_type0(&mut file, &recorded, DEFAULT_DIVISION, bpm_to_tempo(options.bpm))?;
+
+    info!("Wrote {} messages to {}", recorded.len(), options.file);
+    Ok(())
+}
+
+/// `mc rec --format csv|json`: write each message as it arrives
+/// Lines are buffered and flushed every `FLUSH_INTERVAL`, so a crash loses at most that
+/// much of the recording
+fn record_events(options: &cli::RecordArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::eventlog::{event_line, RecordFormat, CSV_HEADER};
+    use midi::parser::MessageParser;
+    use midi::ports::find_input_port;
+    use midi::timeline::Timeline;
+    use midir::MidiInput;
+    use std::io::Write;
+    use std::sync::atomic::{AtomicU64, Ordering};
+    use std::sync::{Arc, Mutex};
+    use std::time::Instant;
+
+    const FLUSH_INTERVAL: Duration = Duration::from_secs(1);
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_in = MidiInput::new("mc-rec")?;
+    let in_port = find_input_port(&midi_in, &options.input, options.match_mode)?;
+    let port_name = midi_in.port_name(&in_port)?;
+
+    let mut file = io::BufWriter::new(std::fs::File::create(&options.file)?);
+    if options.format == RecordFormat::Csv {
+        writeln!(file, "{}", CSV_HEADER)?;
+    }
+    let file = Arc::new(Mutex::new(file));
+    let callback_file = Arc::clone(&file);
+    let format = options.format;
+    let mut parser = MessageParser::new();
+    let mut timeline = Timeline::new(options.timestamps);
+    let count = Arc::new(AtomicU64::new(0));
+    let callback_count = Arc::clone(&count);
+    let mut failed = false;
+
+    let in_conn = midi_in.connect(
+        &in_port,
+        "mc-rec-in",
+        move |timestamp, bytes, _| {
+            let time = timeline.elapsed_us(timestamp, Instant::now()) as f64 / 1_000_000.0;
+            let Ok(mut file) = callback_file.lock() else {
+                return;
+            };
+            let mut result = Ok(());
+            for message in parser.push(bytes) {
+                if let Some(line) = event_line(format, time, &message) {
+                    result = result.and_then(|_| writeln!(file, "{}", line));
+                    callback_count.fetch_add(1, Ordering::Relaxed);
+                }
+            }
+            // Report the first failure only (e.g. the disk filled up), not every message
+            if let Err(e) = result {
+                if !failed {
+                    error!("Error writing recording: {}", e);
+                }
+                failed = true;
+            }
+        },
+        (),
+    )
+    .map_err(connect_error("Input", &port_name))?;
+
+    info!("Recording {} to {} (ctrl+c to stop)", port_name, options.file);
+    let mut flushed_at = Instant::now();
+    while !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(Duration::from_millis(50));
+        if flushed_at.elapsed() >= FLUSH_INTERVAL {
+            if let Ok(mut file) = file.lock() {
+                if let Err(e) = file.flush() {
+                    error!("Error writing recording: {}", e);
+                }
+            }
+            flushed_at = Instant::now();
+        }
+    }
+    in_conn.close();
+
+    file.lock().map_err(|_| "Recording file poisoned")?.flush()?;
+    info!("Wrote {} messages to {}", count.load(Ordering::Relaxed), options.file);
+    Ok(())
+}
+
+/// Play mode: send the messages of an SMF (or an `mc rec --format` recording) to an
+/// output with their original timing, scaled by `--speed`
+/// On Ctrl+C, All Notes Off is sent on every channel that still has notes sounding
+fn run_play(options: &cli::PlayArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::eventlog::{read_events, RecordFormat};
+    use midi::notes::ActiveNotes;
+    use midi::ports::find_output_port;
+    use midi::smf::read_smf;
+    use midir::MidiOutput;
+    use std::sync::atomic::Ordering;
+    use std::time::Instant;
+
+    let messages = match options.format {
+        RecordFormat::Smf => {
+            let data = std::fs::read(&options.file)?;
+            read_smf(&data).map_err(|e| format!("{}: {}", options.file, e))?
+        }
+        format => {
+            let text = std::fs::read_to_string(&options.file)?;
+            let (messages, skipped) = read_events(&text, format);
+            for warning in &skipped {
+                error!("{}: skipping {}", options.file, warning);
+            }
+            messages
+        }
+    };
+    if messages.is_empty() {
+        return Err(format!("{} contains no MIDI messages", options.file).into());
+    }
+
+    let interrupted = signal::interrupt_flag()?;
+
+    let midi_out = MidiOutput::new("mc-play")?;
+    let out_port = find_output_port(&midi_out, &options.output, options.match_mode)?;
+    let port_name = midi_out.port_name(&out_port)?;
+    let mut out = midi_out
+        .connect(&out_port, "mc-play-out")
+        .map_err(connect_error("Output", &port_name))?;
+
+    info!("Playing {} to {} (ctrl+c to stop)", options.file, port_name);
+
+    let mut active_notes = ActiveNotes::new();
+
+    'playback: loop {
+        let start = Instant::now();
+        for message in &messages {
+            let due = Duration::from_secs_f64(message.time_us as f64 / 1_000_000.0 / options.speed);
+            // Sleep in short steps so Ctrl+C is handled promptly during long rests
+            loop {
+                if interrupted.load(Ordering::Relaxed) {
+                    break 'playback;
+                }
+                let elapsed = start.elapsed();
+                if elapsed >= due {
+                    break;
+                }
+                std::thread::sleep((due - elapsed).min(Duration::from_millis(20)));
+            }
+
+            if let Err(e) = out.send(&message.bytes) {
+                error!("Failed to send message: {}", e);
+                continue;
+            }
+            active_notes.track(&message.bytes);
+        }
+
+        if !options.loop_playback {
+            break;
+        }
+    }
+
+    for message in active_notes.all_notes_off() {
+        let _ = out.send(&message);
+    }
+
+    Ok(())
+}
+
+/// CLI mode: list all MIDI ports and exit
+/// This creates a fresh MIDI context that sees current system state
+fn list_ports_and_exit() -> Result<(), Box<dyn std::error::Error>> {
+    use midi::MidiManager;
+
+    let inputs = MidiManager::list_input_ports();
+    let outputs = MidiManager::list_output_ports();
+
+    // Print in JSON format for easy parsing
+    println!("{{");
+    println!("  \"inputs\": [");
+    for (i, port) in inputs.iter().enumerate() {
+        let comma = if i < inputs.len() - 1 { "," } else { "" };
+        println!("    \"{}\"{}",port.name, comma);
+    }
+    println!("  ],");
+    println!("  \"outputs\": [");
+    for (i, port) in outputs.iter().enumerate() {
+        let comma = if i < outputs.len() - 1 { "," } else { "" };
+        println!("    \"{}\"{}",port.name, comma);
+    }
+    println!("  ]");
+    println!("}}");
+
+    Ok(())
+}
+
+/// List mode: print MIDI ports in driver order with their indices
+/// Pretty output by default, or a JSON object with `--json` for scripting
+fn list_ports(options: &cli::ListArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::ports::{input_ports, json_escape, output_ports, PortEntry};
+
+    if options.drivers {
+        return list_drivers(options);
+    }
+
+    // Enumeration errors are returned so the process exits nonzero
+    let inputs = input_ports()?;
+    let outputs = output_ports()?;
+
+    if options.json {
+        let format_ports = |entries: &[PortEntry]| -> String {
+            entries
+                .iter()
+                .enumerate()
+                .map(|(i, entry)| {
+                    let id = if options.verbose {
+                        format!(",\"id\":\"{}\"", json_escape(&entry.id))
+                    } else {
+                        String::new()
+                    };
+                    format!("{{\"index\":{},\"name\":\"{}\"{}}}", i, json_escape(&entry.name), id)
+                })
+                .collect::<Vec<_>>()
+                .join(",")
+        };
+        println!(
+            "{{\"inputs\":[{}],\"outputs\":[{}]}}",
+            format_ports(&inputs),
+            format_ports(&outputs)
+        );
+    } else {
+        let print_ports = |entries: &[PortEntry]| {
+            for (i, entry) in entries.iter().enumerate() {
+                if options.verbose {
+                    println!("  {}: {}  (id:{})", i, entry.name, entry.id);
+                } else {
+                    println!("  {}: {}", i, entry.name);
+                }
+            }
+        };
+        println!("Inputs:");
+        print_ports(&inputs);
+        println!("Outputs:");
+        print_ports(&outputs);
+    }
+
+    if options.watch {
+        let names = |entries: Vec<PortEntry>| entries.into_iter().map(|entry| entry.name).collect();
+        watch_ports(names(inputs), names(outputs), options)?;
+    }
+
+    Ok(())
+}
+
+/// `list --drivers`: the MIDI driver compiled in, and whether it can create virtual ports
+/// midir picks its backend at build time, so there is only ever one
+fn list_drivers(options: &cli::ListArgs) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::ports::{driver_has_virtual_ports, driver_name};
+
+    // Opening a client shows whether the driver actually works on this machine
+    let available = midir::MidiInput::new("mc-list").is_ok();
+    if options.json {
+        println!(
+            "{{\"drivers\":[{{\"name\":\"{}\",\"available\":{},\"virtual_ports\":{}}}]}}",
+            driver_name(),
+            available,
+            driver_has_virtual_ports()
+        );
+    } else {
+        let virtual_ports = if driver_has_virtual_ports() { ", virtual ports" } else { "" };
+        let status = if available { "available" } else { "unavailable" };
+        println!("Drivers:");
+        println!("  {} ({}{})", driver_name(), status, virtual_ports);
+    }
+    Ok(())
+}
+
+/// `list --watch`: rescan until ctrl+c, printing `+`/`-` lines (or JSON events) for changes
+fn watch_ports(
+    mut inputs: Vec<String>,
+    mut outputs: Vec<String>,
+    options: &cli::ListArgs,
+) -> Result<(), Box<dyn std::error::Error>> {
+    use midi::ports::{input_port_names, json_escape, output_port_names, port_changes};
+    use std::sync::atomic::Ordering;
+
+    let interrupted = signal::interrupt_flag()?;
+    info!("Watching for port changes (ctrl+c to stop)");
+
+    let report = |kind: &str, added: Vec<String>, removed: Vec<String>| {
+        let changes = added.into_iter().map(|n| ("added", '+', n));
+        for (event, sign, name) in changes.chain(removed.into_iter().map(|n| ("removed", '-', n))) {
+            if options.json {
+                println!(
+                    "{{\"event\":\"{}\",\"kind\":\"{}\",\"name\":\"{}\"}}",
+                    event,
+                    kind,
+                    json_escape(&name)
+                );
+            } else {
+                println!("{} {}: {}", sign, kind, name);
+            }
+        }
+    };
+
+    while !interrupted.load(Ordering::Relaxed) {
+        std::thread::sleep(options.interval);
+
+        // A failed scan (e.g. driver busy mid-hotplug) is retried on the next tick
+        let (Ok(new_inputs), Ok(new_outputs)) = (input_port_names(), output_port_names()) else {
+            continue;
+        };
+        let (added, removed) = port_changes(&inputs, &new_inputs);
+        report("input", added, removed);
+        let (added, removed) = port_changes(&outputs, &new_outputs);
+        report("output", added, removed);
+
+        inputs = new_inputs;
+        outputs = new_outputs;
     }
-    println!("  ]");
-    println!("}}");
 
     Ok(())
 }
@@ -0,0 +1,200 @@
+/// Arpeggiator for `mc arp`: held notes are played one at a time on each step
+use super::humanize::Rng;
+
+/// Order in which held notes are stepped through
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Pattern {
+    Up,
+    Down,
+    /// Up then down, without repeating the top and bottom notes
+    UpDown,
+    Random,
+}
+
+impl std::str::FromStr for Pattern {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "up" => Ok(Pattern::Up),
+            "down" => Ok(Pattern::Down),
+            "updown" => Ok(Pattern::UpDown),
+            "random" => Ok(Pattern::Random),
+            _ => Err(format!("Unknown pattern '{}' (expected up, down, updown or random)", s)),
+        }
+    }
+}
+
+/// Steps through the held notes; the caller decides when each step happens
+#[derive(Debug, Clone)]
+pub struct Arpeggiator {
+    pattern: Pattern,
+    octaves: u8,
+    /// Held notes and their velocities, in ascending note order
+    held: Vec<(u8, u8)>,
+    /// Channel of the most recent Note On, 0-based
+    channel: u8,
+    step: usize,
+    /// Note currently sounding, as (channel, note)
+    sounding: Option<(u8, u8)>,
+    rng: Rng,
+}
+
+impl Arpeggiator {
+    pub fn new(pattern: Pattern, octaves: u8, seed: u64) -> Self {
+        Self {
+            pattern,
+            octaves: octaves.max(1),
+            held: Vec::new(),
+            channel: 0,
+            step: 0,
+            sounding: None,
+            rng: Rng::new(seed),
+        }
+    }
+
+    /// Takes a note message from the input
+    /// Returns false for anything else, which the caller passes through
+    pub fn input(&mut self, msg: &[u8]) -> bool {
+        let [status, note, velocity] = *msg else {
+            return false;
+        };
+        match status & 0xF0 {
+            0x90 if velocity > 0 => {
+                self.channel = status & 0x0F;
+                if let Err(i) = self.held.binary_search_by_key(&note, |&(n, _)| n) {
+                    self.held.insert(i, (note, velocity));
+                }
+                true
+            }
+            0x80 | 0x90 => {
+                self.held.retain(|&(n, _)| n != note);
+                true
+            }
+            _ => false,
+        }
+    }
+
+    /// Advances one step: releases the previous note and plays the next one
+    /// Once every key is released this only releases, and the pattern starts over
+    pub fn tick(&mut self) -> Vec<Vec<u8>> {
+        let mut messages = self.release();
+
+        let sequence = self.sequence();
+        if sequence.is_empty() {
+            self.step = 0;
+            return messages;
+        }
+
+        let len = sequence.len();
+        let index = match self.pattern {
+            Pattern::Up => self.step % len,
+            Pattern::Down => len - 1 - self.step % len,
+            Pattern::UpDown if len > 1 => {
+                let position = self.step % (2 * len - 2);
+                if position < len {
+                    position
+                } else {
+                    2 * len - 2 - position
+                }
+            }
+            Pattern::UpDown => 0,
+            Pattern::Random => self.rng.below_or_equal(len as u64 - 1) as usize,
+        };
+        self.step = self.step.wrapping_add(1);
+
+        let (note, velocity) = sequence[index];
+        messages.push(vec![0x90 | self.channel, note, velocity]);
+        self.sounding = Some((self.channel, note));
+        messages
+    }
+
+    /// A Note Off for the sounding note, if any (also used on shutdown)
+    pub fn release(&mut self) -> Vec<Vec<u8>> {
+        match self.sounding.take() {
+            Some((channel, note)) => vec![vec![0x80 | channel, note, 0]],
+            None => Vec::new(),
+        }
+    }
+
+    /// Held notes repeated over the octave range, lowest first
+    fn sequence(&self) -> Vec<(u8, u8)> {
+        (0..self.octaves)
+            .flat_map(|octave| {
+                self.held
+                    .iter()
+                    .filter_map(move |&(note, velocity)| {
+                        let note = note as u16 + 12 * octave as u16;
+                        (note <= 127).then_some((note as u8, velocity))
+                    })
+            })
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Notes played over `steps` ticks
+    fn played(arp: &mut Arpeggiator, steps: usize) -> Vec<u8> {
+        (0..steps)
+            .filter_map(|_| arp.tick().into_iter().find(|m| m[0] & 0xF0 == 0x90).map(|m| m[1]))
+            .collect()
+    }
+
+    fn hold(arp: &mut Arpeggiator, notes: &[u8]) {
+        for &note in notes {
+            assert!(arp.input(&[0x90, note, 100]));
+        }
+    }
+
+    #[test]
+    fn test_patterns() {
+        let mut up = Arpeggiator::new(Pattern::Up, 1, 0);
+        hold(&mut up, &[64, 60, 67]);
+        assert_eq!(played(&mut up, 4), vec![60, 64, 67, 60]);
+
+        let mut down = Arpeggiator::new(Pattern::Down, 1, 0);
+        hold(&mut down, &[60, 64, 67]);
+        assert_eq!(played(&mut down, 4), vec![67, 64, 60, 67]);
+
+        let mut updown = Arpeggiator::new(Pattern::UpDown, 1, 0);
+        hold(&mut updown, &[60, 64, 67]);
+        assert_eq!(played(&mut updown, 6), vec![60, 64, 67, 64, 60, 64]);
+
+        let mut random = Arpeggiator::new(Pattern::Random, 1, 1);
+        hold(&mut random, &[60, 64, 67]);
+        assert!(played(&mut random, 20).iter().all(|n| [60, 64, 67].contains(n)));
+    }
+
+    #[test]
+    fn test_octaves() {
+        let mut arp = Arpeggiator::new(Pattern::Up, 2, 0);
+        hold(&mut arp, &[60, 64]);
+        assert_eq!(played(&mut arp, 4), vec![60, 64, 72, 76]);
+
+        // Notes pushed past 127 are skipped
+        let mut high = Arpeggiator::new(Pattern::Up, 2, 0);
+        hold(&mut high, &[120]);
+        assert_eq!(played(&mut high, 2), vec![120, 120]);
+    }
+
+    #[test]
+    fn test_release_stops_and_note_offs() {
+        let mut arp = Arpeggiator::new(Pattern::Up, 1, 0);
+        assert!(arp.tick().is_empty());
+
+        arp.input(&[0x92, 60, 90]);
+        assert_eq!(arp.tick(), vec![vec![0x92, 60, 90]]);
+
+        // Releasing every key sends the last Note Off, then nothing
+        assert!(arp.input(&[0x82, 60, 0]));
+        assert_eq!(arp.tick(), vec![vec![0x82, 60, 0]]);
+        assert!(arp.tick().is_empty());
+
+        // Other messages aren't taken
+        assert!(!arp.input(&[0xB0, 1, 64]));
+        assert!(!arp.input(&[0xF8]));
+    }
+}
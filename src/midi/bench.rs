@@ -0,0 +1,129 @@
+/// Round-trip latency measurement for `mc bench`
+/// Each probe is a Note Off on channel 16 whose note and release velocity carry a 14-bit
+/// id, so it can be matched when it comes back, and it sounds nothing on gear that
+/// happens to be listening. Round trips are summarized as nearest-rank percentiles.
+use std::fmt;
+use std::time::{Duration, Instant};
+
+/// Probe ids before they wrap; a probe this many sends old counts as lost
+pub const PROBE_IDS: usize = 1 << 14;
+
+const PROBE_STATUS: u8 = 0x8F;
+
+pub fn probe(id: u16) -> [u8; 3] {
+    [PROBE_STATUS, (id & 0x7F) as u8, (id >> 7 & 0x7F) as u8]
+}
+
+pub fn probe_id(msg: &[u8]) -> Option<u16> {
+    match *msg {
+        [PROBE_STATUS, low, high] if low < 0x80 && high < 0x80 => Some((high as u16) << 7 | low as u16),
+        _ => None,
+    }
+}
+
+/// When each probe still on its way was sent
+pub struct Probes {
+    sent: Vec<Option<Instant>>,
+}
+
+impl Default for Probes {
+    fn default() -> Self {
+        Self { sent: vec![None; PROBE_IDS] }
+    }
+}
+
+impl Probes {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn send(&mut self, id: u16, at: Instant) {
+        self.sent[id as usize % PROBE_IDS] = Some(at);
+    }
+
+    /// The round trip of a probe arriving back; None for other messages and for a probe
+    /// that already came back
+    pub fn receive(&mut self, msg: &[u8], at: Instant) -> Option<Duration> {
+        let sent = self.sent[probe_id(msg)? as usize].take()?;
+        Some(at.saturating_duration_since(sent))
+    }
+}
+
+/// Round trips in microseconds
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct LatencySummary {
+    pub count: usize,
+    pub min: u64,
+    pub p50: u64,
+    pub p95: u64,
+    pub p99: u64,
+    pub max: u64,
+}
+
+impl LatencySummary {
+    /// None without samples
+    pub fn from_samples(mut samples: Vec<u64>) -> Option<Self> {
+        if samples.is_empty() {
+            return None;
+        }
+        samples.sort_unstable();
+        // Nearest rank: the smallest sample with at least p% of them at or below it
+        let percentile = |p: usize| samples[(samples.len() * p).div_ceil(100).max(1) - 1];
+        Some(Self {
+            count: samples.len(),
+            min: samples[0],
+            p50: percentile(50),
+            p95: percentile(95),
+            p99: percentile(99),
+            max: samples[samples.len() - 1],
+        })
+    }
+}
+
+impl fmt::Display for LatencySummary {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "min {} us, p50 {} us, p95 {} us, p99 {} us, max {} us",
+            self.min, self.p50, self.p95, self.p99, self.max
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_probe_ids() {
+        assert_eq!(probe(0), [0x8F, 0, 0]);
+        assert_eq!(probe(300), [0x8F, 44, 2]);
+        assert_eq!(probe_id(&probe(300)), Some(300));
+        assert_eq!(probe_id(&probe(PROBE_IDS as u16 - 1)), Some(PROBE_IDS as u16 - 1));
+        assert_eq!(probe_id(&[0x80, 44, 2]), None);
+        assert_eq!(probe_id(&[0x8F, 44]), None);
+    }
+
+    #[test]
+    fn test_round_trips() {
+        let start = Instant::now();
+        let mut probes = Probes::new();
+        probes.send(7, start);
+        assert_eq!(probes.receive(&probe(7), start + Duration::from_micros(250)), Some(Duration::from_micros(250)));
+        // A second copy and an unsent probe aren't round trips
+        assert_eq!(probes.receive(&probe(7), start + Duration::from_millis(1)), None);
+        assert_eq!(probes.receive(&probe(8), start), None);
+        assert_eq!(probes.receive(&[0x90, 60, 100], start), None);
+    }
+
+    #[test]
+    fn test_percentiles() {
+        assert_eq!(LatencySummary::from_samples(Vec::new()), None);
+        let summary = LatencySummary::from_samples((1..=100).rev().collect()).unwrap();
+        assert_eq!((summary.min, summary.p50, summary.p95, summary.p99, summary.max), (1, 50, 95, 99, 100));
+        assert_eq!(summary.to_string(), "min 1 us, p50 50 us, p95 95 us, p99 99 us, max 100 us");
+
+        let summary = LatencySummary::from_samples(vec![300]).unwrap();
+        assert_eq!((summary.count, summary.p50, summary.p99), (1, 300, 300));
+    }
+}
@@ -0,0 +1,194 @@
+/// Queue between a pipeline's input callback and its sending thread (`mc fwd --buffer`)
+/// The callback only ever pushes, so a slow output can't hold up the driver's thread;
+/// with a capacity, a full queue drops a message instead of growing without bound.
+use std::collections::VecDeque;
+use std::sync::{Condvar, Mutex};
+
+/// Which message a full `--buffer` drops
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum Overflow {
+    /// Drop the message waiting longest, keeping the most recent input
+    #[default]
+    DropOldest,
+    /// Drop the message that just arrived, keeping what's already queued
+    DropNewest,
+}
+
+impl std::str::FromStr for Overflow {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "oldest" => Ok(Overflow::DropOldest),
+            "newest" => Ok(Overflow::DropNewest),
+            _ => Err(format!("Unknown overflow policy '{}' (expected oldest or newest)", s)),
+        }
+    }
+}
+
+impl std::fmt::Display for Overflow {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            Overflow::DropOldest => "oldest",
+            Overflow::DropNewest => "newest",
+        })
+    }
+}
+
+struct State<T> {
+    items: VecDeque<T>,
+    closed: bool,
+    dropped: u64,
+}
+
+/// FIFO shared by one pushing and one popping thread; unbounded without a capacity
+pub struct SendQueue<T> {
+    state: Mutex<State<T>>,
+    ready: Condvar,
+    capacity: Option<usize>,
+    overflow: Overflow,
+}
+
+impl<T> SendQueue<T> {
+    pub fn new(capacity: Option<usize>, overflow: Overflow) -> Self {
+        Self {
+            state: Mutex::new(State {
+                items: VecDeque::new(),
+                closed: false,
+                dropped: 0,
+            }),
+            ready: Condvar::new(),
+            capacity,
+            overflow,
+        }
+    }
+
+    pub fn capacity(&self) -> Option<usize> {
+        self.capacity
+    }
+
+    pub fn overflow(&self) -> Overflow {
+        self.overflow
+    }
+
+    /// Queues an item; returns false if the queue was full and a message was dropped
+    pub fn push(&self, item: T) -> bool {
+        let Ok(mut state) = self.state.lock() else {
+            return false;
+        };
+        let full = self.capacity.is_some_and(|capacity| state.items.len() >= capacity);
+        if full {
+            state.dropped += 1;
+            match self.overflow {
+                Overflow::DropOldest => {
+                    state.items.pop_front();
+                }
+                Overflow::DropNewest => return false,
+            }
+        }
+        state.items.push_back(item);
+        self.ready.notify_one();
+        !full
+    }
+
+    /// Waits for the next item; None once the queue is closed and empty
+    pub fn pop(&self) -> Option<T> {
+        let mut state = self.state.lock().ok()?;
+        loop {
+            if let Some(item) = state.items.pop_front() {
+                return Some(item);
+            }
+            if state.closed {
+                return None;
+            }
+            state = self.ready.wait(state).ok()?;
+        }
+    }
+
+    /// Lets `pop` return None once what's already queued has been taken
+    pub fn close(&self) {
+        if let Ok(mut state) = self.state.lock() {
+            state.closed = true;
+        }
+        self.ready.notify_all();
+    }
+
+    /// Discards everything queued, returning how many items there were
+    pub fn clear(&self) -> usize {
+        self.state.lock().map(|mut state| std::mem::take(&mut state.items).len()).unwrap_or(0)
+    }
+
+    /// How many messages overflow has dropped so far
+    pub fn dropped(&self) -> u64 {
+        self.state.lock().map(|state| state.dropped).unwrap_or(0)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Arc;
+
+    #[test]
+    fn test_drop_oldest() {
+        let queue = SendQueue::new(Some(2), Overflow::DropOldest);
+        assert!(queue.push(1));
+        assert!(queue.push(2));
+        assert!(!queue.push(3));
+        queue.close();
+        assert_eq!((queue.pop(), queue.pop(), queue.pop()), (Some(2), Some(3), None));
+        assert_eq!(queue.dropped(), 1);
+    }
+
+    #[test]
+    fn test_drop_newest() {
+        let queue = SendQueue::new(Some(2), Overflow::DropNewest);
+        assert!(queue.push(1));
+        assert!(queue.push(2));
+        assert!(!queue.push(3));
+        assert!(!queue.push(4));
+        queue.close();
+        assert_eq!((queue.pop(), queue.pop(), queue.pop()), (Some(1), Some(2), None));
+        assert_eq!(queue.dropped(), 2);
+    }
+
+    #[test]
+    fn test_unbounded() {
+        let queue = SendQueue::new(None, Overflow::default());
+        assert!((0..1000).all(|i| queue.push(i)));
+        assert_eq!(queue.dropped(), 0);
+    }
+
+    #[test]
+    fn test_pop_waits_until_closed() {
+        let queue = Arc::new(SendQueue::new(Some(8), Overflow::DropOldest));
+        let consumer = {
+            let queue = Arc::clone(&queue);
+            std::thread::spawn(move || std::iter::from_fn(|| queue.pop()).collect::<Vec<_>>())
+        };
+        for i in 0..5 {
+            queue.push(i);
+        }
+        queue.close();
+        assert_eq!(consumer.join().unwrap(), vec![0, 1, 2, 3, 4]);
+    }
+
+    #[test]
+    fn test_clear() {
+        let queue = SendQueue::new(None, Overflow::default());
+        queue.push(1);
+        queue.push(2);
+        assert_eq!(queue.clear(), 2);
+        queue.close();
+        assert_eq!(queue.pop(), None);
+        // Overflow drops are counted separately
+        assert_eq!(queue.dropped(), 0);
+    }
+
+    #[test]
+    fn test_parse_overflow() {
+        assert_eq!("oldest".parse(), Ok(Overflow::DropOldest));
+        assert_eq!("newest".parse(), Ok(Overflow::DropNewest));
+        assert!("first".parse::<Overflow>().is_err());
+    }
+}
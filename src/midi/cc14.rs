@@ -0,0 +1,139 @@
+/// Control Change value scaling for `mc fwd --cc-scale`, 14-bit aware with `--combine-14bit`
+/// High-resolution controllers send a value as an MSB controller followed by its LSB
+/// partner (e.g. CC 1 then CC 33). Scaling those halves separately would wrap the fine
+/// value, so paired controllers are scaled as one 14-bit value and split again, always
+/// MSB first. A received MSB resets its LSB to 0, as the MIDI spec has receivers do.
+
+/// Pairs recognised by `--combine-14bit` unless `--cc14-pair` is given: CC 1-31 with
+/// CC 33-63. Bank Select (CC 0/32) is left out so scaling never changes banks.
+pub fn default_pairs() -> Vec<(u8, u8)> {
+    (1..32).map(|msb| (msb, msb + 32)).collect()
+}
+
+/// What a controller number is to the scaler
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Role {
+    /// A 7-bit controller, scaled on its own
+    Single,
+    Msb { lsb: u8 },
+    Lsb { msb: u8 },
+}
+
+#[derive(Debug, Clone)]
+pub struct CcScaler {
+    scale: f32,
+    roles: [Role; 128],
+    /// Last (MSB, LSB) received per channel, indexed by the MSB controller
+    received: [[(u8, u8); 128]; 16],
+    /// Last MSB value sent per channel and MSB controller, so an LSB update only
+    /// repeats the MSB when scaling moved it
+    sent_msb: [[Option<u8>; 128]; 16],
+}
+
+impl CcScaler {
+    /// `pairs` are (MSB, LSB) controllers to scale as 14-bit values; empty scales every
+    /// controller as 7 bits
+    pub fn new(scale: f32, pairs: &[(u8, u8)]) -> Self {
+        let mut roles = [Role::Single; 128];
+        for &(msb, lsb) in pairs {
+            roles[(msb & 0x7F) as usize] = Role::Msb { lsb: lsb & 0x7F };
+            roles[(lsb & 0x7F) as usize] = Role::Lsb { msb: msb & 0x7F };
+        }
+        Self {
+            scale,
+            roles,
+            received: [[(0, 0); 128]; 16],
+            sent_msb: [[None; 128]; 16],
+        }
+    }
+
+    /// Returns the messages to forward in place of `msg`; anything but a Control Change
+    /// passes through unchanged
+    pub fn process(&mut self, msg: &[u8]) -> Vec<Vec<u8>> {
+        let [status, controller, value] = *msg else {
+            return vec![msg.to_vec()];
+        };
+        if status & 0xF0 != 0xB0 {
+            return vec![msg.to_vec()];
+        }
+        let channel = (status & 0x0F) as usize;
+
+        match self.roles[(controller & 0x7F) as usize] {
+            Role::Single => {
+                let scaled = (value as f32 * self.scale).round().clamp(0.0, 127.0) as u8;
+                vec![vec![status, controller, scaled]]
+            }
+            Role::Msb { lsb } => {
+                self.received[channel][controller as usize] = (value, 0);
+                let (msb_value, lsb_value) = self.scaled(channel, controller);
+                self.sent_msb[channel][controller as usize] = Some(msb_value);
+                let mut out = vec![vec![status, controller, msb_value]];
+                if lsb_value != 0 {
+                    out.push(vec![status, lsb, lsb_value]);
+                }
+                out
+            }
+            Role::Lsb { msb } => {
+                self.received[channel][msb as usize].1 = value;
+                let (msb_value, lsb_value) = self.scaled(channel, msb);
+                let mut out = Vec::new();
+                if self.sent_msb[channel][msb as usize] != Some(msb_value) {
+                    self.sent_msb[channel][msb as usize] = Some(msb_value);
+                    out.push(vec![status, msb, msb_value]);
+                }
+                out.push(vec![status, controller, lsb_value]);
+                out
+            }
+        }
+    }
+
+    /// The scaled 14-bit value of a pair, split into (MSB, LSB)
+    fn scaled(&self, channel: usize, msb: u8) -> (u8, u8) {
+        let (high, low) = self.received[channel][msb as usize];
+        let combined = ((high as u16) << 7 | low as u16) as f32;
+        let scaled = (combined * self.scale).round().clamp(0.0, 16383.0) as u16;
+        ((scaled >> 7) as u8, (scaled & 0x7F) as u8)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_seven_bit_scaling() {
+        let mut scaler = CcScaler::new(0.5, &[]);
+        assert_eq!(scaler.process(&[0xB0, 7, 100]), vec![vec![0xB0, 7, 50]]);
+        assert_eq!(scaler.process(&[0xB0, 33, 127]), vec![vec![0xB0, 33, 64]]);
+        let mut scaler = CcScaler::new(2.0, &[]);
+        assert_eq!(scaler.process(&[0xB0, 7, 100]), vec![vec![0xB0, 7, 127]]);
+        // Other messages are untouched
+        assert_eq!(scaler.process(&[0x90, 60, 100]), vec![vec![0x90, 60, 100]]);
+    }
+
+    #[test]
+    fn test_pair_scaled_as_fourteen_bits() {
+        let mut scaler = CcScaler::new(0.5, &default_pairs());
+        // 0x41 << 7 | 0x00 = 8320, halved to 4160 = 0x20 << 7 | 0x40
+        assert_eq!(scaler.process(&[0xB0, 1, 0x41]), vec![vec![0xB0, 1, 0x20], vec![0xB0, 33, 0x40]]);
+        // 0x41 << 7 | 0x7F = 8447, halved to 4224 (rounded) = 0x21 << 7 | 0x00
+        assert_eq!(scaler.process(&[0xB0, 33, 0x7F]), vec![vec![0xB0, 1, 0x21], vec![0xB0, 33, 0x00]]);
+        // The MSB isn't repeated when it doesn't change
+        assert_eq!(scaler.process(&[0xB0, 33, 0x7F]), vec![vec![0xB0, 33, 0x00]]);
+    }
+
+    #[test]
+    fn test_channels_kept_apart() {
+        let mut scaler = CcScaler::new(1.5, &[(7, 39)]);
+        scaler.process(&[0xB0, 7, 40]);
+        // Channel 2's LSB combines with its own (unset) MSB, not channel 1's
+        assert_eq!(scaler.process(&[0xB1, 39, 10]), vec![vec![0xB1, 7, 0], vec![0xB1, 39, 15]]);
+    }
+
+    #[test]
+    fn test_default_pairs() {
+        let pairs = default_pairs();
+        assert_eq!((pairs[0], pairs[30]), ((1, 33), (31, 63)));
+        assert!(!pairs.iter().any(|&(msb, _)| msb == 0));
+    }
+}
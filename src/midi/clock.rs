@@ -0,0 +1,192 @@
+use std::time::{Duration, Instant};
+
+/// Timing Clock pulses per quarter note defined by the MIDI spec
+pub const DEFAULT_PPQN: u32 = 24;
+
+pub const CLOCK: u8 = 0xF8;
+pub const START: u8 = 0xFA;
+pub const CONTINUE: u8 = 0xFB;
+pub const STOP: u8 = 0xFC;
+
+/// Absolute tick times for a clock at a fixed tempo
+/// Each deadline is computed from the start time rather than by adding intervals, so
+/// sleep overshoot and rounding never accumulate into drift
+#[derive(Debug, Clone, Copy)]
+pub struct ClockSchedule {
+    start: Instant,
+    tick_secs: f64,
+}
+
+impl ClockSchedule {
+    pub fn new(start: Instant, bpm: f64, ppqn: u32) -> Self {
+        Self {
+            start,
+            tick_secs: 60.0 / (bpm * ppqn as f64),
+        }
+    }
+
+    /// When tick `n` (counting from 0) is due
+    pub fn deadline(&self, tick: u64) -> Instant {
+        self.start + Duration::from_secs_f64(self.tick_secs * tick as f64)
+    }
+}
+
+/// Margin before a deadline where we stop sleeping and spin, since OS sleeps overshoot
+const SPIN_MARGIN: Duration = Duration::from_millis(1);
+
+/// Waits until `deadline` with sub-millisecond accuracy
+pub fn sleep_until(deadline: Instant) {
+    loop {
+        let now = Instant::now();
+        if now >= deadline {
+            return;
+        }
+        let remaining = deadline - now;
+        if remaining > SPIN_MARGIN {
+            std::thread::sleep(remaining - SPIN_MARGIN);
+        } else {
+            std::hint::spin_loop();
+        }
+    }
+}
+
+/// Clock intervals kept for the tempo estimate: 4 beats at 24 PPQN
+const TEMPO_WINDOW: usize = 96;
+
+/// Estimates tempo from incoming Timing Clock, for `mc tempo`
+#[derive(Debug, Clone)]
+pub struct TempoTracker {
+    ppqn: u32,
+    last_clock_us: Option<u64>,
+    /// Most recent intervals between clocks, oldest first
+    intervals_us: std::collections::VecDeque<u64>,
+}
+
+/// Tempo implied by the clock window
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct TempoEstimate {
+    pub bpm: f64,
+    /// Standard deviation of the intervals between clocks, in microseconds
+    pub jitter_us: f64,
+    /// Intervals the estimate is based on
+    pub samples: usize,
+}
+
+impl TempoTracker {
+    pub fn new(ppqn: u32) -> Self {
+        Self {
+            ppqn,
+            last_clock_us: None,
+            intervals_us: std::collections::VecDeque::with_capacity(TEMPO_WINDOW),
+        }
+    }
+
+    /// Feeds a realtime message with its timestamp; Start, Continue and Stop restart the window
+    pub fn push(&mut self, timestamp_us: u64, message: &[u8]) {
+        match message {
+            [CLOCK] => {
+                if let Some(last) = self.last_clock_us.replace(timestamp_us) {
+                    if self.intervals_us.len() == TEMPO_WINDOW {
+                        self.intervals_us.pop_front();
+                    }
+                    self.intervals_us.push_back(timestamp_us.saturating_sub(last));
+                }
+            }
+            [START] | [CONTINUE] | [STOP] => self.reset(),
+            _ => {}
+        }
+    }
+
+    pub fn reset(&mut self) {
+        self.last_clock_us = None;
+        self.intervals_us.clear();
+    }
+
+    /// None until at least two clocks have arrived since the last reset
+    pub fn estimate(&self) -> Option<TempoEstimate> {
+        let samples = self.intervals_us.len();
+        if samples == 0 {
+            return None;
+        }
+        let mean = self.intervals_us.iter().sum::<u64>() as f64 / samples as f64;
+        if mean == 0.0 {
+            return None;
+        }
+        let variance = self
+            .intervals_us
+            .iter()
+            .map(|&interval| (interval as f64 - mean).powi(2))
+            .sum::<f64>()
+            / samples as f64;
+
+        Some(TempoEstimate {
+            bpm: 60_000_000.0 / (mean * self.ppqn as f64),
+            jitter_us: variance.sqrt(),
+            samples,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_deadlines() {
+        let start = Instant::now();
+        let schedule = ClockSchedule::new(start, 120.0, DEFAULT_PPQN);
+        assert_eq!(schedule.deadline(0), start);
+        // 120 BPM: a quarter note every 500ms
+        assert_eq!(schedule.deadline(24) - start, Duration::from_millis(500));
+        // No accumulated rounding after an hour of ticks
+        let hour = schedule.deadline(24 * 2 * 3600) - start;
+        assert!(hour.abs_diff(Duration::from_secs(3600)) < Duration::from_micros(1));
+    }
+
+    #[test]
+    fn test_ppqn_override() {
+        let start = Instant::now();
+        let schedule = ClockSchedule::new(start, 60.0, 48);
+        assert_eq!(schedule.deadline(48) - start, Duration::from_secs(1));
+    }
+
+    #[test]
+    fn test_sleep_until() {
+        let deadline = Instant::now() + Duration::from_millis(5);
+        sleep_until(deadline);
+        assert!(Instant::now() >= deadline);
+    }
+
+    #[test]
+    fn test_tempo_estimate() {
+        let mut tracker = TempoTracker::new(DEFAULT_PPQN);
+        assert_eq!(tracker.estimate(), None);
+
+        // 120 BPM at 24 PPQN is a clock every 20833us; alternate +-100us of jitter
+        for tick in 0..49u64 {
+            let jitter = if tick % 2 == 0 { 100 } else { 0 };
+            tracker.push(tick * 20_833 + jitter, &[CLOCK]);
+        }
+        let estimate = tracker.estimate().unwrap();
+        assert_eq!(estimate.samples, 48);
+        assert!((estimate.bpm - 120.0).abs() < 0.01, "{}", estimate.bpm);
+        assert!((estimate.jitter_us - 100.0).abs() < 0.01, "{}", estimate.jitter_us);
+    }
+
+    #[test]
+    fn test_tempo_window_and_reset() {
+        let mut tracker = TempoTracker::new(DEFAULT_PPQN);
+        for tick in 0..200u64 {
+            tracker.push(tick * 10_000, &[CLOCK]);
+        }
+        assert_eq!(tracker.estimate().unwrap().samples, TEMPO_WINDOW);
+
+        // Non-clock messages are ignored, Stop starts over
+        tracker.push(2_000_000, &[0x90, 60, 100]);
+        assert!(tracker.estimate().is_some());
+        tracker.push(2_000_000, &[STOP]);
+        assert_eq!(tracker.estimate(), None);
+        tracker.push(3_000_000, &[CLOCK]);
+        assert_eq!(tracker.estimate(), None);
+    }
+}
@@ -0,0 +1,224 @@
+/// Human-readable decoding of MIDI messages
+/// Shared by `mc monitor` and anything else that prints messages
+use std::fmt;
+
+/// A MIDI message split into its type, channel and data bytes
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DecodedMessage {
+    pub kind: &'static str,
+    /// 1-based channel for channel messages
+    pub channel: Option<u8>,
+    pub data1: Option<u8>,
+    pub data2: Option<u8>,
+    /// Total length in bytes (useful for SysEx)
+    pub len: usize,
+}
+
+const NOTE_NAMES: [&str; 12] = ["C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"];
+
+/// Returns the name of a note number, using C4 = 60
+pub fn note_name(note: u8) -> String {
+    let octave = (note / 12) as i8 - 1;
+    format!("{}{}", NOTE_NAMES[(note % 12) as usize], octave)
+}
+
+/// Parses a note name such as `C4`, `F#2` or `Bb-1` (C4 = 60, the inverse of `note_name`)
+/// Flats are accepted as well as the sharps `note_name` prints
+pub fn parse_note_name(name: &str) -> Option<u8> {
+    let mut chars = name.chars();
+    let letter = chars.next()?.to_ascii_uppercase();
+    let rest = chars.as_str();
+    let (accidental, octave) = match rest.chars().next() {
+        Some('#') => (1, &rest[1..]),
+        Some('b') => (-1, &rest[1..]),
+        _ => (0, rest),
+    };
+
+    let base = NOTE_NAMES.iter().position(|n| n.len() == 1 && n.starts_with(letter))? as i32;
+    let octave: i32 = octave.parse().ok()?;
+    let note = (octave + 1) * 12 + base + accidental;
+    u8::try_from(note).ok().filter(|&n| n <= 127)
+}
+
+/// Decodes a single complete MIDI message
+pub fn decode(msg: &[u8]) -> DecodedMessage {
+    let status = msg.first().copied().unwrap_or(0);
+    let data1 = msg.get(1).copied();
+    let data2 = msg.get(2).copied();
+
+    let (kind, channel) = if (0x80..0xF0).contains(&status) {
+        let kind = match status & 0xF0 {
+            0x80 => "NoteOff",
+            0x90 => "NoteOn",
+            0xA0 => "PolyPressure",
+            0xB0 => "CC",
+            0xC0 => "ProgramChange",
+            0xD0 => "ChannelPressure",
+            _ => "PitchBend",
+        };
+        (kind, Some((status & 0x0F) + 1))
+    } else {
+        let kind = match status {
+            0xF0 => "SysEx",
+            0xF1 => "MTCQuarterFrame",
+            0xF2 => "SongPosition",
+            0xF3 => "SongSelect",
+            0xF6 => "TuneRequest",
+            0xF8 => "Clock",
+            0xFA => "Start",
+            0xFB => "Continue",
+            0xFC => "Stop",
+            0xFE => "ActiveSensing",
+            0xFF => "Reset",
+            _ => "Unknown",
+        };
+        (kind, None)
+    };
+
+    DecodedMessage {
+        kind,
+        channel,
+        data1,
+        data2,
+        len: msg.len(),
+    }
+}
+
+impl fmt::Display for DecodedMessage {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.kind)?;
+        if let Some(channel) = self.channel {
+            write!(f, " ch={}", channel)?;
+        }
+
+        let d1 = self.data1.unwrap_or(0);
+        let d2 = self.data2.unwrap_or(0);
+        match self.kind {
+            "NoteOn" | "NoteOff" => write!(f, " note={} ({}) vel={}", d1, note_name(d1), d2),
+            "PolyPressure" => write!(f, " note={} ({}) pressure={}", d1, note_name(d1), d2),
+            "CC" => write!(f, " cc={} val={}", d1, d2),
+            "ProgramChange" => write!(f, " pgm={}", d1),
+            "ChannelPressure" => write!(f, " pressure={}", d1),
+            "PitchBend" => write!(f, " value={}", ((d2 as i16) << 7 | d1 as i16) - 8192),
+            "SysEx" => write!(f, " len={}", self.len),
+            "MTCQuarterFrame" => write!(f, " type={} value={}", d1 >> 4, d1 & 0x0F),
+            "SongPosition" => write!(f, " beats={}", (d2 as u16) << 7 | d1 as u16),
+            "SongSelect" => write!(f, " song={}", d1),
+            _ => Ok(()),
+        }
+    }
+}
+
+/// Formats bytes as space-separated hex, e.g. "90 3C 64"
+pub fn hex_bytes(msg: &[u8]) -> String {
+    msg.iter()
+        .map(|b| format!("{:02X}", b))
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+/// Formats a message as a single-line JSON object (NDJSON)
+/// This is the schema shared by `mc monitor` and `mc fwd` with `--log-format json`;
+/// `ts` is seconds since the Unix epoch
+pub fn message_json(ts: f64, msg: &[u8]) -> String {
+    fn field(value: Option<u8>) -> String {
+        value.map_or("null".to_string(), |v| v.to_string())
+    }
+
+    let decoded = decode(msg);
+    format!(
+        "{{\"ts\":{:.6},\"status\":\"{}\",\"channel\":{},\"data1\":{},\"data2\":{},\"raw\":\"{}\"}}",
+        ts,
+        decoded.kind,
+        field(decoded.channel),
+        field(decoded.data1),
+        field(decoded.data2),
+        hex_bytes(msg)
+    )
+}
+
+/// Reads a message back from the `message_json` schema
+/// Only `raw` is used, so clients can send back any object they received
+pub fn message_from_json(text: &str) -> Result<Vec<u8>, String> {
+    #[derive(serde::Deserialize)]
+    struct Message {
+        raw: String,
+    }
+
+    let message: Message = serde_json::from_str(text).map_err(|e| e.to_string())?;
+    message
+        .raw
+        .split_whitespace()
+        .map(|byte| u8::from_str_radix(byte, 16).map_err(|_| format!("Invalid hex byte '{}'", byte)))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_note_name() {
+        assert_eq!(note_name(60), "C4");
+        assert_eq!(note_name(61), "C#4");
+        assert_eq!(note_name(0), "C-1");
+        assert_eq!(note_name(127), "G9");
+    }
+
+    #[test]
+    fn test_decode_channel_messages() {
+        assert_eq!(decode(&[0x90, 60, 100]).to_string(), "NoteOn ch=1 note=60 (C4) vel=100");
+        assert_eq!(decode(&[0xB0, 74, 12]).to_string(), "CC ch=1 cc=74 val=12");
+        assert_eq!(decode(&[0xC1, 5]).to_string(), "ProgramChange ch=2 pgm=5");
+        assert_eq!(decode(&[0xEF, 0x00, 0x40]).to_string(), "PitchBend ch=16 value=0");
+        assert_eq!(decode(&[0xE0, 0x00, 0x00]).to_string(), "PitchBend ch=1 value=-8192");
+    }
+
+    #[test]
+    fn test_decode_system_messages() {
+        assert_eq!(decode(&[0xF8]).to_string(), "Clock");
+        assert_eq!(decode(&[0xF0, 0x7E, 0x7F, 0xF7]).to_string(), "SysEx len=4");
+        assert_eq!(decode(&[0xF2, 0x10, 0x01]).to_string(), "SongPosition beats=144");
+    }
+
+    #[test]
+    fn test_hex_bytes() {
+        assert_eq!(hex_bytes(&[0x90, 0x3C, 0x64]), "90 3C 64");
+    }
+
+    #[test]
+    fn test_message_json() {
+        assert_eq!(
+            message_json(1.5, &[0x90, 0x3C, 0x64]),
+            r#"{"ts":1.500000,"status":"NoteOn","channel":1,"data1":60,"data2":100,"raw":"90 3C 64"}"#
+        );
+        assert_eq!(
+            message_json(0.0, &[0xF8]),
+            r#"{"ts":0.000000,"status":"Clock","channel":null,"data1":null,"data2":null,"raw":"F8"}"#
+        );
+    }
+
+    #[test]
+    fn test_message_from_json() {
+        let json = message_json(1.5, &[0x90, 0x3C, 0x64]);
+        assert_eq!(message_from_json(&json), Ok(vec![0x90, 0x3C, 0x64]));
+        assert_eq!(message_from_json(r#"{"raw":"b0 07 7f"}"#), Ok(vec![0xB0, 0x07, 0x7F]));
+        assert!(message_from_json(r#"{"raw":"zz"}"#).is_err());
+        assert!(message_from_json(r#"{"status":"NoteOn"}"#).is_err());
+    }
+
+    #[test]
+    fn test_parse_note_name() {
+        assert_eq!(parse_note_name("C4"), Some(60));
+        assert_eq!(parse_note_name("c-1"), Some(0));
+        assert_eq!(parse_note_name("F#2"), Some(42));
+        assert_eq!(parse_note_name("Gb2"), Some(42));
+        assert_eq!(parse_note_name("G9"), Some(127));
+        assert_eq!(parse_note_name("G#9"), None);
+        assert_eq!(parse_note_name("H4"), None);
+        assert_eq!(parse_note_name("C"), None);
+        for note in 0..=127 {
+            assert_eq!(parse_note_name(&note_name(note)), Some(note));
+        }
+    }
+}
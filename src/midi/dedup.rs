@@ -0,0 +1,177 @@
+use super::notes::ActiveNotes;
+use std::collections::hash_map::DefaultHasher;
+use std::collections::VecDeque;
+use std::hash::{Hash, Hasher};
+use std::time::{Duration, Instant};
+
+/// Upper bound on remembered messages, oldest are forgotten first
+const CAPACITY: usize = 256;
+
+/// Suppresses byte-identical messages seen again within a time window (`--dedup-window`)
+/// Breaks feedback loops between chained commands, but also drops legitimate fast
+/// repeats such as retriggered notes. Realtime messages (clock, transport) are never
+/// suppressed since they are identical by nature, and a Note Off only when its key isn't
+/// sounding, so a note let through again is always released.
+#[derive(Debug)]
+pub struct Dedup {
+    window: Duration,
+    recent: VecDeque<(Instant, u64)>,
+    /// Notes sounding from the messages let through
+    sounding: ActiveNotes,
+}
+
+fn message_hash(msg: &[u8]) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    msg.hash(&mut hasher);
+    hasher.finish()
+}
+
+impl Dedup {
+    pub fn new(window: Duration) -> Self {
+        Self {
+            window,
+            recent: VecDeque::with_capacity(CAPACITY),
+            sounding: ActiveNotes::new(),
+        }
+    }
+
+    /// Returns true if the message was already seen within the window
+    /// Every message is remembered, so a steady stream of repeats stays suppressed
+    pub fn is_duplicate(&mut self, msg: &[u8]) -> bool {
+        self.is_duplicate_at(Instant::now(), msg)
+    }
+
+    fn is_duplicate_at(&mut self, now: Instant, msg: &[u8]) -> bool {
+        if msg.first().is_some_and(|&status| status >= 0xF8) {
+            return false;
+        }
+
+        while let Some((seen_at, _)) = self.recent.front() {
+            if now.duration_since(*seen_at) <= self.window {
+                break;
+            }
+            self.recent.pop_front();
+        }
+
+        let hash = message_hash(msg);
+        let duplicate = self.recent.iter().any(|(_, seen)| *seen == hash) && !self.releases_sounding(msg);
+
+        if self.recent.len() == CAPACITY {
+            self.recent.pop_front();
+        }
+        self.recent.push_back((now, hash));
+
+        if !duplicate {
+            self.sounding.track(msg);
+        }
+        duplicate
+    }
+
+    /// True for a Note Off (or Note On with velocity 0) whose key is sounding
+    fn releases_sounding(&self, msg: &[u8]) -> bool {
+        match *msg {
+            [status, note, velocity] if status & 0xF0 == 0x80 || (status & 0xF0 == 0x90 && velocity == 0) => {
+                self.sounding.is_on(status & 0x0F, note)
+            }
+            _ => false,
+        }
+    }
+}
+
+/// `CcDedup` slot that hasn't seen a value yet
+const NO_VALUE: u8 = 0xFF;
+
+/// Suppresses a Control Change whose value matches the last one on the same channel and
+/// controller (`--dedup-cc`), for controllers that keep re-sending unchanged values
+/// Only Control Change is affected; pitch bend and everything else always pass.
+#[derive(Debug, Clone)]
+pub struct CcDedup {
+    /// Last value per channel * 128 + controller
+    last: Vec<u8>,
+}
+
+impl CcDedup {
+    pub fn new() -> Self {
+        Self {
+            last: vec![NO_VALUE; 16 * 128],
+        }
+    }
+
+    /// Returns true if the message repeats the previous value for its controller
+    pub fn is_repeat(&mut self, msg: &[u8]) -> bool {
+        if msg.len() != 3 || msg[0] & 0xF0 != 0xB0 {
+            return false;
+        }
+        let slot = &mut self.last[(msg[0] & 0x0F) as usize * 128 + (msg[1] & 0x7F) as usize];
+        let repeat = *slot == msg[2];
+        *slot = msg[2];
+        repeat
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_repeat_within_window() {
+        let mut dedup = Dedup::new(Duration::from_millis(10));
+        let now = Instant::now();
+        assert!(!dedup.is_duplicate_at(now, &[0x90, 60, 100]));
+        assert!(dedup.is_duplicate_at(now + Duration::from_millis(5), &[0x90, 60, 100]));
+        assert!(!dedup.is_duplicate_at(now + Duration::from_millis(5), &[0x90, 62, 100]));
+    }
+
+    #[test]
+    fn test_repeat_after_window() {
+        let mut dedup = Dedup::new(Duration::from_millis(10));
+        let now = Instant::now();
+        assert!(!dedup.is_duplicate_at(now, &[0xB0, 7, 100]));
+        assert!(!dedup.is_duplicate_at(now + Duration::from_millis(20), &[0xB0, 7, 100]));
+    }
+
+    #[test]
+    fn test_note_off_releases_retriggered_note() {
+        let mut dedup = Dedup::new(Duration::from_millis(10));
+        let now = Instant::now();
+        assert!(!dedup.is_duplicate_at(now, &[0x90, 0x3C, 0x64]));
+        assert!(!dedup.is_duplicate_at(now, &[0x80, 0x3C, 0x00]));
+        assert!(!dedup.is_duplicate_at(now, &[0x90, 0x3C, 0x5A]));
+        assert!(!dedup.is_duplicate_at(now, &[0x80, 0x3C, 0x00]));
+        // With nothing left sounding, a repeated Note Off is a duplicate again
+        assert!(dedup.is_duplicate_at(now, &[0x80, 0x3C, 0x00]));
+        assert!(!dedup.sounding.is_on(0, 0x3C));
+    }
+
+    #[test]
+    fn test_realtime_never_suppressed() {
+        let mut dedup = Dedup::new(Duration::from_millis(10));
+        let now = Instant::now();
+        assert!(!dedup.is_duplicate_at(now, &[0xF8]));
+        assert!(!dedup.is_duplicate_at(now, &[0xF8]));
+    }
+
+    #[test]
+    fn test_cc_dedup() {
+        let mut dedup = CcDedup::new();
+        // The first value always passes, including 0
+        assert!(!dedup.is_repeat(&[0xB0, 7, 0]));
+        assert!(dedup.is_repeat(&[0xB0, 7, 0]));
+        assert!(!dedup.is_repeat(&[0xB0, 7, 1]));
+        assert!(!dedup.is_repeat(&[0xB0, 7, 0]));
+
+        // Tracked per channel and controller
+        assert!(!dedup.is_repeat(&[0xB1, 7, 0]));
+        assert!(!dedup.is_repeat(&[0xB0, 8, 0]));
+    }
+
+    #[test]
+    fn test_cc_dedup_ignores_other_messages() {
+        let mut dedup = CcDedup::new();
+        for _ in 0..3 {
+            assert!(!dedup.is_repeat(&[0xE0, 0x00, 0x40]));
+            assert!(!dedup.is_repeat(&[0x90, 60, 100]));
+            assert!(!dedup.is_repeat(&[0xD0, 10]));
+        }
+    }
+}
@@ -0,0 +1,99 @@
+/// MIDI delay for `mc fwd --echo`
+/// Each Note On is repeated `repeats` times, `delay` apart, its velocity multiplied by
+/// `decay` on every repeat; the repeats stop early once the velocity would drop below 1
+/// (a velocity of 0 would read as Note Off). The played note's Note Off is repeated at
+/// the same offsets, but only as often as its Note On was, so every echo is released.
+use std::collections::HashMap;
+use std::time::Duration;
+
+#[derive(Debug, Clone)]
+pub struct NoteDelay {
+    delay: Duration,
+    repeats: u8,
+    decay: f32,
+    /// How many echoes each held (channel, note) was given
+    held: HashMap<(u8, u8), u8>,
+}
+
+impl NoteDelay {
+    pub fn new(delay: Duration, repeats: u8, decay: f32) -> Self {
+        Self {
+            delay,
+            repeats,
+            decay,
+            held: HashMap::new(),
+        }
+    }
+
+    /// The echoes of a message that was just sent, each with how long after it to send
+    /// Anything other than Note On/Off has none
+    pub fn echoes(&mut self, msg: &[u8]) -> Vec<(Duration, Vec<u8>)> {
+        let [status, note, velocity] = *msg else {
+            return Vec::new();
+        };
+        let key = (status & 0x0F, note);
+        match status & 0xF0 {
+            0x90 if velocity > 0 => {
+                let mut echoes = Vec::new();
+                for repeat in 1..=self.repeats {
+                    let echoed = (velocity as f32 * self.decay.powi(repeat as i32)).round();
+                    if echoed < 1.0 {
+                        break;
+                    }
+                    echoes.push((self.delay * repeat as u32, vec![status, note, echoed.min(127.0) as u8]));
+                }
+                self.held.insert(key, echoes.len() as u8);
+                echoes
+            }
+            0x80 | 0x90 => {
+                let count = self.held.remove(&key).unwrap_or(0);
+                (1..=count).map(|repeat| (self.delay * repeat as u32, msg.to_vec())).collect()
+            }
+            _ => Vec::new(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const MS: Duration = Duration::from_millis(1);
+
+    #[test]
+    fn test_note_on_repeats_decay() {
+        let mut delay = NoteDelay::new(250 * MS, 3, 0.5);
+        assert_eq!(
+            delay.echoes(&[0x90, 60, 100]),
+            vec![
+                (250 * MS, vec![0x90, 60, 50]),
+                (500 * MS, vec![0x90, 60, 25]),
+                (750 * MS, vec![0x90, 60, 13]),
+            ]
+        );
+        // The Note Off follows each echo
+        assert_eq!(
+            delay.echoes(&[0x80, 60, 0]),
+            vec![(250 * MS, vec![0x80, 60, 0]), (500 * MS, vec![0x80, 60, 0]), (750 * MS, vec![0x80, 60, 0])]
+        );
+    }
+
+    #[test]
+    fn test_stops_below_velocity_one() {
+        let mut delay = NoteDelay::new(100 * MS, 8, 0.5);
+        // 3 -> 2 (1.5 rounded), 1 (0.75 rounded), then 0.375 would be silent
+        let echoes = delay.echoes(&[0x90, 60, 3]);
+        assert_eq!(echoes.iter().map(|(_, m)| m[2]).collect::<Vec<_>>(), vec![2, 1]);
+        // Only the two echoes are released; Note On velocity 0 counts as a Note Off
+        assert_eq!(delay.echoes(&[0x90, 60, 0]).len(), 2);
+    }
+
+    #[test]
+    fn test_other_messages_have_no_echoes() {
+        let mut delay = NoteDelay::new(100 * MS, 3, 0.7);
+        assert!(delay.echoes(&[0xB0, 64, 127]).is_empty());
+        assert!(delay.echoes(&[0xF8]).is_empty());
+        // A Note Off for a note played before the forward started
+        assert!(delay.echoes(&[0x80, 60, 0]).is_empty());
+    }
+}
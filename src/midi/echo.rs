@@ -0,0 +1,84 @@
+use std::collections::VecDeque;
+use std::time::{Duration, Instant};
+
+/// How long a sent message is remembered when looking for its echo
+const ECHO_WINDOW: Duration = Duration::from_millis(100);
+
+/// Upper bound on remembered messages (dense streams just age out sooner)
+const MAX_RECENT: usize = 256;
+
+/// Remembers messages recently sent by one direction of a bidirectional forward
+/// so the other direction can drop them if they come straight back (loopback)
+#[derive(Debug, Default)]
+pub struct EchoGuard {
+    recent: VecDeque<(Instant, Vec<u8>)>,
+}
+
+impl EchoGuard {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Records a message that was just sent
+    pub fn record(&mut self, msg: &[u8]) {
+        self.record_at(Instant::now(), msg);
+    }
+
+    /// Returns true (and forgets the message) if it matches one sent within the window
+    pub fn is_echo(&mut self, msg: &[u8]) -> bool {
+        self.is_echo_at(Instant::now(), msg)
+    }
+
+    fn record_at(&mut self, now: Instant, msg: &[u8]) {
+        self.expire(now);
+        if self.recent.len() == MAX_RECENT {
+            self.recent.pop_front();
+        }
+        self.recent.push_back((now, msg.to_vec()));
+    }
+
+    fn is_echo_at(&mut self, now: Instant, msg: &[u8]) -> bool {
+        self.expire(now);
+        match self.recent.iter().position(|(_, sent)| sent == msg) {
+            Some(idx) => {
+                self.recent.remove(idx);
+                true
+            }
+            None => false,
+        }
+    }
+
+    fn expire(&mut self, now: Instant) {
+        while let Some((sent_at, _)) = self.recent.front() {
+            if now.duration_since(*sent_at) <= ECHO_WINDOW {
+                break;
+            }
+            self.recent.pop_front();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_echo_dropped_once() {
+        let mut guard = EchoGuard::new();
+        let now = Instant::now();
+        guard.record_at(now, &[0x90, 60, 100]);
+
+        assert!(!guard.is_echo_at(now, &[0x90, 61, 100]));
+        assert!(guard.is_echo_at(now, &[0x90, 60, 100]));
+        // Only one copy was sent, so a second arrival is genuine input
+        assert!(!guard.is_echo_at(now, &[0x90, 60, 100]));
+    }
+
+    #[test]
+    fn test_echo_window_expires() {
+        let mut guard = EchoGuard::new();
+        let now = Instant::now();
+        guard.record_at(now, &[0xB0, 7, 100]);
+        assert!(!guard.is_echo_at(now + ECHO_WINDOW * 2, &[0xB0, 7, 100]));
+    }
+}
@@ -0,0 +1,132 @@
+/// Typed errors for opening driver ports, so `main` can explain them and pick an exit code
+use midir::{ConnectError, ConnectErrorKind, InitError};
+use std::error::Error as StdError;
+use thiserror::Error;
+
+/// Exit status for anything without a more specific one
+pub const EXIT_FAILURE: i32 = 1;
+/// Exit status when a port argument doesn't resolve to exactly one port
+pub const EXIT_PORT_NOT_FOUND: i32 = 2;
+/// Exit status when a port is held by another application
+pub const EXIT_PORT_BUSY: i32 = 3;
+/// Exit status when the MIDI driver (ALSA, CoreMIDI, WinMM, JACK) can't be used at all
+pub const EXIT_DRIVER_UNAVAILABLE: i32 = 4;
+
+#[derive(Debug, Error)]
+pub enum PortError {
+    /// No port, several ports or an invalid pattern for a port argument
+    #[error("{0}")]
+    NotFound(String),
+    /// The driver refused the connection because another application holds the port
+    #[error("{direction} port '{port}' is already in use by another application. {}", busy_hint())]
+    Busy { direction: &'static str, port: String },
+    #[error("Failed to open {direction} port '{port}': {reason}")]
+    Open {
+        direction: &'static str,
+        port: String,
+        reason: String,
+    },
+}
+
+impl PortError {
+    /// Process exit status for this error
+    pub fn exit_code(&self) -> i32 {
+        match self {
+            PortError::NotFound(_) => EXIT_PORT_NOT_FOUND,
+            PortError::Busy { .. } => EXIT_PORT_BUSY,
+            PortError::Open { .. } => EXIT_FAILURE,
+        }
+    }
+}
+
+/// Process exit status for an error returned by a command
+/// midir's InitError reaches `main` unwrapped, so a driver that won't start is
+/// recognised by its type
+pub fn exit_code(error: &(dyn StdError + 'static)) -> i32 {
+    if let Some(port_error) = error.downcast_ref::<PortError>() {
+        port_error.exit_code()
+    } else if error.is::<InitError>() {
+        EXIT_DRIVER_UNAVAILABLE
+    } else {
+        EXIT_FAILURE
+    }
+}
+
+/// Builds a `map_err` adapter for midir's connect calls
+/// `direction` is "Input" or "Output"; `port` is the name shown to the user
+pub fn connect_error<T>(direction: &'static str, port: &str) -> impl FnOnce(ConnectError<T>) -> PortError {
+    let port = port.to_string();
+    move |e| match e.kind() {
+        ConnectErrorKind::Other(reason) if is_busy(reason) => PortError::Busy { direction, port },
+        _ => PortError::Open {
+            direction,
+            port,
+            reason: e.to_string(),
+        },
+    }
+}
+
+/// midir only reports a static description, so busy ports are recognised by it
+/// The Windows MM API opens devices exclusively and fails to create the port when
+/// another application has it; the other backends mention the busy device
+fn is_busy(reason: &str) -> bool {
+    let reason = reason.to_lowercase();
+    reason.contains("windows mm") || reason.contains("busy") || reason.contains("in use")
+}
+
+/// Where to look for the application holding the port
+fn busy_hint() -> &'static str {
+    if cfg!(target_os = "linux") {
+        "Close it, or find it with `fuser -v /dev/snd/*`"
+    } else if cfg!(target_os = "macos") {
+        "Close it (often a DAW that captures every device), or check Audio MIDI Setup"
+    } else {
+        "Close it (often a DAW or another MIDI tool) and try again"
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_is_busy() {
+        assert!(is_busy("could not create Windows MM MIDI input port"));
+        assert!(is_busy("Device or resource busy"));
+        assert!(!is_busy("could not find port"));
+    }
+
+    #[test]
+    fn test_exit_codes() {
+        let busy = PortError::Busy {
+            direction: "Output",
+            port: "USB MIDI".to_string(),
+        };
+        assert_eq!(busy.exit_code(), EXIT_PORT_BUSY);
+        assert!(busy.to_string().starts_with("Output port 'USB MIDI' is already in use"));
+
+        let open = PortError::Open {
+            direction: "Input",
+            port: "Keys".to_string(),
+            reason: "invalid port".to_string(),
+        };
+        assert_eq!(open.exit_code(), EXIT_FAILURE);
+    }
+
+    #[test]
+    fn test_exit_code_from_boxed_errors() {
+        let not_found: Box<dyn StdError> = PortError::NotFound("Input port 'x' not found".to_string()).into();
+        assert_eq!(exit_code(not_found.as_ref()), EXIT_PORT_NOT_FOUND);
+        assert_eq!(not_found.to_string(), "Input port 'x' not found");
+
+        let busy: Box<dyn StdError> = PortError::Busy {
+            direction: "Input",
+            port: "Keys".to_string(),
+        }
+        .into();
+        assert_eq!(exit_code(busy.as_ref()), EXIT_PORT_BUSY);
+
+        let generic: Box<dyn StdError> = "Invalid file".into();
+        assert_eq!(exit_code(generic.as_ref()), EXIT_FAILURE);
+    }
+}
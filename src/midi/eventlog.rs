@@ -0,0 +1,197 @@
+/// Text recordings for `mc rec --format csv|json`, played back by `mc play --format`
+/// One event per line with its time in seconds from the first message, the fields
+/// `message_json` gives `mc monitor`, and the raw bytes in hex. Easier to read in a
+/// spreadsheet or script than a Standard MIDI File.
+use super::decode::{decode, hex_bytes, message_json};
+use super::send::parse_line;
+use super::smf::TimedMessage;
+use super::validation::is_valid_midi_message;
+
+/// What `mc rec` writes
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum RecordFormat {
+    /// Standard MIDI File (type 0)
+    #[default]
+    Smf,
+    /// Comma-separated values with a header row
+    Csv,
+    /// One JSON object per line (NDJSON)
+    Json,
+}
+
+impl std::str::FromStr for RecordFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "mid" | "smf" => Ok(RecordFormat::Smf),
+            "csv" => Ok(RecordFormat::Csv),
+            "json" => Ok(RecordFormat::Json),
+            _ => Err(format!("Unknown format '{}' (expected mid, csv or json)", s)),
+        }
+    }
+}
+
+/// First line of a CSV recording
+pub const CSV_HEADER: &str = "time,status,channel,data1,data2,raw";
+
+/// One CSV row; channel and data fields are empty when a message has none
+pub fn csv_row(time: f64, msg: &[u8]) -> String {
+    fn field(value: Option<u8>) -> String {
+        value.map_or(String::new(), |v| v.to_string())
+    }
+
+    let decoded = decode(msg);
+    format!(
+        "{:.6},{},{},{},{},{}",
+        time,
+        decoded.kind,
+        field(decoded.channel),
+        field(decoded.data1),
+        field(decoded.data2),
+        hex_bytes(msg)
+    )
+}
+
+/// One line of a recording in `format`, without the newline; None for SMF
+pub fn event_line(format: RecordFormat, time: f64, msg: &[u8]) -> Option<String> {
+    match format {
+        RecordFormat::Smf => None,
+        RecordFormat::Csv => Some(csv_row(time, msg)),
+        RecordFormat::Json => Some(message_json(time, msg)),
+    }
+}
+
+/// Reads a recording back; only the time and raw fields are used, so hand-edited files
+/// only need those right. Times are taken relative to the first event, which also lets
+/// `mc monitor --log-format json` output (Unix times) be played.
+/// Returns the events and a warning for each line that was skipped
+pub fn read_events(text: &str, format: RecordFormat) -> (Vec<TimedMessage>, Vec<String>) {
+    let mut events = Vec::new();
+    let mut warnings = Vec::new();
+    let mut start = None;
+
+    for (index, line) in text.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || (index == 0 && line == CSV_HEADER) {
+            continue;
+        }
+        let event = match format {
+            RecordFormat::Csv => csv_event(line),
+            RecordFormat::Json => json_event(line),
+            RecordFormat::Smf => Err("not a text recording".to_string()),
+        };
+        match event {
+            Ok((time, bytes)) => {
+                let start = *start.get_or_insert(time);
+                let time_us = ((time - start).max(0.0) * 1_000_000.0).round() as u64;
+                events.push(TimedMessage { time_us, bytes });
+            }
+            Err(reason) => warnings.push(format!("line {}: {}", index + 1, reason)),
+        }
+    }
+    (events, warnings)
+}
+
+fn csv_event(line: &str) -> Result<(f64, Vec<u8>), String> {
+    let fields: Vec<&str> = line.split(',').collect();
+    let [time, _, _, _, _, raw] = fields[..] else {
+        return Err(format!("expected 6 fields, found {}", fields.len()));
+    };
+    Ok((parse_time(time.trim())?, parse_raw(raw)?))
+}
+
+fn json_event(line: &str) -> Result<(f64, Vec<u8>), String> {
+    #[derive(serde::Deserialize)]
+    struct Event {
+        ts: f64,
+        raw: String,
+    }
+
+    let event: Event = serde_json::from_str(line).map_err(|e| e.to_string())?;
+    if !event.ts.is_finite() {
+        return Err(format!("invalid time {}", event.ts));
+    }
+    Ok((event.ts, parse_raw(&event.raw)?))
+}
+
+fn parse_time(value: &str) -> Result<f64, String> {
+    value
+        .parse::<f64>()
+        .ok()
+        .filter(|time| time.is_finite())
+        .ok_or_else(|| format!("invalid time '{}'", value))
+}
+
+/// Raw bytes in hex, checked to be one complete message
+fn parse_raw(value: &str) -> Result<Vec<u8>, String> {
+    let invalid = || format!("invalid message '{}'", value.trim());
+    let bytes = parse_line(value).map_err(|_| invalid())?.ok_or_else(invalid)?;
+    if !is_valid_midi_message(&bytes) {
+        return Err(invalid());
+    }
+    Ok(bytes)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_csv_row() {
+        assert_eq!(csv_row(0.25, &[0x91, 0x3C, 0x64]), "0.250000,NoteOn,2,60,100,91 3C 64");
+        assert_eq!(csv_row(1.0, &[0xF8]), "1.000000,Clock,,,,F8");
+        // SysEx bytes stay in the raw field, space-separated, so no quoting is needed
+        assert_eq!(csv_row(0.0, &[0xF0, 0x7E, 0xF7]), "0.000000,SysEx,,126,247,F0 7E F7");
+    }
+
+    #[test]
+    fn test_parse_format() {
+        assert_eq!("csv".parse(), Ok(RecordFormat::Csv));
+        assert_eq!("json".parse(), Ok(RecordFormat::Json));
+        assert_eq!("mid".parse(), Ok(RecordFormat::Smf));
+        assert!("xml".parse::<RecordFormat>().is_err());
+    }
+
+    #[test]
+    fn test_read_csv() {
+        let text = format!(
+            "{}\n{}\n{}\n0.5,Clock,,,,F8\n",
+            CSV_HEADER,
+            csv_row(0.0, &[0x90, 0x3C, 0x64]),
+            csv_row(0.25, &[0x80, 0x3C, 0x00])
+        );
+        let (events, warnings) = read_events(&text, RecordFormat::Csv);
+        assert!(warnings.is_empty());
+        let times: Vec<u64> = events.iter().map(|e| e.time_us).collect();
+        assert_eq!(times, vec![0, 250_000, 500_000]);
+        assert_eq!(events[1].bytes, vec![0x80, 0x3C, 0x00]);
+    }
+
+    #[test]
+    fn test_read_json_relative_to_first() {
+        let text = format!("{}\n{}\n", message_json(1700000000.0, &[0xF8]), message_json(1700000001.5, &[0xFA]));
+        let (events, warnings) = read_events(&text, RecordFormat::Json);
+        assert!(warnings.is_empty());
+        assert_eq!((events[0].time_us, events[1].time_us), (0, 1_500_000));
+        assert_eq!(events[1].bytes, vec![0xFA]);
+    }
+
+    #[test]
+    fn test_malformed_rows_skipped() {
+        let text = "0.0,NoteOn,1,60,100,90 3C 64\n\
+                    oops\n\
+                    x,NoteOn,1,60,100,90 3C 64\n\
+                    0.1,NoteOn,1,60,100,90 3C\n\
+                    0.2,NoteOn,1,60,100,90 3C ZZ\n\
+                    0.3,NoteOff,1,60,0,80 3C 00\n";
+        let (events, warnings) = read_events(text, RecordFormat::Csv);
+        assert_eq!(events.len(), 2);
+        assert_eq!(warnings.len(), 4);
+        assert!(warnings[0].starts_with("line 2:"));
+
+        let (events, warnings) = read_events("{\"ts\":0}\nnot json\n", RecordFormat::Json);
+        assert!(events.is_empty());
+        assert_eq!(warnings.len(), 2);
+    }
+}
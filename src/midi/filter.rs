@@ -0,0 +1,381 @@
+/// Message filtering applied by `mc fwd` before forwarding
+#[derive(Debug, Clone, Default)]
+pub struct Filter {
+    /// Bitmask of allowed channels (bit 0 = channel 1), None allows all
+    channels: Option<u16>,
+    /// Drop Timing Clock (0xF8)
+    drop_clock: bool,
+    /// Drop Clock, Start, Continue, Stop and Active Sensing (0xF8, 0xFA-0xFC, 0xFE)
+    drop_realtime: bool,
+    /// Allow or deny list of message types
+    types: Option<TypeFilter>,
+    /// Inclusive note range for Note On/Off and poly aftertouch, None allows all notes
+    note_range: Option<(u8, u8)>,
+    /// Manufacturer IDs SysEx must start with, empty allows all SysEx
+    sysex_manufacturers: Vec<Vec<u8>>,
+    /// Notes to drop (Note On/Off and poly aftertouch), None blocks none
+    blocked_notes: Option<[bool; 128]>,
+    /// Control Change controllers to drop, None blocks none
+    blocked_ccs: Option<[bool; 128]>,
+}
+
+/// Declarative message type selection from `--only` / `--except`
+/// Each value is a bitmask of MESSAGE_TYPES entries
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TypeFilter {
+    Only(u32),
+    Except(u32),
+}
+
+/// Message type names and the status bytes they cover
+const MESSAGE_TYPES: &[(&str, &[u8])] = &[
+    ("note", &[0x80, 0x90]),
+    ("polytouch", &[0xA0]),
+    ("cc", &[0xB0]),
+    ("program", &[0xC0]),
+    ("aftertouch", &[0xD0]),
+    ("pitchbend", &[0xE0]),
+    ("sysex", &[0xF0, 0xF7]),
+    ("mtc", &[0xF1]),
+    ("songpos", &[0xF2]),
+    ("songselect", &[0xF3]),
+    ("tune", &[0xF6]),
+    ("clock", &[0xF8]),
+    ("transport", &[0xFA, 0xFB, 0xFC]),
+    ("activesense", &[0xFE]),
+    ("reset", &[0xFF]),
+];
+
+/// Parses a comma-separated list of message type names into a bitmask
+pub fn parse_message_types(list: &str) -> Result<u32, String> {
+    let mut mask = 0;
+    for name in list.split(',').map(str::trim).filter(|n| !n.is_empty()) {
+        let idx = MESSAGE_TYPES
+            .iter()
+            .position(|(type_name, _)| *type_name == name)
+            .ok_or_else(|| {
+                let known: Vec<&str> = MESSAGE_TYPES.iter().map(|(n, _)| *n).collect();
+                format!("Unknown message type '{}' (expected one of: {})", name, known.join(", "))
+            })?;
+        mask |= 1 << idx;
+    }
+
+    if mask == 0 {
+        return Err("Expected at least one message type".to_string());
+    }
+    Ok(mask)
+}
+
+/// Names of the message types in a `parse_message_types` mask, for display
+pub fn message_type_names(mask: u32) -> Vec<&'static str> {
+    MESSAGE_TYPES
+        .iter()
+        .enumerate()
+        .filter(|(idx, _)| mask & (1 << idx) != 0)
+        .map(|(_, (name, _))| *name)
+        .collect()
+}
+
+/// Parses a SysEx manufacturer ID in hex: one byte (`41` for Roland) or three starting
+/// with 00 (`00 20 29`, `002029` or `00:20:29` for Novation)
+pub fn parse_manufacturer_id(value: &str) -> Result<Vec<u8>, String> {
+    let invalid = || format!("Invalid manufacturer ID '{}' (expected 1 byte, or 3 starting with 00, in hex)", value);
+    let digits: String = value.chars().filter(|c| !c.is_whitespace() && *c != ':').collect();
+    if !digits.is_ascii() || digits.len() % 2 != 0 {
+        return Err(invalid());
+    }
+    let bytes = (0..digits.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(&digits[i..i + 2], 16).ok().filter(|&b| b <= 0x7F))
+        .collect::<Option<Vec<u8>>>()
+        .ok_or_else(invalid)?;
+    match bytes[..] {
+        [id] if id != 0x00 => Ok(bytes),
+        [0x00, _, _] => Ok(bytes),
+        _ => Err(invalid()),
+    }
+}
+
+/// Returns the MESSAGE_TYPES bit for a status byte (0 for data bytes)
+fn message_type_bit(status: u8) -> u32 {
+    let key = if status < 0xF0 { status & 0xF0 } else { status };
+    MESSAGE_TYPES
+        .iter()
+        .position(|(_, statuses)| statuses.contains(&key))
+        .map(|idx| 1 << idx)
+        .unwrap_or(0)
+}
+
+/// Lookup table with an entry set for each of `numbers`, None when there are none
+fn block_table(numbers: &[u8]) -> Option<[bool; 128]> {
+    if numbers.is_empty() {
+        return None;
+    }
+    let mut table = [false; 128];
+    for &n in numbers {
+        table[(n & 0x7F) as usize] = true;
+    }
+    Some(table)
+}
+
+/// Realtime status bytes covered by `--no-realtime`
+const FILTERED_REALTIME: [u8; 5] = [0xF8, 0xFA, 0xFB, 0xFC, 0xFE];
+
+impl Filter {
+    /// Creates a filter from 1-based channel numbers (empty allows all channels)
+    pub fn new(channels: &[u8]) -> Self {
+        let channels = if channels.is_empty() {
+            None
+        } else {
+            Some(
+                channels
+                    .iter()
+                    .fold(0u16, |mask, &ch| mask | (1 << (ch.saturating_sub(1) & 0x0F))),
+            )
+        };
+
+        Self {
+            channels,
+            ..Self::default()
+        }
+    }
+
+    /// Drops clock (`no_clock`) or clock plus transport and active sensing (`no_realtime`)
+    /// SysEx and channel messages are unaffected
+    pub fn with_realtime_filter(mut self, no_clock: bool, no_realtime: bool) -> Self {
+        self.drop_clock = no_clock;
+        self.drop_realtime = no_realtime;
+        self
+    }
+
+    /// Restricts forwarding to (or excludes) the given message types
+    pub fn with_types(mut self, types: Option<TypeFilter>) -> Self {
+        self.types = types;
+        self
+    }
+
+    /// Only forwards notes within `min..=max` (a keyboard zone); other messages are unaffected
+    pub fn with_note_range(mut self, range: Option<(u8, u8)>) -> Self {
+        self.note_range = range;
+        self
+    }
+
+    /// Only forwards SysEx from the given manufacturers (`parse_manufacturer_id` bytes);
+    /// SysEx arrives here complete, so the ID is always there to check
+    pub fn with_sysex_manufacturers(mut self, ids: &[Vec<u8>]) -> Self {
+        self.sysex_manufacturers = ids.to_vec();
+        self
+    }
+
+    /// Drops the given notes, Note Off as well as Note On so nothing downstream is left
+    /// waiting for a release, and the given controllers
+    pub fn with_blocked(mut self, notes: &[u8], ccs: &[u8]) -> Self {
+        self.blocked_notes = block_table(notes);
+        self.blocked_ccs = block_table(ccs);
+        self
+    }
+
+    /// Returns true if the message should be forwarded
+    pub fn accepts(&self, msg: &[u8]) -> bool {
+        if msg.is_empty() {
+            return false;
+        }
+
+        let status = msg[0];
+
+        if self.drop_clock && status == 0xF8 {
+            return false;
+        }
+        if self.drop_realtime && FILTERED_REALTIME.contains(&status) {
+            return false;
+        }
+
+        match self.types {
+            Some(TypeFilter::Only(mask)) if message_type_bit(status) & mask == 0 => return false,
+            Some(TypeFilter::Except(mask)) if message_type_bit(status) & mask != 0 => return false,
+            _ => {}
+        }
+
+        if status == 0xF0 && !self.sysex_manufacturers.is_empty() {
+            return self.sysex_manufacturers.iter().any(|id| msg[1..].starts_with(id));
+        }
+
+        // System messages (0xF0-0xFF) have no channel and pass the channel filter
+        if status >= 0xF0 {
+            return true;
+        }
+
+        if let Some(mask) = self.channels {
+            if status >= 0x80 && mask & (1 << (status & 0x0F)) == 0 {
+                return false;
+            }
+        }
+
+        if let (Some((min, max)), 0x80 | 0x90 | 0xA0, Some(&note)) = (self.note_range, status & 0xF0, msg.get(1)) {
+            if !(min..=max).contains(&note) {
+                return false;
+            }
+        }
+
+        let blocked = match (status & 0xF0, msg.get(1)) {
+            (0x80 | 0x90 | 0xA0, Some(_)) => self.blocked_notes.as_ref(),
+            (0xB0, Some(_)) => self.blocked_ccs.as_ref(),
+            _ => None,
+        };
+        if blocked.is_some_and(|table| table[(msg[1] & 0x7F) as usize]) {
+            return false;
+        }
+
+        true
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_no_channels_allows_all() {
+        let filter = Filter::new(&[]);
+        assert!(filter.accepts(&[0x90, 0x3C, 0x64]));
+        assert!(filter.accepts(&[0x9F, 0x3C, 0x64]));
+    }
+
+    #[test]
+    fn test_channel_filter() {
+        let filter = Filter::new(&[1, 10]);
+
+        // Channel 1 and 10 pass
+        assert!(filter.accepts(&[0x90, 0x3C, 0x64]));
+        assert!(filter.accepts(&[0xB9, 0x07, 0x7F]));
+
+        // Other channels are dropped
+        assert!(!filter.accepts(&[0x91, 0x3C, 0x64]));
+        assert!(!filter.accepts(&[0xCF, 0x05]));
+    }
+
+    #[test]
+    fn test_system_messages_pass() {
+        let filter = Filter::new(&[2]);
+        assert!(filter.accepts(&[0xF8]));
+        assert!(filter.accepts(&[0xF0, 0x7E, 0x7F, 0xF7]));
+        assert!(filter.accepts(&[0xFF]));
+    }
+
+    #[test]
+    fn test_no_clock() {
+        let filter = Filter::new(&[]).with_realtime_filter(true, false);
+        assert!(!filter.accepts(&[0xF8]));
+        assert!(filter.accepts(&[0xFA]));
+        assert!(filter.accepts(&[0xFE]));
+        assert!(filter.accepts(&[0x90, 0x3C, 0x64]));
+    }
+
+    #[test]
+    fn test_no_realtime() {
+        let filter = Filter::new(&[]).with_realtime_filter(false, true);
+        for status in [0xF8, 0xFA, 0xFB, 0xFC, 0xFE] {
+            assert!(!filter.accepts(&[status]));
+        }
+
+        // SysEx, channel messages and reset are unaffected
+        assert!(filter.accepts(&[0xF0, 0x7E, 0x7F, 0xF7]));
+        assert!(filter.accepts(&[0xB0, 0x07, 0x7F]));
+        assert!(filter.accepts(&[0xFF]));
+    }
+
+    #[test]
+    fn test_only_types() {
+        let mask = parse_message_types("note,cc").unwrap();
+        let filter = Filter::new(&[]).with_types(Some(TypeFilter::Only(mask)));
+        assert!(filter.accepts(&[0x90, 0x3C, 0x64]));
+        assert!(filter.accepts(&[0x85, 0x3C, 0x00]));
+        assert!(filter.accepts(&[0xB0, 0x07, 0x7F]));
+        assert!(!filter.accepts(&[0xE0, 0x00, 0x40]));
+        assert!(!filter.accepts(&[0xF8]));
+        assert!(!filter.accepts(&[0xF0, 0x7E, 0x7F, 0xF7]));
+    }
+
+    #[test]
+    fn test_except_types() {
+        let mask = parse_message_types("sysex").unwrap();
+        let filter = Filter::new(&[]).with_types(Some(TypeFilter::Except(mask)));
+        assert!(!filter.accepts(&[0xF0, 0x7E, 0x7F, 0xF7]));
+        assert!(filter.accepts(&[0x90, 0x3C, 0x64]));
+        assert!(filter.accepts(&[0xF8]));
+    }
+
+    #[test]
+    fn test_parse_message_types() {
+        assert!(parse_message_types("note, pitchbend").is_ok());
+        assert!(parse_message_types("note,bogus").unwrap_err().contains("bogus"));
+        assert!(parse_message_types("").is_err());
+    }
+
+    #[test]
+    fn test_note_range() {
+        let filter = Filter::new(&[]).with_note_range(Some((48, 59)));
+        assert!(filter.accepts(&[0x90, 48, 100]));
+        assert!(filter.accepts(&[0x80, 59, 0]));
+        assert!(filter.accepts(&[0xA0, 50, 20]));
+        assert!(!filter.accepts(&[0x90, 47, 100]));
+        assert!(!filter.accepts(&[0x80, 60, 0]));
+        assert!(!filter.accepts(&[0xA0, 60, 20]));
+
+        // Non-note messages always pass
+        assert!(filter.accepts(&[0xB0, 1, 64]));
+        assert!(filter.accepts(&[0xE0, 0x00, 0x40]));
+        assert!(filter.accepts(&[0xC0, 5]));
+        assert!(filter.accepts(&[0xD0, 100]));
+    }
+
+    #[test]
+    fn test_message_type_names() {
+        let mask = parse_message_types("cc, note,clock").unwrap();
+        assert_eq!(message_type_names(mask), vec!["note", "cc", "clock"]);
+    }
+
+    #[test]
+    fn test_parse_manufacturer_id() {
+        assert_eq!(parse_manufacturer_id("41"), Ok(vec![0x41]));
+        assert_eq!(parse_manufacturer_id("00 20 29"), Ok(vec![0x00, 0x20, 0x29]));
+        assert_eq!(parse_manufacturer_id("00:20:29"), Ok(vec![0x00, 0x20, 0x29]));
+        assert_eq!(parse_manufacturer_id("002029"), Ok(vec![0x00, 0x20, 0x29]));
+        // 00 alone is the prefix of a three-byte ID, not an ID
+        assert!(parse_manufacturer_id("00").is_err());
+        assert!(parse_manufacturer_id("4120").is_err());
+        assert!(parse_manufacturer_id("80").is_err());
+        assert!(parse_manufacturer_id("4").is_err());
+        assert!(parse_manufacturer_id("zz").is_err());
+    }
+
+    #[test]
+    fn test_blocked() {
+        let filter = Filter::new(&[]).with_blocked(&[60], &[1, 74]);
+        assert!(!filter.accepts(&[0x90, 60, 100]));
+        // Its Note Off and aftertouch go with it, on every channel
+        assert!(!filter.accepts(&[0x83, 60, 0]));
+        assert!(!filter.accepts(&[0xA0, 60, 20]));
+        assert!(filter.accepts(&[0x90, 61, 100]));
+        assert!(!filter.accepts(&[0xB0, 1, 64]));
+        assert!(!filter.accepts(&[0xB5, 74, 0]));
+        assert!(filter.accepts(&[0xB0, 7, 100]));
+        // Other messages with the same data byte are unaffected
+        assert!(filter.accepts(&[0xC0, 60]));
+        assert!(filter.accepts(&[0xF2, 1, 0]));
+    }
+
+    #[test]
+    fn test_sysex_manufacturer_filter() {
+        let filter = Filter::new(&[]).with_sysex_manufacturers(&[vec![0x41], vec![0x00, 0x20, 0x29]]);
+        assert!(filter.accepts(&[0xF0, 0x41, 0x10, 0x42, 0xF7]));
+        assert!(filter.accepts(&[0xF0, 0x00, 0x20, 0x29, 0x02, 0xF7]));
+        assert!(!filter.accepts(&[0xF0, 0x43, 0x10, 0xF7]));
+        // Another three-byte ID, and universal SysEx
+        assert!(!filter.accepts(&[0xF0, 0x00, 0x20, 0x6B, 0x7F, 0xF7]));
+        assert!(!filter.accepts(&[0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7]));
+        // Everything else is unaffected
+        assert!(filter.accepts(&[0x90, 0x3C, 0x64]));
+        assert!(filter.accepts(&[0xF8]));
+    }
+}
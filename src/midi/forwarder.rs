@@ -2,6 +2,10 @@ use crate::connection::Connection;
 use crate::events::AppEvent;
 use crossbeam::channel::Sender;
 use std::process::{Child, Command};
+use std::time::{Duration, Instant};
+
+/// How long a worker gets to release its notes and close its ports before it's killed
+const STOP_GRACE: Duration = Duration::from_millis(500);
 
 /// Handle for a running forwarder subprocess
 pub struct ForwarderHandle {
@@ -11,10 +15,40 @@ pub struct ForwarderHandle {
 
 impl Drop for ForwarderHandle {
     fn drop(&mut self) {
-        // Kill the worker subprocess when handle is dropped
-        let _ = self.child.kill();
-        let _ = self.child.wait();
+        // Stop the worker subprocess when handle is dropped
+        stop_child(&mut self.child, STOP_GRACE);
+    }
+}
+
+/// Asks a worker to exit (SIGTERM, which it handles like ctrl+c), killing it if it's
+/// still running after `grace`
+/// Killing outright would skip the worker's shutdown, leaving notes hanging and, with
+/// some drivers, the port unusable until the device is replugged.
+fn stop_child(child: &mut Child, grace: Duration) {
+    if request_exit(child) {
+        let deadline = Instant::now() + grace;
+        while Instant::now() < deadline {
+            match child.try_wait() {
+                Ok(Some(_)) => return,
+                Ok(None) => std::thread::sleep(Duration::from_millis(10)),
+                Err(_) => break,
+            }
+        }
     }
+    let _ = child.kill();
+    let _ = child.wait();
+}
+
+#[cfg(unix)]
+fn request_exit(child: &Child) -> bool {
+    // SAFETY: kill(2) only signals the process; the pid is our own child, not yet reaped
+    unsafe { libc::kill(child.id() as libc::pid_t, libc::SIGTERM) == 0 }
+}
+
+/// There is no SIGTERM to send here, so the worker is killed straight away
+#[cfg(not(unix))]
+fn request_exit(_child: &Child) -> bool {
+    false
 }
 
 /// Starts a MIDI forwarder subprocess that forwards messages from input to output
@@ -63,3 +97,34 @@ pub fn start_forwarder(
         child,
     })
 }
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use std::os::unix::process::ExitStatusExt;
+
+    #[test]
+    fn test_stop_runs_child_cleanup() {
+        // Stands in for a worker: exits with its own status once asked to stop
+        let mut child = Command::new("sh")
+            .arg("-c")
+            .arg("trap 'exit 7' TERM; while :; do sleep 0.01; done")
+            .spawn()
+            .unwrap();
+        std::thread::sleep(Duration::from_millis(100));
+        stop_child(&mut child, Duration::from_secs(5));
+        assert_eq!(child.wait().unwrap().code(), Some(7));
+    }
+
+    #[test]
+    fn test_stop_kills_after_grace() {
+        let mut child = Command::new("sh")
+            .arg("-c")
+            .arg("trap '' TERM; while :; do sleep 0.01; done")
+            .spawn()
+            .unwrap();
+        std::thread::sleep(Duration::from_millis(100));
+        stop_child(&mut child, Duration::from_millis(50));
+        assert_eq!(child.wait().unwrap().signal(), Some(9));
+    }
+}
@@ -0,0 +1,133 @@
+/// Chord generation for `mc fwd --harmonize`
+/// Each played note also sounds at the configured intervals; releasing it releases the
+/// notes it added. Output notes shared by several played notes are reference counted
+/// so one release doesn't cut off a note another key is still holding
+use std::collections::HashMap;
+
+#[derive(Debug, Clone)]
+pub struct Harmonizer {
+    /// Semitone offsets added to each played note
+    intervals: Vec<i8>,
+    /// Output notes sounding for each held (channel, played note), the played note first
+    held: HashMap<(u8, u8), Vec<u8>>,
+    /// How many held notes are sounding each output note, per channel
+    counts: Vec<[u8; 128]>,
+}
+
+impl Harmonizer {
+    pub fn new(intervals: &[i8]) -> Self {
+        Self {
+            intervals: intervals.to_vec(),
+            held: HashMap::new(),
+            counts: vec![[0; 128]; 16],
+        }
+    }
+
+    /// Returns the messages to send for one input message
+    /// Anything other than Note On/Off passes through unchanged
+    pub fn process(&mut self, msg: &[u8]) -> Vec<Vec<u8>> {
+        let [status, note, velocity] = *msg else {
+            return vec![msg.to_vec()];
+        };
+        let channel = status & 0x0F;
+        match status & 0xF0 {
+            0x90 if velocity > 0 => {
+                // A retrigger without a Note Off releases the previous chord first
+                let mut messages = self.release(channel, note, 0);
+                let notes: Vec<u8> = std::iter::once(note)
+                    .chain(self.intervals.iter().filter_map(|&interval| {
+                        u8::try_from(note as i16 + interval as i16).ok().filter(|&n| n <= 127)
+                    }))
+                    .collect();
+                for &n in &notes {
+                    let count = &mut self.counts[channel as usize][n as usize];
+                    *count = count.saturating_add(1);
+                    messages.push(vec![status, n, velocity]);
+                }
+                self.held.insert((channel, note), notes);
+                messages
+            }
+            0x80 | 0x90 => {
+                if self.held.contains_key(&(channel, note)) {
+                    self.release(channel, note, velocity)
+                } else {
+                    // Not started here (e.g. held before the forward began)
+                    vec![msg.to_vec()]
+                }
+            }
+            _ => vec![msg.to_vec()],
+        }
+    }
+
+    /// Note Offs for the chord of a played note, skipping notes still held by another key
+    fn release(&mut self, channel: u8, note: u8, velocity: u8) -> Vec<Vec<u8>> {
+        let Some(notes) = self.held.remove(&(channel, note)) else {
+            return Vec::new();
+        };
+        let mut messages = Vec::new();
+        for n in notes {
+            let count = &mut self.counts[channel as usize][n as usize];
+            *count = count.saturating_sub(1);
+            if *count == 0 {
+                messages.push(vec![0x80 | channel, n, velocity]);
+            }
+        }
+        messages
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_chord_on_and_off() {
+        let mut harmonizer = Harmonizer::new(&[4, 7]);
+        assert_eq!(
+            harmonizer.process(&[0x90, 60, 100]),
+            vec![vec![0x90, 60, 100], vec![0x90, 64, 100], vec![0x90, 67, 100]]
+        );
+        assert_eq!(
+            harmonizer.process(&[0x80, 60, 40]),
+            vec![vec![0x80, 60, 40], vec![0x80, 64, 40], vec![0x80, 67, 40]]
+        );
+
+        // Note On with velocity 0 releases too
+        harmonizer.process(&[0x91, 60, 100]);
+        assert_eq!(harmonizer.process(&[0x91, 60, 0]).len(), 3);
+    }
+
+    #[test]
+    fn test_out_of_range_notes_are_dropped() {
+        let mut harmonizer = Harmonizer::new(&[-12, 12]);
+        assert_eq!(harmonizer.process(&[0x90, 120, 90]), vec![vec![0x90, 120, 90], vec![0x90, 108, 90]]);
+        assert_eq!(harmonizer.process(&[0x80, 120, 0]), vec![vec![0x80, 120, 0], vec![0x80, 108, 0]]);
+    }
+
+    #[test]
+    fn test_shared_notes_stay_on() {
+        // C (+4 = E) and E played together: releasing C must not cut E
+        let mut harmonizer = Harmonizer::new(&[4]);
+        harmonizer.process(&[0x90, 60, 100]);
+        harmonizer.process(&[0x90, 64, 100]);
+        assert_eq!(harmonizer.process(&[0x80, 60, 0]), vec![vec![0x80, 60, 0]]);
+        assert_eq!(harmonizer.process(&[0x80, 64, 0]), vec![vec![0x80, 64, 0], vec![0x80, 68, 0]]);
+    }
+
+    #[test]
+    fn test_retrigger_and_pass_through() {
+        let mut harmonizer = Harmonizer::new(&[7]);
+        harmonizer.process(&[0x90, 60, 100]);
+        // A second Note On releases the first chord before replaying it
+        assert_eq!(
+            harmonizer.process(&[0x90, 60, 80]),
+            vec![vec![0x80, 60, 0], vec![0x80, 67, 0], vec![0x90, 60, 80], vec![0x90, 67, 80]]
+        );
+        assert_eq!(harmonizer.process(&[0x80, 60, 0]).len(), 2);
+
+        // Unknown Note Off, CC and clock pass through
+        assert_eq!(harmonizer.process(&[0x80, 50, 0]), vec![vec![0x80, 50, 0]]);
+        assert_eq!(harmonizer.process(&[0xB0, 64, 127]), vec![vec![0xB0, 64, 127]]);
+        assert_eq!(harmonizer.process(&[0xF8]), vec![vec![0xF8]]);
+    }
+}
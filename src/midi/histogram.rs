@@ -0,0 +1,120 @@
+/// Note On velocity counts per channel, for `mc monitor --histogram`
+/// The report groups velocities 1-127 into sixteen ranges of eight, one row each, with
+/// bars scaled to the busiest range of the channel; channels without notes are left out.
+use std::fmt::Write;
+
+/// Velocities per row of the report
+const BUCKET_SIZE: u8 = 8;
+
+/// Characters in the longest bar
+const BAR_WIDTH: u64 = 40;
+
+pub struct VelocityHistogram {
+    counts: [[u64; 128]; 16],
+}
+
+impl Default for VelocityHistogram {
+    fn default() -> Self {
+        Self { counts: [[0; 128]; 16] }
+    }
+}
+
+impl VelocityHistogram {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Counts a Note On; anything else, including Note On with velocity 0, is ignored
+    pub fn record(&mut self, msg: &[u8]) {
+        if let [status, _, velocity] = *msg {
+            if status & 0xF0 == 0x90 && velocity > 0 {
+                self.counts[(status & 0x0F) as usize][(velocity & 0x7F) as usize] += 1;
+            }
+        }
+    }
+
+    /// One block per channel that had notes, or a line saying there were none
+    pub fn report(&self) -> String {
+        let mut report = String::new();
+        for (channel, counts) in self.counts.iter().enumerate() {
+            let total: u64 = counts.iter().sum();
+            if total == 0 {
+                continue;
+            }
+            let sum: u64 = counts.iter().enumerate().map(|(v, &n)| v as u64 * n).sum();
+            let _ = writeln!(
+                report,
+                "Channel {} ({} notes, mean velocity {:.1})",
+                channel + 1,
+                total,
+                sum as f64 / total as f64
+            );
+
+            let buckets: Vec<(u8, u8, u64)> = (1..=127u8)
+                .step_by(BUCKET_SIZE as usize)
+                .map(|low| {
+                    let high = low.saturating_add(BUCKET_SIZE - 1).min(127);
+                    (low, high, counts[low as usize..=high as usize].iter().sum())
+                })
+                .collect();
+            let most = buckets.iter().map(|&(_, _, n)| n).max().unwrap_or(1);
+            for (low, high, count) in buckets {
+                // Round up so a range with any notes shows at least one mark
+                let width = (count * BAR_WIDTH).div_ceil(most) as usize;
+                let _ = writeln!(
+                    report,
+                    "  {:>3}-{:<3} |{:<bar$}| {}",
+                    low,
+                    high,
+                    "#".repeat(width),
+                    count,
+                    bar = BAR_WIDTH as usize
+                );
+            }
+        }
+        if report.is_empty() {
+            report.push_str("No Note Ons received\n");
+        }
+        report
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_report() {
+        let mut histogram = VelocityHistogram::new();
+        for _ in 0..4 {
+            histogram.record(&[0x90, 60, 100]);
+        }
+        histogram.record(&[0x90, 60, 1]);
+        histogram.record(&[0x90, 60, 0]);
+        histogram.record(&[0x80, 60, 64]);
+        histogram.record(&[0xB0, 7, 100]);
+
+        let report = histogram.report();
+        let lines: Vec<&str> = report.lines().collect();
+        assert_eq!(lines[0], "Channel 1 (5 notes, mean velocity 80.2)");
+        assert_eq!(lines.len(), 17);
+        assert_eq!(lines[1], format!("    1-8   |{:<40}| 1", "#".repeat(10)));
+        // 100 falls in 97-104, the busiest range, so its bar is full
+        assert_eq!(lines[13], format!("   97-104 |{}| 4", "#".repeat(40)));
+        assert_eq!(lines[16], format!("  121-127 |{:<40}| 0", ""));
+    }
+
+    #[test]
+    fn test_channels() {
+        let mut histogram = VelocityHistogram::new();
+        assert_eq!(histogram.report(), "No Note Ons received\n");
+        histogram.record(&[0x99, 36, 127]);
+        histogram.record(&[0x92, 36, 64]);
+        let report = histogram.report();
+        let headers: Vec<&str> = report.lines().filter(|line| line.starts_with("Channel")).collect();
+        assert_eq!(
+            headers,
+            vec!["Channel 3 (1 notes, mean velocity 64.0)", "Channel 10 (1 notes, mean velocity 127.0)"]
+        );
+    }
+}
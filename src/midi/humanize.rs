@@ -0,0 +1,134 @@
+/// Random timing and velocity variation for `mc fwd --humanize-timing/--humanize-velocity`
+use std::time::Duration;
+
+/// Small seeded generator (SplitMix64), so `--seed` reproduces a run exactly
+#[derive(Debug, Clone)]
+pub struct Rng {
+    state: u64,
+}
+
+impl Rng {
+    pub fn new(seed: u64) -> Self {
+        Self { state: seed }
+    }
+
+    pub fn next_u64(&mut self) -> u64 {
+        self.state = self.state.wrapping_add(0x9E37_79B9_7F4A_7C15);
+        let mut z = self.state;
+        z = (z ^ (z >> 30)).wrapping_mul(0xBF58_476D_1CE4_E5B9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94D0_49BB_1331_11EB);
+        z ^ (z >> 31)
+    }
+
+    /// Uniform value in `0..=max`
+    pub fn below_or_equal(&mut self, max: u64) -> u64 {
+        match max.checked_add(1) {
+            Some(bound) => self.next_u64() % bound,
+            None => self.next_u64(),
+        }
+    }
+}
+
+/// A seed from the clock, for runs without `--seed`
+pub fn time_seed() -> u64 {
+    std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .map(|d| d.as_nanos() as u64)
+        .unwrap_or_default()
+}
+
+#[derive(Debug, Clone)]
+pub struct Humanize {
+    /// Largest delay added to a note
+    timing: Duration,
+    /// Largest change to a Note On velocity, up or down
+    velocity: u8,
+    rng: Rng,
+}
+
+impl Humanize {
+    pub fn new(timing: Duration, velocity: u8, seed: u64) -> Self {
+        Self {
+            timing,
+            velocity,
+            rng: Rng::new(seed),
+        }
+    }
+
+    /// True if sends need to go through the scheduler
+    pub fn delays(&self) -> bool {
+        !self.timing.is_zero()
+    }
+
+    /// Moves a Note On's velocity by up to the configured amount, clamped to 1-127
+    /// so a note is never turned into a Note Off
+    pub fn velocity(&mut self, message: &mut [u8]) {
+        if self.velocity == 0 || message.len() != 3 || message[0] & 0xF0 != 0x90 || message[2] == 0 {
+            return;
+        }
+        let spread = self.velocity as i16;
+        let offset = self.rng.below_or_equal(2 * spread as u64) as i16 - spread;
+        message[2] = (message[2] as i16 + offset).clamp(1, 127) as u8;
+    }
+
+    /// Random delay for a Note On or Note Off; other messages aren't delayed
+    /// Delays only ever push notes later, and the scheduler sends in arrival order,
+    /// so a Note On can't overtake the Note Off before it
+    pub fn delay(&mut self, message: &[u8]) -> Duration {
+        let is_note = matches!(message.first().map(|s| s & 0xF0), Some(0x80 | 0x90));
+        if !is_note || self.timing.is_zero() {
+            return Duration::ZERO;
+        }
+        Duration::from_micros(self.rng.below_or_equal(self.timing.as_micros() as u64))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_seed_is_reproducible() {
+        let mut a = Rng::new(42);
+        let mut b = Rng::new(42);
+        let mut c = Rng::new(43);
+        let run_a: Vec<u64> = (0..8).map(|_| a.next_u64()).collect();
+        let run_b: Vec<u64> = (0..8).map(|_| b.next_u64()).collect();
+        let run_c: Vec<u64> = (0..8).map(|_| c.next_u64()).collect();
+        assert_eq!(run_a, run_b);
+        assert_ne!(run_a, run_c);
+    }
+
+    #[test]
+    fn test_velocity_stays_in_range() {
+        let mut humanize = Humanize::new(Duration::ZERO, 20, 1);
+        for velocity in [1, 64, 127] {
+            for _ in 0..200 {
+                let mut msg = [0x90, 60, velocity];
+                humanize.velocity(&mut msg);
+                assert!((1..=127).contains(&msg[2]));
+                assert!((msg[2] as i16 - velocity as i16).abs() <= 20);
+            }
+        }
+
+        // Note On with velocity 0 is a Note Off and stays one; other messages are untouched
+        let mut off = [0x90, 60, 0];
+        humanize.velocity(&mut off);
+        assert_eq!(off, [0x90, 60, 0]);
+        let mut cc = [0xB0, 7, 100];
+        humanize.velocity(&mut cc);
+        assert_eq!(cc, [0xB0, 7, 100]);
+    }
+
+    #[test]
+    fn test_delay_only_applies_to_notes() {
+        let max = Duration::from_millis(10);
+        let mut humanize = Humanize::new(max, 0, 7);
+        for _ in 0..200 {
+            assert!(humanize.delay(&[0x90, 60, 100]) <= max);
+            assert!(humanize.delay(&[0x80, 60, 0]) <= max);
+        }
+        assert_eq!(humanize.delay(&[0xB0, 7, 100]), Duration::ZERO);
+        assert_eq!(humanize.delay(&[0xF8]), Duration::ZERO);
+    }
+}
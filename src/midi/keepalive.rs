@@ -0,0 +1,111 @@
+/// Active Sensing keep-alive for `--keepalive` on `mc fwd` and `mc port`
+/// A receiver that has seen Active Sensing (FE) expects some message at least every
+/// 300 ms and silences itself when none comes, so an output that has been quiet for
+/// `KEEPALIVE_IDLE` is sent FE. Any other message sent to it restarts the wait.
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::thread::JoinHandle;
+use std::time::{Duration, Instant};
+
+pub const ACTIVE_SENSING: u8 = 0xFE;
+
+/// Quiet time before FE is sent, leaving room within the 300 ms receivers allow
+pub const KEEPALIVE_IDLE: Duration = Duration::from_millis(250);
+
+/// How often the keep-alive thread looks for quiet outputs
+const CHECK_INTERVAL: Duration = Duration::from_millis(25);
+
+/// When an output last sent anything
+#[derive(Debug, Clone, Copy)]
+pub struct Idle {
+    last_sent: Instant,
+}
+
+impl Idle {
+    pub fn new(now: Instant) -> Self {
+        Self { last_sent: now }
+    }
+
+    pub fn sent(&mut self, at: Instant) {
+        self.last_sent = at;
+    }
+
+    /// True once the output has been quiet for `KEEPALIVE_IDLE`; the FE the caller then
+    /// sends counts as sent, so the next is due `KEEPALIVE_IDLE` later
+    pub fn due(&mut self, now: Instant) -> bool {
+        if now.saturating_duration_since(self.last_sent) < KEEPALIVE_IDLE {
+            return false;
+        }
+        self.last_sent = now;
+        true
+    }
+}
+
+/// The thread sending FE to quiet outputs until stopped
+pub struct KeepAlive {
+    stop: Arc<AtomicBool>,
+    thread: JoinHandle<()>,
+}
+
+impl KeepAlive {
+    /// Calls `tick` every `CHECK_INTERVAL`, for it to send FE to whichever outputs are due
+    pub fn start(mut tick: impl FnMut(Instant) + Send + 'static) -> Self {
+        let stop = Arc::new(AtomicBool::new(false));
+        let thread = {
+            let stop = Arc::clone(&stop);
+            std::thread::spawn(move || {
+                while !stop.load(Ordering::Relaxed) {
+                    std::thread::sleep(CHECK_INTERVAL);
+                    tick(Instant::now());
+                }
+            })
+        };
+        Self { stop, thread }
+    }
+
+    /// Returns once the thread has sent its last FE
+    pub fn stop(self) {
+        self.stop.store(true, Ordering::Relaxed);
+        let _ = self.thread.join();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_due_after_quiet() {
+        let start = Instant::now();
+        let mut idle = Idle::new(start);
+        assert!(!idle.due(start + Duration::from_millis(100)));
+        assert!(idle.due(start + KEEPALIVE_IDLE));
+        // The keep-alive itself restarts the wait
+        assert!(!idle.due(start + KEEPALIVE_IDLE + Duration::from_millis(100)));
+        assert!(idle.due(start + KEEPALIVE_IDLE * 2));
+    }
+
+    #[test]
+    fn test_traffic_resets() {
+        let start = Instant::now();
+        let mut idle = Idle::new(start);
+        idle.sent(start + Duration::from_millis(200));
+        assert!(!idle.due(start + Duration::from_millis(300)));
+        assert!(idle.due(start + Duration::from_millis(450)));
+    }
+
+    #[test]
+    fn test_thread_stops() {
+        let ticks = Arc::new(std::sync::atomic::AtomicUsize::new(0));
+        let counted = Arc::clone(&ticks);
+        let keepalive = KeepAlive::start(move |_| {
+            counted.fetch_add(1, Ordering::Relaxed);
+        });
+        std::thread::sleep(CHECK_INTERVAL * 4);
+        keepalive.stop();
+        let stopped = ticks.load(Ordering::Relaxed);
+        assert!(stopped > 0);
+        std::thread::sleep(CHECK_INTERVAL * 2);
+        assert_eq!(ticks.load(Ordering::Relaxed), stopped);
+    }
+}
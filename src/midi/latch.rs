@@ -0,0 +1,70 @@
+/// Toggle notes for `mc fwd --latch`, for pads that only send momentary notes
+/// Every Note On flips its (channel, note) between latched and released, so hitting
+/// the same pad twice in quick succession always ends where it started.
+/// Incoming Note Offs are dropped, since releasing the pad shouldn't stop the note
+use super::notes::ActiveNotes;
+
+#[derive(Debug, Clone, Default)]
+pub struct Latch {
+    latched: ActiveNotes,
+}
+
+impl Latch {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Returns the message to forward, or None to drop it
+    /// Anything other than Note On/Off passes through unchanged
+    pub fn apply(&mut self, msg: &[u8]) -> Option<Vec<u8>> {
+        let [status, note, velocity] = *msg else {
+            return Some(msg.to_vec());
+        };
+        let channel = status & 0x0F;
+        match status & 0xF0 {
+            0x90 if velocity > 0 => {
+                let message = if self.latched.is_on(channel, note) {
+                    vec![0x80 | channel, note, 0]
+                } else {
+                    msg.to_vec()
+                };
+                self.latched.track(&message);
+                Some(message)
+            }
+            0x80 | 0x90 => None,
+            _ => Some(msg.to_vec()),
+        }
+    }
+
+    /// All Notes Off for every channel with latched notes, for shutdown
+    pub fn all_notes_off(&mut self) -> Vec<Vec<u8>> {
+        self.latched.all_notes_off()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_note_on_toggles() {
+        let mut latch = Latch::new();
+        assert_eq!(latch.apply(&[0x90, 60, 100]), Some(vec![0x90, 60, 100]));
+        // Releasing the pad is ignored
+        assert_eq!(latch.apply(&[0x80, 60, 0]), None);
+        assert_eq!(latch.apply(&[0x90, 60, 0]), None);
+        // The next hit releases the note
+        assert_eq!(latch.apply(&[0x90, 60, 90]), Some(vec![0x80, 60, 0]));
+        assert_eq!(latch.apply(&[0x90, 60, 90]), Some(vec![0x90, 60, 90]));
+    }
+
+    #[test]
+    fn test_channels_are_separate() {
+        let mut latch = Latch::new();
+        latch.apply(&[0x90, 60, 100]);
+        assert_eq!(latch.apply(&[0x91, 60, 100]), Some(vec![0x91, 60, 100]));
+        assert_eq!(latch.apply(&[0xB0, 64, 127]), Some(vec![0xB0, 64, 127]));
+        assert_eq!(latch.all_notes_off(), vec![vec![0xB0, 123, 0], vec![0xB1, 123, 0]]);
+        assert!(latch.all_notes_off().is_empty());
+    }
+}
@@ -0,0 +1,115 @@
+/// Channel activity lamps for `mc monitor --meter`
+/// Each channel's lamp stays lit for `METER_HOLD` after a message on it, so a single
+/// short message is still visible at the redraw rate; system messages share one lamp.
+/// The last message shown leaves out realtime (clock, transport, Active Sensing), which
+/// would otherwise hide everything else while a clock runs.
+use super::decode::decode;
+use std::time::{Duration, Instant};
+
+/// How long a lamp stays lit after a message
+pub const METER_HOLD: Duration = Duration::from_millis(150);
+
+/// Lamps per row: channels 1-16, then system messages
+const LAMPS: usize = 17;
+
+#[derive(Debug, Clone, Default)]
+pub struct ActivityMeter {
+    /// When each lamp was last lit
+    last_seen: [Option<Instant>; LAMPS],
+    last_message: Option<Vec<u8>>,
+}
+
+impl ActivityMeter {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn record(&mut self, msg: &[u8], now: Instant) {
+        let Some(&status) = msg.first() else {
+            return;
+        };
+        let lamp = if status < 0xF0 { (status & 0x0F) as usize } else { LAMPS - 1 };
+        self.last_seen[lamp] = Some(now);
+        if status < 0xF8 {
+            self.last_message = Some(msg.to_vec());
+        }
+    }
+
+    /// Whether each lamp has been lit within `window` of `now`
+    fn lit(&self, now: Instant, window: Duration) -> [bool; LAMPS] {
+        self.last_seen
+            .map(|seen| seen.is_some_and(|at| now.saturating_duration_since(at) < window))
+    }
+
+    fn last_line(&self) -> String {
+        match &self.last_message {
+            Some(msg) => format!("last {}", decode(msg)),
+            None => "last -".to_string(),
+        }
+    }
+
+    /// The meter as drawn on a terminal: channel numbers, their lamps, and the last message
+    pub fn lines(&self, now: Instant) -> [String; 3] {
+        let lamps: String = self
+            .lit(now, METER_HOLD)
+            .iter()
+            .map(|&lit| if lit { "#" } else { "." })
+            .map(|lamp| format!("{:>3}", lamp))
+            .collect();
+        // The system lamp sits one column further out, under "sys"
+        let (channels, system) = lamps.split_at(16 * 3);
+        [
+            format!("ch{} sys", (1..=16).map(|ch| format!("{:>3}", ch)).collect::<String>()),
+            format!("  {} {}", channels, system),
+            self.last_line(),
+        ]
+    }
+
+    /// One line for output that isn't a terminal: the channels heard within `window`
+    pub fn summary(&self, now: Instant, window: Duration) -> String {
+        let lit = self.lit(now, window);
+        let mut active: Vec<String> = (1..=16).filter(|&ch| lit[ch - 1]).map(|ch| ch.to_string()).collect();
+        if lit[LAMPS - 1] {
+            active.push("sys".to_string());
+        }
+        let active = if active.is_empty() { "-".to_string() } else { active.join(",") };
+        format!("active {} | {}", active, self.last_line())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_lamps_hold() {
+        let start = Instant::now();
+        let mut meter = ActivityMeter::new();
+        meter.record(&[0x90, 60, 100], start);
+        meter.record(&[0xB9, 7, 100], start);
+        meter.record(&[0xF8], start);
+
+        let [header, lamps, last] = meter.lines(start + Duration::from_millis(50));
+        assert_eq!(header.len(), lamps.len());
+        let lit: Vec<usize> = lamps.match_indices('#').map(|(idx, _)| idx).collect();
+        let columns: Vec<&str> = lit.iter().map(|&idx| header[idx - 2..=idx].trim()).collect();
+        assert_eq!(columns, vec!["1", "10", "sys"]);
+        // The clock doesn't replace the note-worthy message
+        assert_eq!(last, format!("last {}", decode(&[0xB9, 7, 100])));
+
+        let [_, lamps, _] = meter.lines(start + METER_HOLD);
+        assert!(!lamps.contains('#'));
+    }
+
+    #[test]
+    fn test_summary() {
+        let start = Instant::now();
+        let mut meter = ActivityMeter::new();
+        assert_eq!(meter.summary(start, Duration::from_secs(1)), "active - | last -");
+        meter.record(&[0x93, 60, 100], start);
+        meter.record(&[0xF0, 0x7E, 0x7F, 0x06, 0x01, 0xF7], start);
+        let summary = meter.summary(start + Duration::from_millis(500), Duration::from_secs(1));
+        assert!(summary.starts_with("active 4,sys | last "));
+        assert!(meter.summary(start + Duration::from_secs(2), Duration::from_secs(1)).starts_with("active - |"));
+    }
+}
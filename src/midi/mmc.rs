@@ -0,0 +1,103 @@
+/// MIDI Machine Control transport commands, for `mc fwd --mmc-bridge`
+/// MMC commands are Universal Real Time SysEx: F0 7F <device> 06 <command> F7. Some
+/// gear follows those, some the realtime Start/Continue/Stop bytes; the bridge turns
+/// one into the other using the table below. Other MMC commands (locate, record,
+/// shuttle...) have no realtime equivalent and pass through unchanged.
+use super::clock::{CONTINUE, START, STOP};
+
+pub const MMC_STOP: u8 = 0x01;
+pub const MMC_PLAY: u8 = 0x02;
+pub const MMC_DEFERRED_PLAY: u8 = 0x03;
+pub const MMC_PAUSE: u8 = 0x09;
+
+/// Device ID that addresses every MMC receiver
+const ALL_CALL: u8 = 0x7F;
+
+/// Which way `--mmc-bridge` converts
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum MmcBridge {
+    /// MMC Play and Deferred Play become Start; Stop and Pause become Stop
+    ToRealtime,
+    /// Start and Continue become MMC Play; Stop becomes MMC Stop, sent to all devices
+    ToMmc,
+}
+
+impl std::str::FromStr for MmcBridge {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "to-realtime" => Ok(MmcBridge::ToRealtime),
+            "to-mmc" => Ok(MmcBridge::ToMmc),
+            _ => Err(format!("Unknown MMC bridge '{}' (expected to-realtime or to-mmc)", s)),
+        }
+    }
+}
+
+impl std::fmt::Display for MmcBridge {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            MmcBridge::ToRealtime => "to-realtime",
+            MmcBridge::ToMmc => "to-mmc",
+        })
+    }
+}
+
+/// The command byte of a single-command MMC message, whatever device it addresses
+pub fn mmc_command(msg: &[u8]) -> Option<u8> {
+    match *msg {
+        [0xF0, 0x7F, _, 0x06, command, 0xF7] => Some(command),
+        _ => None,
+    }
+}
+
+/// An MMC command addressed to every device
+pub fn mmc_message(command: u8) -> Vec<u8> {
+    vec![0xF0, 0x7F, ALL_CALL, 0x06, command, 0xF7]
+}
+
+impl MmcBridge {
+    /// The converted message, or None if `msg` isn't covered by the table
+    pub fn convert(self, msg: &[u8]) -> Option<Vec<u8>> {
+        match self {
+            MmcBridge::ToRealtime => match mmc_command(msg)? {
+                MMC_PLAY | MMC_DEFERRED_PLAY => Some(vec![START]),
+                MMC_STOP | MMC_PAUSE => Some(vec![STOP]),
+                _ => None,
+            },
+            MmcBridge::ToMmc => match *msg {
+                [START] | [CONTINUE] => Some(mmc_message(MMC_PLAY)),
+                [STOP] => Some(mmc_message(MMC_STOP)),
+                _ => None,
+            },
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_mmc_to_realtime() {
+        let bridge = MmcBridge::ToRealtime;
+        // Any device ID is recognised
+        assert_eq!(bridge.convert(&[0xF0, 0x7F, 0x10, 0x06, 0x02, 0xF7]), Some(vec![START]));
+        assert_eq!(bridge.convert(&[0xF0, 0x7F, 0x7F, 0x06, 0x09, 0xF7]), Some(vec![STOP]));
+        // Record Strobe has no realtime equivalent
+        assert_eq!(bridge.convert(&[0xF0, 0x7F, 0x7F, 0x06, 0x06, 0xF7]), None);
+        // Not MMC: Universal Non-Real Time, and realtime bytes themselves
+        assert_eq!(bridge.convert(&[0xF0, 0x7E, 0x7F, 0x06, 0x02, 0xF7]), None);
+        assert_eq!(bridge.convert(&[START]), None);
+    }
+
+    #[test]
+    fn test_realtime_to_mmc() {
+        let bridge = MmcBridge::ToMmc;
+        assert_eq!(bridge.convert(&[START]), Some(mmc_message(MMC_PLAY)));
+        assert_eq!(bridge.convert(&[CONTINUE]), Some(mmc_message(MMC_PLAY)));
+        assert_eq!(bridge.convert(&[STOP]), Some(vec![0xF0, 0x7F, 0x7F, 0x06, 0x01, 0xF7]));
+        assert_eq!(bridge.convert(&[0xF8]), None);
+        assert_eq!(bridge.convert(&mmc_message(MMC_PLAY)), None);
+    }
+}
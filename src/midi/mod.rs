@@ -1,7 +1,49 @@
+pub mod arp;
+pub mod bench;
+pub mod buffer;
+pub mod cc14;
+pub mod clock;
+pub mod decode;
+pub mod dedup;
+pub mod delay;
+pub mod echo;
+pub mod error;
+pub mod eventlog;
+pub mod filter;
 pub mod forwarder;
+pub mod harmonize;
+pub mod histogram;
+pub mod humanize;
+pub mod keepalive;
+pub mod latch;
 pub mod manager;
+pub mod meter;
+pub mod mmc;
 pub mod monitor;
+pub mod mtc;
+pub mod notes;
+pub mod parser;
+pub mod pedal;
+pub mod pipeline;
+pub mod port;
+pub mod ports;
+pub mod quantize;
+pub mod recorder;
+pub mod reset;
+pub mod schedule;
+pub mod send;
+pub mod smf;
+pub mod spp;
+pub mod stats;
+pub mod stuck;
+pub mod sysex;
+pub mod throttle;
+pub mod timeline;
+pub mod transform;
+pub mod trigger;
+pub mod ump;
 pub mod validation;
 pub mod virtual_ports;
+pub mod zones;
 
 pub use manager::MidiManager;
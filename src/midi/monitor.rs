@@ -35,7 +35,7 @@ pub mod macos {
                         // Check if devices changed
                         if devices_json != previous_devices && !previous_devices.is_empty() {
                             // Parse the JSON to extract device names
-                            if let Ok(parsed) = parse_port_json(&devices_json) {
+                            if let Ok(parsed) = super::parse_port_json(&devices_json) {
                                 let _ = event_tx.send(AppEvent::PortListUpdate {
                                     inputs: parsed.0,
                                     outputs: parsed.1,
@@ -52,49 +52,6 @@ pub mod macos {
         Ok(())
     }
 
-    /// Parse JSON output from --list-ports into PortId vectors
-    pub(super) fn parse_port_json(json: &str) -> Result<(Vec<crate::connection::PortId>, Vec<crate::connection::PortId>), Box<dyn std::error::Error>> {
-        use crate::connection::PortId;
-        use crate::midi::virtual_ports::{
-            VIRTUAL_INPUT_A_NAME, VIRTUAL_INPUT_B_NAME,
-            VIRTUAL_OUTPUT_A_NAME, VIRTUAL_OUTPUT_B_NAME
-        };
-
-        // Simple JSON parsing (we control the format)
-        let mut inputs = Vec::new();
-        let mut outputs = Vec::new();
-        let mut in_inputs = false;
-        let mut in_outputs = false;
-
-        for line in json.lines() {
-            let trimmed = line.trim();
-            if trimmed.contains("\"inputs\"") {
-                in_inputs = true;
-                in_outputs = false;
-            } else if trimmed.contains("\"outputs\"") {
-                in_inputs = false;
-                in_outputs = true;
-            } else if trimmed.starts_with('"') && trimmed.len() > 2 {
-                // Extract device name between quotes
-                if let Some(end_quote) = trimmed[1..].find('"') {
-                    let name = &trimmed[1..end_quote + 1];
-                    let is_virtual = name == VIRTUAL_INPUT_A_NAME
-                        || name == VIRTUAL_INPUT_B_NAME
-                        || name == VIRTUAL_OUTPUT_A_NAME
-                        || name == VIRTUAL_OUTPUT_B_NAME;
-                    let port = PortId::new(name.to_string(), is_virtual);
-
-                    if in_inputs {
-                        inputs.push(port);
-                    } else if in_outputs {
-                        outputs.push(port);
-                    }
-                }
-            }
-        }
-
-        Ok((inputs, outputs))
-    }
 }
 
 #[cfg(not(target_os = "macos"))]
@@ -132,7 +89,7 @@ pub mod other {
                         // Check if devices changed
                         if devices_json != previous_devices && !previous_devices.is_empty() {
                             // Parse the JSON to extract device names
-                            if let Ok(parsed) = super::macos::parse_port_json(&devices_json) {
+                            if let Ok(parsed) = super::parse_port_json(&devices_json) {
                                 let _ = event_tx.send(AppEvent::PortListUpdate {
                                     inputs: parsed.0,
                                     outputs: parsed.1,
@@ -149,3 +106,47 @@ pub mod other {
         Ok(())
     }
 }
+
+/// Parse JSON output from --list-ports into PortId vectors
+fn parse_port_json(json: &str) -> Result<(Vec<crate::connection::PortId>, Vec<crate::connection::PortId>), Box<dyn std::error::Error>> {
+    use crate::connection::PortId;
+    use crate::midi::virtual_ports::{
+        VIRTUAL_INPUT_A_NAME, VIRTUAL_INPUT_B_NAME,
+        VIRTUAL_OUTPUT_A_NAME, VIRTUAL_OUTPUT_B_NAME
+    };
+
+    // Simple JSON parsing (we control the format)
+    let mut inputs = Vec::new();
+    let mut outputs = Vec::new();
+    let mut in_inputs = false;
+    let mut in_outputs = false;
+
+    for line in json.lines() {
+        let trimmed = line.trim();
+        if trimmed.contains("\"inputs\"") {
+            in_inputs = true;
+            in_outputs = false;
+        } else if trimmed.contains("\"outputs\"") {
+            in_inputs = false;
+            in_outputs = true;
+        } else if trimmed.starts_with('"') && trimmed.len() > 2 {
+            // Extract device name between quotes
+            if let Some(end_quote) = trimmed[1..].find('"') {
+                let name = &trimmed[1..end_quote + 1];
+                let is_virtual = name == VIRTUAL_INPUT_A_NAME
+                    || name == VIRTUAL_INPUT_B_NAME
+                    || name == VIRTUAL_OUTPUT_A_NAME
+                    || name == VIRTUAL_OUTPUT_B_NAME;
+                let port = PortId::new(name.to_string(), is_virtual);
+
+                if in_inputs {
+                    inputs.push(port);
+                } else if in_outputs {
+                    outputs.push(port);
+                }
+            }
+        }
+    }
+
+    Ok((inputs, outputs))
+}
@@ -0,0 +1,251 @@
+/// MIDI Time Code reading for `mc mtc`
+/// Quarter Frame messages (F1 0nnn dddd) carry one nibble of the time each, piece 0
+/// (frames, low nibble) through piece 7 (hours high bit and frame rate). A full time is
+/// known after all eight, by which point two frames have passed, so running forward the
+/// reader adds those two frames. Pieces arriving 7 to 0 mean the source runs in reverse.
+/// Full Frame SysEx (F0 7F <device> 01 01 hh mm ss ff F7), sent when a source locates,
+/// sets the time at once.
+use std::fmt;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum FrameRate {
+    Fps24,
+    Fps25,
+    /// 29.97 drop-frame: frames 0 and 1 are skipped at each minute except every tenth
+    Fps2997Drop,
+    Fps30,
+}
+
+impl FrameRate {
+    /// The rate in the two rate bits of the hours byte
+    fn from_bits(bits: u8) -> Self {
+        match bits & 0x03 {
+            0 => FrameRate::Fps24,
+            1 => FrameRate::Fps25,
+            2 => FrameRate::Fps2997Drop,
+            _ => FrameRate::Fps30,
+        }
+    }
+
+    /// Frame numbers per second
+    fn frames(self) -> u8 {
+        match self {
+            FrameRate::Fps24 => 24,
+            FrameRate::Fps25 => 25,
+            FrameRate::Fps2997Drop | FrameRate::Fps30 => 30,
+        }
+    }
+}
+
+impl fmt::Display for FrameRate {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            FrameRate::Fps24 => "24 fps",
+            FrameRate::Fps25 => "25 fps",
+            FrameRate::Fps2997Drop => "29.97 fps drop-frame",
+            FrameRate::Fps30 => "30 fps",
+        })
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Timecode {
+    pub hours: u8,
+    pub minutes: u8,
+    pub seconds: u8,
+    pub frames: u8,
+    pub rate: FrameRate,
+}
+
+impl Timecode {
+    /// From the hours byte (rate in bits 5-6) and the other fields, as MTC sends them
+    fn from_fields(hours: u8, minutes: u8, seconds: u8, frames: u8) -> Self {
+        Self {
+            hours: hours & 0x1F,
+            minutes: minutes & 0x3F,
+            seconds: seconds & 0x3F,
+            frames: frames & 0x1F,
+            rate: FrameRate::from_bits(hours >> 5),
+        }
+    }
+
+    /// The next frame, skipping the frame numbers drop-frame leaves out
+    fn next_frame(self) -> Self {
+        let mut next = self;
+        next.frames += 1;
+        if next.frames < self.rate.frames() {
+            return next;
+        }
+        next.frames = 0;
+        next.seconds += 1;
+        if next.seconds == 60 {
+            next.seconds = 0;
+            next.minutes += 1;
+            if next.minutes == 60 {
+                next.minutes = 0;
+                next.hours = (next.hours + 1) % 24;
+            }
+            if self.rate == FrameRate::Fps2997Drop && next.minutes % 10 != 0 {
+                next.frames = 2;
+            }
+        }
+        next
+    }
+}
+
+impl fmt::Display for Timecode {
+    /// HH:MM:SS:FF, with `;` before the frames for drop-frame as is customary
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let separator = if self.rate == FrameRate::Fps2997Drop { ';' } else { ':' };
+        write!(
+            f,
+            "{:02}:{:02}:{:02}{}{:02}",
+            self.hours, self.minutes, self.seconds, separator, self.frames
+        )
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Direction {
+    Forward,
+    Reverse,
+}
+
+/// Reassembles Quarter Frames into times
+#[derive(Debug, Clone, Default)]
+pub struct MtcReader {
+    nibbles: [u8; 8],
+    /// Bit n set once piece n has arrived in the current run
+    received: u8,
+    last_piece: Option<u8>,
+    direction: Option<Direction>,
+}
+
+impl MtcReader {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// The time once a message completes one, with the direction it runs in
+    /// (None for a Full Frame, which doesn't run)
+    pub fn push(&mut self, msg: &[u8]) -> Option<(Timecode, Option<Direction>)> {
+        match *msg {
+            [0xF1, data] => self.quarter_frame(data >> 4 & 0x07, data & 0x0F),
+            [0xF0, 0x7F, _, 0x01, 0x01, hours, minutes, seconds, frames, 0xF7] => {
+                *self = Self::new();
+                Some((Timecode::from_fields(hours, minutes, seconds, frames), None))
+            }
+            _ => None,
+        }
+    }
+
+    fn quarter_frame(&mut self, piece: u8, nibble: u8) -> Option<(Timecode, Option<Direction>)> {
+        let direction = match self.last_piece {
+            Some(last) if piece == (last + 1) % 8 => Some(Direction::Forward),
+            Some(last) if piece == (last + 7) % 8 => Some(Direction::Reverse),
+            _ => None,
+        };
+        // A skipped piece or a change of direction starts a new run
+        if direction.is_none() || (self.direction.is_some() && direction != self.direction) {
+            self.received = 0;
+        }
+        self.direction = direction;
+        self.last_piece = Some(piece);
+        self.nibbles[piece as usize] = nibble;
+        self.received |= 1 << piece;
+
+        let direction = self.direction?;
+        let last = if direction == Direction::Forward { 7 } else { 0 };
+        if piece != last || self.received != 0xFF {
+            return None;
+        }
+        let byte = |low: usize| self.nibbles[low] | self.nibbles[low + 1] << 4;
+        let timecode = Timecode::from_fields(byte(6), byte(4), byte(2), byte(0));
+        let timecode = match direction {
+            Direction::Forward => timecode.next_frame().next_frame(),
+            Direction::Reverse => timecode,
+        };
+        Some((timecode, Some(direction)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// The eight Quarter Frames for a time, in sending order
+    fn quarter_frames(hours: u8, minutes: u8, seconds: u8, frames: u8) -> Vec<[u8; 2]> {
+        let fields = [frames, seconds, minutes, hours];
+        (0..8u8)
+            .map(|piece| {
+                let byte = fields[piece as usize / 2];
+                let nibble = if piece % 2 == 0 { byte & 0x0F } else { byte >> 4 };
+                [0xF1, piece << 4 | nibble]
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_forward_quarter_frames() {
+        let mut reader = MtcReader::new();
+        // 25 fps (rate bits 01), 01:02:03:04
+        let messages = quarter_frames(0x20 | 1, 2, 3, 4);
+        for msg in &messages[..7] {
+            assert_eq!(reader.push(msg), None);
+        }
+        let (timecode, direction) = reader.push(&messages[7]).unwrap();
+        assert_eq!(direction, Some(Direction::Forward));
+        assert_eq!(timecode.rate, FrameRate::Fps25);
+        // Two frames passed while the pieces were sent
+        assert_eq!(timecode.to_string(), "01:02:03:06");
+    }
+
+    #[test]
+    fn test_starting_mid_cycle() {
+        let mut reader = MtcReader::new();
+        let messages = quarter_frames(0, 0, 10, 0);
+        // Joining at piece 4 needs the next full cycle
+        for msg in &messages[4..] {
+            assert_eq!(reader.push(msg), None);
+        }
+        for msg in &messages[..7] {
+            assert_eq!(reader.push(msg), None);
+        }
+        assert!(reader.push(&messages[7]).is_some());
+    }
+
+    #[test]
+    fn test_reverse() {
+        let mut reader = MtcReader::new();
+        let messages = quarter_frames(0x60, 0, 0, 12);
+        for msg in messages[1..].iter().rev() {
+            assert_eq!(reader.push(msg), None);
+        }
+        let (timecode, direction) = reader.push(&messages[0]).unwrap();
+        assert_eq!(direction, Some(Direction::Reverse));
+        assert_eq!(timecode.rate, FrameRate::Fps30);
+        assert_eq!(timecode.to_string(), "00:00:00:12");
+    }
+
+    #[test]
+    fn test_full_frame() {
+        let mut reader = MtcReader::new();
+        let (timecode, direction) = reader
+            .push(&[0xF0, 0x7F, 0x7F, 0x01, 0x01, 0x40 | 10, 20, 30, 15, 0xF7])
+            .unwrap();
+        assert_eq!(direction, None);
+        assert_eq!(timecode.to_string(), "10:20:30;15");
+        assert_eq!(reader.push(&[0xF0, 0x7E, 0x7F, 0x06, 0x01, 0xF7]), None);
+    }
+
+    #[test]
+    fn test_frame_carry() {
+        let timecode = Timecode::from_fields(0x40 | 1, 0, 59, 29).next_frame();
+        // Drop-frame skips frames 0 and 1 at minute 1
+        assert_eq!(timecode.to_string(), "01:01:00;02");
+        let timecode = Timecode::from_fields(0x40 | 1, 9, 59, 29).next_frame();
+        assert_eq!(timecode.to_string(), "01:10:00;00");
+        let timecode = Timecode::from_fields(23, 59, 59, 23).next_frame();
+        assert_eq!(timecode.to_string(), "00:00:00:00");
+    }
+}
@@ -0,0 +1,181 @@
+/// Tracks which notes are sounding on each channel
+/// Used to silence hanging notes when a command stops mid-performance
+#[derive(Debug, Clone, Default)]
+pub struct ActiveNotes {
+    /// Bitmask of sounding notes per channel (bit n = note n)
+    notes: [u128; 16],
+}
+
+/// CC 123, All Notes Off
+const ALL_NOTES_OFF: u8 = 123;
+
+/// CC 120, All Sound Off
+const ALL_SOUND_OFF: u8 = 120;
+
+/// How notes still sounding are silenced on shutdown (`--panic-mode`)
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum PanicMode {
+    /// A Note Off for each sounding note, which every synth understands
+    #[default]
+    NoteOff,
+    /// CC 123 on each channel with sounding notes; some synths ignore it
+    AllNotesOff,
+    /// CC 120 on each channel with sounding notes, which also cuts release tails
+    AllSoundOff,
+}
+
+impl std::str::FromStr for PanicMode {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "note-off" => Ok(PanicMode::NoteOff),
+            "all-notes-off" => Ok(PanicMode::AllNotesOff),
+            "all-sound-off" => Ok(PanicMode::AllSoundOff),
+            _ => Err(format!(
+                "Unknown panic mode '{}' (expected note-off, all-notes-off or all-sound-off)",
+                s
+            )),
+        }
+    }
+}
+
+impl std::fmt::Display for PanicMode {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            PanicMode::NoteOff => "note-off",
+            PanicMode::AllNotesOff => "all-notes-off",
+            PanicMode::AllSoundOff => "all-sound-off",
+        })
+    }
+}
+
+impl ActiveNotes {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Updates the tracked state from a message that was sent
+    pub fn track(&mut self, msg: &[u8]) {
+        if let [status, note, velocity] = *msg {
+            let channel = (status & 0x0F) as usize;
+            let bit = 1u128 << (note & 0x7F);
+            match status & 0xF0 {
+                0x90 if velocity > 0 => self.notes[channel] |= bit,
+                0x80 | 0x90 => self.notes[channel] &= !bit,
+                _ => {}
+            }
+        }
+    }
+
+    /// True if `note` is sounding on the 0-based `channel`
+    pub fn is_on(&self, channel: u8, note: u8) -> bool {
+        self.notes[(channel & 0x0F) as usize] & (1u128 << (note & 0x7F)) != 0
+    }
+
+    /// How many notes are sounding across all channels
+    pub fn len(&self) -> usize {
+        self.notes.iter().map(|notes| notes.count_ones() as usize).sum()
+    }
+
+    /// A Note Off for every sounding note, clearing the tracked state
+    pub fn note_offs(&mut self) -> Vec<Vec<u8>> {
+        let mut messages = Vec::new();
+        for (channel, notes) in self.notes.iter_mut().enumerate() {
+            for note in 0..128u8 {
+                if *notes & (1 << note) != 0 {
+                    messages.push(vec![0x80 | channel as u8, note, 0]);
+                }
+            }
+            *notes = 0;
+        }
+        messages
+    }
+
+    /// An All Notes Off (CC 123) for every channel with sounding notes, clearing the tracked state
+    pub fn all_notes_off(&mut self) -> Vec<Vec<u8>> {
+        self.channel_mode(ALL_NOTES_OFF)
+    }
+
+    /// What `mode` sends to silence every sounding note, clearing the tracked state
+    pub fn panic(&mut self, mode: PanicMode) -> Vec<Vec<u8>> {
+        match mode {
+            PanicMode::NoteOff => self.note_offs(),
+            PanicMode::AllNotesOff => self.all_notes_off(),
+            PanicMode::AllSoundOff => self.channel_mode(ALL_SOUND_OFF),
+        }
+    }
+
+    /// Channel mode message `controller` for every channel with sounding notes
+    fn channel_mode(&mut self, controller: u8) -> Vec<Vec<u8>> {
+        let mut messages = Vec::new();
+        for (channel, notes) in self.notes.iter_mut().enumerate() {
+            if *notes != 0 {
+                messages.push(vec![0xB0 | channel as u8, controller, 0]);
+            }
+            *notes = 0;
+        }
+        messages
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_note_on_and_off() {
+        let mut notes = ActiveNotes::new();
+        notes.track(&[0x90, 60, 100]);
+        notes.track(&[0x90, 64, 100]);
+        notes.track(&[0x80, 60, 0]);
+        assert!(!notes.is_on(0, 60));
+        assert!(notes.is_on(0, 64));
+        assert_eq!(notes.note_offs(), vec![vec![0x80, 64, 0]]);
+        assert!(notes.note_offs().is_empty());
+    }
+
+    #[test]
+    fn test_velocity_zero_releases() {
+        let mut notes = ActiveNotes::new();
+        notes.track(&[0x92, 60, 100]);
+        notes.track(&[0x92, 60, 0]);
+        assert!(notes.note_offs().is_empty());
+    }
+
+    #[test]
+    fn test_all_notes_off_per_channel() {
+        let mut notes = ActiveNotes::new();
+        notes.track(&[0x90, 60, 100]);
+        notes.track(&[0x90, 64, 100]);
+        notes.track(&[0x99, 36, 127]);
+        notes.track(&[0xB3, 7, 100]);
+        assert_eq!(
+            notes.all_notes_off(),
+            vec![vec![0xB0, 123, 0], vec![0xB9, 123, 0]]
+        );
+        assert!(notes.all_notes_off().is_empty());
+    }
+
+    #[test]
+    fn test_panic_modes() {
+        let sounding = || {
+            let mut notes = ActiveNotes::new();
+            notes.track(&[0x90, 60, 100]);
+            notes.track(&[0x90, 64, 100]);
+            notes.track(&[0x9F, 36, 127]);
+            notes
+        };
+        assert_eq!(
+            sounding().panic(PanicMode::NoteOff),
+            vec![vec![0x80, 60, 0], vec![0x80, 64, 0], vec![0x8F, 36, 0]]
+        );
+        assert_eq!(sounding().panic(PanicMode::AllNotesOff), vec![vec![0xB0, 123, 0], vec![0xBF, 123, 0]]);
+        assert_eq!(sounding().panic(PanicMode::AllSoundOff), vec![vec![0xB0, 120, 0], vec![0xBF, 120, 0]]);
+        assert!(ActiveNotes::new().panic(PanicMode::AllSoundOff).is_empty());
+
+        assert_eq!("all-sound-off".parse(), Ok(PanicMode::AllSoundOff));
+        assert_eq!(PanicMode::default(), PanicMode::NoteOff);
+        assert!("cc123".parse::<PanicMode>().is_err());
+    }
+}
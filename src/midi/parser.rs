@@ -0,0 +1,305 @@
+use super::ump;
+use crate::logging::info;
+
+/// Splits raw MIDI byte streams into discrete messages
+/// Drivers (and the pipe worker's stdin) may deliver several messages in one buffer,
+/// possibly using running status, so buffers can't be forwarded as a single message
+#[derive(Debug, Clone, Default)]
+pub struct MessageParser {
+    /// Last channel status byte, reused for data bytes without a status
+    running_status: Option<u8>,
+    /// Message currently being assembled (including SysEx spanning several buffers)
+    pending: Vec<u8>,
+    /// Pass on Note On/Off missing their velocity byte, see `with_short_notes`
+    short_notes: bool,
+}
+
+/// Largest SysEx message we'll buffer before discarding it
+pub const MAX_SYSEX_LEN: usize = 64 * 1024;
+
+/// Number of data bytes following a status byte, None for SysEx (variable length)
+pub fn data_length(status: u8) -> Option<usize> {
+    match status {
+        0x80..=0xBF | 0xE0..=0xEF => Some(2),
+        0xC0..=0xDF => Some(1),
+        0xF0 => None,
+        0xF1 | 0xF3 => Some(1),
+        0xF2 => Some(2),
+        _ => Some(0),
+    }
+}
+
+impl MessageParser {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Some drivers deliver a Note Off without its velocity byte, which would otherwise wait
+    /// for a byte that never comes and be lost to the next status byte. With this set, a
+    /// Note On/Off cut short by a status byte or the end of a buffer is returned as it is,
+    /// two bytes long, for `complete_short_note` (`--normalize`). This assumes the driver
+    /// never splits a note across buffers
+    pub fn with_short_notes(mut self, enabled: bool) -> Self {
+        self.short_notes = enabled;
+        self
+    }
+
+    /// The pending message if it's a note one byte short, with `short_notes` set
+    fn take_short_note(&mut self) -> Option<Vec<u8>> {
+        let short = self.short_notes && self.pending.len() == 2 && matches!(self.pending[0] & 0xF0, 0x80 | 0x90);
+        short.then(|| std::mem::take(&mut self.pending))
+    }
+
+    /// Parses a buffer and returns every complete message it contains
+    /// Incomplete trailing messages (including chunked SysEx) are kept and completed by the next call
+    pub fn push(&mut self, bytes: &[u8]) -> Vec<Vec<u8>> {
+        // Leading data bytes with nothing to attach to would be dropped; check whether the
+        // driver is sending MIDI 2.0 packets instead (see `ump`)
+        if self.pending.is_empty() && self.running_status.is_none() {
+            if let Some(decoded) = ump::decode(bytes) {
+                ump::report(&decoded);
+                return decoded.messages;
+            }
+        }
+
+        let mut messages = Vec::new();
+
+        for &byte in bytes {
+            // Realtime bytes may appear anywhere and never affect running status
+            if byte >= 0xF8 {
+                messages.push(vec![byte]);
+                continue;
+            }
+
+            if byte >= 0x80 {
+                if self.pending.first() == Some(&0xF0) {
+                    if byte == 0xF7 {
+                        // Complete SysEx, forwarded as one message
+                        self.pending.push(byte);
+                        messages.push(std::mem::take(&mut self.pending));
+                        continue;
+                    }
+                    // Any other status byte aborts the SysEx
+                    info!(
+                        "Discarding unterminated SysEx ({} bytes) interrupted by status 0x{:02X}",
+                        self.pending.len(),
+                        byte
+                    );
+                    self.pending.clear();
+                }
+
+                // EOX without a SysEx in progress (e.g. tail of a discarded dump)
+                if byte == 0xF7 {
+                    continue;
+                }
+
+                if let Some(note) = self.take_short_note() {
+                    messages.push(note);
+                }
+
+                // System common messages cancel running status
+                self.running_status = if byte < 0xF0 { Some(byte) } else { None };
+                self.pending = vec![byte];
+            } else if self.pending.is_empty() {
+                match self.running_status {
+                    Some(status) => self.pending = vec![status, byte],
+                    // Stray data byte with no status to attach to
+                    None => continue,
+                }
+            } else {
+                self.pending.push(byte);
+
+                // Guard against unbounded growth from a SysEx that never ends
+                if self.pending[0] == 0xF0 && self.pending.len() > MAX_SYSEX_LEN {
+                    info!("Discarding SysEx larger than {} bytes", MAX_SYSEX_LEN);
+                    self.pending.clear();
+                    continue;
+                }
+            }
+
+            if let Some(len) = data_length(self.pending[0]) {
+                if self.pending.len() == len + 1 {
+                    messages.push(std::mem::take(&mut self.pending));
+                }
+            }
+        }
+        if let Some(note) = self.take_short_note() {
+            messages.push(note);
+        }
+
+        messages
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_single_messages() {
+        let mut parser = MessageParser::new();
+        assert_eq!(parser.push(&[0x90, 0x3C, 0x64]), vec![vec![0x90, 0x3C, 0x64]]);
+        assert_eq!(parser.push(&[0xC0, 0x05]), vec![vec![0xC0, 0x05]]);
+        assert_eq!(parser.push(&[0xF8]), vec![vec![0xF8]]);
+    }
+
+    #[test]
+    fn test_program_change_followed_by_cc() {
+        let mut parser = MessageParser::new();
+        assert_eq!(
+            parser.push(&[0xC0, 0x05, 0xB0, 0x07, 0x7F]),
+            vec![vec![0xC0, 0x05], vec![0xB0, 0x07, 0x7F]]
+        );
+    }
+
+    #[test]
+    fn test_running_status() {
+        let mut parser = MessageParser::new();
+
+        // Two notes sharing one status byte
+        assert_eq!(
+            parser.push(&[0x90, 0x3C, 0x64, 0x40, 0x64]),
+            vec![vec![0x90, 0x3C, 0x64], vec![0x90, 0x40, 0x64]]
+        );
+
+        // Running status carries across buffers
+        assert_eq!(parser.push(&[0x43, 0x00]), vec![vec![0x90, 0x43, 0x00]]);
+
+        // A batched second program change is kept rather than truncated
+        assert_eq!(
+            parser.push(&[0xC0, 0x05, 0x06]),
+            vec![vec![0xC0, 0x05], vec![0xC0, 0x06]]
+        );
+    }
+
+    #[test]
+    fn test_split_across_buffers() {
+        let mut parser = MessageParser::new();
+        assert!(parser.push(&[0xB0, 0x07]).is_empty());
+        assert_eq!(parser.push(&[0x7F]), vec![vec![0xB0, 0x07, 0x7F]]);
+    }
+
+    #[test]
+    fn test_system_common_cancels_running_status() {
+        let mut parser = MessageParser::new();
+        assert_eq!(
+            parser.push(&[0x90, 0x3C, 0x64, 0xF2, 0x10, 0x20, 0x3C, 0x00]),
+            vec![vec![0x90, 0x3C, 0x64], vec![0xF2, 0x10, 0x20]]
+        );
+    }
+
+    #[test]
+    fn test_sysex() {
+        let mut parser = MessageParser::new();
+        assert_eq!(
+            parser.push(&[0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7, 0xC1, 0x02]),
+            vec![vec![0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7], vec![0xC1, 0x02]]
+        );
+    }
+
+    #[test]
+    fn test_stray_data_dropped() {
+        let mut parser = MessageParser::new();
+        assert!(parser.push(&[0x3C, 0x64]).is_empty());
+    }
+
+    #[test]
+    fn test_sysex_across_buffers() {
+        let mut parser = MessageParser::new();
+        assert!(parser.push(&[0xF0, 0x43, 0x12]).is_empty());
+        assert!(parser.push(&[0x00, 0x01]).is_empty());
+        assert_eq!(
+            parser.push(&[0x02, 0xF7, 0x90, 0x3C, 0x64]),
+            vec![vec![0xF0, 0x43, 0x12, 0x00, 0x01, 0x02, 0xF7], vec![0x90, 0x3C, 0x64]]
+        );
+    }
+
+    #[test]
+    fn test_realtime_inside_sysex() {
+        let mut parser = MessageParser::new();
+        assert_eq!(parser.push(&[0xF0, 0x43, 0xF8, 0x12]), vec![vec![0xF8]]);
+        assert_eq!(
+            parser.push(&[0xFE, 0x00, 0xF7]),
+            vec![vec![0xFE], vec![0xF0, 0x43, 0x12, 0x00, 0xF7]]
+        );
+    }
+
+    #[test]
+    fn test_sysex_overflow_discarded() {
+        let mut parser = MessageParser::new();
+        parser.push(&[0xF0]);
+        let chunk = vec![0x01; 1024];
+        for _ in 0..64 {
+            assert!(parser.push(&chunk).is_empty());
+        }
+
+        // The tail of the oversized dump (including its EOX) is dropped too
+        assert!(parser.push(&[0x01, 0x02, 0xF7]).is_empty());
+
+        // Parsing continues normally afterwards
+        assert_eq!(parser.push(&[0xC0, 0x05]), vec![vec![0xC0, 0x05]]);
+    }
+
+    #[test]
+    fn test_sysex_interrupted_by_status() {
+        let mut parser = MessageParser::new();
+        assert_eq!(
+            parser.push(&[0xF0, 0x43, 0x12, 0x90, 0x3C, 0x64]),
+            vec![vec![0x90, 0x3C, 0x64]]
+        );
+    }
+
+    #[test]
+    fn test_realtime_inside_channel_message() {
+        let mut parser = MessageParser::new();
+        // Clock between the status and data bytes of a Note On
+        assert_eq!(
+            parser.push(&[0x90, 0xF8, 0x3C, 0x64]),
+            vec![vec![0xF8], vec![0x90, 0x3C, 0x64]]
+        );
+        // Between the two data bytes, and Active Sensing in a running status message
+        assert_eq!(
+            parser.push(&[0x90, 0x3C, 0xF8, 0x00, 0x40, 0xFE, 0x7F]),
+            vec![vec![0xF8], vec![0x90, 0x3C, 0x00], vec![0xFE], vec![0x90, 0x40, 0x7F]]
+        );
+        // Split across buffers
+        assert_eq!(parser.push(&[0xB0, 0x07]), Vec::<Vec<u8>>::new());
+        assert_eq!(parser.push(&[0xFA, 0x64]), vec![vec![0xFA], vec![0xB0, 0x07, 0x64]]);
+    }
+
+    #[test]
+    fn test_realtime_extracted_messages_validate() {
+        use crate::midi::validation::is_valid_midi_message;
+
+        let mut parser = MessageParser::new();
+        let messages = parser.push(&[0x90, 0x3C, 0xF8, 0x64, 0xC0, 0xFF, 0x05]);
+        assert_eq!(messages.len(), 4);
+        assert!(messages.iter().all(|m| is_valid_midi_message(m)));
+    }
+
+    #[test]
+    fn test_short_notes() {
+        // Normally a two-byte Note Off waits for its velocity
+        let mut parser = MessageParser::new();
+        assert!(parser.push(&[0x80, 0x3C]).is_empty());
+
+        let mut parser = MessageParser::new().with_short_notes(true);
+        assert_eq!(parser.push(&[0x80, 0x3C]), vec![vec![0x80, 0x3C]]);
+        assert_eq!(
+            parser.push(&[0x91, 0x40, 0xB0, 0x07, 0x7F]),
+            vec![vec![0x91, 0x40], vec![0xB0, 0x07, 0x7F]]
+        );
+        // Running status still applies, and other short messages still wait
+        assert_eq!(parser.push(&[0x90, 0x3C, 0x64, 0x3E]), vec![vec![0x90, 0x3C, 0x64], vec![0x90, 0x3E]]);
+        assert!(parser.push(&[0xB0, 0x07]).is_empty());
+    }
+
+    #[test]
+    fn test_ump_buffers_translated() {
+        let mut parser = MessageParser::new();
+        assert_eq!(parser.push(&[0x20, 0x90, 0x3C, 0x64]), vec![vec![0x90, 0x3C, 0x64]]);
+        // Running status from a MIDI 1.0 buffer keeps data bytes MIDI 1.0
+        assert_eq!(parser.push(&[0x90, 0x3C, 0x64]), vec![vec![0x90, 0x3C, 0x64]]);
+        assert_eq!(parser.push(&[0x20, 0x40, 0x3E, 0x40]), vec![vec![0x90, 0x20, 0x40], vec![0x90, 0x3E, 0x40]]);
+    }
+}
@@ -0,0 +1,96 @@
+/// Sustain pedal as note length for `mc fwd --pedal-to-length`
+/// While CC 64 is down on a channel, Note Offs are held back and sent when the pedal
+/// lifts, so the receiver sees longer notes instead of a pedal message
+const SUSTAIN: u8 = 64;
+
+#[derive(Debug, Clone, Default)]
+pub struct PedalSustain {
+    /// Pedal state per channel
+    down: [bool; 16],
+    /// Held-back Note Offs per channel (bit n = note n)
+    pending: [u128; 16],
+}
+
+impl PedalSustain {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Returns the messages to send for one input message
+    /// The pedal's own CC 64 is consumed
+    pub fn process(&mut self, msg: &[u8]) -> Vec<Vec<u8>> {
+        let [status, data1, data2] = *msg else {
+            return vec![msg.to_vec()];
+        };
+        let channel = (status & 0x0F) as usize;
+        let bit = 1u128 << (data1 & 0x7F);
+        match status & 0xF0 {
+            0xB0 if data1 == SUSTAIN => {
+                self.down[channel] = data2 >= 64;
+                if self.down[channel] {
+                    return Vec::new();
+                }
+                // Pedal up: release everything it was holding
+                let pending = std::mem::take(&mut self.pending[channel]);
+                (0..128u8)
+                    .filter(|note| pending & (1 << note) != 0)
+                    .map(|note| vec![0x80 | status & 0x0F, note, 0])
+                    .collect()
+            }
+            0x80 | 0x90 if self.down[channel] && (status & 0xF0 == 0x80 || data2 == 0) => {
+                self.pending[channel] |= bit;
+                Vec::new()
+            }
+            // Replaying a note the pedal is holding: end the old one so the new
+            // Note On retriggers, and let this note's own release be held again
+            0x90 if self.pending[channel] & bit != 0 => {
+                self.pending[channel] &= !bit;
+                vec![vec![0x80 | status & 0x0F, data1, 0], msg.to_vec()]
+            }
+            _ => vec![msg.to_vec()],
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_note_offs_held_until_pedal_up() {
+        let mut pedal = PedalSustain::new();
+        assert!(pedal.process(&[0xB0, 64, 127]).is_empty());
+        assert_eq!(pedal.process(&[0x90, 60, 100]), vec![vec![0x90, 60, 100]]);
+        assert_eq!(pedal.process(&[0x90, 64, 100]), vec![vec![0x90, 64, 100]]);
+        assert!(pedal.process(&[0x80, 60, 0]).is_empty());
+        assert!(pedal.process(&[0x90, 64, 0]).is_empty());
+        assert_eq!(pedal.process(&[0xB0, 64, 0]), vec![vec![0x80, 60, 0], vec![0x80, 64, 0]]);
+
+        // With the pedal up, Note Offs pass straight through
+        assert_eq!(pedal.process(&[0x80, 67, 0]), vec![vec![0x80, 67, 0]]);
+    }
+
+    #[test]
+    fn test_repeated_note_while_held() {
+        let mut pedal = PedalSustain::new();
+        pedal.process(&[0xB0, 64, 127]);
+        pedal.process(&[0x90, 60, 100]);
+        pedal.process(&[0x80, 60, 0]);
+        // The sustained note ends before it's played again
+        assert_eq!(pedal.process(&[0x90, 60, 90]), vec![vec![0x80, 60, 0], vec![0x90, 60, 90]]);
+        assert!(pedal.process(&[0x80, 60, 0]).is_empty());
+        assert_eq!(pedal.process(&[0xB0, 64, 0]), vec![vec![0x80, 60, 0]]);
+    }
+
+    #[test]
+    fn test_channels_and_other_messages() {
+        let mut pedal = PedalSustain::new();
+        pedal.process(&[0xB1, 64, 127]);
+        // Channel 1's pedal doesn't hold channel 2
+        assert_eq!(pedal.process(&[0x82, 60, 0]), vec![vec![0x82, 60, 0]]);
+        assert!(pedal.process(&[0x81, 60, 0]).is_empty());
+        assert_eq!(pedal.process(&[0xB1, 1, 64]), vec![vec![0xB1, 1, 64]]);
+        assert_eq!(pedal.process(&[0xF8]), vec![vec![0xF8]]);
+        assert_eq!(pedal.process(&[0xB1, 64, 10]), vec![vec![0x81, 60, 0]]);
+    }
+}
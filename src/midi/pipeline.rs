@@ -0,0 +1,1054 @@
+use super::buffer::{Overflow, SendQueue};
+use super::cc14::CcScaler;
+use super::clock::sleep_until;
+use super::dedup::{CcDedup, Dedup};
+use super::delay::NoteDelay;
+use super::echo::EchoGuard;
+use super::error::connect_error;
+use super::filter::Filter;
+use super::harmonize::Harmonizer;
+use super::humanize::Humanize;
+use super::keepalive::{Idle, KeepAlive, ACTIVE_SENSING};
+use super::latch::Latch;
+use super::notes::{ActiveNotes, PanicMode};
+use super::parser::MessageParser;
+use super::pedal::PedalSustain;
+use super::ports::{feedback_risk, find_input_port, find_output_port, FeedbackRisk, PortMatch};
+use super::quantize::Quantizer;
+use super::reset::Reset;
+use super::schedule::TimingMap;
+use super::spp::SongPosition;
+use super::stats::{LatencyStats, MessageCounts, Metrics};
+use super::stuck::StuckNotes;
+use super::throttle::Throttle;
+use super::transform::{NoteOffStyle, Transform};
+use super::decode::hex_bytes;
+use super::validation::{complete_short_note, is_valid_midi_message};
+use crate::logging::{self, debug, error, info};
+use midir::{MidiInput, MidiInputConnection, MidiOutput, MidiOutputConnection};
+use std::cmp::Reverse;
+use std::collections::BinaryHeap;
+use std::error::Error;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Condvar, Mutex};
+use std::thread::JoinHandle;
+use std::time::{Duration, Instant};
+
+/// Loopback protection for one direction of a bidirectional forward
+#[derive(Clone, Default)]
+pub struct EchoGuards {
+    /// Messages this direction sends, checked by the other direction
+    pub sent: Option<Arc<Mutex<EchoGuard>>>,
+    /// Messages the other direction sent; matching input is dropped
+    pub received: Option<Arc<Mutex<EchoGuard>>>,
+}
+
+/// Processing applied by a pipeline between its input and output
+#[derive(Clone, Default)]
+pub struct PipelineConfig {
+    pub filter: Filter,
+    pub transform: Transform,
+    /// `--dedup-window`
+    pub dedup_window: Option<Duration>,
+    /// `--dedup-cc`
+    pub dedup_cc: bool,
+    pub echo: EchoGuards,
+    /// `--stats`, shared by both directions of a bidirectional forward
+    pub stats: Option<Arc<LatencyStats>>,
+    /// `--throttle-cc`
+    pub throttle_window: Option<Duration>,
+    /// `--throttle-flush-on-stop`: send held values on close instead of dropping them
+    pub throttle_flush_on_stop: bool,
+    /// `--preserve-timing`, holding the `--max-buffer` limit on added delay
+    pub preserve_timing: Option<Duration>,
+    /// `--humanize-timing` / `--humanize-velocity`
+    pub humanize: Option<Humanize>,
+    /// `--harmonize` intervals in semitones; empty when off
+    pub harmonize: Vec<i8>,
+    /// `--latch`
+    pub latch: bool,
+    /// `--pedal-to-length`
+    pub pedal_to_length: bool,
+    /// `--cc-scale`, with the `--combine-14bit` pairs
+    pub cc_scaler: Option<CcScaler>,
+    /// `--normalize-noteoff`: the Note Off form every output gets
+    pub note_off_style: Option<NoteOffStyle>,
+    /// `--echo`
+    pub note_delay: Option<NoteDelay>,
+    /// `--quantize`
+    pub quantizer: Option<Quantizer>,
+    /// `--count`, shared by both directions of a bidirectional forward
+    pub counts: Option<Arc<MessageCounts>>,
+    /// `--reset-on-start`: sent to every output once connected, before any input is forwarded
+    pub reset: Option<Reset>,
+    /// `--buffer`: most messages waiting for the sending thread
+    pub buffer: Option<usize>,
+    /// `--buffer-overflow`
+    pub buffer_overflow: Overflow,
+    /// `--metrics`, shared by both directions of a bidirectional forward
+    pub metrics: Option<Arc<Metrics>>,
+    /// `--allow-loop`: connect even when an output is the input's own loopback
+    pub allow_loop: bool,
+    /// `--detect-stuck`: how long a sent note may stay on, and whether to then release it
+    pub detect_stuck: Option<(Duration, bool)>,
+    /// `--generate-spp`
+    pub generate_spp: bool,
+    /// `--delay`: fixed time added before every message is sent
+    pub delay: Option<Duration>,
+    /// `--flush-on-stop`: send the delayed messages still waiting on close instead of dropping them
+    pub delay_flush_on_stop: bool,
+    /// `--control-note` with the muted flag it toggles, shared by both directions of a
+    /// bidirectional forward and kept across reconnects
+    pub control_note: Option<(u8, Arc<AtomicBool>)>,
+    /// `--keepalive`: send Active Sensing to the outputs while nothing else is sent
+    pub keepalive: bool,
+    /// `--normalize`: complete Note Offs the driver delivers without a velocity byte
+    pub normalize: bool,
+    /// `--panic-mode`: how close silences the notes still sounding
+    pub panic_mode: PanicMode,
+}
+
+impl PipelineConfig {
+    /// The return path of a `--bidir` forward (e.g. controller LED feedback), which isn't
+    /// filtered or transformed: it only shares the counters, the `--control-note` mute and
+    /// how notes are released, and guards against `echo`
+    pub fn reverse(&self, echo: EchoGuards) -> Self {
+        Self {
+            echo,
+            stats: self.stats.clone(),
+            counts: self.counts.clone(),
+            metrics: self.metrics.clone(),
+            allow_loop: self.allow_loop,
+            control_note: self.control_note.clone(),
+            panic_mode: self.panic_mode,
+            ..Self::default()
+        }
+    }
+}
+
+/// What another thread can change while a pipeline runs (`mc run --control-socket`)
+#[derive(Default)]
+struct Live {
+    paused: AtomicBool,
+    /// A filter and transform to switch to, taken by the callback once `updated` is set
+    update: Mutex<Option<(Filter, Transform)>>,
+    updated: AtomicBool,
+}
+
+/// Refuses to forward a loopback port into itself unless `allow_loop` is set, and
+/// mentions the risk when input and output are merely the same device
+pub fn check_feedback(input: &str, output: &str, allow_loop: bool) -> Result<(), String> {
+    match feedback_risk(input, output) {
+        Some(FeedbackRisk::Loopback) if !allow_loop => Err(format!(
+            "{} -> {} is a feedback loop: the port plays back what it is sent, so every message \
+             would come back forever (use --allow-loop if a filter breaks the loop)",
+            input, output
+        )),
+        Some(FeedbackRisk::Loopback) => {
+            info!("Forwarding {} back into itself (--allow-loop)", output);
+            Ok(())
+        }
+        Some(FeedbackRisk::SameDevice) => {
+            info!("{} -> {}: the same device, which loops if it echoes its input", input, output);
+            Ok(())
+        }
+        None => Ok(()),
+    }
+}
+
+/// Every output a pipeline sends to (`mc fwd IN OUT1 OUT2 ...`)
+/// Each message goes to all of them; a failing output is logged and doesn't stop the rest
+struct Outputs {
+    conns: Vec<(String, MidiOutputConnection)>,
+    metrics: Option<Arc<Metrics>>,
+    idle: Idle,
+}
+
+impl Outputs {
+    /// Returns true if at least one output accepted the message
+    fn send(&mut self, message: &[u8]) -> bool {
+        let mut sent = false;
+        for (name, conn) in &mut self.conns {
+            match conn.send(message) {
+                Ok(()) => sent = true,
+                Err(e) => {
+                    error!("Error forwarding message to {}: {}", name, e);
+                    if let Some(metrics) = &self.metrics {
+                        metrics.record_send_error();
+                    }
+                }
+            }
+        }
+        if sent {
+            self.idle.sent(Instant::now());
+            if let Some(metrics) = &self.metrics {
+                metrics.record_forwarded(message);
+            }
+        }
+        sent
+    }
+
+    /// Sends Active Sensing if nothing has gone out for a while (`--keepalive`)
+    /// It isn't forwarded traffic, so it's left out of the metrics and failures aren't logged
+    fn keep_alive(&mut self, now: Instant) {
+        if self.idle.due(now) {
+            for (_, conn) in &mut self.conns {
+                let _ = conn.send(&[ACTIVE_SENSING]);
+            }
+        }
+    }
+}
+
+/// The last step of a pipeline: send to every output and record what was sent
+#[derive(Clone)]
+struct Delivery {
+    outputs: Arc<Mutex<Outputs>>,
+    active_notes: Arc<Mutex<ActiveNotes>>,
+    echo_sent: Option<Arc<Mutex<EchoGuard>>>,
+    stats: Option<Arc<LatencyStats>>,
+    stuck: Option<Arc<Mutex<StuckNotes>>>,
+}
+
+impl Delivery {
+    fn send(&self, message: &[u8], received_at: Instant) {
+        if let Ok(mut outputs) = self.outputs.lock() {
+            if outputs.send(message) {
+                if let Ok(mut notes) = self.active_notes.lock() {
+                    let before = notes.len();
+                    notes.track(message);
+                    if let Some(metrics) = &outputs.metrics {
+                        metrics.add_active_notes(notes.len() as i64 - before as i64);
+                    }
+                }
+                if let Some(sent) = &self.echo_sent {
+                    if let Ok(mut guard) = sent.lock() {
+                        guard.record(message);
+                    }
+                }
+                if let Some(stats) = &self.stats {
+                    stats.record(received_at.elapsed());
+                }
+                if let Some(Ok(mut stuck)) = self.stuck.as_ref().map(|s| s.lock()) {
+                    stuck.observe(message, Instant::now());
+                }
+            }
+        }
+    }
+}
+
+/// `--detect-stuck` state of a pipeline
+struct StuckDetector {
+    notes: Arc<Mutex<StuckNotes>>,
+    /// `--stuck-note-off`: send a Note Off for each stuck note found
+    release: bool,
+}
+
+/// Thread sending `--preserve-timing` and `--humanize-timing` messages at their deadlines,
+/// in arrival order, and everything when `--buffer` decouples sending from the callback
+/// It exits once the queue is closed and empty
+struct Scheduler {
+    thread: JoinHandle<()>,
+    queue: Arc<SendQueue<Scheduled>>,
+}
+
+/// A message waiting for its send time, with when it was received for `--stats`
+type Scheduled = (Instant, Vec<u8>, Instant);
+
+impl Scheduler {
+    fn start(delivery: Delivery, queue: SendQueue<Scheduled>) -> Self {
+        let queue = Arc::new(queue);
+        let thread = {
+            let queue = Arc::clone(&queue);
+            std::thread::spawn(move || {
+                while let Some((deadline, message, received_at)) = queue.pop() {
+                    sleep_until(deadline);
+                    delivery.send(&message, received_at);
+                }
+            })
+        };
+        Self { thread, queue }
+    }
+}
+
+/// Notes waiting to be sent, earliest first; the sequence number keeps equal times in order
+#[derive(Default)]
+struct TimedNotes {
+    pending: BinaryHeap<Reverse<(Instant, u64, Vec<u8>)>>,
+    next: u64,
+    stopped: bool,
+}
+
+/// The input callback's side of the NoteTimer
+#[derive(Clone, Default)]
+struct NoteQueue(Arc<(Mutex<TimedNotes>, Condvar)>);
+
+impl NoteQueue {
+    fn push(&self, due: Instant, message: Vec<u8>) {
+        let (lock, ready) = &*self.0;
+        if let Ok(mut state) = lock.lock() {
+            let seq = state.next;
+            state.next += 1;
+            state.pending.push(Reverse((due, seq, message)));
+            ready.notify_one();
+        }
+    }
+}
+
+/// Thread sending `--echo` repeats and `--quantize`d notes at their times
+/// Unlike the Scheduler it sends by deadline rather than arrival order, so a note held
+/// for later doesn't hold up the ones due before it, or anything else
+struct NoteTimer {
+    queue: NoteQueue,
+    thread: JoinHandle<()>,
+    /// Notes this thread sent, for All Notes Off when the rest are canceled
+    sounded: Arc<Mutex<ActiveNotes>>,
+}
+
+impl NoteTimer {
+    fn start(delivery: Delivery) -> Self {
+        let queue = NoteQueue::default();
+        let sounded = Arc::new(Mutex::new(ActiveNotes::new()));
+        let thread = {
+            let queue = queue.clone();
+            let sounded = Arc::clone(&sounded);
+            std::thread::spawn(move || {
+                let (lock, ready) = &*queue.0;
+                let Ok(mut state) = lock.lock() else {
+                    return;
+                };
+                while !state.stopped {
+                    let now = Instant::now();
+                    match state.pending.peek() {
+                        Some(Reverse((due, _, _))) if *due <= now => {
+                            let Some(Reverse((_, _, message))) = state.pending.pop() else {
+                                continue;
+                            };
+                            drop(state);
+                            delivery.send(&message, now);
+                            if let Ok(mut sounded) = sounded.lock() {
+                                sounded.track(&message);
+                            }
+                            state = match lock.lock() {
+                                Ok(state) => state,
+                                Err(_) => return,
+                            };
+                        }
+                        Some(Reverse((due, _, _))) => {
+                            let wait = *due - now;
+                            state = match ready.wait_timeout(state, wait) {
+                                Ok((state, _)) => state,
+                                Err(_) => return,
+                            };
+                        }
+                        None => {
+                            state = match ready.wait(state) {
+                                Ok(state) => state,
+                                Err(_) => return,
+                            };
+                        }
+                    }
+                }
+            })
+        };
+        Self { queue, thread, sounded }
+    }
+
+    /// Cancels the notes not yet sent; returns All Notes Off for channels with notes it
+    /// sent still sounding, and how many were canceled
+    fn stop(self) -> (Vec<Vec<u8>>, usize) {
+        let (lock, ready) = &*self.queue.0;
+        let canceled = match lock.lock() {
+            Ok(mut state) => {
+                state.stopped = true;
+                std::mem::take(&mut state.pending).len()
+            }
+            Err(_) => 0,
+        };
+        ready.notify_all();
+        let _ = self.thread.join();
+        let all_notes_off = self.sounded.lock().map(|mut s| s.all_notes_off()).unwrap_or_default();
+        (all_notes_off, canceled)
+    }
+}
+
+/// Held `--throttle-cc` values and the thread that sends them when their window ends
+struct Throttler {
+    throttle: Arc<Mutex<Throttle>>,
+    stop: Arc<AtomicBool>,
+    ticker: JoinHandle<()>,
+    flush_on_stop: bool,
+}
+
+impl Throttler {
+    fn start(
+        window: Duration,
+        flush_on_stop: bool,
+        outputs: Arc<Mutex<Outputs>>,
+        echo_sent: Option<Arc<Mutex<EchoGuard>>>,
+    ) -> Self {
+        let throttle = Arc::new(Mutex::new(Throttle::new(window)));
+        let stop = Arc::new(AtomicBool::new(false));
+
+        let ticker = {
+            let throttle = Arc::clone(&throttle);
+            let stop = Arc::clone(&stop);
+            // Check several times per window so held values go out close to its end
+            let tick = (window / 4).max(Duration::from_millis(1));
+            std::thread::spawn(move || {
+                while !stop.load(Ordering::Relaxed) {
+                    std::thread::sleep(tick);
+                    let due = throttle.lock().map(|mut t| t.due(Instant::now())).unwrap_or_default();
+                    send_all(&outputs, echo_sent.as_ref(), &due);
+                }
+            })
+        };
+
+        Self {
+            throttle,
+            stop,
+            ticker,
+            flush_on_stop,
+        }
+    }
+
+    /// Stops the ticker, then sends or drops whatever is still held
+    fn stop(self, outputs: &Mutex<Outputs>) {
+        self.stop.store(true, Ordering::Relaxed);
+        let _ = self.ticker.join();
+        let held = self.throttle.lock().map(|mut t| t.drain()).unwrap_or_default();
+        if self.flush_on_stop {
+            send_all(outputs, None, &held);
+        }
+    }
+}
+
+/// Sends throttled values released outside the input callback
+fn send_all(outputs: &Mutex<Outputs>, echo_sent: Option<&Arc<Mutex<EchoGuard>>>, messages: &[Vec<u8>]) {
+    if messages.is_empty() {
+        return;
+    }
+    if let Ok(mut outputs) = outputs.lock() {
+        for message in messages {
+            if outputs.send(message) {
+                if let Some(Ok(mut guard)) = echo_sent.map(|sent| sent.lock()) {
+                    guard.record(message);
+                }
+            }
+        }
+    }
+}
+
+/// Whether `filter` passes `message`, which is then logged; what the filters drop isn't,
+/// so `--no-clock` and the like keep `--log-level debug` readable
+fn accept(filter: &Filter, message: &[u8], log: impl FnOnce(&[u8])) -> bool {
+    if !filter.accepts(message) {
+        return false;
+    }
+    log(message);
+    true
+}
+
+/// Installs a filter and transform passed to `Pipeline::update`, first releasing the notes
+/// sounding: their Note Offs would otherwise go out transposed to another pitch, or be
+/// dropped by the new channels, and leave the notes stuck
+fn apply_update(
+    filter: &mut Filter,
+    transform: &mut Transform,
+    (new_filter, new_transform): (Filter, Transform),
+    active_notes: &Mutex<ActiveNotes>,
+    mut release: impl FnMut(&[u8]),
+) {
+    let note_offs = active_notes.lock().map(|notes| notes.clone().note_offs()).unwrap_or_default();
+    for note_off in note_offs {
+        release(&note_off);
+    }
+    *filter = new_filter;
+    *transform = new_transform;
+}
+
+/// Flips the `--control-note` mute; muting releases the notes this pipeline has sounding,
+/// since their Note Offs won't get through
+fn toggle_mute(muted: &AtomicBool, delivery: &Delivery, input: &str, now: Instant) {
+    if muted.fetch_xor(true, Ordering::Relaxed) {
+        info!("Unmuted {}", input);
+        return;
+    }
+    info!("Muted {}", input);
+    let note_offs = delivery.active_notes.lock().map(|notes| notes.clone().note_offs()).unwrap_or_default();
+    for note_off in note_offs {
+        delivery.send(&note_off, now);
+    }
+}
+
+/// One input forwarded to one or more outputs through a filter and transform
+/// Used by `mc fwd` (twice with `--bidir`, once per direction)
+pub struct Pipeline {
+    in_conn: MidiInputConnection<()>,
+    outputs: Arc<Mutex<Outputs>>,
+    active_notes: Arc<Mutex<ActiveNotes>>,
+    throttler: Option<Throttler>,
+    scheduler: Option<Scheduler>,
+    note_timer: Option<NoteTimer>,
+    latch: Option<Arc<Mutex<Latch>>>,
+    stuck: Option<StuckDetector>,
+    /// `--delay` without `--flush-on-stop`: drop what the scheduler still holds on close
+    drop_delayed: bool,
+    keepalive: Option<KeepAlive>,
+    panic_mode: PanicMode,
+    live: Arc<Live>,
+    pub input_name: String,
+    pub output_names: Vec<String>,
+}
+
+impl Pipeline {
+    /// Resolves all ports and starts forwarding
+    pub fn connect(
+        input: &str,
+        outputs: &[String],
+        match_mode: PortMatch,
+        config: PipelineConfig,
+    ) -> Result<Self, Box<dyn Error>> {
+        let PipelineConfig {
+            mut filter,
+            mut transform,
+            dedup_window,
+            dedup_cc,
+            echo,
+            stats,
+            throttle_window,
+            throttle_flush_on_stop,
+            preserve_timing,
+            mut humanize,
+            harmonize,
+            latch,
+            pedal_to_length,
+            mut cc_scaler,
+            note_off_style,
+            mut note_delay,
+            mut quantizer,
+            counts,
+            reset,
+            buffer,
+            buffer_overflow,
+            metrics,
+            allow_loop,
+            detect_stuck,
+            generate_spp,
+            delay,
+            delay_flush_on_stop,
+            control_note,
+            keepalive,
+            normalize,
+            panic_mode,
+        } = config;
+        let mut dedup = dedup_window.map(Dedup::new);
+        let mut cc_dedup = dedup_cc.then(CcDedup::new);
+        let mut pedal = pedal_to_length.then(PedalSustain::new);
+        let mut harmonizer = (!harmonize.is_empty()).then(|| Harmonizer::new(&harmonize));
+        let mut song_position = generate_spp.then(SongPosition::new);
+        // Shared with close, which releases whatever is still latched
+        let latch = latch.then(|| Arc::new(Mutex::new(Latch::new())));
+        let callback_latch = latch.clone();
+
+        let midi_in = MidiInput::new("mc-worker")?;
+
+        // Find input and output ports (by index or name)
+        let in_port = find_input_port(&midi_in, input, match_mode)?;
+        let input_name = midi_in.port_name(&in_port)?;
+
+        // Connect to every output (midir consumes the client, so one per output)
+        let mut conns = Vec::new();
+        for output in outputs {
+            let midi_out = MidiOutput::new("mc-worker")?;
+            let out_port = find_output_port(&midi_out, output, match_mode)?;
+            let name = midi_out.port_name(&out_port)?;
+            check_feedback(&input_name, &name, allow_loop)?;
+            let conn = midi_out
+                .connect(&out_port, "mc-worker-out")
+                .map_err(connect_error("Output", &name))?;
+            conns.push((name, conn));
+        }
+        if let Some(reset) = &reset {
+            for (name, conn) in &mut conns {
+                match conn.send(reset.bytes()) {
+                    Ok(()) => info!("Sent {} to {}", reset, name),
+                    Err(e) => error!("Error sending {} to {}: {}", reset, name, e),
+                }
+            }
+        }
+        let output_names = conns.iter().map(|(name, _)| name.clone()).collect();
+        let outputs = Arc::new(Mutex::new(Outputs {
+            conns,
+            metrics,
+            idle: Idle::new(Instant::now()),
+        }));
+        let keepalive = keepalive.then(|| {
+            let outputs = Arc::clone(&outputs);
+            KeepAlive::start(move |now| {
+                if let Ok(mut outputs) = outputs.lock() {
+                    outputs.keep_alive(now);
+                }
+            })
+        });
+
+        // Notes forwarded but not yet released, silenced on shutdown
+        let active_notes = Arc::new(Mutex::new(ActiveNotes::new()));
+
+        let throttler = throttle_window.map(|window| {
+            Throttler::start(window, throttle_flush_on_stop, Arc::clone(&outputs), echo.sent.clone())
+        });
+        let throttle = throttler.as_ref().map(|t| Arc::clone(&t.throttle));
+
+        let stuck = detect_stuck.map(|(threshold, release)| StuckDetector {
+            notes: Arc::new(Mutex::new(StuckNotes::new(threshold))),
+            release,
+        });
+        let delivery = Delivery {
+            outputs: Arc::clone(&outputs),
+            active_notes: Arc::clone(&active_notes),
+            echo_sent: echo.sent.clone(),
+            stats,
+            stuck: stuck.as_ref().map(|s| Arc::clone(&s.notes)),
+        };
+        let mut timing_map = preserve_timing.map(TimingMap::new);
+        let scheduled = timing_map.is_some()
+            || humanize.as_ref().is_some_and(Humanize::delays)
+            || buffer.is_some()
+            || delay.is_some();
+        let scheduler = scheduled.then(|| Scheduler::start(delivery.clone(), SendQueue::new(buffer, buffer_overflow)));
+        let schedule = scheduler.as_ref().map(|s| Arc::clone(&s.queue));
+        let timed = note_delay.is_some() || quantizer.is_some();
+        let note_timer = timed.then(|| NoteTimer::start(delivery.clone()));
+        let note_queue = note_timer.as_ref().map(|timer| timer.queue.clone());
+        // Set while the --buffer is full, so overflow is logged once per burst
+        let mut overflowing = false;
+
+        let mut parser = MessageParser::new().with_short_notes(normalize);
+        // Only the first Note Off completed by --normalize is logged at info level
+        let mut completed = 0u64;
+        let callback_input = input_name.clone();
+        let live = Arc::new(Live::default());
+        let callback_live = Arc::clone(&live);
+
+        // Connect to input with forwarding callback
+        let in_conn = midi_in.connect(
+            &in_port,
+            "mc-worker-in",
+            move |timestamp, bytes, _| {
+                let received_at = Instant::now();
+
+                // Switch to a filter and transform passed to `update`
+                if callback_live.updated.swap(false, Ordering::Acquire) {
+                    if let Some(update) = callback_live.update.lock().ok().and_then(|mut u| u.take()) {
+                        let release = |note_off: &[u8]| delivery.send(note_off, received_at);
+                        apply_update(&mut filter, &mut transform, update, &delivery.active_notes, release);
+                    }
+                }
+
+                // A callback buffer may hold several messages (batched or running status)
+                for message in parser.push(bytes) {
+                    // Notes short of their velocity, which the parser only returns with --normalize
+                    let message = match complete_short_note(&message) {
+                        Some(note_off) => {
+                            completed += 1;
+                            if completed == 1 {
+                                info!(
+                                    "Completed short note {} from {} as {} (further ones are logged at debug level)",
+                                    hex_bytes(&message),
+                                    callback_input,
+                                    hex_bytes(&note_off)
+                                );
+                            } else {
+                                debug!("Completed short note {} as {}", hex_bytes(&message), hex_bytes(&note_off));
+                            }
+                            note_off
+                        }
+                        None => message,
+                    };
+                    // The grid and song position follow the input's clock even when --no-clock drops it
+                    if let Some(quantizer) = quantizer.as_mut() {
+                        quantizer.observe(&message, received_at);
+                    }
+                    if let Some(position) = song_position.as_mut() {
+                        position.observe(&message);
+                    }
+                    if let Some(counts) = &counts {
+                        counts.record(&message);
+                    }
+
+                    // The --control-note toggles forwarding and is never forwarded itself
+                    if let Some((note, muted)) = &control_note {
+                        if let [status, n, velocity] = *message {
+                            if n == *note && matches!(status & 0xF0, 0x80 | 0x90) {
+                                if status & 0xF0 == 0x90 && velocity > 0 {
+                                    toggle_mute(muted, &delivery, &callback_input, received_at);
+                                }
+                                continue;
+                            }
+                        }
+                        if muted.load(Ordering::Relaxed) {
+                            continue;
+                        }
+                    }
+                    if callback_live.paused.load(Ordering::Relaxed) {
+                        continue;
+                    }
+
+                    // Drop messages the other direction just sent (ports looped together)
+                    if let Some(received) = &echo.received {
+                        if received.lock().map(|mut guard| guard.is_echo(&message)).unwrap_or(false) {
+                            continue;
+                        }
+                    }
+
+                    // Drop byte-identical repeats within the --dedup-window
+                    if let Some(dedup) = dedup.as_mut() {
+                        if dedup.is_duplicate(&message) {
+                            continue;
+                        }
+                    }
+
+                    // Drop messages excluded by the channel, realtime or type filters
+                    if !accept(&filter, &message, logging::message) {
+                        continue;
+                    }
+
+                    // Apply transforms (may drop the message, e.g. notes transposed out of range)
+                    let message = match transform.apply(&message) {
+                        Some(transformed) => transformed,
+                        None => continue,
+                    };
+
+                    // Turn momentary notes into toggles (--latch)
+                    let message = match &callback_latch {
+                        Some(latch) => match latch.lock().map(|mut l| l.apply(&message)) {
+                            Ok(Some(message)) => message,
+                            Ok(None) => continue,
+                            Err(_) => message,
+                        },
+                        None => message,
+                    };
+
+                    // Hold Note Offs while the sustain pedal is down (--pedal-to-length)
+                    let messages = match pedal.as_mut() {
+                        Some(pedal) => pedal.process(&message),
+                        None => vec![message],
+                    };
+
+                    // Scale CC values, 14-bit pairs as one value (--cc-scale, --combine-14bit)
+                    let messages: Vec<Vec<u8>> = match cc_scaler.as_mut() {
+                        Some(scaler) => messages.iter().flat_map(|m| scaler.process(m)).collect(),
+                        None => messages,
+                    };
+
+                    // Add chord notes (--harmonize); everything after runs per output message
+                    let expanded: Vec<Vec<u8>> = match harmonizer.as_mut() {
+                        Some(harmonizer) => messages.iter().flat_map(|m| harmonizer.process(m)).collect(),
+                        None => messages,
+                    };
+
+                    // Say where the song stopped and resumes (--generate-spp)
+                    let expanded: Vec<Vec<u8>> = match &song_position {
+                        Some(position) => expanded.into_iter().flat_map(|m| position.with_pointer(m)).collect(),
+                        None => expanded,
+                    };
+
+                    for message in expanded {
+                        // Hold fast CC/pressure for the ticker (--throttle-cc)
+                        let message = match &throttle {
+                            Some(throttle) => match throttle.lock().map(|mut t| t.offer(&message, received_at)) {
+                                Ok(Some(message)) => message,
+                                Ok(None) => continue,
+                                Err(_) => message,
+                            },
+                            None => message,
+                        };
+
+                        // Drop a CC that repeats the value last sent for its controller (--dedup-cc)
+                        if let Some(cc_dedup) = cc_dedup.as_mut() {
+                            if cc_dedup.is_repeat(&message) {
+                                continue;
+                            }
+                        }
+
+                        let mut message = message;
+                        if let Some(humanize) = humanize.as_mut() {
+                            humanize.velocity(&mut message);
+                        }
+                        // Last, so Note Offs made by latch, pedal and harmonize are rewritten too
+                        if let Some(style) = note_off_style {
+                            style.apply(&mut message);
+                        }
+
+                        if !is_valid_midi_message(&message) {
+                            if let Some(counts) = &counts {
+                                counts.record_rejected();
+                            }
+                            continue;
+                        }
+
+                        let echoes = note_delay.as_mut().map(|d| d.echoes(&message)).unwrap_or_default();
+
+                        // Forward now, or from the sending thread: at the input's spacing
+                        // (--preserve-timing) plus any --humanize-timing and --delay, or as
+                        // soon as the output keeps up (--buffer)
+                        // Notes held to the next grid point (--quantize) go out from the timer
+                        let quantized = quantizer
+                            .as_mut()
+                            .and_then(|q| q.deadline(&message, received_at))
+                            .map(|due| due + delay.unwrap_or_default());
+                        let sent_at = match (quantized, &note_queue, &schedule) {
+                            (Some(due), Some(note_queue), _) => {
+                                note_queue.push(due, message);
+                                due
+                            }
+                            (_, _, Some(schedule)) => {
+                                let mut deadline = match timing_map.as_mut() {
+                                    Some(map) => map.deadline(timestamp, received_at),
+                                    None => received_at,
+                                };
+                                if let Some(humanize) = humanize.as_mut() {
+                                    deadline += humanize.delay(&message);
+                                }
+                                deadline += delay.unwrap_or_default();
+                                let queued = schedule.push((deadline, message, received_at));
+                                if !queued && !overflowing {
+                                    error!(
+                                        "Buffer full ({} messages), dropping the {}",
+                                        schedule.capacity().unwrap_or_default(),
+                                        schedule.overflow()
+                                    );
+                                }
+                                overflowing = !queued;
+                                deadline
+                            }
+                            (_, _, None) => {
+                                delivery.send(&message, received_at);
+                                received_at
+                            }
+                        };
+
+                        // Repeat notes after the one just sent (--echo)
+                        if let Some(note_queue) = &note_queue {
+                            for (offset, echo) in echoes {
+                                note_queue.push(sent_at + offset, echo);
+                            }
+                        }
+                    }
+                }
+            },
+            (),
+        )
+        .map_err(connect_error("Input", &input_name))?;
+
+        Ok(Self {
+            in_conn,
+            outputs,
+            active_notes,
+            throttler,
+            scheduler,
+            note_timer,
+            latch,
+            stuck,
+            drop_delayed: delay.is_some() && !delay_flush_on_stop,
+            keepalive,
+            panic_mode,
+            live,
+            input_name,
+            output_names,
+        })
+    }
+
+    pub fn paused(&self) -> bool {
+        self.live.paused.load(Ordering::Relaxed)
+    }
+
+    /// Stops or restarts forwarding without closing the ports; pausing releases the
+    /// notes sounding, since their Note Offs won't get through
+    pub fn set_paused(&self, paused: bool) {
+        if self.live.paused.swap(paused, Ordering::Relaxed) == paused || !paused {
+            return;
+        }
+        let note_offs = self.active_notes.lock().map(|notes| notes.clone().note_offs()).unwrap_or_default();
+        if let Ok(mut outputs) = self.outputs.lock() {
+            for note_off in note_offs {
+                if outputs.send(&note_off) {
+                    if let Ok(mut active) = self.active_notes.lock() {
+                        active.track(&note_off);
+                    }
+                }
+            }
+        }
+    }
+
+    /// Replaces the filter and transform from the next message on, releasing the notes
+    /// sounding when it does
+    pub fn update(&self, filter: Filter, transform: Transform) {
+        if let Ok(mut update) = self.live.update.lock() {
+            *update = Some((filter, transform));
+            self.live.updated.store(true, Ordering::Release);
+        }
+    }
+
+    /// Logs notes sent longer ago than the `--detect-stuck` threshold and still on,
+    /// releasing them with `--stuck-note-off`; call it regularly
+    pub fn check_stuck_notes(&self) {
+        let Some(stuck) = &self.stuck else {
+            return;
+        };
+        let now = Instant::now();
+        let Ok(mut notes) = stuck.notes.lock() else {
+            return;
+        };
+        for note in notes.check(now) {
+            error!("Stuck note from {}: {}", self.input_name, note);
+            if !stuck.release {
+                continue;
+            }
+            let note_off = note.note_off();
+            if let Ok(mut outputs) = self.outputs.lock() {
+                if outputs.send(&note_off) {
+                    info!("Sent Note Off for {}", note);
+                    notes.observe(&note_off, now);
+                    if let Ok(mut active) = self.active_notes.lock() {
+                        active.track(&note_off);
+                    }
+                }
+            }
+        }
+    }
+
+    /// Stops forwarding, releases held notes on every output unless `no_panic` is set
+    /// (plus All Notes Off on channels with `--latch`ed notes, or notes `--echo` and
+    /// `--quantize` scheduled), then closes the outputs
+    pub fn close(self, no_panic: bool) {
+        self.in_conn.close();
+        if let Some(keepalive) = self.keepalive {
+            keepalive.stop();
+        }
+
+        if let Some(Ok(notes)) = self.stuck.as_ref().map(|s| s.notes.lock()) {
+            let summary = notes.summary(Instant::now());
+            if !summary.is_empty() {
+                info!("{} stuck notes from {}:", summary.len(), self.input_name);
+                for note in summary {
+                    info!("  {}", note);
+                }
+            }
+        }
+
+        // Nothing more can be queued, so this returns once the scheduler has sent the rest
+        if let Some(scheduler) = self.scheduler {
+            if self.drop_delayed {
+                let pending = scheduler.queue.clear();
+                if pending > 0 {
+                    info!("Dropped {} delayed messages from {}", pending, self.input_name);
+                }
+            }
+            scheduler.queue.close();
+            let _ = scheduler.thread.join();
+            let dropped = scheduler.queue.dropped();
+            if dropped > 0 {
+                error!("{} messages dropped by a full buffer from {}", dropped, self.input_name);
+            }
+        }
+
+        if let Some(throttler) = self.throttler {
+            throttler.stop(&self.outputs);
+        }
+
+        // Echoes and quantized notes due later are canceled rather than waited for
+        let timed = match self.note_timer {
+            Some(timer) => {
+                let (all_notes_off, canceled) = timer.stop();
+                if canceled > 0 {
+                    info!("Canceled {} pending notes from {}", canceled, self.input_name);
+                }
+                all_notes_off
+            }
+            None => Vec::new(),
+        };
+
+        // This pipeline's notes no longer count, whether or not they're released
+        if let (Ok(outputs), Ok(notes)) = (self.outputs.lock(), self.active_notes.lock()) {
+            if let Some(metrics) = &outputs.metrics {
+                metrics.add_active_notes(-(notes.len() as i64));
+            }
+        }
+
+        if !no_panic {
+            let latched = self
+                .latch
+                .as_ref()
+                .and_then(|latch| latch.lock().ok().map(|mut l| l.all_notes_off()))
+                .unwrap_or_default();
+            let note_offs = self
+                .active_notes
+                .lock()
+                .map(|mut notes| notes.panic(self.panic_mode))
+                .unwrap_or_default();
+            if let Ok(mut outputs) = self.outputs.lock() {
+                for message in note_offs.iter().chain(&latched).chain(&timed) {
+                    outputs.send(message);
+                }
+            }
+        }
+
+        if let Ok(mut outputs) = self.outputs.lock() {
+            for (_, conn) in outputs.conns.drain(..) {
+                conn.close();
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_reverse_passes_feedback_unchanged() {
+        let config = PipelineConfig {
+            filter: Filter::new(&[1]),
+            transform: Transform::new().with_transpose(12),
+            reset: Some(Reset::System),
+            allow_loop: true,
+            ..PipelineConfig::default()
+        };
+        let reverse = config.reverse(EchoGuards::default());
+        assert!(reverse.filter.accepts(&[0x92, 60, 100]));
+        assert_eq!(reverse.transform.apply(&[0x92, 60, 100]), Some(vec![0x92, 60, 100]));
+        assert!(reverse.reset.is_none());
+        assert!(reverse.allow_loop);
+    }
+
+    #[test]
+    fn test_filtered_messages_not_logged() {
+        let filter = Filter::new(&[]).with_realtime_filter(true, false);
+        let mut logged = Vec::new();
+        assert!(!accept(&filter, &[0xF8], |m| logged.push(m.to_vec())));
+        assert!(accept(&filter, &[0x90, 60, 100], |m| logged.push(m.to_vec())));
+        assert_eq!(logged, vec![vec![0x90, 60, 100]]);
+    }
+
+    #[test]
+    fn test_update_releases_sent_pitch() {
+        let mut filter = Filter::new(&[]);
+        let mut transform = Transform::new().with_transpose(12);
+        let active_notes = Mutex::new(ActiveNotes::new());
+        let sent = transform.apply(&[0x90, 60, 100]).unwrap();
+        active_notes.lock().unwrap().track(&sent);
+
+        let mut released = Vec::new();
+        let update = (Filter::new(&[]), Transform::new());
+        apply_update(&mut filter, &mut transform, update, &active_notes, |m| released.push(m.to_vec()));
+        assert_eq!(released, vec![vec![0x80, 72, 0]]);
+
+        // The key's own Note Off now goes out untransposed, with nothing left sounding at 72
+        assert_eq!(transform.apply(&[0x80, 60, 64]), Some(vec![0x80, 60, 64]));
+        for note_off in &released {
+            active_notes.lock().unwrap().track(note_off);
+        }
+        assert!(!active_notes.lock().unwrap().is_on(0, 72));
+    }
+}
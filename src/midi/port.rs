@@ -0,0 +1,311 @@
+use super::error::connect_error;
+use super::eventlog::RecordFormat;
+use super::keepalive::{Idle, KeepAlive, ACTIVE_SENSING};
+use super::notes::{ActiveNotes, PanicMode};
+use super::parser::MessageParser;
+use super::ports::{find_input_port, find_output_port, virtual_port_hint, PortMatch};
+use super::recorder::Recorder;
+use super::reset::Reset;
+use crate::logging::{error, info};
+use midir::{MidiInput, MidiInputConnection, MidiOutput, MidiOutputConnection};
+use std::error::Error;
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+
+/// An output plus the notes sent to it, so they can be released on shutdown
+struct TrackedOutput {
+    conn: MidiOutputConnection,
+    notes: ActiveNotes,
+    idle: Idle,
+}
+
+impl TrackedOutput {
+    fn new(conn: MidiOutputConnection) -> Self {
+        Self {
+            conn,
+            notes: ActiveNotes::new(),
+            idle: Idle::new(Instant::now()),
+        }
+    }
+
+    fn send(&mut self, message: &[u8]) {
+        match self.conn.send(message) {
+            Ok(()) => {
+                self.notes.track(message);
+                self.idle.sent(Instant::now());
+            }
+            Err(e) => error!("Error forwarding message: {}", e),
+        }
+    }
+
+    /// Sends Active Sensing if nothing has gone out for a while (`--keepalive`)
+    fn keep_alive(&mut self, now: Instant) {
+        if self.idle.due(now) {
+            let _ = self.conn.send(&[ACTIVE_SENSING]);
+        }
+    }
+
+    /// Sends the `--reset-on-start` message, if any
+    fn reset(&mut self, reset: Option<&Reset>, name: &str) {
+        if let Some(reset) = reset {
+            match self.conn.send(reset.bytes()) {
+                Ok(()) => info!("Sent {} to {}", reset, name),
+                Err(e) => error!("Error sending {} to {}: {}", reset, name, e),
+            }
+        }
+    }
+}
+
+type SharedOutput = Arc<Mutex<TrackedOutput>>;
+type SharedRecorder = Arc<Mutex<Recorder>>;
+
+/// Adds a message to the `--record` file, if there is one
+fn tee(recorder: Option<&SharedRecorder>, message: &[u8]) {
+    if let Some(Ok(mut recorder)) = recorder.map(|r| r.lock()) {
+        recorder.record(message);
+    }
+}
+
+/// Receives each message arriving at a virtual input, in place of forwarding it to a port
+pub type Sink = Box<dyn FnMut(&[u8]) + Send + 'static>;
+
+/// Callback that parses a raw buffer and sends each message to `output`
+fn forward_to(
+    output: SharedOutput,
+    recorder: Option<SharedRecorder>,
+) -> impl FnMut(u64, &[u8], &mut ()) + Send + 'static {
+    let mut parser = MessageParser::new();
+    move |_timestamp, bytes, _| {
+        for message in parser.push(bytes) {
+            tee(recorder.as_ref(), &message);
+            if let Ok(mut out) = output.lock() {
+                out.send(&message);
+            }
+        }
+    }
+}
+
+/// Which halves of the virtual pair to create
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Sides {
+    Both,
+    /// `--in-only`: just the virtual input (other apps send to it)
+    InputOnly,
+    /// `--out-only`: just the virtual output (other apps receive from it)
+    OutputOnly,
+}
+
+/// What `mc port` should create and bridge
+#[derive(Debug, Clone, PartialEq)]
+pub struct PortConfig {
+    pub name: String,
+    pub to: Option<String>,
+    pub from: Option<String>,
+    pub match_mode: PortMatch,
+    pub sides: Sides,
+    /// `--reset-on-start`: sent to the virtual output and `to` before anything is forwarded
+    pub reset: Option<Reset>,
+    /// `--record`: file and format to log every message passing through to
+    pub record: Option<(String, RecordFormat)>,
+    /// `--client-name`: driver client the ports are created under, instead of `DEFAULT_CLIENT_NAME`
+    pub client_name: Option<String>,
+    /// `--keepalive`: send Active Sensing to the virtual output and `to` while they're quiet
+    pub keepalive: bool,
+    /// `--panic-mode`: how close silences the notes still sounding
+    pub panic_mode: PanicMode,
+}
+
+/// Client name `mc port` registers with the MIDI driver
+pub const DEFAULT_CLIENT_NAME: &str = "mc-port";
+
+/// A named virtual port pair for `mc port`
+/// By default the virtual input loops straight into the virtual output. With `to`, the
+/// virtual input is bridged to a real output instead; with `from`, a real input feeds
+/// the virtual output, exposing a hardware device under a tidy virtual name.
+/// Only the sides that were created are kept, so shutdown never touches a missing port.
+pub struct VirtualPort {
+    inputs: Vec<MidiInputConnection<()>>,
+    outputs: Vec<SharedOutput>,
+    virtual_out: Option<SharedOutput>,
+    recorder: Option<(String, SharedRecorder)>,
+    keepalive: Option<KeepAlive>,
+    panic_mode: PanicMode,
+}
+
+impl VirtualPort {
+    pub fn open(config: &PortConfig) -> Result<Self, Box<dyn Error>> {
+        Self::open_with(config, None)
+    }
+
+    /// Like `open`, but the virtual input's messages go to `sink` instead of `to` or the
+    /// self-loop, for bridges to something other than a MIDI port (e.g. `mc rtp`)
+    pub fn open_with_sink(config: &PortConfig, sink: Sink) -> Result<Self, Box<dyn Error>> {
+        Self::open_with(config, Some(sink))
+    }
+
+    #[cfg(unix)]
+    fn open_with(config: &PortConfig, sink: Option<Sink>) -> Result<Self, Box<dyn Error>> {
+        use super::ports::{driver_name, driver_shows_client_name};
+        use midir::os::unix::{VirtualInput, VirtualOutput};
+
+        let name = config.name.as_str();
+        let client = config.client_name.as_deref().unwrap_or(DEFAULT_CLIENT_NAME);
+        if config.client_name.is_some() && !driver_shows_client_name() {
+            info!("The {} driver doesn't show client names; --client-name has no effect", driver_name());
+        }
+        let mut inputs = Vec::new();
+        let mut outputs = Vec::new();
+        let recorder = match &config.record {
+            Some((path, format)) => {
+                let recorder = Recorder::create(path, *format)
+                    .map_err(|e| format!("Failed to create recording '{}': {}", path, e))?;
+                Some(Arc::new(Mutex::new(recorder)))
+            }
+            None => None,
+        };
+
+        let virtual_out = if config.sides != Sides::InputOnly {
+            let conn = MidiOutput::new(client)?
+                .create_virtual(name)
+                .map_err(|e| format!("Failed to create virtual output '{}': {}{}", name, e, virtual_port_hint()))?;
+            let mut output = TrackedOutput::new(conn);
+            output.reset(config.reset.as_ref(), name);
+            let output = Arc::new(Mutex::new(output));
+            outputs.push(Arc::clone(&output));
+            Some(output)
+        } else {
+            None
+        };
+
+        if config.sides != Sides::OutputOnly {
+            // Where the virtual input's messages go
+            let target = match &config.to {
+                _ if sink.is_some() => None,
+                Some(spec) => {
+                    let midi_out = MidiOutput::new(client)?;
+                    let port = find_output_port(&midi_out, spec, config.match_mode)?;
+                    let port_name = midi_out.port_name(&port)?;
+                    let mut output = TrackedOutput::new(
+                        midi_out
+                            .connect(&port, "mc-port-out")
+                            .map_err(connect_error("Output", spec))?,
+                    );
+                    output.reset(config.reset.as_ref(), &port_name);
+                    let output = Arc::new(Mutex::new(output));
+                    outputs.push(Arc::clone(&output));
+                    Some(output)
+                }
+                // Self-loop only when nothing is bridged
+                None if config.from.is_none() => virtual_out.clone(),
+                None => None,
+            };
+
+            let midi_in = MidiInput::new(client)?;
+            let virtual_in = match (sink, target) {
+                (Some(mut sink), _) => {
+                    let mut parser = MessageParser::new();
+                    let recorder = recorder.clone();
+                    midi_in.create_virtual(
+                        name,
+                        move |_timestamp, bytes, _| {
+                            for message in parser.push(bytes) {
+                                tee(recorder.as_ref(), &message);
+                                sink(&message);
+                            }
+                        },
+                        (),
+                    )
+                }
+                (None, Some(target)) => midi_in.create_virtual(name, forward_to(target, recorder.clone()), ()),
+                // An input-only port with nowhere to send discards everything (but records it)
+                (None, None) => {
+                    let mut parser = MessageParser::new();
+                    let recorder = recorder.clone();
+                    midi_in.create_virtual(
+                        name,
+                        move |_timestamp, bytes, _| {
+                            for message in parser.push(bytes) {
+                                tee(recorder.as_ref(), &message);
+                            }
+                        },
+                        (),
+                    )
+                }
+            }
+            .map_err(|e| format!("Failed to create virtual input '{}': {}{}", name, e, virtual_port_hint()))?;
+            inputs.push(virtual_in);
+        }
+
+        if let (Some(spec), Some(virtual_out)) = (&config.from, &virtual_out) {
+            let midi_in = MidiInput::new(client)?;
+            let port = find_input_port(&midi_in, spec, config.match_mode)?;
+            let conn = midi_in
+                .connect(&port, "mc-port-in", forward_to(Arc::clone(virtual_out), recorder.clone()), ())
+                .map_err(connect_error("Input", spec))?;
+            inputs.push(conn);
+        }
+
+        let keepalive = config.keepalive.then(|| {
+            let outputs = outputs.clone();
+            KeepAlive::start(move |now| {
+                for output in &outputs {
+                    if let Ok(mut out) = output.lock() {
+                        out.keep_alive(now);
+                    }
+                }
+            })
+        });
+
+        Ok(Self {
+            inputs,
+            outputs,
+            virtual_out,
+            recorder: config.record.as_ref().map(|(path, _)| path.clone()).zip(recorder),
+            keepalive,
+            panic_mode: config.panic_mode,
+        })
+    }
+
+    #[cfg(not(unix))]
+    fn open_with(_config: &PortConfig, _sink: Option<Sink>) -> Result<Self, Box<dyn Error>> {
+        Err(super::ports::VIRTUAL_PORTS_UNSUPPORTED.into())
+    }
+
+    /// Sends a message out of the virtual output, if there is one
+    pub fn send(&self, message: &[u8]) {
+        if let Some(Ok(mut out)) = self.virtual_out.as_ref().map(|o| o.lock()) {
+            out.send(message);
+        }
+    }
+
+    /// Stops forwarding, then releases held notes unless `no_panic` is set
+    /// The recording, if any, is finished once the inputs are closed
+    pub fn close(self, no_panic: bool) {
+        for input in self.inputs {
+            input.close();
+        }
+        if let Some(keepalive) = self.keepalive {
+            keepalive.stop();
+        }
+
+        if let Some((path, recorder)) = self.recorder {
+            if let Ok(mut recorder) = recorder.lock() {
+                match recorder.finish() {
+                    Ok(count) => info!("Wrote {} messages to {}", count, path),
+                    Err(e) => error!("Error writing recording {}: {}", path, e),
+                }
+            }
+        }
+
+        if no_panic {
+            return;
+        }
+        for output in self.outputs {
+            if let Ok(mut out) = output.lock() {
+                for message in out.notes.panic(self.panic_mode) {
+                    let _ = out.conn.send(&message);
+                }
+            }
+        }
+    }
+}
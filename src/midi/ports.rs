@@ -0,0 +1,412 @@
+/// Driver-level port enumeration for the CLI commands
+/// Unlike MidiManager's lists these keep the order reported by midir,
+/// so a port's index can be fed back into other commands
+use super::error::PortError;
+use midir::{MidiInput, MidiInputPort, MidiOutput, MidiOutputPort};
+use regex::Regex;
+
+/// A port's display name plus the driver's identifier, which stays unique when names collide
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PortEntry {
+    pub name: String,
+    pub id: String,
+}
+
+/// Lists all MIDI input ports in driver order
+pub fn input_ports() -> Result<Vec<PortEntry>, Box<dyn std::error::Error>> {
+    let midi_in = MidiInput::new("mc-list")?;
+    let mut entries = Vec::new();
+    for port in midi_in.ports().iter() {
+        entries.push(PortEntry {
+            name: midi_in.port_name(port)?,
+            id: port.id(),
+        });
+    }
+    Ok(entries)
+}
+
+/// Lists all MIDI output ports in driver order
+pub fn output_ports() -> Result<Vec<PortEntry>, Box<dyn std::error::Error>> {
+    let midi_out = MidiOutput::new("mc-list")?;
+    let mut entries = Vec::new();
+    for port in midi_out.ports().iter() {
+        entries.push(PortEntry {
+            name: midi_out.port_name(port)?,
+            id: port.id(),
+        });
+    }
+    Ok(entries)
+}
+
+/// Lists the names of all MIDI input ports in driver order
+pub fn input_port_names() -> Result<Vec<String>, Box<dyn std::error::Error>> {
+    Ok(input_ports()?.into_iter().map(|entry| entry.name).collect())
+}
+
+/// Lists the names of all MIDI output ports in driver order
+pub fn output_port_names() -> Result<Vec<String>, Box<dyn std::error::Error>> {
+    Ok(output_ports()?.into_iter().map(|entry| entry.name).collect())
+}
+
+/// Prefix selecting a port by its driver identifier (`mc list --verbose`) instead of its name
+const ID_PREFIX: &str = "id:";
+
+/// Platform-specific advice appended to virtual port creation errors
+#[cfg(unix)]
+pub fn virtual_port_hint() -> &'static str {
+    if cfg!(feature = "jack") {
+        " (built with JACK: check that the JACK server is running)"
+    } else if cfg!(target_os = "linux") {
+        " (virtual ports use the ALSA sequencer: check that /dev/snd/seq exists, e.g. `sudo modprobe snd-seq`)"
+    } else {
+        ""
+    }
+}
+
+/// The MIDI backend midir was built with; it's fixed at compile time (`--features jack`)
+pub fn driver_name() -> &'static str {
+    if cfg!(feature = "jack") {
+        "jack"
+    } else if cfg!(target_os = "linux") {
+        "alsa"
+    } else if cfg!(target_os = "macos") {
+        "coremidi"
+    } else if cfg!(windows) {
+        "winmm"
+    } else {
+        "unknown"
+    }
+}
+
+/// Whether the driver can create virtual ports (`mc port` and the TUI's mc-a/mc-b)
+pub fn driver_has_virtual_ports() -> bool {
+    cfg!(unix)
+}
+
+/// Whether other apps see the client name a port was created under (`mc port
+/// --client-name`): ALSA lists ports as client:port and JACK as client:port, while
+/// CoreMIDI shows only the port's own name
+pub fn driver_shows_client_name() -> bool {
+    cfg!(feature = "jack") || cfg!(target_os = "linux")
+}
+
+/// Message for platforms whose MIDI API has no virtual ports
+#[cfg(not(unix))]
+pub const VIRTUAL_PORTS_UNSUPPORTED: &str = "Virtual ports aren't available with the Windows MIDI API; \
+create a loopback port with a tool such as loopMIDI and use `mc fwd` instead";
+
+/// How a port name given on the command line is matched against driver names
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum PortMatch {
+    /// Name must match exactly
+    Exact,
+    /// Case-insensitive substring of the port name
+    Substring,
+    /// Regular expression matched against the port name
+    Regex,
+}
+
+/// Resolves an input port from a CLI argument (index, `id:` identifier or name)
+pub fn find_input_port(
+    midi_in: &MidiInput,
+    spec: &str,
+    mode: PortMatch,
+) -> Result<MidiInputPort, Box<dyn std::error::Error>> {
+    if let Some(id) = spec.strip_prefix(ID_PREFIX) {
+        return midi_in
+            .find_port_by_id(id.to_string())
+            .ok_or_else(|| PortError::NotFound(format!("No input port with id '{}'", id)).into());
+    }
+    let ports = midi_in.ports();
+    let names: Vec<String> = ports
+        .iter()
+        .map(|p| midi_in.port_name(p).unwrap_or_default())
+        .collect();
+    let idx = select_port(&names, spec, "Input", mode).map_err(PortError::NotFound)?;
+    Ok(ports[idx].clone())
+}
+
+/// Resolves an output port from a CLI argument (index, `id:` identifier or name)
+pub fn find_output_port(
+    midi_out: &MidiOutput,
+    spec: &str,
+    mode: PortMatch,
+) -> Result<MidiOutputPort, Box<dyn std::error::Error>> {
+    if let Some(id) = spec.strip_prefix(ID_PREFIX) {
+        return midi_out
+            .find_port_by_id(id.to_string())
+            .ok_or_else(|| PortError::NotFound(format!("No output port with id '{}'", id)).into());
+    }
+    let ports = midi_out.ports();
+    let names: Vec<String> = ports
+        .iter()
+        .map(|p| midi_out.port_name(p).unwrap_or_default())
+        .collect();
+    let idx = select_port(&names, spec, "Output", mode).map_err(PortError::NotFound)?;
+    Ok(ports[idx].clone())
+}
+
+/// Picks a port from the driver's name list
+/// Numeric arguments are indices as shown by `mc list`. Otherwise an exact name wins,
+/// and in substring or regex mode a single match is accepted
+pub fn select_port(names: &[String], spec: &str, kind: &str, mode: PortMatch) -> Result<usize, String> {
+    if let Ok(idx) = spec.parse::<usize>() {
+        if idx < names.len() {
+            return Ok(idx);
+        }
+        return Err(format!(
+            "{} port index {} out of range ({} ports available)",
+            kind,
+            idx,
+            names.len()
+        ));
+    }
+
+    if let Some(idx) = names.iter().position(|name| name == spec) {
+        return Ok(idx);
+    }
+
+    if mode == PortMatch::Exact {
+        return Err(format!("{} port '{}' not found", kind, spec));
+    }
+
+    let matches: Vec<usize> = if mode == PortMatch::Regex {
+        // Compile once and fail fast on an invalid pattern
+        let pattern = Regex::new(spec)
+            .map_err(|e| format!("Invalid {} port pattern '{}': {}", kind.to_lowercase(), spec, e))?;
+        names
+            .iter()
+            .enumerate()
+            .filter(|(_, name)| pattern.is_match(name))
+            .map(|(i, _)| i)
+            .collect()
+    } else {
+        let needle = spec.to_lowercase();
+        names
+            .iter()
+            .enumerate()
+            .filter(|(_, name)| name.to_lowercase().contains(&needle))
+            .map(|(i, _)| i)
+            .collect()
+    };
+
+    match matches.as_slice() {
+        [] => Err(format!("{} port '{}' not found", kind, spec)),
+        [idx] => Ok(*idx),
+        _ => Err(ambiguous_error(names, &matches, spec, kind)),
+    }
+}
+
+/// Builds an error listing every candidate so the user can disambiguate
+fn ambiguous_error(names: &[String], matches: &[usize], spec: &str, kind: &str) -> String {
+    let candidates: Vec<String> = matches
+        .iter()
+        .map(|&i| format!("  {}: {}", i, names[i]))
+        .collect();
+    format!(
+        "{} port '{}' is ambiguous, matches:\n{}",
+        kind,
+        spec,
+        candidates.join("\n")
+    )
+}
+
+/// Escapes a string for embedding in a JSON string literal
+pub fn json_escape(s: &str) -> String {
+    let mut escaped = String::with_capacity(s.len());
+    for c in s.chars() {
+        match c {
+            '"' => escaped.push_str("\\\""),
+            '\\' => escaped.push_str("\\\\"),
+            '\n' => escaped.push_str("\\n"),
+            '\r' => escaped.push_str("\\r"),
+            '\t' => escaped.push_str("\\t"),
+            c if (c as u32) < 0x20 => escaped.push_str(&format!("\\u{:04x}", c as u32)),
+            c => escaped.push(c),
+        }
+    }
+    escaped
+}
+
+/// True if `spec` would currently resolve to exactly one of `ports`
+/// Used by `--wait` to poll for a device that hasn't appeared yet
+pub fn port_resolves(ports: &[PortEntry], spec: &str, mode: PortMatch) -> bool {
+    if let Some(id) = spec.strip_prefix(ID_PREFIX) {
+        return ports.iter().any(|entry| entry.id == id);
+    }
+    let names: Vec<String> = ports.iter().map(|entry| entry.name.clone()).collect();
+    select_port(&names, spec, "", mode).is_ok()
+}
+
+/// Ports whose input plays back whatever is sent to their output: the IAC bus, ALSA's
+/// Midi Through, loopMIDI and the pairs `mc port` creates (lowercase, matched anywhere)
+const LOOPBACK_PATTERNS: &[&str] = &["iac driver", "iac bus", "midi through", "loopmidi", "mc-port:"];
+
+/// Why forwarding an input to an output could feed back into itself
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum FeedbackRisk {
+    /// Both are the same loopback port: every message comes straight back, endlessly
+    Loopback,
+    /// Both belong to one device, which loops only if it echoes its input (MIDI thru)
+    SameDevice,
+}
+
+/// A port name without ALSA's trailing client:port numbers, which differ between the
+/// two halves of a virtual port
+fn device_name(name: &str) -> &str {
+    match name.rsplit_once(' ') {
+        Some((device, ids))
+            if ids.split_once(':').is_some_and(|(client, port)| {
+                [client, port].iter().all(|n| !n.is_empty() && n.bytes().all(|b| b.is_ascii_digit()))
+            }) =>
+        {
+            device
+        }
+        _ => name,
+    }
+}
+
+/// Whether forwarding the input port `input` to the output port `output` risks a loop
+pub fn feedback_risk(input: &str, output: &str) -> Option<FeedbackRisk> {
+    let device = device_name(input);
+    if !device.eq_ignore_ascii_case(device_name(output)) {
+        return None;
+    }
+    let lower = device.to_lowercase();
+    if LOOPBACK_PATTERNS.iter().any(|pattern| lower.contains(pattern)) {
+        Some(FeedbackRisk::Loopback)
+    } else {
+        Some(FeedbackRisk::SameDevice)
+    }
+}
+
+/// Names in `new` but not `old`, and in `old` but not `new`
+/// Duplicate names count separately, so a second identical device shows as added
+pub fn port_changes(old: &[String], new: &[String]) -> (Vec<String>, Vec<String>) {
+    fn missing_from(from: &[String], other: &[String]) -> Vec<String> {
+        let mut remaining: Vec<&String> = other.iter().collect();
+        from.iter()
+            .filter(|name| match remaining.iter().position(|other| other == name) {
+                Some(i) => {
+                    remaining.swap_remove(i);
+                    false
+                }
+                None => true,
+            })
+            .cloned()
+            .collect()
+    }
+
+    (missing_from(new, old), missing_from(old, new))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn names(list: &[&str]) -> Vec<String> {
+        list.iter().map(|s| s.to_string()).collect()
+    }
+
+    #[test]
+    fn test_select_port_by_index() {
+        let ports = names(&["IAC Driver Bus 1", "USB MIDI 2.0"]);
+        assert_eq!(select_port(&ports, "0", "Input", PortMatch::Exact), Ok(0));
+        assert_eq!(select_port(&ports, "1", "Input", PortMatch::Substring), Ok(1));
+        assert!(select_port(&ports, "2", "Input", PortMatch::Exact)
+            .unwrap_err()
+            .contains("out of range"));
+    }
+
+    #[test]
+    fn test_select_port_exact() {
+        let ports = names(&["IAC Driver Bus 1", "USB MIDI 2.0"]);
+        assert_eq!(select_port(&ports, "USB MIDI 2.0", "Output", PortMatch::Exact), Ok(1));
+        assert!(select_port(&ports, "usb midi", "Output", PortMatch::Exact)
+            .unwrap_err()
+            .contains("not found"));
+    }
+
+    #[test]
+    fn test_select_port_substring() {
+        let ports = names(&["IAC Driver Bus 1", "IAC Driver Bus 10", "USB MIDI 2.0"]);
+        assert_eq!(select_port(&ports, "usb midi", "Output", PortMatch::Substring), Ok(2));
+
+        // An exact name wins over partial matches
+        assert_eq!(select_port(&ports, "IAC Driver Bus 1", "Output", PortMatch::Substring), Ok(0));
+
+        // Multiple partial matches list every candidate
+        let err = select_port(&ports, "iac", "Output", PortMatch::Substring).unwrap_err();
+        assert!(err.contains("ambiguous"));
+        assert!(err.contains("0: IAC Driver Bus 1"));
+        assert!(err.contains("1: IAC Driver Bus 10"));
+    }
+
+    #[test]
+    fn test_select_port_regex() {
+        let ports = names(&["Launchpad X In", "Launchpad X Out", "Midi Through:Midi Through Port-0 14:0"]);
+        assert_eq!(select_port(&ports, "^Launchpad.*Out$", "Output", PortMatch::Regex), Ok(1));
+        assert_eq!(select_port(&ports, r"Port-0 \d+:0$", "Output", PortMatch::Regex), Ok(2));
+
+        let err = select_port(&ports, "^Launchpad", "Output", PortMatch::Regex).unwrap_err();
+        assert!(err.contains("ambiguous"));
+        assert!(err.contains("Launchpad X In"));
+        assert!(err.contains("Launchpad X Out"));
+
+        let err = select_port(&ports, "Launchpad(", "Output", PortMatch::Regex).unwrap_err();
+        assert!(err.contains("Invalid output port pattern"));
+    }
+
+    #[test]
+    fn test_json_escape() {
+        assert_eq!(json_escape("IAC Driver Bus 1"), "IAC Driver Bus 1");
+        assert_eq!(json_escape("a \"b\" c"), "a \\\"b\\\" c");
+        assert_eq!(json_escape("back\\slash"), "back\\\\slash");
+        assert_eq!(json_escape("tab\there"), "tab\\there");
+        assert_eq!(json_escape("\u{1}"), "\\u0001");
+    }
+
+    #[test]
+    fn test_port_changes() {
+        let old = names(&["IAC Bus 1", "Launchpad"]);
+        let new = names(&["IAC Bus 1", "Keystep", "Launchpad", "Launchpad"]);
+        assert_eq!(port_changes(&old, &new), (names(&["Keystep", "Launchpad"]), vec![]));
+        assert_eq!(port_changes(&new, &old), (vec![], names(&["Keystep", "Launchpad"])));
+        assert_eq!(port_changes(&old, &old), (vec![], vec![]));
+    }
+
+    #[test]
+    fn test_port_resolves() {
+        let ports = vec![
+            PortEntry {
+                name: "IAC Driver Bus 1".to_string(),
+                id: "1".to_string(),
+            },
+            PortEntry {
+                name: "Launchpad X".to_string(),
+                id: "130:0".to_string(),
+            },
+        ];
+        assert!(port_resolves(&ports, "launchpad", PortMatch::Substring));
+        assert!(port_resolves(&ports, "id:130:0", PortMatch::Substring));
+        assert!(!port_resolves(&ports, "keystep", PortMatch::Substring));
+        assert!(!port_resolves(&ports, "id:131:0", PortMatch::Substring));
+        assert!(!port_resolves(&ports, "launchpad", PortMatch::Exact));
+    }
+
+    #[test]
+    fn test_feedback_risk() {
+        // The two halves of an `mc port` pair have different ALSA client numbers
+        assert_eq!(feedback_risk("mc-port:Bus 129:0", "mc-port:Bus 130:0"), Some(FeedbackRisk::Loopback));
+        assert_eq!(feedback_risk("IAC Driver Bus 1", "IAC Driver Bus 1"), Some(FeedbackRisk::Loopback));
+        assert_eq!(
+            feedback_risk("Midi Through:Midi Through Port-0 14:0", "Midi Through:Midi Through Port-0 14:0"),
+            Some(FeedbackRisk::Loopback)
+        );
+        assert_eq!(feedback_risk("Moog Sub 37", "Moog Sub 37"), Some(FeedbackRisk::SameDevice));
+
+        assert_eq!(feedback_risk("IAC Driver Bus 1", "IAC Driver Bus 2"), None);
+        assert_eq!(feedback_risk("mc-port:Bus 129:0", "mc-port:Other 130:0"), None);
+        assert_eq!(feedback_risk("Launchpad", "Moog Sub 37"), None);
+    }
+}
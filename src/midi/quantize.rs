@@ -0,0 +1,216 @@
+/// Note timing quantization for `mc fwd --quantize`
+/// Note Ons are held until the next point of a grid, either at a fixed tempo
+/// (`--quantize-bpm`) or following the Timing Clock arriving on the input. A note
+/// played just after a grid point (within `LATE_TOLERANCE` of a step) counts as on it
+/// and goes out at once, so notes played on the beat aren't pushed a whole step late.
+/// A Note Off is held only as long as needed to stay after its Note On.
+use super::clock::{TempoTracker, CLOCK, DEFAULT_PPQN, START};
+use std::collections::HashMap;
+use std::fmt;
+use std::time::{Duration, Instant};
+
+/// Fraction of a step after a grid point that still counts as on it
+const LATE_TOLERANCE: f64 = 0.25;
+
+/// Grid spacing as a note value, e.g. 16 for sixteenth notes or 8t for eighth triplets
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Division {
+    value: u32,
+    triplet: bool,
+}
+
+impl Division {
+    /// Grid step in Timing Clock pulses (24 per quarter note)
+    pub fn pulses(&self) -> u32 {
+        let whole_note = DEFAULT_PPQN * 4;
+        if self.triplet {
+            whole_note * 2 / 3 / self.value
+        } else {
+            whole_note / self.value
+        }
+    }
+}
+
+impl std::str::FromStr for Division {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let note = s.strip_prefix("1/").unwrap_or(s);
+        let (number, triplet) = match note.strip_suffix(['t', 'T']) {
+            Some(number) => (number, true),
+            None => (note, false),
+        };
+        match number.parse::<u32>() {
+            Ok(value) if [1, 2, 4, 8, 16, 32].contains(&value) => Ok(Division { value, triplet }),
+            _ => Err(format!(
+                "Invalid quantize division '{}' (expected 1, 2, 4, 8, 16 or 32, with t for triplets)",
+                s
+            )),
+        }
+    }
+}
+
+impl fmt::Display for Division {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "1/{}{}", self.value, if self.triplet { "T" } else { "" })
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct Quantizer {
+    step_pulses: u32,
+    /// Fixed tempo; None follows the input's clock
+    bpm: Option<f64>,
+    /// Internal grid: the first grid point, set by the first note
+    anchor: Option<Instant>,
+    /// External grid: clock count since Start (or the first clock) and when the last arrived
+    last_clock: Option<(u64, Instant)>,
+    tempo: TempoTracker,
+    /// Reference for the tracker's microsecond timestamps
+    origin: Instant,
+    /// When each sounding (channel, note)'s Note On goes out
+    note_on_at: HashMap<(u8, u8), Instant>,
+}
+
+impl Quantizer {
+    pub fn new(division: Division, bpm: Option<f64>) -> Self {
+        Self {
+            step_pulses: division.pulses(),
+            bpm,
+            anchor: None,
+            last_clock: None,
+            tempo: TempoTracker::new(DEFAULT_PPQN),
+            origin: Instant::now(),
+            note_on_at: HashMap::new(),
+        }
+    }
+
+    /// Feeds every input message, before any filtering, so the grid can follow the clock
+    pub fn observe(&mut self, msg: &[u8], at: Instant) {
+        if self.bpm.is_some() {
+            return;
+        }
+        let timestamp_us = at.saturating_duration_since(self.origin).as_micros() as u64;
+        match msg {
+            [CLOCK] => {
+                let count = self.last_clock.map_or(0, |(count, _)| count + 1);
+                self.last_clock = Some((count, at));
+                self.tempo.push(timestamp_us, msg);
+            }
+            // The first clock after Start is the downbeat
+            [START] => {
+                self.last_clock = None;
+                self.tempo.push(timestamp_us, msg);
+            }
+            _ => {}
+        }
+    }
+
+    /// When to send a note received at `at`; None sends it now
+    pub fn deadline(&mut self, msg: &[u8], at: Instant) -> Option<Instant> {
+        let [status, note, velocity] = *msg else {
+            return None;
+        };
+        let key = (status & 0x0F, note);
+        match status & 0xF0 {
+            0x90 if velocity > 0 => {
+                let due = self.next_grid_point(at)?;
+                self.note_on_at.insert(key, due);
+                Some(due)
+            }
+            0x80 | 0x90 => self.note_on_at.remove(&key).filter(|&on| on > at),
+            _ => None,
+        }
+    }
+
+    /// The grid point a note at `at` belongs to, or None when it's on one (or there's
+    /// no clock to follow yet)
+    fn next_grid_point(&mut self, at: Instant) -> Option<Instant> {
+        let (origin, position, pulse) = match self.bpm {
+            Some(bpm) => {
+                let origin = *self.anchor.get_or_insert(at);
+                let pulse = 60.0 / (bpm * DEFAULT_PPQN as f64);
+                (origin, at.saturating_duration_since(origin).as_secs_f64() / pulse, pulse)
+            }
+            None => {
+                let (count, last) = self.last_clock?;
+                let pulse = 60.0 / (self.tempo.estimate()?.bpm * DEFAULT_PPQN as f64);
+                // Grid points are counted from the clock that started the count
+                let origin = last.checked_sub(Duration::from_secs_f64(pulse * count as f64))?;
+                let elapsed = at.saturating_duration_since(last).as_secs_f64() / pulse;
+                (origin, count as f64 + elapsed, pulse)
+            }
+        };
+
+        let steps = position / self.step_pulses as f64;
+        if steps - steps.floor() <= LATE_TOLERANCE {
+            return None;
+        }
+        let grid = (steps.floor() + 1.0) * self.step_pulses as f64;
+        Some(origin + Duration::from_secs_f64(grid * pulse))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const MS: Duration = Duration::from_millis(1);
+
+    #[test]
+    fn test_parse_division() {
+        assert_eq!("16".parse::<Division>().unwrap().pulses(), 6);
+        assert_eq!("1/4".parse::<Division>().unwrap().pulses(), 24);
+        assert_eq!("8t".parse::<Division>().unwrap().pulses(), 8);
+        assert_eq!("32".parse::<Division>().unwrap().pulses(), 3);
+        assert_eq!("16t".parse::<Division>().unwrap().to_string(), "1/16T");
+        assert!("12".parse::<Division>().is_err());
+        assert!("t".parse::<Division>().is_err());
+    }
+
+    #[test]
+    fn test_internal_grid() {
+        // Sixteenths at 120 BPM are 125ms apart
+        let mut quantizer = Quantizer::new("16".parse().unwrap(), Some(120.0));
+        let start = Instant::now();
+        // The first note anchors the grid
+        assert_eq!(quantizer.deadline(&[0x90, 60, 100], start), None);
+        // 60ms in: held to the next sixteenth
+        assert_eq!(quantizer.deadline(&[0x90, 62, 100], start + 60 * MS), Some(start + 125 * MS));
+        // 20ms after a grid point: on it
+        assert_eq!(quantizer.deadline(&[0x90, 64, 100], start + 270 * MS), None);
+    }
+
+    #[test]
+    fn test_note_off_stays_after_note_on() {
+        let mut quantizer = Quantizer::new("4".parse().unwrap(), Some(120.0));
+        let start = Instant::now();
+        quantizer.deadline(&[0x90, 60, 100], start);
+        let on = quantizer.deadline(&[0x90, 62, 100], start + 200 * MS).unwrap();
+        assert_eq!(on, start + 500 * MS);
+        // Released before its Note On went out: held until then
+        assert_eq!(quantizer.deadline(&[0x80, 62, 0], start + 300 * MS), Some(on));
+        // Released later: sent at once
+        quantizer.deadline(&[0x90, 62, 100], start + 700 * MS);
+        assert_eq!(quantizer.deadline(&[0x90, 62, 0], start + 1200 * MS), None);
+        // Other messages are never held
+        assert_eq!(quantizer.deadline(&[0xB0, 1, 64], start + 200 * MS), None);
+    }
+
+    #[test]
+    fn test_follows_clock() {
+        let mut quantizer = Quantizer::new("8".parse().unwrap(), None);
+        let start = Instant::now();
+        // No clock yet: nothing to align to
+        assert_eq!(quantizer.deadline(&[0x90, 60, 100], start), None);
+
+        // 24 PPQN at 125 BPM is 20ms per pulse; eighths are 12 pulses (240ms)
+        quantizer.observe(&[START], start);
+        for pulse in 0..8u32 {
+            quantizer.observe(&[CLOCK], start + pulse * 20 * MS);
+        }
+        let due = quantizer.deadline(&[0x90, 62, 100], start + 150 * MS).unwrap();
+        let expected = start + 240 * MS;
+        assert!(due.max(expected) - due.min(expected) < MS);
+    }
+}
@@ -0,0 +1,152 @@
+/// Recording of the traffic through `mc port --record`
+/// Text formats are written as messages arrive and flushed at least every
+/// `FLUSH_INTERVAL`; a Standard MIDI File is kept in memory and written by `finish`, as
+/// with `mc rec`. Times count from the first message.
+use super::eventlog::{event_line, RecordFormat, CSV_HEADER};
+use super::smf::{bpm_to_tempo, write_type0, TimedMessage, DEFAULT_DIVISION};
+use crate::logging::error;
+use std::fs::File;
+use std::io::{self, BufWriter, Write};
+use std::time::{Duration, Instant};
+
+/// Longest a written line waits in the buffer
+const FLUSH_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Tempo of a recorded MIDI file, which only sets how ticks are counted
+const RECORD_BPM: f64 = 120.0;
+
+enum Output {
+    Smf(Vec<TimedMessage>),
+    Text { file: BufWriter<File>, flushed_at: Instant },
+}
+
+pub struct Recorder {
+    format: RecordFormat,
+    /// Kept open from the start, so an unwritable path fails before anything runs
+    file: Option<File>,
+    output: Output,
+    start: Option<Instant>,
+    count: u64,
+    failed: bool,
+}
+
+impl Recorder {
+    pub fn create(path: &str, format: RecordFormat) -> io::Result<Self> {
+        let file = File::create(path)?;
+        let (file, output) = match format {
+            RecordFormat::Smf => (Some(file), Output::Smf(Vec::new())),
+            _ => {
+                let mut file = BufWriter::new(file);
+                if format == RecordFormat::Csv {
+                    writeln!(file, "{}", CSV_HEADER)?;
+                }
+                (None, Output::Text { file, flushed_at: Instant::now() })
+            }
+        };
+        Ok(Self {
+            format,
+            file,
+            output,
+            start: None,
+            count: 0,
+            failed: false,
+        })
+    }
+
+    pub fn record(&mut self, msg: &[u8]) {
+        let now = Instant::now();
+        let elapsed = now.duration_since(*self.start.get_or_insert(now));
+        let result = match &mut self.output {
+            Output::Smf(messages) => {
+                messages.push(TimedMessage {
+                    time_us: elapsed.as_micros() as u64,
+                    bytes: msg.to_vec(),
+                });
+                Ok(())
+            }
+            Output::Text { file, flushed_at } => {
+                let line = event_line(self.format, elapsed.as_secs_f64(), msg).unwrap_or_default();
+                writeln!(file, "{}", line).and_then(|_| {
+                    if now.duration_since(*flushed_at) < FLUSH_INTERVAL {
+                        return Ok(());
+                    }
+                    *flushed_at = now;
+                    file.flush()
+                })
+            }
+        };
+        match result {
+            Ok(()) => self.count += 1,
+            // Report the first failure only (e.g. the disk filled up), not every message
+            Err(e) if !self.failed => {
+                error!("Error writing recording: {}", e);
+                self.failed = true;
+            }
+            Err(_) => {}
+        }
+    }
+
+    /// Writes out everything recorded, returning the number of messages
+    /// A MIDI file is written only once; later messages aren't added to it
+    pub fn finish(&mut self) -> io::Result<u64> {
+        match &mut self.output {
+            Output::Smf(messages) => {
+                if let Some(file) = self.file.take() {
+                    let mut file = BufWriter::new(file);
+                    write_type0(&mut file, messages, DEFAULT_DIVISION, bpm_to_tempo(RECORD_BPM))?;
+                    file.flush()?;
+                }
+            }
+            Output::Text { file, .. } => file.flush()?,
+        }
+        Ok(self.count)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::midi::eventlog::read_events;
+
+    fn temp_path(name: &str) -> String {
+        std::env::temp_dir()
+            .join(format!("mc-recorder-{}-{}", std::process::id(), name))
+            .to_string_lossy()
+            .into_owned()
+    }
+
+    #[test]
+    fn test_text_recording() {
+        let path = temp_path("take.csv");
+        let mut recorder = Recorder::create(&path, RecordFormat::Csv).unwrap();
+        recorder.record(&[0x90, 60, 100]);
+        recorder.record(&[0x80, 60, 0]);
+        assert_eq!(recorder.finish().unwrap(), 2);
+
+        let text = std::fs::read_to_string(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+        assert!(text.starts_with(CSV_HEADER));
+        let (events, warnings) = read_events(&text, RecordFormat::Csv);
+        assert!(warnings.is_empty());
+        assert_eq!(events[0].bytes, vec![0x90, 60, 100]);
+        assert_eq!(events[1].bytes, vec![0x80, 60, 0]);
+    }
+
+    #[test]
+    fn test_smf_recording() {
+        let path = temp_path("take.mid");
+        let mut recorder = Recorder::create(&path, RecordFormat::Smf).unwrap();
+        recorder.record(&[0xB0, 7, 100]);
+        assert_eq!(recorder.finish().unwrap(), 1);
+
+        let bytes = std::fs::read(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+        assert!(bytes.starts_with(b"MThd"));
+        assert!(bytes.windows(3).any(|w| w == [0xB0, 7, 100]));
+    }
+
+    #[test]
+    fn test_unwritable_path() {
+        assert!(Recorder::create("/nonexistent/dir/take.mid", RecordFormat::Smf).is_err());
+    }
+}
@@ -0,0 +1,89 @@
+/// Messages `--reset-on-start` can send to put downstream gear in a known state
+use super::decode::hex_bytes;
+use super::send::parse_line;
+use std::fmt;
+
+/// GM System On (Universal Non-Real Time SysEx, all devices)
+pub const GM_SYSTEM_ON: [u8; 6] = [0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7];
+/// GM2 System On
+pub const GM2_SYSTEM_ON: [u8; 6] = [0xF0, 0x7E, 0x7F, 0x09, 0x03, 0xF7];
+
+/// What to send before forwarding starts
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Reset {
+    /// System Reset (0xFF)
+    System,
+    GmOn,
+    Gm2On,
+    /// Any other message, given as hex (e.g. a GS or XG reset)
+    Custom(Vec<u8>),
+}
+
+impl Reset {
+    pub fn bytes(&self) -> &[u8] {
+        match self {
+            Reset::System => &[0xFF],
+            Reset::GmOn => &GM_SYSTEM_ON,
+            Reset::Gm2On => &GM2_SYSTEM_ON,
+            Reset::Custom(bytes) => bytes,
+        }
+    }
+}
+
+impl fmt::Display for Reset {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let name = match self {
+            Reset::System => "System Reset",
+            Reset::GmOn => "GM System On",
+            Reset::Gm2On => "GM2 System On",
+            Reset::Custom(_) => "reset message",
+        };
+        write!(f, "{} ({})", name, hex_bytes(self.bytes()))
+    }
+}
+
+impl std::str::FromStr for Reset {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "reset" => Ok(Reset::System),
+            "gm" => Ok(Reset::GmOn),
+            "gm2" => Ok(Reset::Gm2On),
+            _ => match parse_line(s) {
+                // A SysEx cut short would leave the receiver waiting for its end
+                Ok(Some(bytes)) if bytes[0] != 0xF0 || bytes.last() == Some(&0xF7) => {
+                    Ok(Reset::Custom(bytes))
+                }
+                _ => Err(format!(
+                    "Unknown reset type '{}' (expected reset, gm, gm2 or a message in hex)",
+                    s
+                )),
+            },
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_reset() {
+        assert_eq!("reset".parse(), Ok(Reset::System));
+        assert_eq!("gm".parse::<Reset>().unwrap().bytes(), &GM_SYSTEM_ON);
+        assert_eq!("gm2".parse::<Reset>().unwrap().bytes(), &GM2_SYSTEM_ON);
+        // Roland GS reset
+        let gs: Reset = "F0 41 10 42 12 40 00 7F 00 41 F7".parse().unwrap();
+        assert_eq!(gs.bytes().len(), 11);
+        assert!("".parse::<Reset>().is_err());
+        assert!("F0 7E 7F".parse::<Reset>().is_err());
+        assert!("panic".parse::<Reset>().is_err());
+    }
+
+    #[test]
+    fn test_display() {
+        assert_eq!(Reset::System.to_string(), "System Reset (FF)");
+        assert_eq!(Reset::GmOn.to_string(), "GM System On (F0 7E 7F 09 01 F7)");
+    }
+}
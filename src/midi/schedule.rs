@@ -0,0 +1,77 @@
+/// Send times for `mc fwd --preserve-timing`
+/// Messages are released at their input timestamps' spacing instead of as soon as
+/// the driver delivers them, so bursts of buffered messages keep their original gaps
+use std::time::{Duration, Instant};
+
+/// Maps driver timestamps (microseconds) onto local send deadlines
+/// The first message anchors the mapping. A message arriving after its deadline
+/// re-anchors to itself, and one that would wait longer than `max_buffer`
+/// re-anchors too, so the delay added to any message never exceeds `max_buffer`
+#[derive(Debug, Clone)]
+pub struct TimingMap {
+    max_buffer: Duration,
+    anchor: Option<(u64, Instant)>,
+}
+
+impl TimingMap {
+    pub fn new(max_buffer: Duration) -> Self {
+        Self {
+            max_buffer,
+            anchor: None,
+        }
+    }
+
+    /// Returns when a message stamped `timestamp_us` and received at `now` should be sent
+    pub fn deadline(&mut self, timestamp_us: u64, now: Instant) -> Instant {
+        if let Some((anchor_us, anchor_at)) = self.anchor {
+            // A timestamp going backwards (driver restart) can't be scheduled
+            if let Some(offset) = timestamp_us.checked_sub(anchor_us) {
+                let deadline = anchor_at + Duration::from_micros(offset);
+                if deadline >= now && deadline - now <= self.max_buffer {
+                    return deadline;
+                }
+            }
+        }
+        self.anchor = Some((timestamp_us, now));
+        now
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_burst_keeps_gaps() {
+        let mut map = TimingMap::new(Duration::from_millis(50));
+        let start = Instant::now();
+        // Three messages 10ms apart delivered together
+        assert_eq!(map.deadline(1_000, start), start);
+        assert_eq!(map.deadline(11_000, start), start + Duration::from_millis(10));
+        assert_eq!(map.deadline(21_000, start), start + Duration::from_millis(20));
+    }
+
+    #[test]
+    fn test_late_message_reanchors() {
+        let mut map = TimingMap::new(Duration::from_millis(50));
+        let start = Instant::now();
+        map.deadline(0, start);
+        // Stamped 10ms after the first but delivered 30ms later: sent now
+        let late = start + Duration::from_millis(30);
+        assert_eq!(map.deadline(10_000, late), late);
+        // Later messages follow the new anchor
+        assert_eq!(map.deadline(15_000, late), late + Duration::from_millis(5));
+    }
+
+    #[test]
+    fn test_delay_is_bounded() {
+        let mut map = TimingMap::new(Duration::from_millis(20));
+        let start = Instant::now();
+        map.deadline(0, start);
+        // 100ms gap would exceed the buffer, so it's sent immediately
+        assert_eq!(map.deadline(100_000, start), start);
+        // Timestamps going backwards re-anchor rather than panic
+        let later = start + Duration::from_millis(1);
+        assert_eq!(map.deadline(50, later), later);
+    }
+}
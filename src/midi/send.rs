@@ -0,0 +1,203 @@
+use super::decode::parse_note_name;
+use super::validation::is_valid_midi_message;
+
+/// Parses one line of `mc send` input
+/// Returns None for blank lines and `#` comments (also allowed after a message).
+/// Messages are either hex bytes separated by whitespace, e.g. `90 3C 64`,
+/// or a command such as `noteon ch1 C4 100` (see `parse_command`).
+pub fn parse_line(line: &str) -> Result<Option<Vec<u8>>, String> {
+    // `#` starts a comment unless it's part of a sharp note name (`F#2`)
+    let comment = line
+        .match_indices('#')
+        .map(|(i, _)| i)
+        .find(|&i| i == 0 || line[..i].ends_with(char::is_whitespace));
+    let line = match comment {
+        Some(i) => &line[..i],
+        None => line,
+    }
+    .trim();
+    if line.is_empty() {
+        return Ok(None);
+    }
+
+    if line.starts_with(|c: char| c.is_ascii_alphabetic()) && !looks_like_hex(line) {
+        return parse_command(line).map(Some);
+    }
+
+    let message = line
+        .split_whitespace()
+        .map(|token| {
+            let digits = token.strip_prefix("0x").or_else(|| token.strip_prefix("0X")).unwrap_or(token);
+            match digits.len() {
+                1 | 2 => u8::from_str_radix(digits, 16).map_err(|_| format!("Invalid hex byte '{}'", token)),
+                _ => Err(format!("Invalid hex byte '{}'", token)),
+            }
+        })
+        .collect::<Result<Vec<u8>, String>>()?;
+
+    // The validator checks lengths only; data bytes must also have the high bit clear
+    let data_end = if message[0] == 0xF0 { message.len() - 1 } else { message.len() };
+    if let Some(byte) = message.get(1..data_end).and_then(|data| data.iter().find(|&&b| b > 0x7F)) {
+        return Err(format!("Data byte {:02X} is out of range (00-7F)", byte));
+    }
+    if !is_valid_midi_message(&message) {
+        return Err(format!("'{}' is not a valid MIDI message", line));
+    }
+    Ok(Some(message))
+}
+
+/// True when every token is one or two hex digits or a 0x byte
+/// `CC 05` (program change on channel 13) is hex, but `cc 1 74 12` is a command
+fn looks_like_hex(line: &str) -> bool {
+    let tokens: Vec<&str> = line.split_whitespace().collect();
+    if tokens.len() == 4 && tokens[0].eq_ignore_ascii_case("cc") {
+        return false;
+    }
+    tokens.iter().all(|token| {
+        let digits = token.strip_prefix("0x").or_else(|| token.strip_prefix("0X")).unwrap_or(token);
+        (1..=2).contains(&digits.len()) && digits.chars().all(|c| c.is_ascii_hexdigit())
+    })
+}
+
+/// Parses a command line: `noteon ch1 C4 100`, `noteoff ch1 60 [vel]`, `polytouch ch1 C4 64`,
+/// `cc ch1 74 12`, `pc ch2 5`, `aftertouch ch1 90`, `pitchbend ch1 -8192..8191`
+/// Channels are 1-16 (the `ch` prefix is optional) and notes are numbers or names (C4 = 60).
+/// Errors name the token that failed.
+pub fn parse_command(line: &str) -> Result<Vec<u8>, String> {
+    let tokens: Vec<&str> = line.split_whitespace().collect();
+    let command = tokens[0].to_ascii_lowercase();
+    let args = &tokens[1..];
+
+    let expect = |count: &[usize], usage: &str| -> Result<(), String> {
+        if count.contains(&args.len()) {
+            Ok(())
+        } else {
+            Err(format!("Usage: {}", usage))
+        }
+    };
+
+    match command.as_str() {
+        "noteon" => {
+            expect(&[3], "noteon CH NOTE VELOCITY")?;
+            Ok(vec![0x90 | channel(args[0])?, note(args[1])?, data(args[2], "velocity")?])
+        }
+        "noteoff" => {
+            expect(&[2, 3], "noteoff CH NOTE [VELOCITY]")?;
+            let velocity = args.get(2).map(|v| data(v, "velocity")).transpose()?.unwrap_or(0);
+            Ok(vec![0x80 | channel(args[0])?, note(args[1])?, velocity])
+        }
+        "polytouch" => {
+            expect(&[3], "polytouch CH NOTE PRESSURE")?;
+            Ok(vec![0xA0 | channel(args[0])?, note(args[1])?, data(args[2], "pressure")?])
+        }
+        "cc" => {
+            expect(&[3], "cc CH CONTROLLER VALUE")?;
+            Ok(vec![0xB0 | channel(args[0])?, data(args[1], "controller")?, data(args[2], "value")?])
+        }
+        "pc" => {
+            expect(&[2], "pc CH PROGRAM")?;
+            Ok(vec![0xC0 | channel(args[0])?, data(args[1], "program")?])
+        }
+        "aftertouch" => {
+            expect(&[2], "aftertouch CH PRESSURE")?;
+            Ok(vec![0xD0 | channel(args[0])?, data(args[1], "pressure")?])
+        }
+        "pitchbend" | "pb" => {
+            expect(&[2], "pitchbend CH -8192..8191")?;
+            let bend = args[1]
+                .parse::<i16>()
+                .ok()
+                .filter(|b| (-8192..=8191).contains(b))
+                .ok_or_else(|| format!("Invalid bend '{}' (expected -8192 to 8191)", args[1]))?;
+            let value = (bend + 8192) as u16;
+            Ok(vec![0xE0 | channel(args[0])?, (value & 0x7F) as u8, (value >> 7) as u8])
+        }
+        _ => Err(format!("Unknown command '{}'", tokens[0])),
+    }
+}
+
+/// `ch1`..`ch16` or `1`..`16`, returned 0-based
+fn channel(token: &str) -> Result<u8, String> {
+    let digits = token
+        .strip_prefix("ch")
+        .or_else(|| token.strip_prefix("CH"))
+        .unwrap_or(token);
+    match digits.parse::<u8>() {
+        Ok(ch) if (1..=16).contains(&ch) => Ok(ch - 1),
+        _ => Err(format!("Invalid channel '{}' (expected 1-16)", token)),
+    }
+}
+
+/// A note number (0-127) or name such as `C4`
+fn note(token: &str) -> Result<u8, String> {
+    match token.parse::<u8>() {
+        Ok(n) if n <= 127 => Ok(n),
+        Ok(_) => Err(format!("Invalid note '{}' (expected 0-127 or a name like C4)", token)),
+        Err(_) => parse_note_name(token)
+            .ok_or_else(|| format!("Invalid note '{}' (expected 0-127 or a name like C4)", token)),
+    }
+}
+
+/// A data byte (0-127)
+fn data(token: &str, what: &str) -> Result<u8, String> {
+    match token.parse::<u8>() {
+        Ok(n) if n <= 127 => Ok(n),
+        _ => Err(format!("Invalid {} '{}' (expected 0-127)", what, token)),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_hex_lines() {
+        assert_eq!(parse_line("90 3C 64"), Ok(Some(vec![0x90, 0x3C, 0x64])));
+        assert_eq!(parse_line("  0xB0 0x07 7f  # volume"), Ok(Some(vec![0xB0, 0x07, 0x7F])));
+        assert_eq!(parse_line("F8"), Ok(Some(vec![0xF8])));
+        assert_eq!(parse_line("F0 7E 7F 06 01 F7"), Ok(Some(vec![0xF0, 0x7E, 0x7F, 0x06, 0x01, 0xF7])));
+    }
+
+    #[test]
+    fn test_blank_and_comment_lines() {
+        assert_eq!(parse_line(""), Ok(None));
+        assert_eq!(parse_line("   "), Ok(None));
+        assert_eq!(parse_line("# a comment"), Ok(None));
+    }
+
+    #[test]
+    fn test_invalid_lines() {
+        assert!(parse_line("90 3C").is_err());
+        assert!(parse_line("90 3C 80").is_err());
+        assert!(parse_line("90 3C6 64").is_err());
+        assert!(parse_line("zz").is_err());
+    }
+
+    #[test]
+    fn test_commands() {
+        assert_eq!(parse_line("noteon ch1 C4 100"), Ok(Some(vec![0x90, 60, 100])));
+        assert_eq!(parse_line("noteoff 10 F#2"), Ok(Some(vec![0x89, 42, 0])));
+        assert_eq!(parse_line("noteon 1 F#2 64 # sharp"), Ok(Some(vec![0x90, 42, 64])));
+        assert_eq!(parse_line("NoteOn ch16 127 1  # comment"), Ok(Some(vec![0x9F, 127, 1])));
+        assert_eq!(parse_line("cc ch1 74 12"), Ok(Some(vec![0xB0, 74, 12])));
+        assert_eq!(parse_line("pc ch2 5"), Ok(Some(vec![0xC1, 5])));
+        assert_eq!(parse_line("aftertouch ch1 90"), Ok(Some(vec![0xD0, 90])));
+        assert_eq!(parse_line("pitchbend ch1 0"), Ok(Some(vec![0xE0, 0x00, 0x40])));
+        assert_eq!(parse_line("pb ch1 -8192"), Ok(Some(vec![0xE0, 0x00, 0x00])));
+        assert_eq!(parse_line("pb ch1 8191"), Ok(Some(vec![0xE0, 0x7F, 0x7F])));
+
+        // Hex that happens to start with a letter is still hex
+        assert_eq!(parse_line("B0 07 7F"), Ok(Some(vec![0xB0, 0x07, 0x7F])));
+        assert_eq!(parse_line("CC 05"), Ok(Some(vec![0xCC, 0x05])));
+    }
+
+    #[test]
+    fn test_command_errors_name_the_token() {
+        assert!(parse_line("noteon ch17 C4 100").unwrap_err().contains("'ch17'"));
+        assert!(parse_line("noteon ch1 H4 100").unwrap_err().contains("'H4'"));
+        assert!(parse_line("cc ch1 74 128").unwrap_err().contains("'128'"));
+        assert!(parse_line("pb ch1 9000").unwrap_err().contains("'9000'"));
+        assert!(parse_line("pc ch1").unwrap_err().contains("Usage"));
+        assert!(parse_line("sing ch1 C4").unwrap_err().contains("'sing'"));
+    }
+}
@@ -0,0 +1,344 @@
+/// Standard MIDI File (SMF) reading and writing
+use std::io::{self, Write};
+
+/// Ticks per quarter note used for recordings
+pub const DEFAULT_DIVISION: u16 = 480;
+
+/// A recorded message with its time in microseconds since the start of the recording
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TimedMessage {
+    pub time_us: u64,
+    pub bytes: Vec<u8>,
+}
+
+/// Converts a tempo in BPM to microseconds per quarter note
+pub fn bpm_to_tempo(bpm: f64) -> u32 {
+    (60_000_000.0 / bpm).round() as u32
+}
+
+/// Writes a variable-length quantity as used for delta times and lengths
+fn write_vlq(out: &mut Vec<u8>, mut value: u32) {
+    let mut bytes = [0u8; 5];
+    let mut len = 0;
+    loop {
+        bytes[len] = (value & 0x7F) as u8;
+        len += 1;
+        value >>= 7;
+        if value == 0 {
+            break;
+        }
+    }
+    for i in (0..len).rev() {
+        let continuation = if i > 0 { 0x80 } else { 0x00 };
+        out.push(bytes[i] | continuation);
+    }
+}
+
+/// Serializes messages as a type-0 SMF with a single tempo
+/// Only channel messages and SysEx are stored; realtime and system common
+/// messages have no meaning in a file and are skipped
+pub fn write_type0<W: Write>(
+    writer: &mut W,
+    messages: &[TimedMessage],
+    division: u16,
+    tempo: u32,
+) -> io::Result<()> {
+    let mut track = Vec::new();
+
+    // Tempo meta event at time 0
+    write_vlq(&mut track, 0);
+    track.extend_from_slice(&[0xFF, 0x51, 0x03]);
+    track.extend_from_slice(&tempo.to_be_bytes()[1..]);
+
+    let mut last_tick = 0u64;
+    for message in messages {
+        let status = match message.bytes.first() {
+            Some(&status) => status,
+            None => continue,
+        };
+        if status > 0xF0 {
+            continue;
+        }
+
+        let tick = message.time_us * division as u64 / tempo as u64;
+        let delta = tick.saturating_sub(last_tick).min(0x0FFF_FFFF) as u32;
+        last_tick = last_tick.max(tick);
+        write_vlq(&mut track, delta);
+
+        if status == 0xF0 {
+            // SysEx events store their length after the F0
+            track.push(0xF0);
+            write_vlq(&mut track, (message.bytes.len() - 1) as u32);
+            track.extend_from_slice(&message.bytes[1..]);
+        } else {
+            track.extend_from_slice(&message.bytes);
+        }
+    }
+
+    // End of track
+    write_vlq(&mut track, 0);
+    track.extend_from_slice(&[0xFF, 0x2F, 0x00]);
+
+    // Header chunk: format 0, one track
+    writer.write_all(b"MThd")?;
+    writer.write_all(&6u32.to_be_bytes())?;
+    writer.write_all(&0u16.to_be_bytes())?;
+    writer.write_all(&1u16.to_be_bytes())?;
+    writer.write_all(&division.to_be_bytes())?;
+
+    writer.write_all(b"MTrk")?;
+    writer.write_all(&(track.len() as u32).to_be_bytes())?;
+    writer.write_all(&track)?;
+    writer.flush()
+}
+
+/// Reads a variable-length quantity, advancing the position
+fn read_vlq(data: &[u8], pos: &mut usize) -> Result<u32, String> {
+    let mut value = 0u32;
+    for _ in 0..4 {
+        let byte = *data.get(*pos).ok_or("Unexpected end of track data")?;
+        *pos += 1;
+        value = (value << 7) | (byte & 0x7F) as u32;
+        if byte & 0x80 == 0 {
+            return Ok(value);
+        }
+    }
+    Err("Variable-length value too long".to_string())
+}
+
+/// Reads `len` bytes, advancing the position
+fn read_bytes<'a>(data: &'a [u8], pos: &mut usize, len: usize) -> Result<&'a [u8], String> {
+    let bytes = data
+        .get(*pos..*pos + len)
+        .ok_or("Unexpected end of file")?;
+    *pos += len;
+    Ok(bytes)
+}
+
+/// An event parsed from a track, before tempo is applied
+enum TrackEvent {
+    Message(Vec<u8>),
+    Tempo(u32),
+}
+
+/// Parses one MTrk chunk into (absolute tick, event) pairs
+fn parse_track(data: &[u8]) -> Result<Vec<(u64, TrackEvent)>, String> {
+    let mut events = Vec::new();
+    let mut pos = 0;
+    let mut tick = 0u64;
+    let mut running_status: Option<u8> = None;
+
+    while pos < data.len() {
+        tick += read_vlq(data, &mut pos)? as u64;
+
+        let mut status = *data.get(pos).ok_or("Unexpected end of track data")?;
+        if status < 0x80 {
+            // Running status: reuse the previous channel status
+            status = running_status.ok_or("Data byte without status in track")?;
+        } else {
+            pos += 1;
+        }
+
+        match status {
+            0xFF => {
+                let meta_type = read_bytes(data, &mut pos, 1)?[0];
+                let len = read_vlq(data, &mut pos)? as usize;
+                let payload = read_bytes(data, &mut pos, len)?;
+                match meta_type {
+                    0x2F => break,
+                    0x51 if len == 3 => {
+                        let tempo = u32::from_be_bytes([0, payload[0], payload[1], payload[2]]);
+                        events.push((tick, TrackEvent::Tempo(tempo)));
+                    }
+                    _ => {}
+                }
+            }
+            0xF0 | 0xF7 => {
+                let len = read_vlq(data, &mut pos)? as usize;
+                let payload = read_bytes(data, &mut pos, len)?;
+                // F0 events omit the leading F0, F7 "escape" events are sent as-is
+                let mut message = Vec::with_capacity(len + 1);
+                if status == 0xF0 {
+                    message.push(0xF0);
+                }
+                message.extend_from_slice(payload);
+                events.push((tick, TrackEvent::Message(message)));
+            }
+            0x80..=0xEF => {
+                running_status = Some(status);
+                let len = if (0xC0..=0xDF).contains(&status) { 1 } else { 2 };
+                let mut message = vec![status];
+                message.extend_from_slice(read_bytes(data, &mut pos, len)?);
+                events.push((tick, TrackEvent::Message(message)));
+            }
+            _ => return Err(format!("Unexpected status 0x{:02X} in track", status)),
+        }
+    }
+
+    Ok(events)
+}
+
+/// Parses an SMF (format 0 or 1) into messages timed in microseconds
+/// Tracks are merged and tempo changes anywhere in the file are honored
+pub fn read_smf(data: &[u8]) -> Result<Vec<TimedMessage>, String> {
+    let mut pos = 0;
+    if read_bytes(data, &mut pos, 4)? != b"MThd" {
+        return Err("Not a Standard MIDI File (missing MThd header)".to_string());
+    }
+    let header_len = u32::from_be_bytes(read_bytes(data, &mut pos, 4)?.try_into().unwrap()) as usize;
+    let header = read_bytes(data, &mut pos, header_len)?;
+    if header.len() < 6 {
+        return Err("SMF header too short".to_string());
+    }
+    let format = u16::from_be_bytes([header[0], header[1]]);
+    let division = u16::from_be_bytes([header[4], header[5]]);
+    if format > 1 {
+        return Err(format!("SMF format {} is not supported", format));
+    }
+
+    // Collect events from every track, keeping track order for equal ticks
+    let mut events: Vec<(u64, TrackEvent)> = Vec::new();
+    while pos + 8 <= data.len() {
+        let chunk_type = read_bytes(data, &mut pos, 4)?;
+        let chunk_len = u32::from_be_bytes(read_bytes(data, &mut pos, 4)?.try_into().unwrap()) as usize;
+        let chunk = read_bytes(data, &mut pos, chunk_len)?;
+        if chunk_type == b"MTrk" {
+            events.extend(parse_track(chunk)?);
+        }
+    }
+    events.sort_by_key(|(tick, _)| *tick);
+
+    // SMPTE division gives a fixed tick length, otherwise it depends on tempo
+    let smpte_tick_us = if division & 0x8000 != 0 {
+        let fps = -((division >> 8) as u8 as i8) as f64;
+        let ticks_per_frame = (division & 0xFF) as f64;
+        Some(1_000_000.0 / (fps * ticks_per_frame))
+    } else {
+        None
+    };
+
+    let mut tempo = bpm_to_tempo(120.0) as f64;
+    let mut last_tick = 0u64;
+    let mut time_us = 0.0f64;
+    let mut messages = Vec::new();
+    for (tick, event) in events {
+        let tick_us = smpte_tick_us.unwrap_or(tempo / division as f64);
+        time_us += (tick - last_tick) as f64 * tick_us;
+        last_tick = tick;
+
+        match event {
+            TrackEvent::Tempo(new_tempo) => tempo = new_tempo as f64,
+            TrackEvent::Message(bytes) => messages.push(TimedMessage {
+                time_us: time_us.round() as u64,
+                bytes,
+            }),
+        }
+    }
+
+    Ok(messages)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn vlq(value: u32) -> Vec<u8> {
+        let mut out = Vec::new();
+        write_vlq(&mut out, value);
+        out
+    }
+
+    #[test]
+    fn test_vlq() {
+        assert_eq!(vlq(0), vec![0x00]);
+        assert_eq!(vlq(0x7F), vec![0x7F]);
+        assert_eq!(vlq(0x80), vec![0x81, 0x00]);
+        assert_eq!(vlq(0x3FFF), vec![0xFF, 0x7F]);
+        assert_eq!(vlq(0x0FFF_FFFF), vec![0xFF, 0xFF, 0xFF, 0x7F]);
+    }
+
+    #[test]
+    fn test_write_type0() {
+        let tempo = bpm_to_tempo(120.0);
+        assert_eq!(tempo, 500_000);
+
+        let messages = vec![
+            TimedMessage { time_us: 0, bytes: vec![0x90, 60, 100] },
+            TimedMessage { time_us: 500_000, bytes: vec![0x80, 60, 0] },
+            TimedMessage { time_us: 600_000, bytes: vec![0xF8] },
+        ];
+        let mut file = Vec::new();
+        write_type0(&mut file, &messages, 480, tempo).unwrap();
+
+        assert_eq!(&file[..14], &[b'M', b'T', b'h', b'd', 0, 0, 0, 6, 0, 0, 0, 1, 0x01, 0xE0]);
+        assert_eq!(&file[14..18], b"MTrk");
+        let track = &file[22..];
+        assert_eq!(
+            track,
+            &[
+                0x00, 0xFF, 0x51, 0x03, 0x07, 0xA1, 0x20, // tempo
+                0x00, 0x90, 60, 100, // note on at 0
+                0x83, 0x60, 0x80, 60, 0, // note off one quarter (480 ticks) later
+                0x00, 0xFF, 0x2F, 0x00, // end of track, clock skipped
+            ]
+        );
+        assert_eq!(u32::from_be_bytes([file[18], file[19], file[20], file[21]]) as usize, track.len());
+    }
+
+    #[test]
+    fn test_write_sysex() {
+        let messages = vec![TimedMessage { time_us: 0, bytes: vec![0xF0, 0x43, 0x12, 0xF7] }];
+        let mut file = Vec::new();
+        write_type0(&mut file, &messages, 480, 500_000).unwrap();
+        assert_eq!(&file[29..35], &[0x00, 0xF0, 0x03, 0x43, 0x12, 0xF7]);
+    }
+
+    #[test]
+    fn test_read_vlq() {
+        let mut pos = 0;
+        assert_eq!(read_vlq(&[0x83, 0x60], &mut pos), Ok(480));
+        assert_eq!(pos, 2);
+    }
+
+    #[test]
+    fn test_round_trip() {
+        let messages = vec![
+            TimedMessage { time_us: 0, bytes: vec![0x90, 60, 100] },
+            TimedMessage { time_us: 250_000, bytes: vec![0xF0, 0x43, 0x12, 0xF7] },
+            TimedMessage { time_us: 500_000, bytes: vec![0x80, 60, 0] },
+        ];
+        let mut file = Vec::new();
+        write_type0(&mut file, &messages, 480, 500_000).unwrap();
+        assert_eq!(read_smf(&file).unwrap(), messages);
+    }
+
+    #[test]
+    fn test_read_tempo_change_and_running_status() {
+        // Format 1: tempo track switching from 120 to 60 BPM after one quarter,
+        // note track using running status
+        #[rustfmt::skip]
+        let file: Vec<u8> = [
+            &b"MThd"[..], &[0, 0, 0, 6, 0, 1, 0, 2, 0x01, 0xE0],
+            b"MTrk", &[0, 0, 0, 15],
+            &[0x00, 0xFF, 0x51, 0x03, 0x07, 0xA1, 0x20],
+            &[0x83, 0x60, 0xFF, 0x51, 0x03, 0x0F, 0x42, 0x40],
+            b"MTrk", &[0, 0, 0, 17],
+            &[0x00, 0x90, 60, 100],
+            &[0x83, 0x60, 60, 0],
+            &[0x83, 0x60, 0x90, 62, 100],
+            &[0x00, 0xFF, 0x2F, 0x00],
+        ]
+        .concat();
+
+        let messages = read_smf(&file).unwrap();
+        let times: Vec<u64> = messages.iter().map(|m| m.time_us).collect();
+        assert_eq!(times, vec![0, 500_000, 1_500_000]);
+        assert_eq!(messages[1].bytes, vec![0x90, 60, 0]);
+    }
+
+    #[test]
+    fn test_read_rejects_garbage() {
+        assert!(read_smf(b"RIFF....").is_err());
+        assert!(read_smf(b"MTh").is_err());
+    }
+}
@@ -0,0 +1,206 @@
+/// Song Position Pointer tracking, for `mc spp` and `mc fwd --generate-spp`
+/// SPP (F2 lsb msb) gives a position in MIDI beats, sixteenth notes from the start of the
+/// song, which sequencers send when they locate. Between pointers the position advances
+/// one sixteenth every six Timing Clocks while running; Start goes back to the top.
+use super::clock::{CLOCK, CONTINUE, START, STOP};
+
+pub const SONG_POSITION: u8 = 0xF2;
+
+/// Timing Clocks per MIDI beat (a sixteenth note at 24 PPQN)
+pub const CLOCKS_PER_SIXTEENTH: u32 = 6;
+
+/// Largest position a pointer can hold (14 bits)
+const MAX_POSITION: u32 = 0x3FFF;
+
+/// The position of a well-formed SPP message
+pub fn spp_position(msg: &[u8]) -> Option<u16> {
+    match *msg {
+        [SONG_POSITION, lsb, msb] if lsb < 0x80 && msb < 0x80 => Some((msb as u16) << 7 | lsb as u16),
+        _ => None,
+    }
+}
+
+/// An SPP message for a position, clamped to the 14 bits a pointer holds
+pub fn spp_message(sixteenths: u32) -> Vec<u8> {
+    let position = sixteenths.min(MAX_POSITION);
+    vec![SONG_POSITION, (position & 0x7F) as u8, (position >> 7) as u8]
+}
+
+/// Beats per bar over the note value of a beat, e.g. 4/4 or 6/8
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct TimeSignature {
+    pub beats: u8,
+    /// 1, 2, 4, 8 or 16
+    pub unit: u8,
+}
+
+impl Default for TimeSignature {
+    fn default() -> Self {
+        Self { beats: 4, unit: 4 }
+    }
+}
+
+impl std::str::FromStr for TimeSignature {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = || format!("Invalid time signature '{}' (expected e.g. 4/4 or 6/8)", s);
+        let (beats, unit) = s.split_once('/').ok_or_else(invalid)?;
+        let beats = beats.parse::<u8>().ok().filter(|&b| b > 0).ok_or_else(invalid)?;
+        let unit = unit
+            .parse::<u8>()
+            .ok()
+            .filter(|u| [1, 2, 4, 8, 16].contains(u))
+            .ok_or_else(invalid)?;
+        Ok(Self { beats, unit })
+    }
+}
+
+impl std::fmt::Display for TimeSignature {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}/{}", self.beats, self.unit)
+    }
+}
+
+/// A position as bar, beat and sixteenth within the beat, all counting from 1
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct BarPosition {
+    pub bar: u32,
+    pub beat: u32,
+    pub sixteenth: u32,
+}
+
+impl std::fmt::Display for BarPosition {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}.{}.{}", self.bar, self.beat, self.sixteenth)
+    }
+}
+
+impl TimeSignature {
+    pub fn bar_position(self, sixteenths: u32) -> BarPosition {
+        let per_beat = 16 / self.unit as u32;
+        let per_bar = per_beat * self.beats as u32;
+        BarPosition {
+            bar: sixteenths / per_bar + 1,
+            beat: sixteenths % per_bar / per_beat + 1,
+            sixteenth: sixteenths % per_beat + 1,
+        }
+    }
+}
+
+/// Where the song is, from the pointers, transport and clock seen so far
+#[derive(Debug, Clone, Default)]
+pub struct SongPosition {
+    /// Clocks since the start of the song
+    clocks: u32,
+    running: bool,
+}
+
+impl SongPosition {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Follows one message; returns true if it moved the position or the transport
+    pub fn observe(&mut self, msg: &[u8]) -> bool {
+        if let Some(position) = spp_position(msg) {
+            self.clocks = position as u32 * CLOCKS_PER_SIXTEENTH;
+            return true;
+        }
+        match *msg {
+            [CLOCK] if self.running => self.clocks = self.clocks.saturating_add(1),
+            [START] => {
+                self.clocks = 0;
+                self.running = true;
+            }
+            [CONTINUE] => self.running = true,
+            [STOP] => self.running = false,
+            _ => return false,
+        }
+        true
+    }
+
+    /// Sixteenths from the start, rounded down
+    pub fn sixteenths(&self) -> u32 {
+        self.clocks / CLOCKS_PER_SIXTEENTH
+    }
+
+    pub fn running(&self) -> bool {
+        self.running
+    }
+
+    /// The messages to forward for `msg` with `--generate-spp`: Stop is followed by a
+    /// pointer to where the song stopped, Continue preceded by one to where it resumes
+    /// Call after `observe` has seen the message
+    pub fn with_pointer(&self, msg: Vec<u8>) -> Vec<Vec<u8>> {
+        match *msg {
+            [STOP] => vec![msg, spp_message(self.sixteenths())],
+            [CONTINUE] => vec![spp_message(self.sixteenths()), msg],
+            _ => vec![msg],
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_spp_bytes() {
+        assert_eq!(spp_position(&[0xF2, 0x10, 0x01]), Some(144));
+        assert_eq!(spp_position(&[0xF2, 0x10]), None);
+        assert_eq!(spp_position(&[0xF2, 0x80, 0x00]), None);
+        assert_eq!(spp_message(144), vec![0xF2, 0x10, 0x01]);
+        assert_eq!(spp_message(100_000), vec![0xF2, 0x7F, 0x7F]);
+    }
+
+    #[test]
+    fn test_time_signature() {
+        assert_eq!("6/8".parse(), Ok(TimeSignature { beats: 6, unit: 8 }));
+        assert!("4/3".parse::<TimeSignature>().is_err());
+        assert!("0/4".parse::<TimeSignature>().is_err());
+        assert!("4".parse::<TimeSignature>().is_err());
+
+        let four_four = TimeSignature::default();
+        assert_eq!(four_four.bar_position(0).to_string(), "1.1.1");
+        // Bar 3, beat 2, third sixteenth: 2 bars of 16 plus 4 plus 2
+        assert_eq!(four_four.bar_position(38).to_string(), "3.2.3");
+        // 6/8 beats are eighths, two sixteenths each
+        let six_eight: TimeSignature = "6/8".parse().unwrap();
+        assert_eq!(six_eight.bar_position(13).to_string(), "2.1.2");
+    }
+
+    #[test]
+    fn test_counts_clocks_while_running() {
+        let mut position = SongPosition::new();
+        assert!(position.observe(&[0xF2, 8, 0]));
+        // Stopped: clocks don't move the song
+        position.observe(&[CLOCK]);
+        assert_eq!(position.sixteenths(), 8);
+
+        position.observe(&[CONTINUE]);
+        for _ in 0..13 {
+            position.observe(&[CLOCK]);
+        }
+        assert_eq!(position.sixteenths(), 10);
+        assert!(!position.observe(&[0x90, 60, 100]));
+
+        position.observe(&[START]);
+        assert_eq!(position.sixteenths(), 0);
+        assert!(position.running());
+    }
+
+    #[test]
+    fn test_with_pointer() {
+        let mut position = SongPosition::new();
+        position.observe(&[START]);
+        for _ in 0..24 {
+            position.observe(&[CLOCK]);
+        }
+        position.observe(&[STOP]);
+        assert_eq!(position.with_pointer(vec![STOP]), vec![vec![STOP], vec![0xF2, 4, 0]]);
+        position.observe(&[CONTINUE]);
+        assert_eq!(position.with_pointer(vec![CONTINUE]), vec![vec![0xF2, 4, 0], vec![CONTINUE]]);
+        assert_eq!(position.with_pointer(vec![CLOCK]), vec![vec![CLOCK]]);
+    }
+}
@@ -0,0 +1,332 @@
+use std::fmt;
+use std::fmt::Write;
+use std::sync::atomic::{AtomicI64, AtomicU64, Ordering};
+use std::time::{Duration, Instant};
+
+/// Lock-free counters for `mc fwd --stats`
+/// Latency is measured from entering the input callback to the output send returning
+#[derive(Debug)]
+pub struct LatencyStats {
+    count: AtomicU64,
+    total_us: AtomicU64,
+    min_us: AtomicU64,
+    max_us: AtomicU64,
+}
+
+/// Counters read out over a period of time
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct StatsSummary {
+    pub count: u64,
+    pub elapsed: Duration,
+    pub total_us: u64,
+    pub min_us: u64,
+    pub max_us: u64,
+}
+
+impl StatsSummary {
+    pub fn avg_us(&self) -> u64 {
+        if self.count == 0 {
+            0
+        } else {
+            self.total_us / self.count
+        }
+    }
+}
+
+impl Default for LatencyStats {
+    fn default() -> Self {
+        Self {
+            count: AtomicU64::new(0),
+            total_us: AtomicU64::new(0),
+            min_us: AtomicU64::new(u64::MAX),
+            max_us: AtomicU64::new(0),
+        }
+    }
+}
+
+impl LatencyStats {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Records one forwarded message
+    pub fn record(&self, latency: Duration) {
+        let us = latency.as_micros() as u64;
+        self.count.fetch_add(1, Ordering::Relaxed);
+        self.total_us.fetch_add(us, Ordering::Relaxed);
+        self.min_us.fetch_min(us, Ordering::Relaxed);
+        self.max_us.fetch_max(us, Ordering::Relaxed);
+    }
+
+    /// Reads the counters, then resets them for the next period
+    pub fn take(&self, since: Instant) -> StatsSummary {
+        let count = self.count.swap(0, Ordering::Relaxed);
+        let total_us = self.total_us.swap(0, Ordering::Relaxed);
+        let min_us = self.min_us.swap(u64::MAX, Ordering::Relaxed);
+        let max_us = self.max_us.swap(0, Ordering::Relaxed);
+
+        StatsSummary {
+            count,
+            elapsed: since.elapsed(),
+            total_us,
+            min_us: if count == 0 { 0 } else { min_us },
+            max_us,
+        }
+    }
+
+    /// Folds a period's summary into these counters (used to keep running totals)
+    pub fn add(&self, summary: &StatsSummary) {
+        if summary.count == 0 {
+            return;
+        }
+        self.count.fetch_add(summary.count, Ordering::Relaxed);
+        self.total_us.fetch_add(summary.total_us, Ordering::Relaxed);
+        self.min_us.fetch_min(summary.min_us, Ordering::Relaxed);
+        self.max_us.fetch_max(summary.max_us, Ordering::Relaxed);
+    }
+}
+
+impl fmt::Display for StatsSummary {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let secs = self.elapsed.as_secs_f64();
+        let rate = if secs > 0.0 { self.count as f64 / secs } else { 0.0 };
+        write!(
+            f,
+            "{} msgs ({:.1}/s), latency min/avg/max {}/{}/{} us",
+            self.count,
+            rate,
+            self.min_us,
+            self.avg_us(),
+            self.max_us
+        )
+    }
+}
+
+/// Message classes counted by `mc fwd --count` and `--metrics`
+const COUNT_LABELS: [&str; 10] = [
+    "note-on", "note-off", "cc", "pitchbend", "program", "pressure", "sysex", "clock", "system",
+    "unknown",
+];
+
+/// Per-type message counters for `mc fwd --count`
+/// Incoming messages are classified by status byte the same way `is_valid_midi_message` does;
+/// messages that fail validation are counted separately
+#[derive(Debug, Default)]
+pub struct MessageCounts {
+    counts: [AtomicU64; COUNT_LABELS.len()],
+    rejected: AtomicU64,
+}
+
+impl MessageCounts {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Counts one message received from an input
+    pub fn record(&self, msg: &[u8]) {
+        self.counts[message_class(msg)].fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Counts a message dropped by validation
+    pub fn record_rejected(&self) {
+        self.rejected.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Current totals, e.g. "note-on 12, cc 40, rejected 1" (zero counts are left out)
+    pub fn summary(&self) -> String {
+        let mut parts: Vec<String> = COUNT_LABELS
+            .iter()
+            .zip(&self.counts)
+            .map(|(label, count)| (label, count.load(Ordering::Relaxed)))
+            .filter(|(_, count)| *count > 0)
+            .map(|(label, count)| format!("{} {}", label, count))
+            .collect();
+        let rejected = self.rejected.load(Ordering::Relaxed);
+        if rejected > 0 {
+            parts.push(format!("rejected {}", rejected));
+        }
+        if parts.is_empty() {
+            "no messages".to_string()
+        } else {
+            parts.join(", ")
+        }
+    }
+}
+
+/// Index into COUNT_LABELS
+fn message_class(msg: &[u8]) -> usize {
+    let status = msg.first().copied().unwrap_or(0);
+    match status & 0xF0 {
+        0x90 if msg.get(2) == Some(&0) => 1,
+        0x90 => 0,
+        0x80 => 1,
+        0xB0 => 2,
+        0xE0 => 3,
+        0xC0 => 4,
+        0xA0 | 0xD0 => 5,
+        0xF0 => match status {
+            0xF0 => 6,
+            0xF8 => 7,
+            0xF1..=0xF3 | 0xF6 | 0xFA..=0xFC | 0xFE | 0xFF => 8,
+            _ => 9,
+        },
+        _ => 9,
+    }
+}
+
+/// Counters for `mc fwd --metrics`, rendered in the Prometheus text format
+/// Shared by every pipeline of a forward and kept across reconnects
+#[derive(Debug, Default)]
+pub struct Metrics {
+    forwarded: [AtomicU64; COUNT_LABELS.len()],
+    bytes: AtomicU64,
+    send_errors: AtomicU64,
+    reconnects: AtomicU64,
+    active_notes: AtomicI64,
+}
+
+impl Metrics {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Counts a message that reached at least one output
+    pub fn record_forwarded(&self, msg: &[u8]) {
+        self.forwarded[message_class(msg)].fetch_add(1, Ordering::Relaxed);
+        self.bytes.fetch_add(msg.len() as u64, Ordering::Relaxed);
+    }
+
+    /// Counts one output failing to send a message
+    pub fn record_send_error(&self) {
+        self.send_errors.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn record_reconnect(&self) {
+        self.reconnects.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Adjusts the sounding note gauge by the change in one pipeline's held notes
+    pub fn add_active_notes(&self, delta: i64) {
+        self.active_notes.fetch_add(delta, Ordering::Relaxed);
+    }
+
+    /// The scrape response body
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        let _ = writeln!(out, "# HELP mc_messages_forwarded_total Messages sent to at least one output");
+        let _ = writeln!(out, "# TYPE mc_messages_forwarded_total counter");
+        for (label, count) in COUNT_LABELS.iter().zip(&self.forwarded) {
+            let _ = writeln!(
+                out,
+                "mc_messages_forwarded_total{{type=\"{}\"}} {}",
+                label,
+                count.load(Ordering::Relaxed)
+            );
+        }
+        let metrics = [
+            ("mc_bytes_forwarded_total", "counter", "Bytes of MIDI forwarded", &self.bytes),
+            ("mc_send_errors_total", "counter", "Sends rejected by an output", &self.send_errors),
+            ("mc_reconnects_total", "counter", "Successful --reconnect attempts", &self.reconnects),
+        ];
+        for (name, kind, help, value) in metrics {
+            let _ = writeln!(out, "# HELP {} {}\n# TYPE {} {}", name, help, name, kind);
+            let _ = writeln!(out, "{} {}", name, value.load(Ordering::Relaxed));
+        }
+        let _ = writeln!(out, "# HELP mc_active_notes Notes forwarded and not yet released");
+        let _ = writeln!(out, "# TYPE mc_active_notes gauge");
+        let _ = writeln!(out, "mc_active_notes {}", self.active_notes.load(Ordering::Relaxed).max(0));
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_record_and_take() {
+        let stats = LatencyStats::new();
+        let start = Instant::now();
+        stats.record(Duration::from_micros(10));
+        stats.record(Duration::from_micros(30));
+
+        let summary = stats.take(start);
+        assert_eq!(summary.count, 2);
+        assert_eq!((summary.min_us, summary.avg_us(), summary.max_us), (10, 20, 30));
+
+        // Counters reset after each period
+        let summary = stats.take(start);
+        assert_eq!((summary.count, summary.min_us, summary.max_us), (0, 0, 0));
+    }
+
+    #[test]
+    fn test_add_summaries() {
+        let interval = LatencyStats::new();
+        let total = LatencyStats::new();
+        let start = Instant::now();
+
+        interval.record(Duration::from_micros(40));
+        total.add(&interval.take(start));
+        interval.record(Duration::from_micros(20));
+        total.add(&interval.take(start));
+        total.add(&interval.take(start));
+
+        let summary = total.take(start);
+        assert_eq!(summary.count, 2);
+        assert_eq!((summary.min_us, summary.avg_us(), summary.max_us), (20, 30, 40));
+    }
+
+    #[test]
+    fn test_display() {
+        let summary = StatsSummary {
+            count: 50,
+            elapsed: Duration::from_secs(5),
+            total_us: 1000,
+            min_us: 12,
+            max_us: 95,
+        };
+        assert_eq!(summary.to_string(), "50 msgs (10.0/s), latency min/avg/max 12/20/95 us");
+    }
+
+    #[test]
+    fn test_message_counts() {
+        let counts = MessageCounts::new();
+        assert_eq!(counts.summary(), "no messages");
+
+        counts.record(&[0x90, 60, 100]);
+        counts.record(&[0x90, 60, 0]);
+        counts.record(&[0x80, 60, 0]);
+        counts.record(&[0xB0, 7, 100]);
+        counts.record(&[0xE0, 0, 64]);
+        counts.record(&[0xF0, 0x7E, 0xF7]);
+        counts.record(&[0xF8]);
+        counts.record(&[0xF8]);
+        counts.record(&[0xFA]);
+        counts.record(&[0xF4]);
+        counts.record_rejected();
+        assert_eq!(
+            counts.summary(),
+            "note-on 1, note-off 2, cc 1, pitchbend 1, sysex 1, clock 2, system 1, unknown 1, rejected 1"
+        );
+    }
+
+    #[test]
+    fn test_metrics_render() {
+        let metrics = Metrics::new();
+        metrics.record_forwarded(&[0x90, 60, 100]);
+        metrics.record_forwarded(&[0xF8]);
+        metrics.record_send_error();
+        metrics.record_reconnect();
+        metrics.add_active_notes(2);
+        metrics.add_active_notes(-1);
+
+        let text = metrics.render();
+        assert!(text.contains("mc_messages_forwarded_total{type=\"note-on\"} 1\n"));
+        assert!(text.contains("mc_messages_forwarded_total{type=\"clock\"} 1\n"));
+        assert!(text.contains("mc_messages_forwarded_total{type=\"cc\"} 0\n"));
+        assert!(text.contains("\nmc_bytes_forwarded_total 4\n"));
+        assert!(text.contains("\nmc_send_errors_total 1\n"));
+        assert!(text.contains("\nmc_reconnects_total 1\n"));
+        assert!(text.contains("# TYPE mc_active_notes gauge\nmc_active_notes 1\n"));
+    }
+}
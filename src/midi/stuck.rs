@@ -0,0 +1,171 @@
+/// Stuck-note detection for `--detect-stuck` in `mc monitor` and `mc fwd`
+/// Each (channel, note) is on from its first Note On until a Note Off (or Note On with
+/// velocity 0); one Note Off ends it however many Note Ons came before, as on most
+/// synths. A note still on after the threshold is reported once, and every stuck note
+/// is listed in the summary, with whether it was released in the end.
+use super::decode::note_name;
+use std::collections::HashMap;
+use std::fmt;
+use std::time::{Duration, Instant};
+
+/// How long a note may be held before it counts as stuck, without `--stuck-after`
+pub const DEFAULT_STUCK_AFTER: Duration = Duration::from_secs(10);
+
+/// A note that was on longer than the threshold
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StuckNote {
+    /// 0-based
+    pub channel: u8,
+    pub note: u8,
+    /// How long it was held: until its Note Off, or so far
+    pub held: Duration,
+    pub released: bool,
+}
+
+impl StuckNote {
+    /// The Note Off that releases it
+    pub fn note_off(&self) -> Vec<u8> {
+        vec![0x80 | self.channel, self.note, 0]
+    }
+}
+
+impl fmt::Display for StuckNote {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{} ({}) on channel {}, {} {:.1}s",
+            note_name(self.note),
+            self.note,
+            self.channel + 1,
+            if self.released { "released after" } else { "held" },
+            self.held.as_secs_f64()
+        )
+    }
+}
+
+struct Held {
+    since: Instant,
+    /// Index in `stuck` once reported
+    stuck: Option<usize>,
+}
+
+#[derive(Default)]
+pub struct StuckNotes {
+    threshold: Duration,
+    held: HashMap<(u8, u8), Held>,
+    stuck: Vec<StuckNote>,
+}
+
+impl StuckNotes {
+    pub fn new(threshold: Duration) -> Self {
+        Self {
+            threshold,
+            ..Self::default()
+        }
+    }
+
+    /// Updates the note balance from a message received (monitor) or sent (fwd) at `at`
+    pub fn observe(&mut self, msg: &[u8], at: Instant) {
+        let [status, note, velocity] = *msg else {
+            return;
+        };
+        let key = (status & 0x0F, note);
+        match status & 0xF0 {
+            0x90 if velocity > 0 => {
+                self.held.entry(key).or_insert(Held { since: at, stuck: None });
+            }
+            0x80 | 0x90 => {
+                if let Some(Held { since, stuck: Some(index) }) = self.held.remove(&key) {
+                    self.stuck[index].held = at.saturating_duration_since(since);
+                    self.stuck[index].released = true;
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Notes that have become stuck since the last check; each is returned once
+    pub fn check(&mut self, now: Instant) -> Vec<StuckNote> {
+        let mut keys: Vec<(u8, u8)> = self
+            .held
+            .iter()
+            .filter(|(_, held)| held.stuck.is_none() && now.saturating_duration_since(held.since) >= self.threshold)
+            .map(|(&key, _)| key)
+            .collect();
+        keys.sort_unstable();
+
+        let first = self.stuck.len();
+        for (channel, note) in keys {
+            if let Some(held) = self.held.get_mut(&(channel, note)) {
+                held.stuck = Some(self.stuck.len());
+                self.stuck.push(StuckNote {
+                    channel,
+                    note,
+                    held: now.saturating_duration_since(held.since),
+                    released: false,
+                });
+            }
+        }
+        self.stuck[first..].to_vec()
+    }
+
+    /// Every note that got stuck, with notes still held measured up to `now`
+    pub fn summary(&self, now: Instant) -> Vec<StuckNote> {
+        let mut summary = self.stuck.clone();
+        for held in self.held.values() {
+            if let Some(index) = held.stuck {
+                summary[index].held = now.saturating_duration_since(held.since);
+            }
+        }
+        summary
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const SECOND: Duration = Duration::from_secs(1);
+
+    #[test]
+    fn test_reports_held_notes_once() {
+        let start = Instant::now();
+        let mut notes = StuckNotes::new(5 * SECOND);
+        notes.observe(&[0x90, 60, 100], start);
+        notes.observe(&[0x91, 62, 100], start);
+        notes.observe(&[0x91, 62, 0], start + SECOND);
+        assert!(notes.check(start + 4 * SECOND).is_empty());
+
+        let stuck = notes.check(start + 6 * SECOND);
+        assert_eq!(stuck.len(), 1);
+        assert_eq!((stuck[0].channel, stuck[0].note), (0, 60));
+        assert_eq!(stuck[0].note_off(), vec![0x80, 60, 0]);
+        assert!(notes.check(start + 7 * SECOND).is_empty());
+    }
+
+    #[test]
+    fn test_retrigger_keeps_first_note_on() {
+        let start = Instant::now();
+        let mut notes = StuckNotes::new(5 * SECOND);
+        notes.observe(&[0x90, 60, 100], start);
+        notes.observe(&[0x90, 60, 90], start + 4 * SECOND);
+        assert_eq!(notes.check(start + 5 * SECOND).len(), 1);
+    }
+
+    #[test]
+    fn test_summary() {
+        let start = Instant::now();
+        let mut notes = StuckNotes::new(SECOND);
+        notes.observe(&[0x90, 60, 100], start);
+        notes.observe(&[0x99, 36, 100], start);
+        notes.observe(&[0x90, 64, 100], start);
+        notes.observe(&[0x80, 64, 0], start);
+        notes.check(start + 2 * SECOND);
+        notes.observe(&[0x80, 60, 0], start + 3 * SECOND);
+
+        let summary = notes.summary(start + 10 * SECOND);
+        assert_eq!(summary.len(), 2);
+        assert_eq!(summary[0].to_string(), "C4 (60) on channel 1, released after 3.0s");
+        assert_eq!(summary[1].to_string(), "C2 (36) on channel 10, held 10.0s");
+    }
+}
@@ -0,0 +1,90 @@
+/// `.syx` file handling for `mc sysex`
+/// A `.syx` file is a plain concatenation of complete `F0 ... F7` messages
+
+/// Splits a `.syx` file into its SysEx messages
+/// Anything that isn't a complete message (bytes outside F0..F7, a message cut off
+/// by another status byte or the end of the file) is returned as an error naming
+/// its byte offset, so the caller can warn and keep going
+pub fn split_syx(data: &[u8]) -> Vec<Result<Vec<u8>, String>> {
+    let mut chunks = Vec::new();
+    let mut current: Option<(usize, Vec<u8>)> = None;
+    let mut stray: Option<(usize, usize)> = None;
+
+    for (offset, &byte) in data.iter().enumerate() {
+        if let Some((start, mut message)) = current.take() {
+            match byte {
+                0xF7 => {
+                    message.push(byte);
+                    chunks.push(Ok(message));
+                }
+                0x00..=0x7F => {
+                    message.push(byte);
+                    current = Some((start, message));
+                }
+                _ => {
+                    chunks.push(Err(format!(
+                        "SysEx at offset {} is cut off by {:02X} at offset {}",
+                        start, byte, offset
+                    )));
+                    if byte == 0xF0 {
+                        current = Some((offset, vec![byte]));
+                    } else {
+                        stray = Some((offset, 1));
+                    }
+                }
+            }
+            continue;
+        }
+
+        if byte == 0xF0 {
+            if let Some((start, len)) = stray.take() {
+                chunks.push(Err(stray_error(start, len)));
+            }
+            current = Some((offset, vec![byte]));
+        } else {
+            match stray.as_mut() {
+                Some((_, len)) => *len += 1,
+                None => stray = Some((offset, 1)),
+            }
+        }
+    }
+
+    if let Some((start, len)) = stray {
+        chunks.push(Err(stray_error(start, len)));
+    }
+    if let Some((start, _)) = current {
+        chunks.push(Err(format!("SysEx at offset {} has no closing F7", start)));
+    }
+    chunks
+}
+
+fn stray_error(start: usize, len: usize) -> String {
+    format!("{} byte(s) outside a SysEx message at offset {}", len, start)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_split_complete_messages() {
+        let data = [0xF0, 0x43, 0x10, 0xF7, 0xF0, 0x7E, 0x7F, 0x06, 0x01, 0xF7];
+        assert_eq!(
+            split_syx(&data),
+            vec![Ok(vec![0xF0, 0x43, 0x10, 0xF7]), Ok(vec![0xF0, 0x7E, 0x7F, 0x06, 0x01, 0xF7])]
+        );
+        assert!(split_syx(&[]).is_empty());
+    }
+
+    #[test]
+    fn test_split_malformed_chunks() {
+        // Junk before the first message, a message cut off by the next F0, and a missing F7
+        let data = [0x00, 0x01, 0xF0, 0x41, 0xF0, 0x42, 0xF7, 0xF0, 0x43];
+        let chunks = split_syx(&data);
+        assert_eq!(chunks.len(), 4);
+        assert!(chunks[0].as_ref().unwrap_err().contains("offset 0"));
+        assert!(chunks[1].as_ref().unwrap_err().contains("cut off"));
+        assert_eq!(chunks[2], Ok(vec![0xF0, 0x42, 0xF7]));
+        assert!(chunks[3].as_ref().unwrap_err().contains("no closing F7"));
+    }
+}
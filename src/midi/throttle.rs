@@ -0,0 +1,128 @@
+use std::collections::HashMap;
+use std::time::{Duration, Instant};
+
+/// Coalesces fast Control Change and Channel Pressure for `--throttle-cc`
+/// Each (channel, controller) sends at most once per window: the first value goes out
+/// immediately, later ones within the window replace each other and the latest is sent
+/// when the window ends (see `due`). Everything else is never throttled.
+#[derive(Debug)]
+pub struct Throttle {
+    window: Duration,
+    slots: HashMap<u16, Slot>,
+}
+
+#[derive(Debug)]
+struct Slot {
+    last_sent: Instant,
+    pending: Option<Vec<u8>>,
+}
+
+/// Slot key for throttled messages: status byte plus controller for CC
+fn key(msg: &[u8]) -> Option<u16> {
+    match (msg.first()? & 0xF0, msg.len()) {
+        (0xB0, 3) => Some((msg[0] as u16) << 8 | msg[1] as u16),
+        (0xD0, 2) => Some((msg[0] as u16) << 8),
+        _ => None,
+    }
+}
+
+impl Throttle {
+    pub fn new(window: Duration) -> Self {
+        Self {
+            window,
+            slots: HashMap::new(),
+        }
+    }
+
+    /// Returns the message if it should be sent now; otherwise it's held as the slot's latest value
+    pub fn offer(&mut self, msg: &[u8], now: Instant) -> Option<Vec<u8>> {
+        let Some(key) = key(msg) else {
+            return Some(msg.to_vec());
+        };
+
+        match self.slots.get_mut(&key) {
+            Some(slot) if now.duration_since(slot.last_sent) < self.window => {
+                slot.pending = Some(msg.to_vec());
+                None
+            }
+            _ => {
+                self.slots.insert(key, Slot { last_sent: now, pending: None });
+                Some(msg.to_vec())
+            }
+        }
+    }
+
+    /// Held values whose window has ended, to be sent now
+    pub fn due(&mut self, now: Instant) -> Vec<Vec<u8>> {
+        let window = self.window;
+        let mut due = Vec::new();
+        for slot in self.slots.values_mut() {
+            if now.duration_since(slot.last_sent) >= window {
+                if let Some(msg) = slot.pending.take() {
+                    slot.last_sent = now;
+                    due.push(msg);
+                }
+            }
+        }
+        due
+    }
+
+    /// Every held value, regardless of window (for flushing on shutdown)
+    pub fn drain(&mut self) -> Vec<Vec<u8>> {
+        self.slots.values_mut().filter_map(|slot| slot.pending.take()).collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const WINDOW: Duration = Duration::from_millis(10);
+
+    #[test]
+    fn test_coalesces_within_window() {
+        let mut throttle = Throttle::new(WINDOW);
+        let start = Instant::now();
+
+        assert_eq!(throttle.offer(&[0xB0, 1, 10], start), Some(vec![0xB0, 1, 10]));
+        assert_eq!(throttle.offer(&[0xB0, 1, 11], start + Duration::from_millis(2)), None);
+        assert_eq!(throttle.offer(&[0xB0, 1, 12], start + Duration::from_millis(4)), None);
+        assert!(throttle.due(start + Duration::from_millis(5)).is_empty());
+
+        // Only the latest value is sent when the window ends
+        assert_eq!(throttle.due(start + WINDOW), vec![vec![0xB0, 1, 12]]);
+        assert!(throttle.due(start + WINDOW * 3).is_empty());
+    }
+
+    #[test]
+    fn test_slots_are_per_channel_and_controller() {
+        let mut throttle = Throttle::new(WINDOW);
+        let now = Instant::now();
+        assert!(throttle.offer(&[0xB0, 1, 10], now).is_some());
+        assert!(throttle.offer(&[0xB0, 2, 10], now).is_some());
+        assert!(throttle.offer(&[0xB1, 1, 10], now).is_some());
+        assert!(throttle.offer(&[0xD0, 10], now).is_some());
+        assert!(throttle.offer(&[0xD0, 20], now).is_none());
+    }
+
+    #[test]
+    fn test_notes_never_throttled() {
+        let mut throttle = Throttle::new(WINDOW);
+        let now = Instant::now();
+        for _ in 0..3 {
+            assert!(throttle.offer(&[0x90, 60, 100], now).is_some());
+            assert!(throttle.offer(&[0x80, 60, 0], now).is_some());
+            assert!(throttle.offer(&[0xE0, 0, 64], now).is_some());
+        }
+    }
+
+    #[test]
+    fn test_drain() {
+        let mut throttle = Throttle::new(WINDOW);
+        let now = Instant::now();
+        throttle.offer(&[0xB0, 7, 1], now);
+        throttle.offer(&[0xB0, 7, 2], now);
+        assert_eq!(throttle.drain(), vec![vec![0xB0, 7, 2]]);
+        assert!(throttle.drain().is_empty());
+    }
+}
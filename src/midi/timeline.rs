@@ -0,0 +1,108 @@
+/// Message times for `mc rec`, from the driver's timestamps or our own clock
+/// The driver stamps each message closer to when it actually arrived, but its counter
+/// is only as fine as the driver keeps it (the Windows MIDI API counts whole
+/// milliseconds in 32 bits, so it wraps after about 49.7 days). With `--timestamps
+/// clock` a message is stamped when the callback runs instead: monotonic and fine
+/// grained, but late by however long the driver took to hand the message over.
+use std::time::Instant;
+
+/// Where `mc rec` takes message times from
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum TimestampSource {
+    /// The timestamp the driver passes with each message
+    #[default]
+    Driver,
+    /// `Instant::now()` when the message reaches us
+    Clock,
+}
+
+impl std::str::FromStr for TimestampSource {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "driver" => Ok(TimestampSource::Driver),
+            "clock" => Ok(TimestampSource::Clock),
+            _ => Err(format!("Unknown timestamp source '{}' (expected driver or clock)", s)),
+        }
+    }
+}
+
+/// Span of a 32-bit millisecond counter, in the microseconds midir reports
+const DRIVER_WRAP_US: u64 = (1 << 32) * 1000;
+
+/// Microseconds since the first message, never going backwards
+#[derive(Debug, Clone, Default)]
+pub struct Timeline {
+    source: TimestampSource,
+    /// First clock reading
+    started: Option<Instant>,
+    /// Last driver timestamp and the elapsed time it was given
+    last: Option<(u64, u64)>,
+}
+
+impl Timeline {
+    pub fn new(source: TimestampSource) -> Self {
+        Self { source, ..Self::default() }
+    }
+
+    /// The time of a message the driver stamped `timestamp`, arriving at `now`
+    pub fn elapsed_us(&mut self, timestamp: u64, now: Instant) -> u64 {
+        match self.source {
+            TimestampSource::Clock => {
+                now.saturating_duration_since(*self.started.get_or_insert(now)).as_micros() as u64
+            }
+            TimestampSource::Driver => {
+                let elapsed = match self.last {
+                    None => 0,
+                    Some((last, elapsed)) if timestamp >= last => elapsed + (timestamp - last),
+                    // A counter that wrapped lands far behind; count on from where it wrapped
+                    Some((last, elapsed)) if last - timestamp > DRIVER_WRAP_US / 2 => {
+                        elapsed + (timestamp + DRIVER_WRAP_US).saturating_sub(last)
+                    }
+                    // Any other step back (a driver reset, jitter) keeps the last time
+                    Some((_, elapsed)) => elapsed,
+                };
+                self.last = Some((timestamp, elapsed));
+                elapsed
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn test_driver_wraparound() {
+        let now = Instant::now();
+        let mut timeline = Timeline::new(TimestampSource::Driver);
+        let before_wrap = DRIVER_WRAP_US - 2000;
+        assert_eq!(timeline.elapsed_us(before_wrap, now), 0);
+        assert_eq!(timeline.elapsed_us(before_wrap + 1000, now), 1000);
+        // The counter wraps to 0 and carries on
+        assert_eq!(timeline.elapsed_us(500, now), 2500);
+        assert_eq!(timeline.elapsed_us(1500, now), 3500);
+    }
+
+    #[test]
+    fn test_driver_never_goes_back() {
+        let now = Instant::now();
+        let mut timeline = Timeline::new(TimestampSource::Driver);
+        assert_eq!(timeline.elapsed_us(10_000, now), 0);
+        assert_eq!(timeline.elapsed_us(9_000, now), 0);
+        assert_eq!(timeline.elapsed_us(9_500, now), 500);
+    }
+
+    #[test]
+    fn test_clock_ignores_driver() {
+        let start = Instant::now();
+        let mut timeline = Timeline::new(TimestampSource::Clock);
+        assert_eq!(timeline.elapsed_us(5_000_000, start), 0);
+        assert_eq!(timeline.elapsed_us(0, start + Duration::from_micros(1234)), 1234);
+        assert!("clock".parse::<TimestampSource>().is_ok());
+        assert!("host".parse::<TimestampSource>().is_err());
+    }
+}
@@ -0,0 +1,548 @@
+use crate::midi::mmc::MmcBridge;
+use crate::midi::validation::is_valid_midi_message;
+
+/// Message transforms applied by `mc fwd` before forwarding
+#[derive(Debug, Clone, Default)]
+pub struct Transform {
+    /// Semitone offset for note numbers (0 leaves notes untouched)
+    transpose: i8,
+    /// Velocity lookup table, None leaves velocities untouched
+    velocity_table: Option<[u8; 128]>,
+    /// Whether the velocity table also applies to Note Off
+    velocity_note_off: bool,
+    /// Output channel (0-based) for each input channel, None leaves channels untouched
+    channel_map: Option<[u8; 16]>,
+    /// Output controller number for each Control Change controller, None leaves them untouched
+    cc_map: Option<[u8; 128]>,
+    /// Pitch bend factor around center (negative inverts), None leaves bends untouched
+    bend_scale: Option<f32>,
+    /// Controller to turn each note into (NO_CC leaves the note alone), None converts nothing
+    note_to_cc: Option<[u8; 128]>,
+    /// Controller to turn Channel Pressure into, None leaves pressure untouched
+    aftertouch_to_cc: Option<u8>,
+    /// Transport conversion between MMC and realtime messages
+    mmc_bridge: Option<MmcBridge>,
+}
+
+/// `note_to_cc` entry for notes that stay notes
+const NO_CC: u8 = 0xFF;
+
+/// Named velocity response curves
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum VelocityCurve {
+    Linear,
+    /// Softer response at low velocities
+    Exp,
+    /// Stronger response at low velocities
+    Log,
+}
+
+impl std::str::FromStr for VelocityCurve {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "linear" => Ok(VelocityCurve::Linear),
+            "exp" => Ok(VelocityCurve::Exp),
+            "log" => Ok(VelocityCurve::Log),
+            _ => Err(format!("Unknown velocity curve '{}' (expected linear, exp or log)", s)),
+        }
+    }
+}
+
+/// Which of the two Note Off spellings `--normalize-noteoff` sends
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum NoteOffStyle {
+    /// 0x80 Note Off; a Note On with velocity 0 gets release velocity 64, its meaning in the spec
+    NoteOff,
+    /// Note On with velocity 0 (`--normalize-noteoff-reverse`); release velocity is lost
+    NoteOnZero,
+}
+
+/// Release velocity of a Note On with velocity 0
+pub const DEFAULT_RELEASE_VELOCITY: u8 = 64;
+
+impl NoteOffStyle {
+    /// Rewrites a Note Off in the other spelling in place; other messages are untouched
+    pub fn apply(self, msg: &mut [u8]) {
+        if let [status, _, velocity] = msg {
+            match (self, *status & 0xF0) {
+                (NoteOffStyle::NoteOff, 0x90) if *velocity == 0 => {
+                    *status = 0x80 | (*status & 0x0F);
+                    *velocity = DEFAULT_RELEASE_VELOCITY;
+                }
+                (NoteOffStyle::NoteOnZero, 0x80) => {
+                    *status = 0x90 | (*status & 0x0F);
+                    *velocity = 0;
+                }
+                _ => {}
+            }
+        }
+    }
+}
+
+/// Steepness of the exp/log curves
+const CURVE_STEEPNESS: f32 = 3.0;
+
+impl VelocityCurve {
+    /// Maps a normalized velocity (0.0-1.0) through the curve
+    fn map(self, x: f32) -> f32 {
+        match self {
+            VelocityCurve::Linear => x,
+            VelocityCurve::Exp => {
+                ((CURVE_STEEPNESS * x).exp() - 1.0) / (CURVE_STEEPNESS.exp() - 1.0)
+            }
+            VelocityCurve::Log => (1.0 + CURVE_STEEPNESS * x).ln() / (1.0 + CURVE_STEEPNESS).ln(),
+        }
+    }
+}
+
+impl Transform {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Shifts note numbers by the given number of semitones
+    pub fn with_transpose(mut self, semitones: i8) -> Self {
+        self.transpose = semitones;
+        self
+    }
+
+    /// Reshapes note velocities through a curve and a scale factor
+    /// The lookup table is built once here so the callback only does an index
+    pub fn with_velocity(mut self, curve: VelocityCurve, scale: f32, include_note_off: bool) -> Self {
+        if curve == VelocityCurve::Linear && scale == 1.0 {
+            return self;
+        }
+
+        let mut table = [0u8; 128];
+        for (velocity, entry) in table.iter_mut().enumerate().skip(1) {
+            let shaped = curve.map(velocity as f32 / 127.0) * 127.0 * scale;
+            // A nonzero velocity never becomes 0, which would read as Note Off
+            *entry = shaped.round().clamp(1.0, 127.0) as u8;
+        }
+
+        self.velocity_table = Some(table);
+        self.velocity_note_off = include_note_off;
+        self
+    }
+
+    /// Sets every Note On velocity to `velocity` (1-127); Note On with velocity 0 stays a
+    /// Note Off. Replaces any curve or scale from `with_velocity`
+    pub fn with_fixed_velocity(mut self, velocity: Option<u8>) -> Self {
+        if let Some(velocity) = velocity {
+            let mut table = [velocity; 128];
+            table[0] = 0;
+            self.velocity_table = Some(table);
+            self.velocity_note_off = false;
+        }
+        self
+    }
+
+    /// Moves channel messages to other channels, `map[in] = out` (both 0-based)
+    pub fn with_channel_map(mut self, map: Option<[u8; 16]>) -> Self {
+        self.channel_map = map;
+        self
+    }
+
+    /// Adds `shift` to the channel of every channel message, wrapping modulo 16 so
+    /// channel 16 shifted by +1 is channel 1; applied after any `with_channel_map`
+    pub fn with_channel_shift(mut self, shift: i8) -> Self {
+        if shift % 16 == 0 {
+            return self;
+        }
+        let mut map = self.channel_map.unwrap_or_else(|| std::array::from_fn(|ch| ch as u8));
+        for out in map.iter_mut() {
+            *out = (*out as i16 + shift as i16).rem_euclid(16) as u8;
+        }
+        self.channel_map = Some(map);
+        self
+    }
+
+    /// Renumbers Control Change controllers, `(from, to)` pairs; unmapped controllers pass unchanged
+    pub fn with_cc_map(mut self, mappings: &[(u8, u8)]) -> Self {
+        if mappings.is_empty() {
+            return self;
+        }
+
+        let mut table = [0u8; 128];
+        for (controller, entry) in table.iter_mut().enumerate() {
+            *entry = controller as u8;
+        }
+        for &(from, to) in mappings {
+            table[(from & 0x7F) as usize] = to & 0x7F;
+        }
+
+        self.cc_map = Some(table);
+        self
+    }
+
+    /// Scales pitch bend around its center and optionally flips its direction
+    pub fn with_bend(mut self, scale: f32, invert: bool) -> Self {
+        let scale = if invert { -scale } else { scale };
+        self.bend_scale = if scale == 1.0 { None } else { Some(scale) };
+        self
+    }
+
+    /// Replaces the given notes with Control Change, `(note, controller)` pairs
+    /// Note On becomes the controller with the note's velocity as its value and Note Off
+    /// sends value 0, e.g. for using drum pads as switches
+    pub fn with_note_to_cc(mut self, mappings: &[(u8, u8)]) -> Self {
+        if mappings.is_empty() {
+            return self;
+        }
+
+        let mut table = [NO_CC; 128];
+        for &(note, controller) in mappings {
+            table[(note & 0x7F) as usize] = controller & 0x7F;
+        }
+
+        self.note_to_cc = Some(table);
+        self
+    }
+
+    /// Replaces Channel Pressure with Control Change on `controller`, the pressure as its value
+    pub fn with_aftertouch_to_cc(mut self, controller: Option<u8>) -> Self {
+        self.aftertouch_to_cc = controller.map(|controller| controller & 0x7F);
+        self
+    }
+
+    /// Converts transport commands between MMC and Start/Continue/Stop
+    pub fn with_mmc_bridge(mut self, bridge: Option<MmcBridge>) -> Self {
+        self.mmc_bridge = bridge;
+        self
+    }
+
+    /// Control Change for a mapped Note On/Off
+    fn note_as_cc(&self, msg: &[u8]) -> Option<Vec<u8>> {
+        let table = self.note_to_cc.as_ref()?;
+        if msg.len() != 3 || !matches!(msg[0] & 0xF0, 0x80 | 0x90) {
+            return None;
+        }
+        let controller = table[(msg[1] & 0x7F) as usize];
+        if controller == NO_CC {
+            return None;
+        }
+        let value = if msg[0] & 0xF0 == 0x90 { msg[2] } else { 0 };
+        Some(vec![0xB0 | (msg[0] & 0x0F), controller, value])
+    }
+
+    /// Control Change for Channel Pressure, with `--aftertouch-to-cc`
+    fn pressure_as_cc(&self, msg: &[u8]) -> Option<Vec<u8>> {
+        let controller = self.aftertouch_to_cc?;
+        match *msg {
+            [status, pressure] if status & 0xF0 == 0xD0 => {
+                Some(vec![0xB0 | (status & 0x0F), controller, pressure])
+            }
+            _ => None,
+        }
+    }
+
+    /// Applies the configured transforms
+    /// Returns None if the message should be dropped
+    pub fn apply(&self, msg: &[u8]) -> Option<Vec<u8>> {
+        if let Some(converted) = self.mmc_bridge.and_then(|bridge| bridge.convert(msg)) {
+            return Some(converted);
+        }
+
+        // A converted note or pressure carries on as an ordinary Control Change
+        let converted = self.note_as_cc(msg).or_else(|| self.pressure_as_cc(msg));
+        let msg = converted.as_deref().unwrap_or(msg);
+        let mut out = msg.to_vec();
+
+        if self.transpose != 0 && is_note_message(msg) {
+            // Notes pushed out of range are dropped rather than wrapped
+            let note = msg[1] as i16 + self.transpose as i16;
+            if !(0..=127).contains(&note) {
+                return None;
+            }
+            out[1] = note as u8;
+        }
+
+        if let Some(map) = &self.channel_map {
+            if (0x80..0xF0).contains(&msg[0]) {
+                out[0] = (msg[0] & 0xF0) | (map[(msg[0] & 0x0F) as usize] & 0x0F);
+            }
+        }
+
+        if let Some(table) = &self.cc_map {
+            if msg[0] & 0xF0 == 0xB0 && msg.len() == 3 {
+                out[1] = table[(msg[1] & 0x7F) as usize];
+            }
+        }
+
+        if let Some(scale) = self.bend_scale {
+            if msg[0] & 0xF0 == 0xE0 && msg.len() == 3 {
+                // 14-bit value, LSB first, centered at 8192
+                let bend = ((msg[2] as i32 & 0x7F) << 7 | (msg[1] as i32 & 0x7F)) - 8192;
+                let scaled = (bend as f32 * scale).round().clamp(-8192.0, 8191.0) as i32 + 8192;
+                out[1] = (scaled & 0x7F) as u8;
+                out[2] = (scaled >> 7) as u8;
+            }
+        }
+
+        if let Some(table) = &self.velocity_table {
+            let status = msg[0] & 0xF0;
+            let applies = status == 0x90 || (status == 0x80 && self.velocity_note_off);
+            if applies && is_valid_midi_message(msg) {
+                out[2] = table[(msg[2] & 0x7F) as usize];
+            }
+        }
+
+        Some(out)
+    }
+}
+
+/// Note Off, Note On and Poly Aftertouch all carry a note number in byte 1
+fn is_note_message(msg: &[u8]) -> bool {
+    msg.len() == 3 && matches!(msg[0] & 0xF0, 0x80 | 0x90 | 0xA0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_transpose_notes() {
+        let transform = Transform::new().with_transpose(12);
+        assert_eq!(transform.apply(&[0x90, 60, 100]), Some(vec![0x90, 72, 100]));
+        assert_eq!(transform.apply(&[0x80, 60, 0]), Some(vec![0x80, 72, 0]));
+        assert_eq!(transform.apply(&[0xA0, 60, 30]), Some(vec![0xA0, 72, 30]));
+
+        let transform = Transform::new().with_transpose(-3);
+        assert_eq!(transform.apply(&[0x91, 60, 100]), Some(vec![0x91, 57, 100]));
+    }
+
+    #[test]
+    fn test_transpose_out_of_range_dropped() {
+        assert_eq!(Transform::new().with_transpose(12).apply(&[0x90, 120, 100]), None);
+        assert_eq!(Transform::new().with_transpose(-12).apply(&[0x80, 5, 0]), None);
+        assert_eq!(Transform::new().with_transpose(7).apply(&[0x90, 120, 100]), Some(vec![0x90, 127, 100]));
+    }
+
+    #[test]
+    fn test_transpose_ignores_other_messages() {
+        let transform = Transform::new().with_transpose(12);
+        assert_eq!(transform.apply(&[0xB0, 60, 100]), Some(vec![0xB0, 60, 100]));
+        assert_eq!(transform.apply(&[0xC0, 5]), Some(vec![0xC0, 5]));
+        assert_eq!(transform.apply(&[0xF8]), Some(vec![0xF8]));
+    }
+
+    #[test]
+    fn test_velocity_scale() {
+        let transform = Transform::new().with_velocity(VelocityCurve::Linear, 1.5, false);
+        assert_eq!(transform.apply(&[0x90, 60, 40]), Some(vec![0x90, 60, 60]));
+
+        // Clamped at 127
+        assert_eq!(transform.apply(&[0x90, 60, 120]), Some(vec![0x90, 60, 127]));
+
+        // Velocity 0 still means Note Off
+        assert_eq!(transform.apply(&[0x90, 60, 0]), Some(vec![0x90, 60, 0]));
+
+        // Note Off is untouched unless requested
+        assert_eq!(transform.apply(&[0x80, 60, 40]), Some(vec![0x80, 60, 40]));
+        let transform = Transform::new().with_velocity(VelocityCurve::Linear, 1.5, true);
+        assert_eq!(transform.apply(&[0x80, 60, 40]), Some(vec![0x80, 60, 60]));
+    }
+
+    #[test]
+    fn test_velocity_never_zero() {
+        let transform = Transform::new().with_velocity(VelocityCurve::Linear, 0.01, false);
+        assert_eq!(transform.apply(&[0x90, 60, 1]), Some(vec![0x90, 60, 1]));
+        assert_eq!(transform.apply(&[0x90, 60, 127]), Some(vec![0x90, 60, 1]));
+    }
+
+    #[test]
+    fn test_fixed_velocity() {
+        let transform = Transform::new().with_fixed_velocity(Some(100));
+        assert_eq!(transform.apply(&[0x99, 36, 12]), Some(vec![0x99, 36, 100]));
+        assert_eq!(transform.apply(&[0x90, 38, 127]), Some(vec![0x90, 38, 100]));
+        // Velocity 0 is a Note Off and stays one; real Note Offs keep their release velocity
+        assert_eq!(transform.apply(&[0x99, 36, 0]), Some(vec![0x99, 36, 0]));
+        assert_eq!(transform.apply(&[0x89, 36, 40]), Some(vec![0x89, 36, 40]));
+        assert_eq!(transform.apply(&[0xA9, 36, 40]), Some(vec![0xA9, 36, 40]));
+
+        // Takes the place of a curve set before it
+        let transform = Transform::new()
+            .with_velocity(VelocityCurve::Exp, 2.0, true)
+            .with_fixed_velocity(Some(64));
+        assert_eq!(transform.apply(&[0x90, 60, 10]), Some(vec![0x90, 60, 64]));
+        assert_eq!(transform.apply(&[0x80, 60, 10]), Some(vec![0x80, 60, 10]));
+    }
+
+    #[test]
+    fn test_velocity_curves() {
+        let exp = Transform::new().with_velocity(VelocityCurve::Exp, 1.0, false);
+        let log = Transform::new().with_velocity(VelocityCurve::Log, 1.0, false);
+
+        let exp_mid = exp.apply(&[0x90, 60, 64]).unwrap()[2];
+        let log_mid = log.apply(&[0x90, 60, 64]).unwrap()[2];
+        assert!(exp_mid < 64);
+        assert!(log_mid > 64);
+
+        // Curves keep the end points
+        assert_eq!(exp.apply(&[0x90, 60, 127]).unwrap()[2], 127);
+        assert_eq!(log.apply(&[0x90, 60, 127]).unwrap()[2], 127);
+    }
+
+    #[test]
+    fn test_velocity_ignores_other_messages() {
+        let transform = Transform::new().with_velocity(VelocityCurve::Linear, 2.0, true);
+        assert_eq!(transform.apply(&[0xB0, 7, 40]), Some(vec![0xB0, 7, 40]));
+        assert_eq!(transform.apply(&[0xA0, 60, 40]), Some(vec![0xA0, 60, 40]));
+        assert_eq!(transform.apply(&[0x90, 60]), Some(vec![0x90, 60]));
+    }
+
+    #[test]
+    fn test_channel_map() {
+        let mut map: [u8; 16] = std::array::from_fn(|ch| ch as u8);
+        map[0] = 9;
+        let transform = Transform::new().with_channel_map(Some(map));
+        assert_eq!(transform.apply(&[0x90, 36, 100]), Some(vec![0x99, 36, 100]));
+        assert_eq!(transform.apply(&[0xC0, 5]), Some(vec![0xC9, 5]));
+        assert_eq!(transform.apply(&[0xB1, 7, 100]), Some(vec![0xB1, 7, 100]));
+        assert_eq!(transform.apply(&[0xF8]), Some(vec![0xF8]));
+    }
+
+    #[test]
+    fn test_channel_shift() {
+        let transform = Transform::new().with_channel_shift(4);
+        assert_eq!(transform.apply(&[0x90, 60, 100]), Some(vec![0x94, 60, 100]));
+        assert_eq!(transform.apply(&[0xE3, 0, 64]), Some(vec![0xE7, 0, 64]));
+        // Channel 16 + 1 wraps to channel 1, channel 1 - 1 to channel 16
+        let transform = Transform::new().with_channel_shift(1);
+        assert_eq!(transform.apply(&[0x8F, 60, 0]), Some(vec![0x80, 60, 0]));
+        let transform = Transform::new().with_channel_shift(-1);
+        assert_eq!(transform.apply(&[0xB0, 7, 100]), Some(vec![0xBF, 7, 100]));
+        // System messages have no channel
+        assert_eq!(transform.apply(&[0xF8]), Some(vec![0xF8]));
+        assert_eq!(transform.apply(&[0xF2, 0, 0]), Some(vec![0xF2, 0, 0]));
+
+        let mut map: [u8; 16] = std::array::from_fn(|ch| ch as u8);
+        map[0] = 9;
+        let transform = Transform::new().with_channel_map(Some(map)).with_channel_shift(-15);
+        assert_eq!(transform.apply(&[0xC0, 5]), Some(vec![0xCA, 5]));
+        assert_eq!(transform.apply(&[0xC1, 5]), Some(vec![0xC2, 5]));
+    }
+
+    #[test]
+    fn test_cc_map() {
+        let transform = Transform::new().with_cc_map(&[(1, 74), (11, 7)]);
+        // Controller renumbered, value byte preserved
+        assert_eq!(transform.apply(&[0xB0, 1, 0]), Some(vec![0xB0, 74, 0]));
+        assert_eq!(transform.apply(&[0xB3, 1, 127]), Some(vec![0xB3, 74, 127]));
+        assert_eq!(transform.apply(&[0xB0, 11, 64]), Some(vec![0xB0, 7, 64]));
+
+        // Unmapped controllers and other messages pass through unchanged
+        assert_eq!(transform.apply(&[0xB0, 2, 33]), Some(vec![0xB0, 2, 33]));
+        assert_eq!(transform.apply(&[0x90, 1, 100]), Some(vec![0x90, 1, 100]));
+        assert_eq!(transform.apply(&[0xA0, 1, 50]), Some(vec![0xA0, 1, 50]));
+    }
+
+    #[test]
+    fn test_bend_scale() {
+        const MIN: [u8; 3] = [0xE0, 0x00, 0x00];
+        const CENTER: [u8; 3] = [0xE0, 0x00, 0x40];
+        const MAX: [u8; 3] = [0xE0, 0x7F, 0x7F];
+
+        let half = Transform::new().with_bend(0.5, false);
+        assert_eq!(half.apply(&MIN), Some(vec![0xE0, 0x00, 0x20]));
+        assert_eq!(half.apply(&CENTER), Some(CENTER.to_vec()));
+        // 8191 * 0.5 rounds to 4096 above center
+        assert_eq!(half.apply(&MAX), Some(vec![0xE0, 0x00, 0x60]));
+
+        // Scaling up clamps instead of overflowing into the other direction
+        let double = Transform::new().with_bend(2.0, false);
+        assert_eq!(double.apply(&MIN), Some(MIN.to_vec()));
+        assert_eq!(double.apply(&MAX), Some(MAX.to_vec()));
+        assert_eq!(double.apply(&CENTER), Some(CENTER.to_vec()));
+    }
+
+    #[test]
+    fn test_bend_invert() {
+        let invert = Transform::new().with_bend(1.0, true);
+        assert_eq!(invert.apply(&[0xE0, 0x00, 0x00]), Some(vec![0xE0, 0x7F, 0x7F]));
+        assert_eq!(invert.apply(&[0xE0, 0x7F, 0x7F]), Some(vec![0xE0, 0x01, 0x00]));
+        assert_eq!(invert.apply(&[0xE3, 0x00, 0x40]), Some(vec![0xE3, 0x00, 0x40]));
+
+        // Other messages are untouched
+        assert_eq!(invert.apply(&[0xB0, 0x00, 0x40]), Some(vec![0xB0, 0x00, 0x40]));
+        assert!(Transform::new().with_bend(1.0, false).bend_scale.is_none());
+    }
+
+    #[test]
+    fn test_note_to_cc() {
+        let transform = Transform::new().with_note_to_cc(&[(36, 64)]);
+        assert_eq!(transform.apply(&[0x99, 36, 100]), Some(vec![0xB9, 64, 100]));
+        assert_eq!(transform.apply(&[0x89, 36, 40]), Some(vec![0xB9, 64, 0]));
+        // Note On with velocity 0 is a Note Off
+        assert_eq!(transform.apply(&[0x99, 36, 0]), Some(vec![0xB9, 64, 0]));
+
+        // Other notes and messages forward normally
+        assert_eq!(transform.apply(&[0x99, 38, 100]), Some(vec![0x99, 38, 100]));
+        assert_eq!(transform.apply(&[0xA9, 36, 10]), Some(vec![0xA9, 36, 10]));
+        assert_eq!(transform.apply(&[0xB9, 36, 10]), Some(vec![0xB9, 36, 10]));
+    }
+
+    #[test]
+    fn test_note_to_cc_skips_note_transforms() {
+        let transform = Transform::new()
+            .with_note_to_cc(&[(36, 64)])
+            .with_transpose(12)
+            .with_velocity(VelocityCurve::Linear, 0.5, false);
+        assert_eq!(transform.apply(&[0x90, 36, 100]), Some(vec![0xB0, 64, 100]));
+        assert_eq!(transform.apply(&[0x90, 38, 100]), Some(vec![0x90, 50, 50]));
+    }
+
+    #[test]
+    fn test_normalize_note_off() {
+        let mut msg = vec![0x93, 60, 0];
+        NoteOffStyle::NoteOff.apply(&mut msg);
+        assert_eq!(msg, vec![0x83, 60, 64]);
+
+        // Real Note Ons and Note Offs already in the wanted form are untouched
+        for original in [vec![0x90, 60, 1], vec![0x80, 60, 20], vec![0xB0, 7, 0]] {
+            let mut msg = original.clone();
+            NoteOffStyle::NoteOff.apply(&mut msg);
+            assert_eq!(msg, original);
+        }
+    }
+
+    #[test]
+    fn test_normalize_note_off_reverse() {
+        let mut msg = vec![0x85, 60, 40];
+        NoteOffStyle::NoteOnZero.apply(&mut msg);
+        assert_eq!(msg, vec![0x95, 60, 0]);
+
+        for original in [vec![0x90, 60, 100], vec![0x90, 60, 0], vec![0xA0, 60, 0]] {
+            let mut msg = original.clone();
+            NoteOffStyle::NoteOnZero.apply(&mut msg);
+            assert_eq!(msg, original);
+        }
+    }
+
+    #[test]
+    fn test_aftertouch_to_cc() {
+        let transform = Transform::new().with_aftertouch_to_cc(Some(1));
+        assert_eq!(transform.apply(&[0xD0, 90]), Some(vec![0xB0, 1, 90]));
+        assert_eq!(transform.apply(&[0xD5, 0]), Some(vec![0xB5, 1, 0]));
+
+        // Poly aftertouch and everything else is untouched
+        assert_eq!(transform.apply(&[0xA0, 60, 90]), Some(vec![0xA0, 60, 90]));
+        assert_eq!(transform.apply(&[0xB0, 2, 90]), Some(vec![0xB0, 2, 90]));
+        assert_eq!(Transform::new().apply(&[0xD0, 90]), Some(vec![0xD0, 90]));
+
+        // The new CC goes through the CC map like any other
+        let transform = Transform::new().with_aftertouch_to_cc(Some(1)).with_cc_map(&[(1, 74)]);
+        assert_eq!(transform.apply(&[0xD0, 90]), Some(vec![0xB0, 74, 90]));
+    }
+
+    #[test]
+    fn test_mmc_bridge() {
+        let transform = Transform::new().with_mmc_bridge(Some(MmcBridge::ToRealtime)).with_transpose(12);
+        assert_eq!(transform.apply(&[0xF0, 0x7F, 0x7F, 0x06, 0x02, 0xF7]), Some(vec![0xFA]));
+        // Everything else still goes through the other transforms
+        assert_eq!(transform.apply(&[0x90, 60, 100]), Some(vec![0x90, 72, 100]));
+        assert_eq!(Transform::new().apply(&[0xFA]), Some(vec![0xFA]));
+    }
+}
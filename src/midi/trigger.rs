@@ -0,0 +1,194 @@
+/// MIDI events that run shell commands, for `mc trigger`
+/// Events are `noteon:NOTE` (a name like C4 or a number), `cc:N>VALUE` / `cc:N<VALUE`
+/// (controller N crossing VALUE upwards / downwards) and `program:N`, on any channel.
+/// A trigger that fired ignores its event again until its debounce time has passed.
+use super::decode::parse_note_name;
+use crate::logging::{debug, error, info};
+use std::fmt;
+use std::process::Command;
+use std::time::{Duration, Instant};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TriggerEvent {
+    NoteOn(u8),
+    /// Controller rising above the value
+    CcAbove { controller: u8, threshold: u8 },
+    /// Controller falling below the value
+    CcBelow { controller: u8, threshold: u8 },
+    Program(u8),
+}
+
+impl std::str::FromStr for TriggerEvent {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = || {
+            format!(
+                "Invalid trigger '{}' (expected noteon:NOTE, cc:N>VALUE, cc:N<VALUE or program:N)",
+                s
+            )
+        };
+        let data = |value: &str| value.parse::<u8>().ok().filter(|&b| b <= 127).ok_or_else(invalid);
+
+        let (kind, value) = s.split_once(':').ok_or_else(invalid)?;
+        match kind {
+            "noteon" => {
+                let note = data(value).or_else(|_| parse_note_name(value).ok_or_else(invalid))?;
+                Ok(TriggerEvent::NoteOn(note))
+            }
+            "cc" => {
+                if let Some((controller, threshold)) = value.split_once('>') {
+                    Ok(TriggerEvent::CcAbove { controller: data(controller)?, threshold: data(threshold)? })
+                } else if let Some((controller, threshold)) = value.split_once('<') {
+                    Ok(TriggerEvent::CcBelow { controller: data(controller)?, threshold: data(threshold)? })
+                } else {
+                    Err(invalid())
+                }
+            }
+            "program" => Ok(TriggerEvent::Program(data(value)?)),
+            _ => Err(invalid()),
+        }
+    }
+}
+
+impl fmt::Display for TriggerEvent {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            TriggerEvent::NoteOn(note) => write!(f, "noteon:{}", note),
+            TriggerEvent::CcAbove { controller, threshold } => write!(f, "cc:{}>{}", controller, threshold),
+            TriggerEvent::CcBelow { controller, threshold } => write!(f, "cc:{}<{}", controller, threshold),
+            TriggerEvent::Program(program) => write!(f, "program:{}", program),
+        }
+    }
+}
+
+/// An event with its command and the state needed to match it
+#[derive(Debug, Clone)]
+pub struct Trigger {
+    pub event: TriggerEvent,
+    pub command: String,
+    debounce: Duration,
+    last_fired: Option<Instant>,
+    /// Last value of the controller per channel, to see a threshold being crossed
+    last_value: [Option<u8>; 16],
+}
+
+impl Trigger {
+    pub fn new(event: TriggerEvent, command: &str, debounce: Duration) -> Self {
+        Self {
+            event,
+            command: command.to_string(),
+            debounce,
+            last_fired: None,
+            last_value: [None; 16],
+        }
+    }
+
+    /// True if `msg` fires the trigger now
+    pub fn fires(&mut self, msg: &[u8], now: Instant) -> bool {
+        let matched = match (self.event, msg) {
+            (TriggerEvent::NoteOn(note), &[status, n, velocity]) => {
+                status & 0xF0 == 0x90 && n == note && velocity > 0
+            }
+            (TriggerEvent::CcAbove { controller, threshold }, &[status, c, value])
+            | (TriggerEvent::CcBelow { controller, threshold }, &[status, c, value])
+                if status & 0xF0 == 0xB0 && c == controller =>
+            {
+                let previous = self.last_value[(status & 0x0F) as usize].replace(value);
+                // The first value seen counts as a crossing if it is already past
+                match self.event {
+                    TriggerEvent::CcAbove { .. } => value > threshold && previous.map_or(true, |p| p <= threshold),
+                    _ => value < threshold && previous.map_or(true, |p| p >= threshold),
+                }
+            }
+            (TriggerEvent::Program(program), &[status, p]) => status & 0xF0 == 0xC0 && p == program,
+            _ => false,
+        };
+        if !matched || self.last_fired.is_some_and(|last| now.duration_since(last) < self.debounce) {
+            return false;
+        }
+        self.last_fired = Some(now);
+        true
+    }
+}
+
+/// Runs a command through the shell on its own thread, so the MIDI callback never waits
+pub fn spawn(command: &str) {
+    info!("Running '{}'", command);
+    let command = command.to_string();
+    std::thread::spawn(move || {
+        #[cfg(unix)]
+        let status = Command::new("sh").arg("-c").arg(&command).status();
+        #[cfg(not(unix))]
+        let status = Command::new("cmd").arg("/C").arg(&command).status();
+        match status {
+            Ok(status) if status.success() => debug!("'{}' finished", command),
+            Ok(status) => error!("'{}' exited with {}", command, status),
+            Err(e) => error!("Failed to run '{}': {}", command, e),
+        }
+    });
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const MS: Duration = Duration::from_millis(1);
+
+    #[test]
+    fn test_parse_events() {
+        assert_eq!("noteon:C4".parse(), Ok(TriggerEvent::NoteOn(60)));
+        assert_eq!("noteon:36".parse(), Ok(TriggerEvent::NoteOn(36)));
+        assert_eq!("cc:64>63".parse(), Ok(TriggerEvent::CcAbove { controller: 64, threshold: 63 }));
+        assert_eq!("cc:1<10".parse(), Ok(TriggerEvent::CcBelow { controller: 1, threshold: 10 }));
+        assert_eq!("program:5".parse(), Ok(TriggerEvent::Program(5)));
+        assert!("noteon:H4".parse::<TriggerEvent>().is_err());
+        assert!("cc:64".parse::<TriggerEvent>().is_err());
+        assert!("cc:128>1".parse::<TriggerEvent>().is_err());
+        assert!("noteoff:C4".parse::<TriggerEvent>().is_err());
+        assert!("program".parse::<TriggerEvent>().is_err());
+    }
+
+    #[test]
+    fn test_note_and_program() {
+        let start = Instant::now();
+        let mut trigger = Trigger::new(TriggerEvent::NoteOn(60), "true", Duration::ZERO);
+        assert!(trigger.fires(&[0x99, 60, 100], start));
+        assert!(!trigger.fires(&[0x90, 60, 0], start));
+        assert!(!trigger.fires(&[0x90, 61, 100], start));
+        assert!(!trigger.fires(&[0x80, 60, 100], start));
+
+        let mut trigger = Trigger::new(TriggerEvent::Program(5), "true", Duration::ZERO);
+        assert!(trigger.fires(&[0xC3, 5], start));
+        assert!(!trigger.fires(&[0xC3, 6], start));
+    }
+
+    #[test]
+    fn test_cc_crossing() {
+        let start = Instant::now();
+        let event = TriggerEvent::CcAbove { controller: 1, threshold: 64 };
+        let mut trigger = Trigger::new(event, "true", Duration::ZERO);
+        assert!(!trigger.fires(&[0xB0, 1, 10], start));
+        assert!(trigger.fires(&[0xB0, 1, 70], start));
+        // Staying above doesn't fire again; dropping back and rising does
+        assert!(!trigger.fires(&[0xB0, 1, 90], start));
+        assert!(!trigger.fires(&[0xB0, 1, 20], start));
+        assert!(trigger.fires(&[0xB0, 1, 100], start));
+        // Each channel crosses on its own
+        assert!(trigger.fires(&[0xB1, 1, 100], start));
+
+        let event = TriggerEvent::CcBelow { controller: 1, threshold: 64 };
+        let mut trigger = Trigger::new(event, "true", Duration::ZERO);
+        assert!(!trigger.fires(&[0xB0, 1, 100], start));
+        assert!(trigger.fires(&[0xB0, 1, 0], start));
+    }
+
+    #[test]
+    fn test_debounce() {
+        let start = Instant::now();
+        let mut trigger = Trigger::new(TriggerEvent::NoteOn(60), "true", 100 * MS);
+        assert!(trigger.fires(&[0x90, 60, 100], start));
+        assert!(!trigger.fires(&[0x90, 60, 100], start + 50 * MS));
+        assert!(trigger.fires(&[0x90, 60, 100], start + 150 * MS));
+    }
+}
@@ -0,0 +1,158 @@
+/// Universal MIDI Packet (MIDI 2.0) recognition for input buffers
+/// midir's backends deliver MIDI 1.0 byte streams, but a driver or bridge that hands over
+/// raw UMP words would otherwise be parsed as stray data bytes and silently lost. A buffer
+/// is only taken as UMP when it starts with a data byte (a MIDI 1.0 buffer starts with a
+/// status byte unless running status is in effect) and every packet in it is well-formed.
+/// MIDI 1.0 messages carried in UMP are translated back; MIDI 2.0 messages are dropped.
+use super::parser::data_length;
+use crate::logging::{debug, error};
+use std::sync::atomic::{AtomicBool, Ordering};
+
+/// What a UMP buffer held
+#[derive(Debug, Clone, PartialEq, Eq, Default)]
+pub struct UmpBuffer {
+    /// MIDI 1.0 messages translated from system, MIDI 1.0 channel voice and SysEx packets
+    pub messages: Vec<Vec<u8>>,
+    /// Packets with no MIDI 1.0 equivalent here (MIDI 2.0 channel voice, multi-packet
+    /// SysEx, 128-bit data)
+    pub unsupported: usize,
+}
+
+/// Packet length in 32-bit words for message types 0-5; later types are reserved
+fn packet_words(message_type: u8) -> Option<usize> {
+    match message_type {
+        0..=2 => Some(1),
+        3 | 4 => Some(2),
+        5 => Some(4),
+        _ => None,
+    }
+}
+
+/// Splits a buffer into UMP packets, or None if it isn't a well-formed UMP buffer
+pub fn decode(bytes: &[u8]) -> Option<UmpBuffer> {
+    if bytes.is_empty() || bytes.len() % 4 != 0 || bytes[0] >= 0x80 {
+        return None;
+    }
+
+    let mut decoded = UmpBuffer::default();
+    let mut rest = bytes;
+    while !rest.is_empty() {
+        let message_type = rest[0] >> 4;
+        let len = packet_words(message_type)? * 4;
+        let packet = rest.get(..len)?;
+        rest = &rest[len..];
+
+        match message_type {
+            // Utility (NOOP, jitter reduction): nothing to forward
+            0 => {}
+            1 => {
+                let status = packet[1];
+                if !matches!(status, 0xF1..=0xF3 | 0xF6 | 0xF8 | 0xFA..=0xFC | 0xFE | 0xFF) {
+                    return None;
+                }
+                decoded.messages.push(midi1_message(status, &packet[2..4])?);
+            }
+            2 => {
+                let status = packet[1];
+                if !(0x80..=0xEF).contains(&status) {
+                    return None;
+                }
+                decoded.messages.push(midi1_message(status, &packet[2..4])?);
+            }
+            3 => {
+                let (form, count) = (packet[1] >> 4, (packet[1] & 0x0F) as usize);
+                let data = packet[2..].get(..count)?;
+                if data.iter().any(|&b| b >= 0x80) {
+                    return None;
+                }
+                // Only a SysEx complete in one packet is translated
+                if form == 0 {
+                    let mut sysex = vec![0xF0];
+                    sysex.extend_from_slice(data);
+                    sysex.push(0xF7);
+                    decoded.messages.push(sysex);
+                } else {
+                    decoded.unsupported += 1;
+                }
+            }
+            4 => {
+                if !(0x80..=0xEF).contains(&packet[1]) {
+                    return None;
+                }
+                decoded.unsupported += 1;
+            }
+            _ => decoded.unsupported += 1,
+        }
+    }
+    Some(decoded)
+}
+
+/// A MIDI 1.0 message from a status byte and the packet's two data bytes
+fn midi1_message(status: u8, data: &[u8]) -> Option<Vec<u8>> {
+    let len = data_length(status)?;
+    if data[..len].iter().any(|&b| b >= 0x80) {
+        return None;
+    }
+    let mut message = vec![status];
+    message.extend_from_slice(&data[..len]);
+    Some(message)
+}
+
+/// Logs (once per process) that UMP input was seen, and what was dropped from it
+pub fn report(decoded: &UmpBuffer) {
+    static WARNED: AtomicBool = AtomicBool::new(false);
+    if !WARNED.swap(true, Ordering::Relaxed) {
+        error!(
+            "Input is sending MIDI 2.0 (UMP) packets; MIDI 1.0 messages in them are translated, \
+             MIDI 2.0 messages are not supported yet and are dropped"
+        );
+    }
+    if decoded.unsupported > 0 {
+        debug!("Dropped {} UMP packets with no MIDI 1.0 equivalent", decoded.unsupported);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_midi1_channel_voice() {
+        // Group 0 Note On, group 3 Program Change (one data byte)
+        let decoded = decode(&[0x20, 0x90, 0x3C, 0x64, 0x23, 0xC1, 0x05, 0x00]).unwrap();
+        assert_eq!(decoded.messages, vec![vec![0x90, 0x3C, 0x64], vec![0xC1, 0x05]]);
+        assert_eq!(decoded.unsupported, 0);
+    }
+
+    #[test]
+    fn test_system_and_sysex() {
+        let decoded = decode(&[
+            0x10, 0xF8, 0x00, 0x00, // Timing Clock
+            0x30, 0x03, 0x7E, 0x7F, 0x09, 0x00, 0x00, 0x00, // complete SysEx, 3 bytes
+            0x30, 0x16, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, // SysEx start: not translated
+        ])
+        .unwrap();
+        assert_eq!(decoded.messages, vec![vec![0xF8], vec![0xF0, 0x7E, 0x7F, 0x09, 0xF7]]);
+        assert_eq!(decoded.unsupported, 1);
+    }
+
+    #[test]
+    fn test_midi2_channel_voice_unsupported() {
+        // MIDI 2.0 Note On with a 16-bit velocity
+        let decoded = decode(&[0x40, 0x90, 0x3C, 0x00, 0x80, 0x00, 0x00, 0x00]).unwrap();
+        assert!(decoded.messages.is_empty());
+        assert_eq!(decoded.unsupported, 1);
+    }
+
+    #[test]
+    fn test_midi1_buffers_are_not_ump() {
+        assert_eq!(decode(&[0x90, 0x3C, 0x64, 0x00]), None);
+        // Running status data bytes
+        assert_eq!(decode(&[0x3C, 0x64, 0x3E, 0x64]), None);
+        // Truncated 64-bit packet
+        assert_eq!(decode(&[0x40, 0x90, 0x3C, 0x00]), None);
+        // Reserved message type
+        assert_eq!(decode(&[0x60, 0x00, 0x00, 0x00]), None);
+        assert_eq!(decode(&[]), None);
+    }
+}
@@ -1,3 +1,5 @@
+use super::transform::DEFAULT_RELEASE_VELOCITY;
+
 /// Validates the length of a MIDI message based on its type
 /// Ported from Go's fwd.go lines 111-143
 pub fn is_valid_midi_message(msg: &[u8]) -> bool {
@@ -21,13 +23,20 @@ pub fn is_valid_midi_message(msg: &[u8]) -> bool {
     }
 }
 
-/// Validates system messages (0xF0 status byte)
-fn validate_system_message(msg: &[u8]) -> bool {
-    if msg.len() < 2 {
-        return false;
+/// The three-byte Note Off for a note message missing its velocity, as some drivers
+/// send them: 0x80 gets the default release velocity, 0x90 velocity 0 (`--normalize`)
+/// None for any other message
+pub fn complete_short_note(msg: &[u8]) -> Option<Vec<u8>> {
+    match *msg {
+        [status, note] if note < 0x80 && status & 0xF0 == 0x80 => Some(vec![status, note, DEFAULT_RELEASE_VELOCITY]),
+        [status, note] if note < 0x80 && status & 0xF0 == 0x90 => Some(vec![status, note, 0]),
+        _ => None,
     }
+}
 
-    match msg[1] {
+/// Validates system messages (0xF0-0xFF status bytes)
+fn validate_system_message(msg: &[u8]) -> bool {
+    match msg[0] {
         // SysEx start - variable length
         0xF0 => true,
 
@@ -38,28 +47,12 @@ fn validate_system_message(msg: &[u8]) -> bool {
         0xF2 => msg.len() == 3,
 
         // Tune Request, Clock, Start, Continue, Stop, Active Sensing, Reset
-        0xF6 | 0xF7 | 0xF8 | 0xFA | 0xFB | 0xFC => msg.len() == 1,
+        0xF6 | 0xF7 | 0xF8 | 0xFA | 0xFB | 0xFC | 0xFE | 0xFF => msg.len() == 1,
 
         _ => false,
     }
 }
 
-/// Checks if a message is a Program Change message
-/// Program Change messages need special handling (truncate to 2 bytes if longer)
-pub fn is_program_change(msg: &[u8]) -> bool {
-    !msg.is_empty() && (msg[0] & 0xF0) == 0xC0
-}
-
-/// Truncates a Program Change message to 2 bytes if needed
-/// Returns the correct message to forward
-pub fn normalize_program_change(msg: &[u8]) -> Vec<u8> {
-    if msg.len() >= 2 {
-        msg[..2].to_vec()
-    } else {
-        msg.to_vec()
-    }
-}
-
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -82,15 +75,6 @@ mod tests {
         // Program Change with wrong length
         assert!(!is_valid_midi_message(&[0xC0]));
         assert!(!is_valid_midi_message(&[0xC0, 0x05, 0x00]));
-
-        // Check program change detection
-        assert!(is_program_change(&[0xC0, 0x05]));
-        assert!(is_program_change(&[0xC0, 0x05, 0x00]));
-        assert!(!is_program_change(&[0x90, 0x3C, 0x64]));
-
-        // Normalize program change
-        assert_eq!(normalize_program_change(&[0xC0, 0x05, 0x00]), vec![0xC0, 0x05]);
-        assert_eq!(normalize_program_change(&[0xC0, 0x05]), vec![0xC0, 0x05]);
     }
 
     #[test]
@@ -105,12 +89,49 @@ mod tests {
     #[test]
     fn test_system_messages() {
         // MIDI Time Code (2 bytes)
-        assert!(is_valid_midi_message(&[0xF0, 0xF1]));
+        assert!(is_valid_midi_message(&[0xF1, 0x00]));
+        assert!(!is_valid_midi_message(&[0xF1]));
 
         // Song Position Pointer (3 bytes)
-        assert!(is_valid_midi_message(&[0xF0, 0xF2, 0x00]));
+        assert!(is_valid_midi_message(&[0xF2, 0x00, 0x00]));
 
         // Clock (1 byte)
-        assert!(is_valid_midi_message(&[0xF0, 0xF8]));
+        assert!(is_valid_midi_message(&[0xF8]));
+        assert!(!is_valid_midi_message(&[0xF8, 0x00]));
+
+        // SysEx (variable length)
+        assert!(is_valid_midi_message(&[0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7]));
+    }
+
+    #[test]
+    fn test_complete_short_note() {
+        assert_eq!(complete_short_note(&[0x80, 0x3C]), Some(vec![0x80, 0x3C, 0x40]));
+        assert_eq!(complete_short_note(&[0x93, 0x3C]), Some(vec![0x93, 0x3C, 0x00]));
+        let completed = complete_short_note(&[0x8F, 0x00]).unwrap();
+        assert!(is_valid_midi_message(&completed));
+        // Complete notes and other messages are left alone
+        assert_eq!(complete_short_note(&[0x80, 0x3C, 0x10]), None);
+        assert_eq!(complete_short_note(&[0xB0, 0x07]), None);
+        assert_eq!(complete_short_note(&[0xC0, 0x05]), None);
+        assert_eq!(complete_short_note(&[0x80, 0x90]), None);
+    }
+
+    #[test]
+    fn test_realtime_messages() {
+        // Every realtime status byte: 0xF9 and 0xFD are undefined
+        let expected = [
+            (0xF8, true),  // Clock
+            (0xF9, false), // Undefined
+            (0xFA, true),  // Start
+            (0xFB, true),  // Continue
+            (0xFC, true),  // Stop
+            (0xFD, false), // Undefined
+            (0xFE, true),  // Active Sensing
+            (0xFF, true),  // Reset
+        ];
+        for (status, valid) in expected {
+            assert_eq!(is_valid_midi_message(&[status]), valid, "0x{:02X}", status);
+            assert!(!is_valid_midi_message(&[status, 0x00]), "0x{:02X} with a data byte", status);
+        }
     }
 }
@@ -1,4 +1,5 @@
 use anyhow::Result;
+use crate::logging::error;
 use midir::{MidiInput, MidiInputConnection, MidiOutput, MidiOutputConnection};
 use std::sync::{Arc, Mutex};
 use std::process::ChildStdin;
@@ -36,6 +37,7 @@ impl VirtualPorts {
     /// Creates two independent pairs (A and B) for message isolation
     #[cfg(unix)]
     pub fn create() -> Result<Self> {
+        use super::parser::MessageParser;
         use midir::os::unix::{VirtualInput, VirtualOutput};
 
         // Create MIDI input and output objects for pair A
@@ -45,7 +47,7 @@ impl VirtualPorts {
         // Create virtual output port A
         let output_connection_a = midi_out_a
             .create_virtual(VIRTUAL_OUTPUT_A_NAME)
-            .map_err(|e| anyhow::anyhow!("Failed to create virtual output A: {:?}", e))?;
+            .map_err(|e| anyhow::anyhow!("Failed to create virtual output A: {:?}{}", e, crate::midi::ports::virtual_port_hint()))?;
         let output_shared_a = Arc::new(Mutex::new(output_connection_a));
 
         // Create broadcast lists for input A
@@ -55,16 +57,21 @@ impl VirtualPorts {
         let pipes_for_callback_a = Arc::clone(&pipe_workers_a);
 
         // Create virtual input port A with callback
+        let mut parser_a = MessageParser::new();
         let input_connection_a = midi_in_a
             .create_virtual(
                 VIRTUAL_INPUT_A_NAME,
                 move |_timestamp, message, _| {
-                    // Forward to in-process outputs
+                    // Forward to in-process outputs one message at a time, so realtime
+                    // bytes interleaved in a buffer go out on their own
+                    let messages = parser_a.push(message);
                     if let Ok(outputs) = outputs_for_callback_a.lock() {
-                        for output in outputs.iter() {
-                            if let Ok(mut out) = output.lock() {
-                                if let Err(e) = out.send(message) {
-                                    eprintln!("Error forwarding from {}: {}", VIRTUAL_INPUT_A_NAME, e);
+                        for parsed in &messages {
+                            for output in outputs.iter() {
+                                if let Ok(mut out) = output.lock() {
+                                    if let Err(e) = out.send(parsed) {
+                                        error!("Error forwarding from {}: {}", VIRTUAL_INPUT_A_NAME, e);
+                                    }
                                 }
                             }
                         }
@@ -81,7 +88,7 @@ impl VirtualPorts {
                 },
                 (),
             )
-            .map_err(|e| anyhow::anyhow!("Failed to create virtual input A: {:?}", e))?;
+            .map_err(|e| anyhow::anyhow!("Failed to create virtual input A: {:?}{}", e, crate::midi::ports::virtual_port_hint()))?;
 
         // Create MIDI input and output objects for pair B
         let midi_in_b = MidiInput::new("mc-b")?;
@@ -90,7 +97,7 @@ impl VirtualPorts {
         // Create virtual output port B
         let output_connection_b = midi_out_b
             .create_virtual(VIRTUAL_OUTPUT_B_NAME)
-            .map_err(|e| anyhow::anyhow!("Failed to create virtual output B: {:?}", e))?;
+            .map_err(|e| anyhow::anyhow!("Failed to create virtual output B: {:?}{}", e, crate::midi::ports::virtual_port_hint()))?;
         let output_shared_b = Arc::new(Mutex::new(output_connection_b));
 
         // Create broadcast lists for input B
@@ -100,16 +107,21 @@ impl VirtualPorts {
         let pipes_for_callback_b = Arc::clone(&pipe_workers_b);
 
         // Create virtual input port B with callback
+        let mut parser_b = MessageParser::new();
         let input_connection_b = midi_in_b
             .create_virtual(
                 VIRTUAL_INPUT_B_NAME,
                 move |_timestamp, message, _| {
-                    // Forward to in-process outputs
+                    // Forward to in-process outputs one message at a time, so realtime
+                    // bytes interleaved in a buffer go out on their own
+                    let messages = parser_b.push(message);
                     if let Ok(outputs) = outputs_for_callback_b.lock() {
-                        for output in outputs.iter() {
-                            if let Ok(mut out) = output.lock() {
-                                if let Err(e) = out.send(message) {
-                                    eprintln!("Error forwarding from {}: {}", VIRTUAL_INPUT_B_NAME, e);
+                        for parsed in &messages {
+                            for output in outputs.iter() {
+                                if let Ok(mut out) = output.lock() {
+                                    if let Err(e) = out.send(parsed) {
+                                        error!("Error forwarding from {}: {}", VIRTUAL_INPUT_B_NAME, e);
+                                    }
                                 }
                             }
                         }
@@ -126,7 +138,7 @@ impl VirtualPorts {
                 },
                 (),
             )
-            .map_err(|e| anyhow::anyhow!("Failed to create virtual input B: {:?}", e))?;
+            .map_err(|e| anyhow::anyhow!("Failed to create virtual input B: {:?}{}", e, crate::midi::ports::virtual_port_hint()))?;
 
         Ok(VirtualPorts {
             _input_connection_a: input_connection_a,
@@ -285,8 +297,6 @@ impl VirtualPorts {
 
     #[cfg(not(unix))]
     pub fn create() -> Result<Self> {
-        Err(anyhow::anyhow!(
-            "Virtual ports are only supported on Unix/macOS/Linux platforms"
-        ))
+        Err(anyhow::anyhow!(crate::midi::ports::VIRTUAL_PORTS_UNSUPPORTED))
     }
 }
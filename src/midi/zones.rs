@@ -0,0 +1,243 @@
+/// Keyboard zones for `mc split --zone`
+/// Each zone sends the notes in its range to one output, optionally transposed; zones
+/// may overlap to layer sounds. Where a Note On went is remembered per channel and key,
+/// so its Note Off and Polyphonic Aftertouch follow it there whatever the zones say by
+/// then. Everything else goes to every zone's output, or only to the default output.
+use super::decode::{note_name, parse_note_name};
+use std::collections::HashMap;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Zone {
+    pub low: u8,
+    pub high: u8,
+    pub output: String,
+    /// Semitones added to the zone's notes
+    pub transpose: i8,
+}
+
+impl Zone {
+    fn contains(&self, note: u8) -> bool {
+        (self.low..=self.high).contains(&note)
+    }
+
+    /// The range as given on the command line, e.g. C-1:B3
+    pub fn range(&self) -> String {
+        format!("{}:{}", note_name(self.low), note_name(self.high))
+    }
+}
+
+impl std::str::FromStr for Zone {
+    type Err = String;
+
+    /// Parses `LOW:HIGH=OUTPUT`; an empty end runs to the bottom or top of the keyboard
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = |reason: String| format!("Invalid zone '{}': {}", s, reason);
+        let note = |value: &str, open: u8| {
+            if value.is_empty() {
+                return Ok(open);
+            }
+            value
+                .parse::<u8>()
+                .ok()
+                .filter(|&n| n <= 127)
+                .or_else(|| parse_note_name(value))
+                .ok_or_else(|| invalid(format!("'{}' is not a note (0-127 or a name like C4)", value)))
+        };
+
+        let (range, output) = s
+            .split_once('=')
+            .ok_or_else(|| invalid("expected LOW:HIGH=OUTPUT".to_string()))?;
+        let (low, high) = range
+            .split_once(':')
+            .ok_or_else(|| invalid("expected LOW:HIGH=OUTPUT".to_string()))?;
+        let (low, high) = (note(low, 0)?, note(high, 127)?);
+        if low > high {
+            return Err(invalid(format!("{} is above {}", note_name(low), note_name(high))));
+        }
+        if output.is_empty() {
+            return Err(invalid("no output port".to_string()));
+        }
+        Ok(Zone {
+            low,
+            high,
+            output: output.to_string(),
+            transpose: 0,
+        })
+    }
+}
+
+/// Where each message from the input goes, as indices into `outputs()`
+#[derive(Debug, Clone)]
+pub struct ZoneRouter {
+    zones: Vec<(Zone, usize)>,
+    outputs: Vec<String>,
+    default_output: Option<usize>,
+    /// Output and sent note of every sounding (channel, key)
+    held: HashMap<(u8, u8), Vec<(usize, u8)>>,
+}
+
+impl ZoneRouter {
+    /// Zones naming the same output share it
+    pub fn new(zones: &[Zone], default_output: Option<&str>) -> Self {
+        let mut outputs: Vec<String> = Vec::new();
+        let mut output_index = |name: &str| match outputs.iter().position(|o| o == name) {
+            Some(idx) => idx,
+            None => {
+                outputs.push(name.to_string());
+                outputs.len() - 1
+            }
+        };
+        let zones = zones.iter().map(|zone| (zone.clone(), output_index(&zone.output))).collect();
+        let default_output = default_output.map(output_index);
+        Self {
+            zones,
+            outputs,
+            default_output,
+            held: HashMap::new(),
+        }
+    }
+
+    /// Ports to open, zone outputs first
+    pub fn outputs(&self) -> &[String] {
+        &self.outputs
+    }
+
+    pub fn route(&mut self, msg: &[u8]) -> Vec<(usize, Vec<u8>)> {
+        let kind = msg.first().map_or(0, |status| status & 0xF0);
+        if msg.len() != 3 || !matches!(kind, 0x80 | 0x90 | 0xA0) {
+            self.release_all(msg);
+            return match self.default_output {
+                Some(idx) => vec![(idx, msg.to_vec())],
+                None => (0..self.outputs.len()).map(|idx| (idx, msg.to_vec())).collect(),
+            };
+        }
+
+        let key = (msg[0] & 0x0F, msg[1]);
+        let targets = match kind {
+            0x90 if msg[2] > 0 => {
+                let targets = self.targets(msg[1]);
+                // A key struck again before its Note Off adds to where that Note Off goes
+                let held = self.held.entry(key).or_default();
+                for target in &targets {
+                    if !held.contains(target) {
+                        held.push(*target);
+                    }
+                }
+                if held.is_empty() {
+                    self.held.remove(&key);
+                }
+                targets
+            }
+            0xA0 => self.held.get(&key).cloned().unwrap_or_else(|| self.targets(msg[1])),
+            // A note held since before we started goes wherever its zones say now
+            _ => self.held.remove(&key).unwrap_or_else(|| self.targets(msg[1])),
+        };
+        targets
+            .into_iter()
+            .map(|(idx, note)| (idx, vec![msg[0], note, msg[2]]))
+            .collect()
+    }
+
+    /// Output and transposed note of every zone playing `note`; notes transposed off the
+    /// keyboard are left out
+    fn targets(&self, note: u8) -> Vec<(usize, u8)> {
+        self.zones
+            .iter()
+            .filter(|(zone, _)| zone.contains(note))
+            .filter_map(|(zone, idx)| {
+                let sent = note as i16 + zone.transpose as i16;
+                (0..=127).contains(&sent).then_some((*idx, sent as u8))
+            })
+            .collect()
+    }
+
+    /// All Sound Off and All Notes Off end every note on their channel
+    fn release_all(&mut self, msg: &[u8]) {
+        if let [status @ 0xB0..=0xBF, 120 | 123, _] = *msg {
+            self.held.retain(|&(channel, _), _| channel != status & 0x0F);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn zone(spec: &str, transpose: i8) -> Zone {
+        Zone {
+            transpose,
+            ..spec.parse().unwrap()
+        }
+    }
+
+    #[test]
+    fn test_parse_zone() {
+        assert_eq!(
+            ":59=bass".parse(),
+            Ok(Zone {
+                low: 0,
+                high: 59,
+                output: "bass".to_string(),
+                transpose: 0
+            })
+        );
+        let lead: Zone = "C4:=IAC Driver Bus 2".parse().unwrap();
+        assert_eq!((lead.low, lead.high, lead.output.as_str()), (60, 127, "IAC Driver Bus 2"));
+        assert_eq!(lead.range(), "C4:G9");
+        assert!("60=lead".parse::<Zone>().is_err());
+        assert!("72:60=lead".parse::<Zone>().is_err());
+        assert!("60:X9=lead".parse::<Zone>().is_err());
+        assert!("60:=".parse::<Zone>().is_err());
+    }
+
+    #[test]
+    fn test_split_point() {
+        let mut router = ZoneRouter::new(&[zone(":59=bass", -12), zone("60:=lead", 0)], None);
+        assert_eq!(router.outputs(), ["bass", "lead"]);
+        assert_eq!(router.route(&[0x90, 48, 100]), vec![(0, vec![0x90, 36, 100])]);
+        assert_eq!(router.route(&[0x90, 60, 100]), vec![(1, vec![0x90, 60, 100])]);
+        assert_eq!(router.route(&[0x80, 48, 64]), vec![(0, vec![0x80, 36, 64])]);
+        // Non-note messages reach every zone
+        assert_eq!(router.route(&[0xB0, 64, 127]), vec![(0, vec![0xB0, 64, 127]), (1, vec![0xB0, 64, 127])]);
+    }
+
+    #[test]
+    fn test_layers_and_default_output() {
+        let mut router = ZoneRouter::new(&[zone(":=pad", 0), zone("60:=pad", 12), zone("60:=strings", 0)], Some("fx"));
+        assert_eq!(router.outputs(), ["pad", "strings", "fx"]);
+        assert_eq!(
+            router.route(&[0x91, 64, 90]),
+            vec![(0, vec![0x91, 64, 90]), (0, vec![0x91, 76, 90]), (1, vec![0x91, 64, 90])]
+        );
+        assert_eq!(router.route(&[0xE1, 0, 64]), vec![(2, vec![0xE1, 0, 64])]);
+    }
+
+    #[test]
+    fn test_note_off_follows_note_on() {
+        let mut router = ZoneRouter::new(&[zone(":59=bass", 0), zone("60:=lead", 0)], None);
+        router.route(&[0x90, 59, 100]);
+        // The split point moves while the note is held
+        router.zones[0].0.high = 47;
+        router.zones[1].0.low = 48;
+        assert_eq!(router.route(&[0xA0, 59, 30]), vec![(0, vec![0xA0, 59, 30])]);
+        assert_eq!(router.route(&[0x90, 59, 0]), vec![(0, vec![0x90, 59, 0])]);
+        // Once released, the key follows the new split
+        assert_eq!(router.route(&[0x90, 59, 100]), vec![(1, vec![0x90, 59, 100])]);
+    }
+
+    #[test]
+    fn test_transposed_off_keyboard() {
+        let mut router = ZoneRouter::new(&[zone(":=high", 12)], None);
+        assert!(router.route(&[0x90, 120, 100]).is_empty());
+        assert!(router.route(&[0x80, 120, 0]).is_empty());
+        assert!(router.held.is_empty());
+    }
+
+    #[test]
+    fn test_all_notes_off_clears_held() {
+        let mut router = ZoneRouter::new(&[zone(":59=bass", 0)], None);
+        router.route(&[0x92, 40, 100]);
+        router.route(&[0xB2, 123, 0]);
+        assert!(router.held.is_empty());
+    }
+}
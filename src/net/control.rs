@@ -0,0 +1,267 @@
+use crate::config::Route;
+use crate::logging::{debug, info};
+use crate::midi::ports::json_escape;
+use crossbeam::channel::{Receiver, Sender};
+use std::io;
+use std::sync::atomic::AtomicBool;
+use std::sync::Arc;
+
+// The control socket of `mc run --control-socket PATH`: a Unix socket taking one command
+// per line and answering each with one line of JSON. Routes are numbered from 1 as in
+// the routes file:
+//
+//   routes                     -> {"ok":true,"routes":[{"route":1,"input":...,"paused":false,...}]}
+//   pause N / resume N         -> {"ok":true}
+//   channels N 1,2,10 | all    -> {"ok":true}
+//   transpose N -12            -> {"ok":true}
+//   anything else              -> {"ok":false,"error":"..."}
+//
+// Connections are served on their own threads; commands are handed to the thread that
+// owns the routes, which runs them one at a time.
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ControlCommand {
+    Routes,
+    Pause(usize),
+    Resume(usize),
+    /// Channels 1-16 to forward; empty forwards all
+    Channels(usize, Vec<u8>),
+    Transpose(usize, i8),
+}
+
+impl std::str::FromStr for ControlCommand {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let words: Vec<&str> = s.split_whitespace().collect();
+        let route = |word: &str| {
+            word.parse::<usize>()
+                .ok()
+                .filter(|&n| n > 0)
+                .ok_or_else(|| format!("Invalid route '{}' (expected a number from 1)", word))
+        };
+        match words.as_slice() {
+            ["routes"] => Ok(ControlCommand::Routes),
+            ["pause", n] => Ok(ControlCommand::Pause(route(n)?)),
+            ["resume", n] => Ok(ControlCommand::Resume(route(n)?)),
+            ["channels", n, "all"] => Ok(ControlCommand::Channels(route(n)?, Vec::new())),
+            ["channels", n, list] => {
+                let channels = list
+                    .split(',')
+                    .map(|ch| {
+                        ch.parse::<u8>()
+                            .ok()
+                            .filter(|ch| (1..=16).contains(ch))
+                            .ok_or_else(|| format!("Invalid channel '{}' (expected 1-16)", ch))
+                    })
+                    .collect::<Result<_, _>>()?;
+                Ok(ControlCommand::Channels(route(n)?, channels))
+            }
+            ["transpose", n, semitones] => {
+                let semitones = semitones
+                    .parse::<i8>()
+                    .ok()
+                    .filter(|&t| t != i8::MIN)
+                    .ok_or_else(|| format!("Invalid transpose '{}' (expected -127 to 127)", semitones))?;
+                Ok(ControlCommand::Transpose(route(n)?, semitones))
+            }
+            [] => Err("Empty command".to_string()),
+            [command, ..] => Err(format!(
+                "Unknown command '{}' (expected routes, pause, resume, channels or transpose)",
+                command
+            )),
+        }
+    }
+}
+
+pub fn ok_reply() -> String {
+    "{\"ok\":true}".to_string()
+}
+
+pub fn error_reply(error: &str) -> String {
+    format!("{{\"ok\":false,\"error\":\"{}\"}}", json_escape(error))
+}
+
+/// The answer to `routes`: each route with whether it is paused
+pub fn routes_reply(routes: &[(&Route, bool)]) -> String {
+    let entries: Vec<String> = routes
+        .iter()
+        .enumerate()
+        .map(|(idx, (route, paused))| {
+            let channels: Vec<String> = route.channels.iter().map(u8::to_string).collect();
+            format!(
+                "{{\"route\":{},\"input\":\"{}\",\"output\":\"{}\",\"paused\":{},\"channels\":[{}],\"transpose\":{}}}",
+                idx + 1,
+                json_escape(&route.input),
+                json_escape(&route.output),
+                paused,
+                channels.join(","),
+                route.transpose
+            )
+        })
+        .collect();
+    format!("{{\"ok\":true,\"routes\":[{}]}}", entries.join(","))
+}
+
+/// A command from a client, answered with `reply`
+pub struct ControlRequest {
+    pub command: ControlCommand,
+    reply: Sender<String>,
+}
+
+impl ControlRequest {
+    pub fn reply(self, line: String) {
+        // The client may have gone; nothing is waiting then
+        let _ = self.reply.send(line);
+    }
+}
+
+/// Listens on `path` until `interrupted` is set, passing each command on
+/// A socket file left by an earlier run is replaced; one still answering is an error
+#[cfg(unix)]
+pub fn listen(path: &str, interrupted: Arc<AtomicBool>) -> io::Result<Receiver<ControlRequest>> {
+    use std::os::unix::net::{UnixListener, UnixStream};
+    use std::sync::atomic::Ordering;
+    use std::time::Duration;
+
+    if std::path::Path::new(path).exists() {
+        if UnixStream::connect(path).is_ok() {
+            return Err(io::Error::new(
+                io::ErrorKind::AddrInUse,
+                format!("{} is in use by another process", path),
+            ));
+        }
+        std::fs::remove_file(path)?;
+    }
+    let listener = UnixListener::bind(path)?;
+    listener.set_nonblocking(true)?;
+    info!("Control socket listening on {}", path);
+
+    let (requests, received) = crossbeam::channel::unbounded();
+    let path = path.to_string();
+    std::thread::spawn(move || {
+        while !interrupted.load(Ordering::Relaxed) {
+            match listener.accept() {
+                Ok((stream, _)) => {
+                    let requests = requests.clone();
+                    std::thread::spawn(move || {
+                        if let Err(e) = serve_client(stream, &requests) {
+                            debug!("Control client: {}", e);
+                        }
+                    });
+                }
+                Err(e) if e.kind() == io::ErrorKind::WouldBlock => {
+                    std::thread::sleep(Duration::from_millis(50));
+                }
+                Err(e) => {
+                    debug!("Control socket: {}", e);
+                    break;
+                }
+            }
+        }
+        let _ = std::fs::remove_file(&path);
+    });
+    Ok(received)
+}
+
+#[cfg(not(unix))]
+pub fn listen(_path: &str, _interrupted: Arc<AtomicBool>) -> io::Result<Receiver<ControlRequest>> {
+    Err(io::Error::new(
+        io::ErrorKind::Unsupported,
+        "--control-socket needs Unix domain sockets, which this system doesn't have",
+    ))
+}
+
+/// Answers one line per command until the client disconnects
+#[cfg(unix)]
+fn serve_client(stream: std::os::unix::net::UnixStream, requests: &Sender<ControlRequest>) -> io::Result<()> {
+    use std::io::{BufRead, BufReader, Write};
+
+    stream.set_nonblocking(false)?;
+    let mut writer = stream.try_clone()?;
+    for line in BufReader::new(stream).lines() {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let reply = match line.parse::<ControlCommand>() {
+            Ok(command) => {
+                debug!("Control command: {}", line.trim());
+                let (reply, answer) = crossbeam::channel::bounded(1);
+                if requests.send(ControlRequest { command, reply }).is_err() {
+                    // The routes are shutting down
+                    return Ok(());
+                }
+                answer.recv().unwrap_or_else(|_| error_reply("Shutting down"))
+            }
+            Err(e) => error_reply(&e),
+        };
+        writeln!(writer, "{}", reply)?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_commands() {
+        assert_eq!("routes".parse(), Ok(ControlCommand::Routes));
+        assert_eq!(" pause  2 ".parse(), Ok(ControlCommand::Pause(2)));
+        assert_eq!("resume 1".parse(), Ok(ControlCommand::Resume(1)));
+        assert_eq!("channels 1 1,10".parse(), Ok(ControlCommand::Channels(1, vec![1, 10])));
+        assert_eq!("channels 3 all".parse(), Ok(ControlCommand::Channels(3, vec![])));
+        assert_eq!("transpose 1 -12".parse(), Ok(ControlCommand::Transpose(1, -12)));
+        assert!("pause 0".parse::<ControlCommand>().is_err());
+        assert!("pause".parse::<ControlCommand>().is_err());
+        assert!("channels 1 17".parse::<ControlCommand>().is_err());
+        assert!("transpose 1 -128".parse::<ControlCommand>().is_err());
+        assert!("stop 1".parse::<ControlCommand>().is_err());
+        assert!("".parse::<ControlCommand>().is_err());
+    }
+
+    #[test]
+    fn test_replies() {
+        let route = Route {
+            input: "Launch\"pad".to_string(),
+            output: "IAC".to_string(),
+            channels: vec![1, 2],
+            channel_map: None,
+            transpose: -12,
+        };
+        assert_eq!(
+            routes_reply(&[(&route, true)]),
+            "{\"ok\":true,\"routes\":[{\"route\":1,\"input\":\"Launch\\\"pad\",\"output\":\"IAC\",\
+             \"paused\":true,\"channels\":[1,2],\"transpose\":-12}]}"
+        );
+        assert_eq!(error_reply("No route 3"), "{\"ok\":false,\"error\":\"No route 3\"}");
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_socket_round_trip() {
+        use std::io::{BufRead, BufReader, Write};
+        use std::os::unix::net::UnixStream;
+
+        let path = std::env::temp_dir().join(format!("mc-control-{}.sock", std::process::id()));
+        let path = path.to_string_lossy().into_owned();
+        let interrupted = Arc::new(AtomicBool::new(false));
+        let requests = listen(&path, Arc::clone(&interrupted)).unwrap();
+        let server = std::thread::spawn(move || {
+            let request = requests.recv().unwrap();
+            assert_eq!(request.command, ControlCommand::Pause(1));
+            request.reply(ok_reply());
+        });
+
+        let mut client = UnixStream::connect(&path).unwrap();
+        let mut lines = BufReader::new(client.try_clone().unwrap()).lines();
+        writeln!(client, "bogus").unwrap();
+        assert!(lines.next().unwrap().unwrap().starts_with("{\"ok\":false"));
+        writeln!(client, "pause 1").unwrap();
+        assert_eq!(lines.next().unwrap().unwrap(), ok_reply());
+        server.join().unwrap();
+        interrupted.store(true, std::sync::atomic::Ordering::Relaxed);
+        let _ = std::fs::remove_file(&path);
+    }
+}
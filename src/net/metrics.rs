@@ -0,0 +1,70 @@
+use crate::logging::debug;
+use crate::midi::stats::Metrics;
+use std::io::{self, BufRead, BufReader, Write};
+use std::net::{TcpListener, TcpStream};
+use std::time::Duration;
+
+// Prometheus scrape endpoint for `mc fwd --metrics`: a bare HTTP/1.1 responder that
+// answers `GET /metrics` and closes the connection. Scrapes are handled one at a time.
+
+/// Answers scrapes until the process exits
+pub fn serve(listener: TcpListener, metrics: &Metrics) {
+    for stream in listener.incoming() {
+        let result = stream.and_then(|mut stream| {
+            stream.set_read_timeout(Some(Duration::from_secs(5)))?;
+            respond(&mut stream, metrics)
+        });
+        if let Err(e) = result {
+            debug!("Metrics request failed: {}", e);
+        }
+    }
+}
+
+fn respond(stream: &mut TcpStream, metrics: &Metrics) -> io::Result<()> {
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut request = String::new();
+    reader.read_line(&mut request)?;
+    // Skip the headers; nothing in them changes the response
+    loop {
+        let mut line = String::new();
+        if reader.read_line(&mut line)? == 0 || line.trim_end().is_empty() {
+            break;
+        }
+    }
+
+    let (status, body) = match request_path(&request) {
+        Some("/metrics") => ("200 OK", metrics.render()),
+        Some(_) => ("404 Not Found", "Not found; metrics are at /metrics\n".to_string()),
+        None => ("400 Bad Request", String::new()),
+    };
+    write!(
+        stream,
+        "HTTP/1.1 {}\r\nContent-Type: text/plain; version=0.0.4\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        status,
+        body.len(),
+        body
+    )
+}
+
+/// Path of a GET request line, without any query string
+fn request_path(request_line: &str) -> Option<&str> {
+    let mut parts = request_line.split_whitespace();
+    match (parts.next(), parts.next()) {
+        (Some("GET"), Some(target)) => target.split('?').next(),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_request_path() {
+        assert_eq!(request_path("GET /metrics HTTP/1.1\r\n"), Some("/metrics"));
+        assert_eq!(request_path("GET /metrics?name[]=x HTTP/1.1"), Some("/metrics"));
+        assert_eq!(request_path("GET / HTTP/1.0"), Some("/"));
+        assert_eq!(request_path("POST /metrics HTTP/1.1"), None);
+        assert_eq!(request_path(""), None);
+    }
+}
@@ -0,0 +1,6 @@
+pub mod control;
+pub mod metrics;
+pub mod osc;
+pub mod rtp;
+pub mod udp;
+pub mod ws;
@@ -0,0 +1,457 @@
+// MIDI <-> Open Sound Control mapping for `mc osc-send` / `mc osc-recv`
+//
+// Addresses sit under a configurable prefix (default `/midi`). Channels are 1-16:
+//
+// | address      | arguments                           |
+// |--------------|-------------------------------------|
+// | `/note`      | channel, note, velocity (0 = off)   |
+// | `/polytouch` | channel, note, pressure             |
+// | `/cc`        | channel, controller, value          |
+// | `/program`   | channel, program                    |
+// | `/aftertouch`| channel, pressure                   |
+// | `/pitchbend` | channel, bend (-8192 to 8191)       |
+// | `/sysex`     | blob with the complete F0 ... F7    |
+// | `/raw`       | blob with any other message's bytes |
+//
+// `osc-send --map` sends chosen controllers to their own address instead, as one
+// float scaled from 0-127 into a range.
+
+use std::collections::HashMap;
+
+pub const DEFAULT_PREFIX: &str = "/midi";
+
+/// Characters an OSC address can't contain (they're pattern syntax or separators)
+const RESERVED_ADDRESS_CHARS: &[char] = &[' ', '#', '*', ',', '?', '[', ']', '{', '}'];
+
+/// OSC argument types we send or accept
+#[derive(Debug, Clone, PartialEq)]
+pub enum Arg {
+    Int(i32),
+    Float(f32),
+    Blob(Vec<u8>),
+}
+
+impl Arg {
+    /// Numeric value as an integer; Max and Pd often send floats
+    fn as_int(&self) -> Option<i32> {
+        match self {
+            Arg::Int(value) => Some(*value),
+            Arg::Float(value) => Some(value.round() as i32),
+            Arg::Blob(_) => None,
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct OscMessage {
+    pub address: String,
+    pub args: Vec<Arg>,
+}
+
+/// Appends `bytes` plus NUL padding to a multiple of four (OSC-string rules)
+fn push_padded_string(out: &mut Vec<u8>, bytes: &[u8]) {
+    out.extend_from_slice(bytes);
+    out.push(0);
+    while out.len() % 4 != 0 {
+        out.push(0);
+    }
+}
+
+pub fn encode_message(message: &OscMessage) -> Vec<u8> {
+    let mut out = Vec::new();
+    push_padded_string(&mut out, message.address.as_bytes());
+
+    let tags: String = std::iter::once(',')
+        .chain(message.args.iter().map(|arg| match arg {
+            Arg::Int(_) => 'i',
+            Arg::Float(_) => 'f',
+            Arg::Blob(_) => 'b',
+        }))
+        .collect();
+    push_padded_string(&mut out, tags.as_bytes());
+
+    for arg in &message.args {
+        match arg {
+            Arg::Int(value) => out.extend_from_slice(&value.to_be_bytes()),
+            Arg::Float(value) => out.extend_from_slice(&value.to_be_bytes()),
+            Arg::Blob(bytes) => {
+                out.extend_from_slice(&(bytes.len() as i32).to_be_bytes());
+                out.extend_from_slice(bytes);
+                while out.len() % 4 != 0 {
+                    out.push(0);
+                }
+            }
+        }
+    }
+    out
+}
+
+fn read_string(data: &[u8], pos: &mut usize) -> Result<String, String> {
+    let rest = data.get(*pos..).ok_or("Truncated OSC string")?;
+    let len = rest.iter().position(|&b| b == 0).ok_or("Unterminated OSC string")?;
+    let value = String::from_utf8_lossy(&rest[..len]).into_owned();
+    *pos += (len + 4) & !3;
+    Ok(value)
+}
+
+/// A size prefix, which must not be negative: it comes from the network
+fn read_size(data: &[u8], pos: &mut usize) -> Result<usize, String> {
+    let size = i32::from_be_bytes(read_word(data, pos)?);
+    usize::try_from(size).map_err(|_| format!("Negative OSC size {}", size))
+}
+
+fn read_word(data: &[u8], pos: &mut usize) -> Result<[u8; 4], String> {
+    let word = data.get(*pos..*pos + 4).ok_or("Truncated OSC argument")?;
+    *pos += 4;
+    Ok(word.try_into().unwrap())
+}
+
+/// Parses an OSC packet, flattening bundles into their messages
+/// Bundle time tags are ignored; everything is delivered on arrival.
+pub fn parse_packet(data: &[u8]) -> Result<Vec<OscMessage>, String> {
+    let mut pos = 0;
+    if data.starts_with(b"#bundle\0") {
+        // "#bundle", 8 byte time tag, then size-prefixed elements
+        pos = 16;
+        let mut messages = Vec::new();
+        while pos < data.len() {
+            let size = read_size(data, &mut pos)?;
+            let end = pos.checked_add(size).ok_or("Truncated bundle element")?;
+            let element = data.get(pos..end).ok_or("Truncated bundle element")?;
+            messages.extend(parse_packet(element)?);
+            pos = end;
+        }
+        return Ok(messages);
+    }
+
+    let address = read_string(data, &mut pos)?;
+    if !address.starts_with('/') {
+        return Err(format!("Invalid OSC address '{}'", address));
+    }
+    // Type tags are optional in old implementations; treat a missing list as no arguments
+    let tags = if pos < data.len() { read_string(data, &mut pos)? } else { ",".to_string() };
+
+    let mut args = Vec::new();
+    for tag in tags.chars().skip(1) {
+        args.push(match tag {
+            'i' => Arg::Int(i32::from_be_bytes(read_word(data, &mut pos)?)),
+            'f' => Arg::Float(f32::from_be_bytes(read_word(data, &mut pos)?)),
+            'b' => {
+                let len = read_size(data, &mut pos)?;
+                let end = pos.checked_add(len).ok_or("Truncated OSC blob")?;
+                let bytes = data.get(pos..end).ok_or("Truncated OSC blob")?.to_vec();
+                // Padding to a multiple of 4; `end` is within the packet, so this can't overflow
+                pos = (end + 3) & !3;
+                Arg::Blob(bytes)
+            }
+            other => return Err(format!("Unsupported OSC argument type '{}'", other)),
+        });
+    }
+
+    Ok(vec![OscMessage { address, args }])
+}
+
+/// Maps a MIDI message to its OSC form under `prefix`
+pub fn midi_to_osc(prefix: &str, msg: &[u8]) -> Option<OscMessage> {
+    let status = *msg.first()?;
+    let channel = Arg::Int((status & 0x0F) as i32 + 1);
+    let data = |i: usize| msg.get(i).map(|&b| Arg::Int(b as i32));
+
+    let (name, args) = match status & 0xF0 {
+        0x80 => ("note", vec![channel, data(1)?, Arg::Int(0)]),
+        0x90 => ("note", vec![channel, data(1)?, data(2)?]),
+        0xA0 => ("polytouch", vec![channel, data(1)?, data(2)?]),
+        0xB0 => ("cc", vec![channel, data(1)?, data(2)?]),
+        0xC0 => ("program", vec![channel, data(1)?]),
+        0xD0 => ("aftertouch", vec![channel, data(1)?]),
+        0xE0 => {
+            let value = ((*msg.get(2)? as i32) << 7 | *msg.get(1)? as i32) - 8192;
+            ("pitchbend", vec![channel, Arg::Int(value)])
+        }
+        _ if status == 0xF0 => ("sysex", vec![Arg::Blob(msg.to_vec())]),
+        _ => ("raw", vec![Arg::Blob(msg.to_vec())]),
+    };
+
+    Some(OscMessage {
+        address: format!("{}/{}", prefix, name),
+        args,
+    })
+}
+
+/// Maps an OSC message back to MIDI, None if it isn't one of ours or is out of range
+pub fn osc_to_midi(prefix: &str, message: &OscMessage) -> Option<Vec<u8>> {
+    let name = message.address.strip_prefix(prefix)?.strip_prefix('/')?;
+    if let [Arg::Blob(bytes)] = message.args.as_slice() {
+        return match name {
+            "sysex" | "raw" => Some(bytes.clone()),
+            _ => None,
+        };
+    }
+
+    let ints: Vec<i32> = message.args.iter().map(Arg::as_int).collect::<Option<_>>()?;
+    let channel = match ints.first() {
+        Some(&channel @ 1..=16) => (channel - 1) as u8,
+        _ => return None,
+    };
+    let data = |i: usize| match ints.get(i) {
+        Some(&value @ 0..=127) => Some(value as u8),
+        _ => None,
+    };
+
+    let msg = match (name, ints.len()) {
+        ("note", 3) => match data(2)? {
+            0 => vec![0x80 | channel, data(1)?, 0],
+            velocity => vec![0x90 | channel, data(1)?, velocity],
+        },
+        ("polytouch", 3) => vec![0xA0 | channel, data(1)?, data(2)?],
+        ("cc", 3) => vec![0xB0 | channel, data(1)?, data(2)?],
+        ("program", 2) => vec![0xC0 | channel, data(1)?],
+        ("aftertouch", 2) => vec![0xD0 | channel, data(1)?],
+        ("pitchbend", 2) => {
+            let value = ints[1].checked_add(8192).filter(|v| (0..16384).contains(v))?;
+            vec![0xE0 | channel, (value & 0x7F) as u8, (value >> 7) as u8]
+        }
+        _ => return None,
+    };
+    Some(msg)
+}
+
+/// A `--map` spec: controller `controller` on any channel goes to `address` as a float
+/// from `min` (value 0) to `max` (value 127); `min` may be above `max` to invert
+#[derive(Debug, Clone, PartialEq)]
+pub struct CcMapping {
+    pub controller: u8,
+    pub address: String,
+    pub min: f32,
+    pub max: f32,
+}
+
+impl CcMapping {
+    /// The float sent for a controller value
+    pub fn scale(&self, value: u8) -> f32 {
+        self.min + (self.max - self.min) * value as f32 / 127.0
+    }
+}
+
+impl std::str::FromStr for CcMapping {
+    type Err = String;
+
+    /// Parses `ccN=/address:MIN-MAX`; the range defaults to 0.0-1.0
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = |reason: String| format!("Invalid mapping '{}': {}", s, reason);
+
+        let (controller, target) = s
+            .split_once('=')
+            .ok_or_else(|| invalid("expected ccN=/address:MIN-MAX".to_string()))?;
+        let controller = controller
+            .strip_prefix("cc")
+            .and_then(|n| n.parse::<u8>().ok())
+            .filter(|&n| n <= 127)
+            .ok_or_else(|| invalid(format!("'{}' is not a controller (cc0 to cc127)", controller)))?;
+
+        let (address, range) = match target.split_once(':') {
+            Some((address, range)) => (address, Some(range)),
+            None => (target, None),
+        };
+        if !address.starts_with('/') || address.len() < 2 || address.contains(RESERVED_ADDRESS_CHARS) {
+            return Err(invalid(format!("'{}' is not an OSC address", address)));
+        }
+
+        let (min, max) = match range {
+            None => (0.0, 1.0),
+            Some(range) => {
+                // Skip the first character so a negative minimum isn't taken as the separator
+                let split = range
+                    .char_indices()
+                    .skip(1)
+                    .find(|&(_, c)| c == '-')
+                    .map(|(i, _)| i)
+                    .ok_or_else(|| invalid(format!("range '{}' should be MIN-MAX", range)))?;
+                let bound = |value: &str| {
+                    value
+                        .parse::<f32>()
+                        .ok()
+                        .filter(|v| v.is_finite())
+                        .ok_or_else(|| invalid(format!("'{}' is not a number", value)))
+                };
+                let (min, max) = (bound(&range[..split])?, bound(&range[split + 1..])?);
+                if min == max {
+                    return Err(invalid(format!("range '{}' is empty", range)));
+                }
+                (min, max)
+            }
+        };
+
+        Ok(CcMapping {
+            controller,
+            address: address.to_string(),
+            min,
+            max,
+        })
+    }
+}
+
+/// The mapped form of a Control Change, None if its controller isn't mapped
+pub fn mapped_cc(mappings: &HashMap<u8, CcMapping>, msg: &[u8]) -> Option<OscMessage> {
+    let &[status, controller, value] = msg else {
+        return None;
+    };
+    if status & 0xF0 != 0xB0 {
+        return None;
+    }
+    let mapping = mappings.get(&controller)?;
+    Some(OscMessage {
+        address: mapping.address.clone(),
+        args: vec![Arg::Float(mapping.scale(value))],
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_encode_message() {
+        let message = OscMessage {
+            address: "/midi/cc".to_string(),
+            args: vec![Arg::Int(1), Arg::Int(7), Arg::Int(127)],
+        };
+        let packet = encode_message(&message);
+        assert_eq!(&packet[..12], b"/midi/cc\0\0\0\0");
+        assert_eq!(&packet[12..20], b",iii\0\0\0\0");
+        assert_eq!(&packet[20..], &[0, 0, 0, 1, 0, 0, 0, 7, 0, 0, 0, 127]);
+        assert_eq!(parse_packet(&packet), Ok(vec![message]));
+    }
+
+    #[test]
+    fn test_blob_round_trip() {
+        let message = midi_to_osc(DEFAULT_PREFIX, &[0xF0, 0x7E, 0x7F, 0xF7]).unwrap();
+        assert_eq!(message.address, "/midi/sysex");
+        let packet = encode_message(&message);
+        assert_eq!(packet.len() % 4, 0);
+        assert_eq!(parse_packet(&packet), Ok(vec![message.clone()]));
+        assert_eq!(osc_to_midi(DEFAULT_PREFIX, &message), Some(vec![0xF0, 0x7E, 0x7F, 0xF7]));
+    }
+
+    #[test]
+    fn test_bundle() {
+        let element = encode_message(&OscMessage {
+            address: "/midi/program".to_string(),
+            args: vec![Arg::Int(2), Arg::Int(5)],
+        });
+        let mut bundle = b"#bundle\0".to_vec();
+        bundle.extend_from_slice(&[0, 0, 0, 0, 0, 0, 0, 1]);
+        for _ in 0..2 {
+            bundle.extend_from_slice(&(element.len() as i32).to_be_bytes());
+            bundle.extend_from_slice(&element);
+        }
+        assert_eq!(parse_packet(&bundle).unwrap().len(), 2);
+    }
+
+    #[test]
+    fn test_bad_sizes_rejected() {
+        let bundle = |size: i32| {
+            let mut bundle = b"#bundle\0".to_vec();
+            bundle.extend_from_slice(&[0; 8]);
+            bundle.extend_from_slice(&size.to_be_bytes());
+            bundle.extend_from_slice(b"/x\0\0");
+            bundle
+        };
+        assert!(parse_packet(&bundle(-1)).is_err());
+        assert!(parse_packet(&bundle(i32::MIN)).is_err());
+        assert!(parse_packet(&bundle(64)).is_err());
+        assert!(parse_packet(&bundle(i32::MAX)).is_err());
+
+        let blob = |len: i32| {
+            let mut packet = b"/midi/raw\0\0\0,b\0\0".to_vec();
+            packet.extend_from_slice(&len.to_be_bytes());
+            packet.extend_from_slice(&[0xF8, 0, 0, 0]);
+            packet
+        };
+        assert_eq!(parse_packet(&blob(1)).unwrap()[0].args, vec![Arg::Blob(vec![0xF8])]);
+        assert!(parse_packet(&blob(-1)).is_err());
+        assert!(parse_packet(&blob(-4)).is_err());
+        assert!(parse_packet(&blob(8)).is_err());
+        assert!(parse_packet(&blob(i32::MAX)).is_err());
+    }
+
+    #[test]
+    fn test_midi_mapping_round_trip() {
+        let messages: [&[u8]; 7] = [
+            &[0x90, 60, 100],
+            &[0x81, 60, 0],
+            &[0xA2, 60, 30],
+            &[0xB0, 7, 127],
+            &[0xCF, 5],
+            &[0xD3, 64],
+            &[0xE0, 0x00, 0x40],
+        ];
+        for msg in messages {
+            let osc = midi_to_osc("/synth", msg).unwrap();
+            assert_eq!(osc_to_midi("/synth", &osc).as_deref(), Some(msg), "{:?}", osc);
+        }
+
+        let bend = midi_to_osc("/midi", &[0xE0, 0x7F, 0x7F]).unwrap();
+        assert_eq!(bend.args, vec![Arg::Int(1), Arg::Int(8191)]);
+    }
+
+    #[test]
+    fn test_osc_to_midi_accepts_floats_and_rejects_garbage() {
+        let message = |address: &str, args: Vec<Arg>| OscMessage {
+            address: address.to_string(),
+            args,
+        };
+        assert_eq!(
+            osc_to_midi("/midi", &message("/midi/cc", vec![Arg::Float(1.0), Arg::Float(74.0), Arg::Float(63.6)])),
+            Some(vec![0xB0, 74, 64])
+        );
+        assert_eq!(osc_to_midi("/midi", &message("/midi/cc", vec![Arg::Int(17), Arg::Int(1), Arg::Int(1)])), None);
+        assert_eq!(osc_to_midi("/midi", &message("/midi/cc", vec![Arg::Int(1), Arg::Int(128), Arg::Int(1)])), None);
+        assert_eq!(osc_to_midi("/midi", &message("/other/cc", vec![Arg::Int(1), Arg::Int(1), Arg::Int(1)])), None);
+        assert_eq!(osc_to_midi("/midi", &message("/midicc", vec![Arg::Int(1), Arg::Int(1), Arg::Int(1)])), None);
+    }
+
+    #[test]
+    fn test_parse_cc_mapping() {
+        let mapping: CcMapping = "cc74=/synth/cutoff:0.0-1.0".parse().unwrap();
+        assert_eq!(mapping.controller, 74);
+        assert_eq!(mapping.address, "/synth/cutoff");
+        assert_eq!((mapping.min, mapping.max), (0.0, 1.0));
+
+        let mapping: CcMapping = "cc1=/pan:-1-1".parse().unwrap();
+        assert_eq!((mapping.min, mapping.max), (-1.0, 1.0));
+        let mapping: CcMapping = "cc7=/level".parse().unwrap();
+        assert_eq!((mapping.min, mapping.max), (0.0, 1.0));
+        let mapping: CcMapping = "cc7=/invert:10--10".parse().unwrap();
+        assert_eq!((mapping.min, mapping.max), (10.0, -10.0));
+
+        for spec in [
+            "74=/cutoff",
+            "cc128=/cutoff",
+            "cc74",
+            "cc74=cutoff",
+            "cc74=/",
+            "cc74=/a b",
+            "cc74=/cut*",
+            "cc74=/cutoff:1",
+            "cc74=/cutoff:0-x",
+            "cc74=/cutoff:0.5-0.5",
+            "cc74=/cutoff:0-inf",
+        ] {
+            assert!(spec.parse::<CcMapping>().is_err(), "{}", spec);
+        }
+    }
+
+    #[test]
+    fn test_mapped_cc() {
+        let mapping: CcMapping = "cc74=/synth/cutoff:20-220".parse().unwrap();
+        let mappings = HashMap::from([(74, mapping)]);
+        let osc = mapped_cc(&mappings, &[0xB3, 74, 127]).unwrap();
+        assert_eq!(osc.address, "/synth/cutoff");
+        assert_eq!(osc.args, vec![Arg::Float(220.0)]);
+        assert_eq!(mapped_cc(&mappings, &[0xB0, 74, 0]).unwrap().args, vec![Arg::Float(20.0)]);
+        // Other controllers and messages keep the default mapping
+        assert_eq!(mapped_cc(&mappings, &[0xB0, 1, 64]), None);
+        assert_eq!(mapped_cc(&mappings, &[0x90, 74, 64]), None);
+    }
+}
@@ -0,0 +1,485 @@
+use crate::logging::{debug, info};
+use crate::midi::parser::data_length;
+use std::io;
+use std::net::{SocketAddr, UdpSocket};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+// AppleMIDI (RTP-MIDI, RFC 6295) session support, enough for macOS Network MIDI and
+// iOS apps to connect and exchange messages.
+//
+// A session listens on two consecutive UDP ports: control (P) and data (P + 1). The
+// initiator invites us on both, then keeps the session alive with clock sync exchanges
+// on the data port. MIDI travels on the data port as RTP packets. Only one peer is
+// served at a time, and the recovery journal is neither sent nor read, so packets lost
+// on the network are simply lost.
+
+/// Marks AppleMIDI control packets (never a valid RTP header)
+const SIGNATURE: [u8; 2] = [0xFF, 0xFF];
+const PROTOCOL_VERSION: u32 = 2;
+/// RTP payload type conventionally used for MIDI
+const PAYLOAD_TYPE: u8 = 0x61;
+const RTP_HEADER_LEN: usize = 12;
+
+/// An AppleMIDI control packet
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Control {
+    /// `IN`: the peer asks to join a session
+    Invitation { token: u32, ssrc: u32, name: String },
+    /// `OK`: an invitation was accepted
+    Accepted { token: u32, ssrc: u32, name: String },
+    /// `NO`: an invitation was rejected
+    Rejected { token: u32, ssrc: u32 },
+    /// `BY`: the peer is leaving
+    End { ssrc: u32 },
+    /// `CK`: clock sync; `count` says which of the three timestamps are filled in
+    Sync { ssrc: u32, count: u8, timestamps: [u64; 3] },
+    /// `RS`: receiver feedback (journal acknowledgement); nothing to do without a journal
+    Feedback { ssrc: u32, seq: u16 },
+}
+
+fn read_u32(data: &[u8], pos: usize) -> Option<u32> {
+    Some(u32::from_be_bytes(data.get(pos..pos + 4)?.try_into().ok()?))
+}
+
+fn read_u64(data: &[u8], pos: usize) -> Option<u64> {
+    Some(u64::from_be_bytes(data.get(pos..pos + 8)?.try_into().ok()?))
+}
+
+/// Name that follows an invitation, NUL terminated
+fn read_name(data: &[u8]) -> String {
+    let end = data.iter().position(|&b| b == 0).unwrap_or(data.len());
+    String::from_utf8_lossy(&data[..end]).into_owned()
+}
+
+/// Parses a control packet, None for anything else (including RTP data)
+pub fn parse_control(data: &[u8]) -> Option<Control> {
+    if data.len() < 4 || data[..2] != SIGNATURE {
+        return None;
+    }
+
+    match &data[2..4] {
+        b"IN" | b"OK" | b"NO" | b"BY" => {
+            // version, initiator token, ssrc, then an optional name
+            let token = read_u32(data, 8)?;
+            let ssrc = read_u32(data, 12)?;
+            let name = data.get(16..).map(read_name).unwrap_or_default();
+            Some(match &data[2..4] {
+                b"IN" => Control::Invitation { token, ssrc, name },
+                b"OK" => Control::Accepted { token, ssrc, name },
+                b"NO" => Control::Rejected { token, ssrc },
+                _ => Control::End { ssrc },
+            })
+        }
+        b"CK" => Some(Control::Sync {
+            ssrc: read_u32(data, 4)?,
+            count: *data.get(8)?,
+            timestamps: [read_u64(data, 12)?, read_u64(data, 20)?, read_u64(data, 28)?],
+        }),
+        b"RS" => Some(Control::Feedback {
+            ssrc: read_u32(data, 4)?,
+            seq: (read_u32(data, 8)? >> 16) as u16,
+        }),
+        _ => None,
+    }
+}
+
+pub fn encode_control(control: &Control) -> Vec<u8> {
+    let mut packet = SIGNATURE.to_vec();
+    let mut session = |command: &[u8], token: u32, ssrc: u32, name: Option<&str>| {
+        packet.extend_from_slice(command);
+        packet.extend_from_slice(&PROTOCOL_VERSION.to_be_bytes());
+        packet.extend_from_slice(&token.to_be_bytes());
+        packet.extend_from_slice(&ssrc.to_be_bytes());
+        if let Some(name) = name {
+            packet.extend_from_slice(name.as_bytes());
+            packet.push(0);
+        }
+    };
+
+    match control {
+        Control::Invitation { token, ssrc, name } => session(b"IN", *token, *ssrc, Some(name)),
+        Control::Accepted { token, ssrc, name } => session(b"OK", *token, *ssrc, Some(name)),
+        Control::Rejected { token, ssrc } => session(b"NO", *token, *ssrc, None),
+        Control::End { ssrc } => session(b"BY", 0, *ssrc, None),
+        Control::Sync { ssrc, count, timestamps } => {
+            packet.extend_from_slice(b"CK");
+            packet.extend_from_slice(&ssrc.to_be_bytes());
+            packet.extend_from_slice(&[*count, 0, 0, 0]);
+            for timestamp in timestamps {
+                packet.extend_from_slice(&timestamp.to_be_bytes());
+            }
+        }
+        Control::Feedback { ssrc, seq } => {
+            packet.extend_from_slice(b"RS");
+            packet.extend_from_slice(&ssrc.to_be_bytes());
+            packet.extend_from_slice(&((*seq as u32) << 16).to_be_bytes());
+        }
+    }
+    packet
+}
+
+/// Builds an RTP-MIDI packet carrying one message, without a journal
+pub fn encode_midi_packet(seq: u16, timestamp: u32, ssrc: u32, message: &[u8]) -> Vec<u8> {
+    let mut packet = Vec::with_capacity(RTP_HEADER_LEN + 2 + message.len());
+    packet.extend_from_slice(&[0x80, PAYLOAD_TYPE]);
+    packet.extend_from_slice(&seq.to_be_bytes());
+    packet.extend_from_slice(&timestamp.to_be_bytes());
+    packet.extend_from_slice(&ssrc.to_be_bytes());
+
+    // Command section header: short form holds up to 15 bytes, long form (B flag) 4095
+    if message.len() <= 0x0F {
+        packet.push(message.len() as u8);
+    } else {
+        let len = message.len().min(0x0FFF);
+        packet.push(0x80 | (len >> 8) as u8);
+        packet.push(len as u8);
+    }
+    packet.extend_from_slice(&message[..message.len().min(0x0FFF)]);
+    packet
+}
+
+/// Reads a command list delta time (1-4 bytes, 7 bits each)
+fn skip_delta_time(list: &[u8], pos: &mut usize) -> Result<(), String> {
+    for _ in 0..4 {
+        let byte = *list.get(*pos).ok_or("Truncated delta time")?;
+        *pos += 1;
+        if byte & 0x80 == 0 {
+            return Ok(());
+        }
+    }
+    Err("Delta time too long".to_string())
+}
+
+/// Extracts the MIDI messages from an RTP-MIDI packet's command list
+/// Running status is resolved, so every returned message starts with its status byte.
+/// Only SysEx that fits in one packet is supported.
+pub fn parse_midi_packet(data: &[u8]) -> Result<Vec<Vec<u8>>, String> {
+    if data.len() < RTP_HEADER_LEN + 1 || data[0] >> 6 != 2 {
+        return Err("Not an RTP packet".to_string());
+    }
+    let csrc_count = (data[0] & 0x0F) as usize;
+    let mut pos = RTP_HEADER_LEN + 4 * csrc_count;
+
+    let flags = *data.get(pos).ok_or("Missing MIDI command section")?;
+    let mut len = (flags & 0x0F) as usize;
+    pos += 1;
+    if flags & 0x80 != 0 {
+        len = (len << 8) | *data.get(pos).ok_or("Truncated command section header")? as usize;
+        pos += 1;
+    }
+    // Z flag: the first command has a delta time too
+    let first_has_delta = flags & 0x20 != 0;
+    let list = data.get(pos..pos + len).ok_or("Truncated command list")?;
+
+    let mut messages = Vec::new();
+    let mut running_status = None;
+    let mut pos = 0;
+    while pos < list.len() {
+        if !messages.is_empty() || first_has_delta {
+            skip_delta_time(list, &mut pos)?;
+        }
+
+        let mut message = Vec::new();
+        let status = match list.get(pos) {
+            Some(&byte) if byte >= 0x80 => {
+                pos += 1;
+                byte
+            }
+            Some(_) => running_status.ok_or("Data byte without running status")?,
+            None => return Err("Delta time without a command".to_string()),
+        };
+        message.push(status);
+
+        match data_length(status) {
+            Some(count) => {
+                let bytes = list.get(pos..pos + count).ok_or("Truncated command")?;
+                message.extend_from_slice(bytes);
+                pos += count;
+            }
+            None => {
+                let end = list[pos..]
+                    .iter()
+                    .position(|&b| b == 0xF7)
+                    .ok_or("SysEx split across packets is not supported")?;
+                message.extend_from_slice(&list[pos..=pos + end]);
+                pos += end + 1;
+            }
+        }
+
+        match status {
+            0x80..=0xEF => running_status = Some(status),
+            // Realtime leaves running status alone; system common cancels it
+            0xF0..=0xF7 => running_status = None,
+            _ => {}
+        }
+        messages.push(message);
+    }
+
+    Ok(messages)
+}
+
+/// The remote end of a session
+#[derive(Debug, Clone)]
+struct Peer {
+    ssrc: u32,
+    name: String,
+    control: SocketAddr,
+    /// Known once the data port invitation arrives
+    data: Option<SocketAddr>,
+}
+
+/// Shared between the receive loop and every `Sender`
+struct State {
+    ssrc: u32,
+    start: Instant,
+    peer: Mutex<Option<Peer>>,
+}
+
+impl State {
+    /// Session clock in 100 microsecond units, as AppleMIDI expects
+    fn now(&self) -> u64 {
+        (self.start.elapsed().as_micros() / 100) as u64
+    }
+}
+
+/// A listening AppleMIDI session on a control/data port pair
+pub struct Session {
+    name: String,
+    control: UdpSocket,
+    data: UdpSocket,
+    state: Arc<State>,
+}
+
+impl Session {
+    /// Binds the control port and the data port right after it
+    pub fn bind(name: &str, port: u16) -> io::Result<Self> {
+        let control = UdpSocket::bind(("0.0.0.0", port))?;
+        let data = UdpSocket::bind(("0.0.0.0", port.wrapping_add(1)))?;
+        // Short timeouts so `poll` can alternate between the sockets
+        control.set_read_timeout(Some(Duration::from_millis(10)))?;
+        data.set_read_timeout(Some(Duration::from_millis(10)))?;
+
+        // No RNG dependency; the SSRC only has to differ from the peer's
+        let nanos = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .map(|d| d.subsec_nanos())
+            .unwrap_or(0);
+        let ssrc = std::process::id().rotate_left(16) ^ nanos;
+
+        Ok(Self {
+            name: name.to_string(),
+            control,
+            data,
+            state: Arc::new(State {
+                ssrc,
+                start: Instant::now(),
+                peer: Mutex::new(None),
+            }),
+        })
+    }
+
+    /// Handle for sending MIDI to the peer from another thread
+    pub fn sender(&self) -> io::Result<Sender> {
+        Ok(Sender {
+            data: self.data.try_clone()?,
+            state: Arc::clone(&self.state),
+            seq: 0,
+        })
+    }
+
+    /// Waits briefly for packets on both ports, answering control traffic and passing
+    /// received MIDI messages to `deliver`
+    pub fn poll(&mut self, deliver: &mut dyn FnMut(&[u8])) -> io::Result<()> {
+        let mut buffer = [0u8; 2048];
+        for is_data in [false, true] {
+            let socket = if is_data { &self.data } else { &self.control };
+            let (len, from) = match socket.recv_from(&mut buffer) {
+                Ok(received) => received,
+                Err(e) if matches!(e.kind(), io::ErrorKind::WouldBlock | io::ErrorKind::TimedOut) => continue,
+                Err(e) => return Err(e),
+            };
+            let packet = &buffer[..len];
+
+            match parse_control(packet) {
+                Some(control) => self.handle_control(control, from, is_data)?,
+                None if is_data => {
+                    if !self.is_peer(from) {
+                        continue;
+                    }
+                    match parse_midi_packet(packet) {
+                        Ok(messages) => messages.iter().for_each(|m| deliver(m)),
+                        Err(e) => debug!("Ignoring RTP packet from {}: {}", from, e),
+                    }
+                }
+                None => {}
+            }
+        }
+        Ok(())
+    }
+
+    fn is_peer(&self, from: SocketAddr) -> bool {
+        let peer = self.state.peer.lock().unwrap();
+        peer.as_ref().map_or(false, |p| p.data == Some(from))
+    }
+
+    fn handle_control(&mut self, control: Control, from: SocketAddr, is_data: bool) -> io::Result<()> {
+        let socket = if is_data { &self.data } else { &self.control };
+        let ssrc = self.state.ssrc;
+        let mut peer = self.state.peer.lock().unwrap();
+
+        match control {
+            Control::Invitation { token, ssrc: peer_ssrc, name } => {
+                let reply = match peer.as_mut() {
+                    // Data port invitation completing the handshake
+                    Some(p) if p.ssrc == peer_ssrc && is_data => {
+                        p.data = Some(from);
+                        info!("RTP-MIDI session with {} ({}) established", p.name, from.ip());
+                        Control::Accepted { token, ssrc, name: self.name.clone() }
+                    }
+                    // Re-invitation on the control port, e.g. after the peer restarted
+                    Some(p) if p.ssrc == peer_ssrc || p.control == from => {
+                        *p = Peer { ssrc: peer_ssrc, name, control: from, data: None };
+                        Control::Accepted { token, ssrc, name: self.name.clone() }
+                    }
+                    Some(p) => {
+                        info!("Rejecting invitation from {} ({}): already connected to {}", name, from, p.name);
+                        Control::Rejected { token, ssrc }
+                    }
+                    None if !is_data => {
+                        info!("Invitation from {} ({})", name, from);
+                        *peer = Some(Peer { ssrc: peer_ssrc, name, control: from, data: None });
+                        Control::Accepted { token, ssrc, name: self.name.clone() }
+                    }
+                    // Data invitation without a control one first
+                    None => Control::Rejected { token, ssrc },
+                };
+                socket.send_to(&encode_control(&reply), from)?;
+            }
+            Control::Sync { ssrc: peer_ssrc, count, mut timestamps } => {
+                if peer.as_ref().map_or(true, |p| p.ssrc != peer_ssrc) {
+                    return Ok(());
+                }
+                // Answer the initiator's first and second timestamps; the third ends the round
+                if count < 2 {
+                    timestamps[count as usize + 1] = self.state.now();
+                    let reply = Control::Sync { ssrc, count: count + 1, timestamps };
+                    socket.send_to(&encode_control(&reply), from)?;
+                }
+            }
+            Control::End { ssrc: peer_ssrc } => {
+                if let Some(p) = peer.as_ref().filter(|p| p.ssrc == peer_ssrc) {
+                    info!("RTP-MIDI session with {} ended", p.name);
+                    *peer = None;
+                }
+            }
+            Control::Accepted { .. } | Control::Rejected { .. } | Control::Feedback { .. } => {}
+        }
+        Ok(())
+    }
+
+    /// Tells the peer we're leaving
+    pub fn close(self) {
+        if let Some(peer) = self.state.peer.lock().unwrap().take() {
+            let bye = encode_control(&Control::End { ssrc: self.state.ssrc });
+            let _ = self.control.send_to(&bye, peer.control);
+        }
+    }
+}
+
+/// Sends MIDI messages to the session's peer; messages are dropped while nobody is connected
+pub struct Sender {
+    data: UdpSocket,
+    state: Arc<State>,
+    seq: u16,
+}
+
+impl Sender {
+    pub fn send(&mut self, message: &[u8]) -> io::Result<()> {
+        let target = match self.state.peer.lock().unwrap().as_ref().and_then(|p| p.data) {
+            Some(target) => target,
+            None => return Ok(()),
+        };
+        let packet = encode_midi_packet(self.seq, self.state.now() as u32, self.state.ssrc, message);
+        self.seq = self.seq.wrapping_add(1);
+        self.data.send_to(&packet, target)?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_invitation_round_trip() {
+        let invitation = Control::Invitation {
+            token: 0x1234_5678,
+            ssrc: 42,
+            name: "iPad".to_string(),
+        };
+        let packet = encode_control(&invitation);
+        assert_eq!(&packet[..4], b"\xFF\xFFIN");
+        assert_eq!(&packet[4..8], &[0, 0, 0, 2]);
+        assert_eq!(packet.last(), Some(&0));
+        assert_eq!(parse_control(&packet), Some(invitation));
+    }
+
+    #[test]
+    fn test_sync_round_trip() {
+        let sync = Control::Sync {
+            ssrc: 7,
+            count: 1,
+            timestamps: [100, 200, 0],
+        };
+        let packet = encode_control(&sync);
+        assert_eq!(packet.len(), 36);
+        assert_eq!(parse_control(&packet), Some(sync));
+    }
+
+    #[test]
+    fn test_rtp_is_not_control() {
+        assert_eq!(parse_control(&encode_midi_packet(1, 2, 3, &[0x90, 60, 100])), None);
+    }
+
+    #[test]
+    fn test_midi_packet_round_trip() {
+        let packet = encode_midi_packet(9, 1000, 5, &[0x90, 60, 100]);
+        assert_eq!(packet[1], PAYLOAD_TYPE);
+        assert_eq!(parse_midi_packet(&packet), Ok(vec![vec![0x90, 60, 100]]));
+
+        let sysex: Vec<u8> = [0xF0].into_iter().chain(0..20).chain([0xF7]).collect();
+        let packet = encode_midi_packet(10, 1000, 5, &sysex);
+        assert_eq!(parse_midi_packet(&packet), Ok(vec![sysex]));
+    }
+
+    #[test]
+    fn test_command_list_with_delta_times_and_running_status() {
+        let mut packet = encode_midi_packet(1, 0, 5, &[]);
+        packet.pop();
+        // Note On, delta 0, running status Note On, delta 0x81 0x00, clock, delta 0, CC
+        let list = [0x90, 60, 100, 0x00, 64, 90, 0x81, 0x00, 0xF8, 0x00, 67, 80, 0x00, 0xB0, 7, 127];
+        // Long form header (B flag), since the list is more than 15 bytes
+        packet.extend_from_slice(&[0x80, list.len() as u8]);
+        packet.extend_from_slice(&list);
+
+        assert_eq!(
+            parse_midi_packet(&packet),
+            Ok(vec![
+                vec![0x90, 60, 100],
+                vec![0x90, 64, 90],
+                vec![0xF8],
+                vec![0x90, 67, 80],
+                vec![0xB0, 7, 127],
+            ])
+        );
+    }
+
+    #[test]
+    fn test_rejects_malformed_packets() {
+        assert!(parse_midi_packet(&[0xFF, 0xFF, b'I', b'N']).is_err());
+        let mut packet = encode_midi_packet(1, 0, 5, &[0x90, 60, 100]);
+        packet.pop();
+        assert!(parse_midi_packet(&packet).is_err());
+    }
+}
@@ -0,0 +1,147 @@
+// Datagram format for `mc net-send` / `mc net-recv`, one MIDI message per datagram:
+//
+// | bytes | field                                         |
+// |-------|-----------------------------------------------|
+// | 4     | sequence number (big endian, wraps)           |
+// | 8     | sender timestamp in microseconds (big endian) |
+// | 2     | message length (big endian)                   |
+// | n     | raw MIDI message                              |
+
+/// Size of everything before the message bytes
+pub const HEADER_LEN: usize = 14;
+
+/// A decoded datagram
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Packet {
+    pub seq: u32,
+    pub timestamp_us: u64,
+    pub message: Vec<u8>,
+}
+
+/// Largest message that fits one datagram: the IPv4 UDP payload limit less the header,
+/// which also keeps the length within its 16 bits
+pub const MAX_MESSAGE_LEN: usize = 65_507 - HEADER_LEN;
+
+/// Fails for a message longer than `MAX_MESSAGE_LEN` (only a SysEx dump can be)
+pub fn encode_packet(seq: u32, timestamp_us: u64, message: &[u8]) -> Result<Vec<u8>, String> {
+    if message.len() > MAX_MESSAGE_LEN {
+        return Err(format!(
+            "{} byte message doesn't fit a datagram (at most {} bytes)",
+            message.len(),
+            MAX_MESSAGE_LEN
+        ));
+    }
+    let mut packet = Vec::with_capacity(HEADER_LEN + message.len());
+    packet.extend_from_slice(&seq.to_be_bytes());
+    packet.extend_from_slice(&timestamp_us.to_be_bytes());
+    packet.extend_from_slice(&(message.len() as u16).to_be_bytes());
+    packet.extend_from_slice(message);
+    Ok(packet)
+}
+
+pub fn decode_packet(data: &[u8]) -> Result<Packet, String> {
+    if data.len() < HEADER_LEN {
+        return Err(format!("Datagram too short ({} bytes)", data.len()));
+    }
+    let seq = u32::from_be_bytes(data[0..4].try_into().unwrap());
+    let timestamp_us = u64::from_be_bytes(data[4..12].try_into().unwrap());
+    let len = u16::from_be_bytes(data[12..14].try_into().unwrap()) as usize;
+    let message = data
+        .get(HEADER_LEN..HEADER_LEN + len)
+        .ok_or_else(|| format!("Datagram truncated (expected {} message bytes)", len))?;
+
+    Ok(Packet {
+        seq,
+        timestamp_us,
+        message: message.to_vec(),
+    })
+}
+
+/// Tracks sequence numbers on the receiving side to spot lost or reordered datagrams
+#[derive(Debug, Default)]
+pub struct SequenceTracker {
+    expected: Option<u32>,
+}
+
+/// What a received sequence number says about the stream
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Sequence {
+    InOrder,
+    /// This many datagrams were skipped
+    Dropped(u32),
+    /// Arrived after a later datagram
+    Late,
+}
+
+impl SequenceTracker {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn observe(&mut self, seq: u32) -> Sequence {
+        let result = match self.expected {
+            None => Sequence::InOrder,
+            Some(expected) if seq == expected => Sequence::InOrder,
+            // Distance forward with wrap-around; a "huge" gap is really a late packet
+            Some(expected) => match seq.wrapping_sub(expected) {
+                gap if gap < u32::MAX / 2 => Sequence::Dropped(gap),
+                _ => return Sequence::Late,
+            },
+        };
+        self.expected = Some(seq.wrapping_add(1));
+        result
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_round_trip() {
+        let packet = encode_packet(7, 123_456, &[0x90, 60, 100]).unwrap();
+        assert_eq!(packet.len(), HEADER_LEN + 3);
+        assert_eq!(
+            decode_packet(&packet),
+            Ok(Packet {
+                seq: 7,
+                timestamp_us: 123_456,
+                message: vec![0x90, 60, 100],
+            })
+        );
+    }
+
+    #[test]
+    fn test_decode_rejects_short_packets() {
+        assert!(decode_packet(&[0; 4]).is_err());
+        let mut packet = encode_packet(1, 0, &[0xF0, 0x7E, 0xF7]).unwrap();
+        packet.truncate(packet.len() - 1);
+        assert!(decode_packet(&packet).is_err());
+    }
+
+    #[test]
+    fn test_encode_rejects_oversized_messages() {
+        let largest = vec![0; MAX_MESSAGE_LEN];
+        let packet = encode_packet(1, 0, &largest).unwrap();
+        assert_eq!(decode_packet(&packet).unwrap().message.len(), MAX_MESSAGE_LEN);
+        assert!(encode_packet(1, 0, &vec![0; MAX_MESSAGE_LEN + 1]).is_err());
+        assert!(encode_packet(1, 0, &vec![0; u16::MAX as usize + 1]).is_err());
+    }
+
+    #[test]
+    fn test_sequence_tracking() {
+        let mut tracker = SequenceTracker::new();
+        assert_eq!(tracker.observe(10), Sequence::InOrder);
+        assert_eq!(tracker.observe(11), Sequence::InOrder);
+        assert_eq!(tracker.observe(14), Sequence::Dropped(2));
+        assert_eq!(tracker.observe(13), Sequence::Late);
+        assert_eq!(tracker.observe(15), Sequence::InOrder);
+    }
+
+    #[test]
+    fn test_sequence_wraps() {
+        let mut tracker = SequenceTracker::new();
+        tracker.observe(u32::MAX);
+        assert_eq!(tracker.observe(0), Sequence::InOrder);
+    }
+}
@@ -0,0 +1,377 @@
+use crate::logging::{debug, info};
+use std::io::{self, BufRead, BufReader, Read, Write};
+use std::net::{Shutdown, TcpListener, TcpStream};
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+// A small WebSocket server (RFC 6455) for `mc ws`: just the handshake, unfragmented
+// text frames, ping/pong and close. Enough for browsers; no extensions or TLS.
+
+const HANDSHAKE_GUID: &str = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11";
+
+/// Largest client frame we accept; clients only send single MIDI messages
+const MAX_FRAME_LEN: u64 = 64 * 1024;
+
+const OP_CONTINUATION: u8 = 0x0;
+const OP_TEXT: u8 = 0x1;
+const OP_BINARY: u8 = 0x2;
+const OP_CLOSE: u8 = 0x8;
+const OP_PING: u8 = 0x9;
+const OP_PONG: u8 = 0xA;
+
+/// SHA-1, needed only for `Sec-WebSocket-Accept`
+fn sha1(data: &[u8]) -> [u8; 20] {
+    let mut h: [u32; 5] = [0x6745_2301, 0xEFCD_AB89, 0x98BA_DCFE, 0x1032_5476, 0xC3D2_E1F0];
+
+    let mut message = data.to_vec();
+    message.push(0x80);
+    while message.len() % 64 != 56 {
+        message.push(0);
+    }
+    message.extend_from_slice(&((data.len() as u64) * 8).to_be_bytes());
+
+    for block in message.chunks(64) {
+        let mut w = [0u32; 80];
+        for i in 0..16 {
+            w[i] = u32::from_be_bytes(block[i * 4..i * 4 + 4].try_into().unwrap());
+        }
+        for i in 16..80 {
+            w[i] = (w[i - 3] ^ w[i - 8] ^ w[i - 14] ^ w[i - 16]).rotate_left(1);
+        }
+
+        let [mut a, mut b, mut c, mut d, mut e] = h;
+        for (i, word) in w.iter().enumerate() {
+            let (f, k) = match i {
+                0..=19 => ((b & c) | (!b & d), 0x5A82_7999),
+                20..=39 => (b ^ c ^ d, 0x6ED9_EBA1),
+                40..=59 => ((b & c) | (b & d) | (c & d), 0x8F1B_BCDC),
+                _ => (b ^ c ^ d, 0xCA62_C1D6),
+            };
+            let temp = a.rotate_left(5).wrapping_add(f).wrapping_add(e).wrapping_add(k).wrapping_add(*word);
+            e = d;
+            d = c;
+            c = b.rotate_left(30);
+            b = a;
+            a = temp;
+        }
+        for (state, value) in h.iter_mut().zip([a, b, c, d, e]) {
+            *state = state.wrapping_add(value);
+        }
+    }
+
+    let mut digest = [0u8; 20];
+    for (chunk, word) in digest.chunks_mut(4).zip(h) {
+        chunk.copy_from_slice(&word.to_be_bytes());
+    }
+    digest
+}
+
+fn base64(data: &[u8]) -> String {
+    const ALPHABET: &[u8] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+    let mut out = String::new();
+    for chunk in data.chunks(3) {
+        let n = chunk.iter().enumerate().fold(0u32, |n, (i, &b)| n | (b as u32) << (16 - 8 * i));
+        for i in 0..4 {
+            if i <= chunk.len() {
+                out.push(ALPHABET[(n >> (18 - 6 * i) & 0x3F) as usize] as char);
+            } else {
+                out.push('=');
+            }
+        }
+    }
+    out
+}
+
+/// Value for the `Sec-WebSocket-Accept` response header
+pub fn accept_key(key: &str) -> String {
+    base64(&sha1(format!("{}{}", key.trim(), HANDSHAKE_GUID).as_bytes()))
+}
+
+/// Reads the HTTP upgrade request and answers it
+fn handshake(stream: &mut TcpStream) -> io::Result<()> {
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut key = None;
+    loop {
+        let mut line = String::new();
+        if reader.read_line(&mut line)? == 0 {
+            return Err(io::Error::new(io::ErrorKind::UnexpectedEof, "connection closed during handshake"));
+        }
+        let line = line.trim_end();
+        if line.is_empty() {
+            break;
+        }
+        if let Some((name, value)) = line.split_once(':') {
+            if name.eq_ignore_ascii_case("sec-websocket-key") {
+                key = Some(value.trim().to_string());
+            }
+        }
+    }
+
+    match key {
+        Some(key) => write!(
+            stream,
+            "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: {}\r\n\r\n",
+            accept_key(&key)
+        ),
+        None => {
+            write!(stream, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")?;
+            Err(io::Error::new(io::ErrorKind::InvalidData, "not a WebSocket request"))
+        }
+    }
+}
+
+/// Builds an unmasked (server to client) frame
+pub fn encode_frame(opcode: u8, payload: &[u8]) -> Vec<u8> {
+    let mut frame = vec![0x80 | opcode];
+    match payload.len() {
+        len @ 0..=125 => frame.push(len as u8),
+        len @ 126..=0xFFFF => {
+            frame.push(126);
+            frame.extend_from_slice(&(len as u16).to_be_bytes());
+        }
+        len => {
+            frame.push(127);
+            frame.extend_from_slice(&(len as u64).to_be_bytes());
+        }
+    }
+    frame.extend_from_slice(payload);
+    frame
+}
+
+/// A frame received from a client
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Frame {
+    pub fin: bool,
+    pub opcode: u8,
+    pub payload: Vec<u8>,
+}
+
+/// Reads one frame, unmasking the payload
+pub fn read_frame<R: Read>(reader: &mut R) -> io::Result<Frame> {
+    let mut header = [0u8; 2];
+    reader.read_exact(&mut header)?;
+    let fin = header[0] & 0x80 != 0;
+    let opcode = header[0] & 0x0F;
+    let masked = header[1] & 0x80 != 0;
+
+    let len = match header[1] & 0x7F {
+        126 => {
+            let mut bytes = [0u8; 2];
+            reader.read_exact(&mut bytes)?;
+            u16::from_be_bytes(bytes) as u64
+        }
+        127 => {
+            let mut bytes = [0u8; 8];
+            reader.read_exact(&mut bytes)?;
+            u64::from_be_bytes(bytes)
+        }
+        len => len as u64,
+    };
+    if len > MAX_FRAME_LEN {
+        return Err(io::Error::new(io::ErrorKind::InvalidData, format!("frame too large ({} bytes)", len)));
+    }
+
+    let mut mask = [0u8; 4];
+    if masked {
+        reader.read_exact(&mut mask)?;
+    }
+    let mut payload = vec![0u8; len as usize];
+    reader.read_exact(&mut payload)?;
+    if masked {
+        for (i, byte) in payload.iter_mut().enumerate() {
+            *byte ^= mask[i % 4];
+        }
+    }
+
+    Ok(Frame { fin, opcode, payload })
+}
+
+struct Client {
+    id: u64,
+    stream: TcpStream,
+}
+
+/// The connected clients, shared between the accept loop, readers and broadcasters
+#[derive(Clone, Default)]
+pub struct Clients {
+    clients: Arc<Mutex<Vec<Client>>>,
+}
+
+impl Clients {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Sends a text frame to every client, dropping those that can't keep up or are gone
+    pub fn broadcast(&self, text: &str) {
+        let frame = encode_frame(OP_TEXT, text.as_bytes());
+        if let Ok(mut clients) = self.clients.lock() {
+            clients.retain_mut(|client| match client.stream.write_all(&frame) {
+                Ok(()) => true,
+                Err(e) => {
+                    debug!("Dropping WebSocket client {}: {}", client.id, e);
+                    let _ = client.stream.shutdown(Shutdown::Both);
+                    false
+                }
+            });
+        }
+    }
+
+    fn add(&self, id: u64, stream: TcpStream) {
+        if let Ok(mut clients) = self.clients.lock() {
+            clients.push(Client { id, stream });
+        }
+    }
+
+    fn remove(&self, id: u64) {
+        if let Ok(mut clients) = self.clients.lock() {
+            clients.retain(|client| client.id != id);
+        }
+    }
+
+    /// Sends a close frame to every client and disconnects them
+    pub fn close_all(&self) {
+        if let Ok(mut clients) = self.clients.lock() {
+            for client in clients.iter_mut() {
+                let _ = client.stream.write_all(&encode_frame(OP_CLOSE, &1001u16.to_be_bytes()));
+                let _ = client.stream.shutdown(Shutdown::Both);
+            }
+            clients.clear();
+        }
+    }
+}
+
+/// Handles messages received from clients
+pub type OnText = Arc<dyn Fn(&str) + Send + Sync>;
+
+/// Accepts clients until `interrupted` is set
+/// Each client gets a reader thread; text frames are passed to `on_text`
+pub fn serve(listener: TcpListener, clients: &Clients, on_text: OnText, interrupted: &AtomicBool) -> io::Result<()> {
+    static NEXT_ID: AtomicU64 = AtomicU64::new(1);
+
+    listener.set_nonblocking(true)?;
+    while !interrupted.load(Ordering::Relaxed) {
+        let (mut stream, peer) = match listener.accept() {
+            Ok(accepted) => accepted,
+            Err(e) if e.kind() == io::ErrorKind::WouldBlock => {
+                std::thread::sleep(Duration::from_millis(50));
+                continue;
+            }
+            Err(e) => return Err(e),
+        };
+
+        let clients = clients.clone();
+        let on_text = Arc::clone(&on_text);
+        std::thread::spawn(move || {
+            let id = NEXT_ID.fetch_add(1, Ordering::Relaxed);
+            let setup = stream
+                .set_nonblocking(false)
+                // Broadcasts run in the MIDI callback, so a stalled client must not block it for long
+                .and_then(|_| stream.set_write_timeout(Some(Duration::from_millis(100))))
+                .and_then(|_| handshake(&mut stream))
+                .and_then(|_| stream.try_clone());
+            let writer = match setup {
+                Ok(writer) => writer,
+                Err(e) => {
+                    debug!("WebSocket handshake with {} failed: {}", peer, e);
+                    return;
+                }
+            };
+
+            info!("WebSocket client {} connected", peer);
+            clients.add(id, writer);
+            if let Err(e) = read_client(&mut stream, &clients, id, &on_text) {
+                debug!("WebSocket client {}: {}", peer, e);
+            }
+            clients.remove(id);
+            let _ = stream.shutdown(Shutdown::Both);
+            info!("WebSocket client {} disconnected", peer);
+        });
+    }
+    Ok(())
+}
+
+/// Reads frames until the client closes the connection
+fn read_client(stream: &mut TcpStream, clients: &Clients, id: u64, on_text: &OnText) -> io::Result<()> {
+    let reply = |opcode: u8, payload: &[u8]| -> io::Result<()> {
+        let mut clients = clients.clients.lock().map_err(|_| io::Error::new(io::ErrorKind::Other, "poisoned"))?;
+        match clients.iter_mut().find(|client| client.id == id) {
+            Some(client) => client.stream.write_all(&encode_frame(opcode, payload)),
+            None => Ok(()),
+        }
+    };
+
+    loop {
+        let frame = read_frame(stream)?;
+        match frame.opcode {
+            OP_TEXT if frame.fin => on_text(&String::from_utf8_lossy(&frame.payload)),
+            OP_PING => reply(OP_PONG, &frame.payload)?,
+            OP_PONG => {}
+            OP_CLOSE => {
+                // Echo the status code back, completing the closing handshake
+                let _ = reply(OP_CLOSE, frame.payload.get(..2).unwrap_or(&[]));
+                return Ok(());
+            }
+            OP_TEXT | OP_BINARY | OP_CONTINUATION => {
+                debug!("Ignoring unsupported WebSocket frame (opcode {}, fin {})", frame.opcode, frame.fin);
+            }
+            _ => return Err(io::Error::new(io::ErrorKind::InvalidData, "unknown opcode")),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_sha1() {
+        assert_eq!(
+            sha1(b"abc"),
+            [
+                0xA9, 0x99, 0x3E, 0x36, 0x47, 0x06, 0x81, 0x6A, 0xBA, 0x3E, 0x25, 0x71, 0x78, 0x50, 0xC2, 0x6C, 0x9C,
+                0xD0, 0xD8, 0x9D
+            ]
+        );
+    }
+
+    #[test]
+    fn test_base64() {
+        assert_eq!(base64(b""), "");
+        assert_eq!(base64(b"f"), "Zg==");
+        assert_eq!(base64(b"fo"), "Zm8=");
+        assert_eq!(base64(b"foo"), "Zm9v");
+    }
+
+    #[test]
+    fn test_accept_key() {
+        // Example from RFC 6455 section 1.3
+        assert_eq!(accept_key("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=");
+    }
+
+    #[test]
+    fn test_encode_frame_lengths() {
+        assert_eq!(encode_frame(OP_TEXT, b"hi"), vec![0x81, 2, b'h', b'i']);
+        assert_eq!(&encode_frame(OP_TEXT, &[0; 200])[..4], &[0x81, 126, 0, 200]);
+        assert_eq!(&encode_frame(OP_BINARY, &[0; 70000])[..2], &[0x82, 127]);
+    }
+
+    #[test]
+    fn test_read_masked_frame() {
+        let mask = [0x37, 0xFA, 0x21, 0x3D];
+        let mut data = vec![0x81, 0x85];
+        data.extend_from_slice(&mask);
+        data.extend(b"Hello".iter().enumerate().map(|(i, b)| b ^ mask[i % 4]));
+
+        let frame = read_frame(&mut data.as_slice()).unwrap();
+        assert_eq!(frame, Frame { fin: true, opcode: OP_TEXT, payload: b"Hello".to_vec() });
+    }
+
+    #[test]
+    fn test_read_frame_rejects_oversized() {
+        let mut data = vec![0x81, 0xFF];
+        data.extend_from_slice(&u64::MAX.to_be_bytes());
+        assert!(read_frame(&mut data.as_slice()).is_err());
+    }
+}